@@ -26,24 +26,44 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 )
 
 func main() {
 	framework.NewServer().
 		BindFlags(pflag.CommandLine).
-		RegisterRestoreItemAction("kubevirt-velero-plugin/restore-vm-action", newVMRestoreItemAction).
-		RegisterRestoreItemAction("kubevirt-velero-plugin/restore-vmi-action", newVMIRestoreItemAction).
-		RegisterRestoreItemAction("kubevirt-velero-plugin/restore-pvc-action", newPVCRestoreItemAction).
-		RegisterRestoreItemAction("kubevirt-velero-plugin/restore-pod-action", newPodRestoreItemAction).
-		RegisterRestoreItemAction("kubevirt-velero-plugin/restore-volumesnapshot-action", newVolumeSnapshotRestoreItemAction).
-		RegisterBackupItemAction("kubevirt-velero-plugin/backup-datavolume-action", newDVBackupItemAction).
-		RegisterBackupItemAction("kubevirt-velero-plugin/backup-pvc-action", newPVCBackupItemAction).
-		RegisterBackupItemAction("kubevirt-velero-plugin/backup-volumesnapshot-action", newVolumeSnapshotBackupItemAction).
-		RegisterBackupItemAction("kubevirt-velero-plugin/backup-virtualmachine-action", newVMBackupItemAction).
-		RegisterBackupItemAction("kubevirt-velero-plugin/backup-virtualmachineinstance-action", newVMIBackupItemAction).
+		RegisterRestoreItemActionV2("kubevirt-velero-plugin/restore-vm-action", checkCompatibility(newVMRestoreItemAction)).
+		RegisterRestoreItemActionV2("kubevirt-velero-plugin/restore-vmi-action", checkCompatibility(newVMIRestoreItemAction)).
+		RegisterRestoreItemAction("kubevirt-velero-plugin/restore-pvc-action", checkCompatibility(newPVCRestoreItemAction)).
+		RegisterRestoreItemAction("kubevirt-velero-plugin/restore-datavolume-action", checkCompatibility(newDVRestoreItemAction)).
+		RegisterRestoreItemAction("kubevirt-velero-plugin/restore-pod-action", checkCompatibility(newPodRestoreItemAction)).
+		RegisterRestoreItemAction("kubevirt-velero-plugin/restore-volumesnapshot-action", checkCompatibility(newVolumeSnapshotRestoreItemAction)).
+		RegisterRestoreItemAction("kubevirt-velero-plugin/restore-virtualmachinepool-action", checkCompatibility(newVMPoolRestoreItemAction)).
+		RegisterRestoreItemAction("kubevirt-velero-plugin/restore-virtualmachineinstancereplicaset-action", checkCompatibility(newVMIReplicaSetRestoreItemAction)).
+		RegisterRestoreItemAction("kubevirt-velero-plugin/restore-controllerrevision-action", checkCompatibility(newControllerRevisionRestoreItemAction)).
+		RegisterRestoreItemAction("kubevirt-velero-plugin/restore-secret-action", checkCompatibility(newSecretRestoreItemAction)).
+		RegisterBackupItemAction("kubevirt-velero-plugin/backup-datavolume-action", checkCompatibility(newDVBackupItemAction)).
+		RegisterBackupItemAction("kubevirt-velero-plugin/backup-pvc-action", checkCompatibility(newPVCBackupItemAction)).
+		RegisterBackupItemAction("kubevirt-velero-plugin/backup-volumesnapshot-action", checkCompatibility(newVolumeSnapshotBackupItemAction)).
+		RegisterBackupItemAction("kubevirt-velero-plugin/backup-virtualmachine-action", checkCompatibility(newVMBackupItemAction)).
+		RegisterBackupItemActionV2("kubevirt-velero-plugin/backup-virtualmachineinstance-action", checkCompatibility(newVMIBackupItemAction)).
+		RegisterBackupItemAction("kubevirt-velero-plugin/backup-virtualmachinepool-action", checkCompatibility(newVMPoolBackupItemAction)).
+		RegisterBackupItemAction("kubevirt-velero-plugin/backup-virtualmachineinstancereplicaset-action", checkCompatibility(newVMIReplicaSetBackupItemAction)).
+		RegisterBackupItemAction("kubevirt-velero-plugin/backup-secret-action", checkCompatibility(newSecretBackupItemAction)).
+		RegisterItemBlockAction("kubevirt-velero-plugin/virtualmachine-itemblock-action", checkCompatibility(newVMItemBlockAction)).
+		RegisterDeleteItemAction("kubevirt-velero-plugin/delete-virtualmachineinstance-action", checkCompatibility(newVMIDeleteItemAction)).
 		Serve()
 }
 
+// checkCompatibility wraps an action initializer, so the first action created by the plugin process
+// verifies the KubeVirt and CDI versions of the cluster are supported
+func checkCompatibility(initializer common.HandlerInitializer) common.HandlerInitializer {
+	return func(logger logrus.FieldLogger) (interface{}, error) {
+		util.CheckCompatibility(logger)
+		return initializer(logger)
+	}
+}
+
 func newPVCBackupItemAction(logger logrus.FieldLogger) (interface{}, error) {
 	logger.Debug("Creating PVCBackupItemAction")
 	return plugin.NewPVCBackupItemAction(logger), nil
@@ -74,6 +94,26 @@ func newVMIBackupItemAction(logger logrus.FieldLogger) (interface{}, error) {
 	return plugin.NewVMIBackupItemAction(logger, client), nil
 }
 
+func newVMPoolBackupItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	logger.Debug("Creating VMPoolBackupItemAction")
+	return plugin.NewVMPoolBackupItemAction(logger), nil
+}
+
+func newVMItemBlockAction(logger logrus.FieldLogger) (interface{}, error) {
+	logger.Debug("Creating VMItemBlockAction")
+	return plugin.NewVMItemBlockAction(logger), nil
+}
+
+func newVMIReplicaSetBackupItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	logger.Debug("Creating VMIReplicaSetBackupItemAction")
+	return plugin.NewVMIReplicaSetBackupItemAction(logger), nil
+}
+
+func newSecretBackupItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	logger.Debug("Creating SecretBackupItemAction")
+	return plugin.NewSecretBackupItemAction(logger), nil
+}
+
 func newVMRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
 	logger.Debug("Creating VMRestoreItemAction")
 	return plugin.NewVMRestoreItemAction(logger), nil
@@ -84,6 +124,11 @@ func newVMIRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
 	return plugin.NewVMIRestoreItemAction(logger), nil
 }
 
+func newDVRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	logger.Debug("Creating DVRestoreItemAction")
+	return plugin.NewDVRestoreItemAction(logger), nil
+}
+
 func newPVCRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
 	logger.Debug("Creating PvcRestoreItemAction")
 	return plugin.NewPVCRestoreItemAction(logger), nil
@@ -99,3 +144,27 @@ func newVolumeSnapshotRestoreItemAction(logger logrus.FieldLogger) (interface{},
 	return plugin.NewVolumeSnapshotRestoreItemAction(logger), nil
 }
 
+func newVMPoolRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	logger.Debug("Creating VMPoolRestoreItemAction")
+	return plugin.NewVMPoolRestoreItemAction(logger), nil
+}
+
+func newVMIReplicaSetRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	logger.Debug("Creating VMIReplicaSetRestoreItemAction")
+	return plugin.NewVMIReplicaSetRestoreItemAction(logger), nil
+}
+
+func newControllerRevisionRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	logger.Debug("Creating ControllerRevisionRestoreItemAction")
+	return plugin.NewControllerRevisionRestoreItemAction(logger), nil
+}
+
+func newSecretRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	logger.Debug("Creating SecretRestoreItemAction")
+	return plugin.NewSecretRestoreItemAction(logger), nil
+}
+
+func newVMIDeleteItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	logger.Debug("Creating VMIDeleteItemAction")
+	return plugin.NewVMIDeleteItemAction(logger), nil
+}
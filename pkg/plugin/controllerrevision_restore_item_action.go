@@ -0,0 +1,78 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+)
+
+// ControllerRevisionRestoreItemAction is a restore item action for restoring the instancetype and
+// preference ControllerRevisions of VMs
+type ControllerRevisionRestoreItemAction struct {
+	log logrus.FieldLogger
+}
+
+// NewControllerRevisionRestoreItemAction instantiates a ControllerRevisionRestoreItemAction.
+func NewControllerRevisionRestoreItemAction(log logrus.FieldLogger) *ControllerRevisionRestoreItemAction {
+	return &ControllerRevisionRestoreItemAction{log: log}
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *ControllerRevisionRestoreItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+			IncludedResources: []string{"ControllerRevision"},
+		},
+		nil
+}
+
+// Execute renames the ControllerRevision of a renamed VM, the way the VM restore rewrites its revision names
+func (p *ControllerRevisionRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	p.log.Info("Executing ControllerRevisionRestoreItemAction")
+
+	if input == nil {
+		return nil, fmt.Errorf("input object nil!")
+	}
+
+	revision := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+	vmName, ok := util.GetRevisionVMName(revision)
+	if !ok {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	config := util.LoadPluginConfig(common.PluginKindRestoreItemAction, input.Restore.ObjectMeta, p.log)
+	renamer, err := util.GetVMRenamer(input.Restore, config, revision.GetNamespace())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if newName := renamer.DependentName(vmName, revision.GetName()); newName != revision.GetName() {
+		p.log.Infof("Renaming ControllerRevision %s/%s to %s", revision.GetNamespace(), revision.GetName(), newName)
+		revision.SetName(newName)
+	}
+	return velero.NewRestoreItemActionExecuteOutput(revision), nil
+}
@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"kubevirt.io/api/instancetype"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+)
+
+func TestControllerRevisionRestoreItemAction(t *testing.T) {
+	kubevirtLabels := map[string]interface{}{
+		instancetype.ControllerRevisionObjectNameLabel:       "u1.small",
+		instancetype.ControllerRevisionObjectUIDLabel:        "1234",
+		instancetype.ControllerRevisionObjectGenerationLabel: "1",
+	}
+
+	testCases := []struct {
+		name         string
+		revision     string
+		labels       map[string]interface{}
+		restoreLabel map[string]string
+		expectedName string
+	}{
+		{"Revision of a renamed VM should be renamed",
+			"test-vm-u1.small-1234-1", kubevirtLabels, map[string]string{util.RenamePrefixLabel: "clone-"}, "clone-test-vm-u1.small-1234-1"},
+		{"Revision should keep its name when VMs are not renamed",
+			"test-vm-u1.small-1234-1", kubevirtLabels, nil, "test-vm-u1.small-1234-1"},
+		{"Revision not created for a VM should keep its name",
+			"test-statefulset-5d8f", nil, map[string]string{util.RenamePrefixLabel: "clone-"}, "test-statefulset-5d8f"},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+	action := NewControllerRevisionRestoreItemAction(logrus.StandardLogger())
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+				Item: &unstructured.Unstructured{
+					Object: map[string]interface{}{
+						"apiVersion": "apps/v1",
+						"kind":       "ControllerRevision",
+						"metadata": map[string]interface{}{
+							"name":      tc.revision,
+							"namespace": testNamespace,
+							"labels":    tc.labels,
+						},
+					},
+				},
+				Restore: &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{Labels: tc.restoreLabel}},
+			})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedName, output.UpdatedItem.(*unstructured.Unstructured).GetName())
+		})
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -82,7 +83,7 @@ func (p *DVBackupItemAction) Execute(item runtime.Unstructured, backup *v1.Backu
 	kind := item.GetObjectKind().GroupVersionKind().Kind
 	switch kind {
 	case "PersistentVolumeClaim":
-		return p.handlePVC(item)
+		return p.handlePVC(backup, item)
 	case "DataVolume":
 		return p.handleDataVolume(backup, item)
 	}
@@ -90,7 +91,7 @@ func (p *DVBackupItemAction) Execute(item runtime.Unstructured, backup *v1.Backu
 	return item, extra, nil
 }
 
-func (p *DVBackupItemAction) handlePVC(item runtime.Unstructured) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+func (p *DVBackupItemAction) handlePVC(backup *v1.Backup, item runtime.Unstructured) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
 	metadata, err := meta.Accessor(item)
 	if err != nil {
 		return nil, nil, err
@@ -113,6 +114,11 @@ func (p *DVBackupItemAction) handlePVC(item runtime.Unstructured) (runtime.Unstr
 			// The PVC is not finished, we mark it as inprogress, so it can be skipped during restore
 			// so it does not conflict with CDI action
 			annotations[AnnInProgress] = dv.Name
+			util.RecordEvent(p.log, util.PersistentVolumeClaimGroupVersionKind, metadata, corev1.EventTypeWarning, util.EventDataVolumeInProgress,
+				"DataVolume %s has not succeeded yet, backup %s will not restore this PVC", dv.Name, backup.Name)
+		}
+		if vmName, ok := util.GetVMOwner(dv); ok {
+			annotations[util.OwnerVMAnnotation] = vmName
 		}
 		metadata.SetAnnotations(annotations)
 	}
@@ -130,12 +136,30 @@ func (p *DVBackupItemAction) handleDataVolume(backup *v1.Backup, item runtime.Un
 	p.log.Infof("handling DataVolume %v/%v", dv.GetNamespace(), dv.GetName())
 	dvSucceeded := dv.Status.Phase == cdiv1.Succeeded
 	if dvSucceeded {
-		annotations := dv.GetAnnotations()
-		if annotations == nil {
-			annotations = make(map[string]string)
+		// The restored DataVolume is only pre-populated when its PVC is restored with it
+		pvcInBackup, err := util.IsPVCInBackup(backup, dv.GetNamespace(), dv.GetName())
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		if pvcInBackup {
+			annotations := dv.GetAnnotations()
+			if annotations == nil {
+				annotations = make(map[string]string)
+			}
+			annotations[AnnPrePopulated] = dv.GetName()
+			dv.SetAnnotations(annotations)
+		} else {
+			p.log.Infof("PVC of DataVolume %s/%s is not backed up, it will be populated again on restore", dv.GetNamespace(), dv.GetName())
 		}
-		annotations[AnnPrePopulated] = dv.GetName()
-		dv.SetAnnotations(annotations)
+	}
+
+	// Owner references are not restored, remember the owning VM so the restore can rename
+	// the DataVolume together with it
+	if vmName, ok := util.GetVMOwner(&dv); ok {
+		if dv.Annotations == nil {
+			dv.Annotations = make(map[string]string)
+		}
+		dv.Annotations[util.OwnerVMAnnotation] = vmName
 	}
 
 	dvMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&dv)
@@ -143,7 +167,10 @@ func (p *DVBackupItemAction) handleDataVolume(backup *v1.Backup, item runtime.Un
 		return nil, nil, errors.WithStack(err)
 	}
 
-	extra := kvgraph.NewDataVolumeBackupGraph(&dv)
+	extra, err := kvgraph.NewDataVolumeBackupGraph(&dv, backup)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
 
 	return &unstructured.Unstructured{Object: dvMap}, extra, nil
 }
@@ -11,6 +11,7 @@ import (
 	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/utils/ptr"
 )
 
 func TestDV(t *testing.T) {
@@ -42,17 +43,24 @@ func TestDV(t *testing.T) {
 	testCases := []struct {
 		name               string
 		dv                 *unstructured.Unstructured
+		backup             v1.Backup
+		isPvcExcluded      bool
 		hasAnnPrePopulated bool
 	}{
-		{"Should add AnnPrePopulated to succeeded DV", &object, true},
-		{"Should not add AnnPrePopulated to unfinished DV", &objectNotSucceeded, false},
+		{"Should add AnnPrePopulated to succeeded DV", &object, v1.Backup{}, false, true},
+		{"Should not add AnnPrePopulated to unfinished DV", &objectNotSucceeded, v1.Backup{}, false, false},
+		{"Should not add AnnPrePopulated when PVCs are not backed up", &object,
+			v1.Backup{Spec: v1.BackupSpec{ExcludedResources: []string{"persistentvolumeclaims"}}}, false, false},
+		{"Should not add AnnPrePopulated when the PVC is excluded by label", &object,
+			v1.Backup{ObjectMeta: metav1.ObjectMeta{UID: "test-excluded-pvc"}}, true, false},
 	}
 
 	logrus.SetLevel(logrus.ErrorLevel)
 	action := NewDVBackupItemAction(logrus.StandardLogger())
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			item, _, _ := action.Execute(tc.dv, &v1.Backup{})
+			util.IsPVCExcludedByLabel = func(namespace, pvcName string) (bool, error) { return tc.isPvcExcluded, nil }
+			item, _, _ := action.Execute(tc.dv, &tc.backup)
 
 			metadata, _ := meta.Accessor(item)
 			annotations := metadata.GetAnnotations()
@@ -69,6 +77,18 @@ func TestDV(t *testing.T) {
 		assert.Equal(t, "persistentvolumeclaims", extra[0].Resource)
 		assert.Equal(t, "test-datavolume", extra[0].Name)
 	})
+
+	t.Run("DV owned by a VM should record its owner", func(t *testing.T) {
+		owned := object.DeepCopy()
+		owned.SetOwnerReferences([]metav1.OwnerReference{
+			{APIVersion: "kubevirt.io/v1", Kind: "VirtualMachine", Name: "test-vm", Controller: ptr.To(true)},
+		})
+		item, _, err := action.Execute(owned, &v1.Backup{})
+
+		assert.NoError(t, err)
+		metadata, _ := meta.Accessor(item)
+		assert.Equal(t, "test-vm", metadata.GetAnnotations()[util.OwnerVMAnnotation])
+	})
 }
 
 func TestPVC(t *testing.T) {
@@ -157,6 +177,25 @@ func TestPVC(t *testing.T) {
 
 		})
 	}
+
+	t.Run("PVC of a DV owned by a VM should record the VM", func(t *testing.T) {
+		util.GetDV = func(ns, name string) (*cdiv1.DataVolume, error) {
+			return &cdiv1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+					OwnerReferences: []metav1.OwnerReference{
+						{APIVersion: "kubevirt.io/v1", Kind: "VirtualMachine", Name: "test-vm", Controller: ptr.To(true)},
+					},
+				},
+				Status: cdiv1.DataVolumeStatus{Phase: "Succeeded"},
+			}, nil
+		}
+		item, _, err := action.Execute(testCases[0].pvc, &v1.Backup{})
+
+		assert.NoError(t, err)
+		metadata, _ := meta.Accessor(item)
+		assert.Equal(t, "test-vm", metadata.GetAnnotations()[util.OwnerVMAnnotation])
+	})
 }
 
 func TestUnfinishedPVC(t *testing.T) {
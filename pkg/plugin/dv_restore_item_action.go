@@ -0,0 +1,130 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util/kvgraph"
+)
+
+const (
+	AnnCloneToken         = "cdi.kubevirt.io/storage.clone.token"
+	AnnExtendedCloneToken = "cdi.kubevirt.io/storage.extended.clone.token"
+	AnnUsePopulator       = "cdi.kubevirt.io/storage.usePopulator"
+)
+
+// CDI internal annotations which are only valid for the original DataVolume and
+// prevent CDI from populating the restored one
+var staleDataVolumeAnnotations = []string{
+	AnnCloneToken,
+	AnnExtendedCloneToken,
+	AnnUsePopulator,
+}
+
+// DVRestoreItemAction is a restore item action for restoring DataVolumes
+type DVRestoreItemAction struct {
+	log logrus.FieldLogger
+}
+
+// NewDVRestoreItemAction instantiates a DVRestoreItemAction.
+func NewDVRestoreItemAction(log logrus.FieldLogger) *DVRestoreItemAction {
+	return &DVRestoreItemAction{log: log}
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *DVRestoreItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+			IncludedResources: []string{"DataVolume"},
+		},
+		nil
+}
+
+// Execute makes sure a pre-populated DataVolume is restored together with its PVC. When the PVC
+// is not part of the restore the DataVolume is populated again by CDI.
+func (p *DVRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	p.log.Info("Executing DVRestoreItemAction")
+
+	if input == nil {
+		return nil, fmt.Errorf("input object nil!")
+	}
+
+	var dv cdiv1.DataVolume
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), &dv); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	p.log.Infof("handling DataVolume %v/%v", dv.GetNamespace(), dv.GetName())
+
+	var additionalItems []velero.ResourceIdentifier
+	if _, prePopulated := dv.Annotations[AnnPrePopulated]; prePopulated {
+		if util.IsResourceInRestore("persistentvolumeclaims", input.Restore) {
+			// The PVC shares the DataVolume name
+			additionalItems = kvgraph.NewDataVolumeRestoreGraph(&dv)
+		} else {
+			p.log.Infof("PVC of DataVolume %s/%s is not restored, it will be populated again", dv.GetNamespace(), dv.GetName())
+			delete(dv.Annotations, AnnPrePopulated)
+		}
+	}
+
+	for _, annotation := range staleDataVolumeAnnotations {
+		delete(dv.Annotations, annotation)
+	}
+	dv.Status = cdiv1.DataVolumeStatus{}
+
+	// Velero's change-storage-class mapping only applies to PVCs
+	_, prePopulated := dv.Annotations[AnnPrePopulated]
+	if class := util.RemapDataVolumeStorageClass(&dv.Spec, util.LoadStorageClassMapping(input.Restore.UID, p.log), prePopulated, p.log); class != "" {
+		p.log.Infof("Setting storage class of DataVolume %s/%s to %s", dv.GetNamespace(), dv.GetName(), class)
+	}
+
+	// The additional items keep the backed up names, the DataVolume follows the rename of its VM
+	config := util.LoadPluginConfig(common.PluginKindRestoreItemAction, input.Restore.ObjectMeta, p.log)
+	renamer, err := util.GetVMRenamer(input.Restore, config, dv.GetNamespace())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	oldName := dv.GetName()
+	if newName := renamer.RenameOwnedObject(&dv); newName != "" {
+		p.log.Infof("Renaming DataVolume %s/%s to %s", dv.GetNamespace(), oldName, newName)
+		if _, prePopulated := dv.Annotations[AnnPrePopulated]; prePopulated {
+			dv.Annotations[AnnPrePopulated] = newName
+		}
+	}
+
+	item, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&dv)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	output := velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: item})
+	output.AdditionalItems = additionalItems
+	return output, nil
+}
@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	k8sv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+)
+
+func TestDVRestoreItemAction(t *testing.T) {
+	newInput := func(annotations map[string]interface{}, restoreSpec velerov1.RestoreSpec) *velero.RestoreItemActionExecuteInput {
+		return &velero.RestoreItemActionExecuteInput{
+			Item: &unstructured.Unstructured{
+				Object: map[string]interface{}{
+					"apiVersion": "cdi.kubevirt.io/v1beta1",
+					"kind":       "DataVolume",
+					"metadata": map[string]interface{}{
+						"name":        "test-dv",
+						"namespace":   testNamespace,
+						"annotations": annotations,
+					},
+					"status": map[string]interface{}{
+						"phase": "Succeeded",
+					},
+				},
+			},
+			Restore: &velerov1.Restore{Spec: restoreSpec},
+		}
+	}
+	getAnnotations := func(output *velero.RestoreItemActionExecuteOutput) map[string]interface{} {
+		annotations, _ := output.UpdatedItem.UnstructuredContent()["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+		return annotations
+	}
+	pvc := velero.ResourceIdentifier{
+		GroupResource: schema.GroupResource{Group: "", Resource: "persistentvolumeclaims"},
+		Namespace:     testNamespace,
+		Name:          "test-dv",
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetStorageClassMapping = func() (map[string]string, error) { return nil, nil }
+	action := NewDVRestoreItemAction(logrus.StandardLogger())
+
+	t.Run("Pre-populated DV should return its PVC as additional item", func(t *testing.T) {
+		output, err := action.Execute(newInput(map[string]interface{}{AnnPrePopulated: "test-dv"}, velerov1.RestoreSpec{}))
+		assert.NoError(t, err)
+		assert.Equal(t, []velero.ResourceIdentifier{pvc}, output.AdditionalItems)
+		assert.Contains(t, getAnnotations(output), AnnPrePopulated)
+	})
+
+	t.Run("Pre-populated DV should be populated again when PVCs are excluded from restore", func(t *testing.T) {
+		output, err := action.Execute(newInput(map[string]interface{}{AnnPrePopulated: "test-dv"}, velerov1.RestoreSpec{
+			ExcludedResources: []string{"persistentvolumeclaims"},
+		}))
+		assert.NoError(t, err)
+		assert.Empty(t, output.AdditionalItems)
+		assert.NotContains(t, getAnnotations(output), AnnPrePopulated)
+	})
+
+	t.Run("Pre-populated DV should be populated again when PVCs are not included in restore", func(t *testing.T) {
+		output, err := action.Execute(newInput(map[string]interface{}{AnnPrePopulated: "test-dv"}, velerov1.RestoreSpec{
+			IncludedResources: []string{"datavolumes"},
+		}))
+		assert.NoError(t, err)
+		assert.Empty(t, output.AdditionalItems)
+		assert.NotContains(t, getAnnotations(output), AnnPrePopulated)
+	})
+
+	t.Run("DV which is not pre-populated should not return additional items", func(t *testing.T) {
+		output, err := action.Execute(newInput(nil, velerov1.RestoreSpec{}))
+		assert.NoError(t, err)
+		assert.Empty(t, output.AdditionalItems)
+	})
+
+	t.Run("Stale CDI annotations and status should be removed", func(t *testing.T) {
+		output, err := action.Execute(newInput(map[string]interface{}{
+			AnnCloneToken:         "token",
+			AnnExtendedCloneToken: "token",
+			AnnUsePopulator:       "true",
+			"user-annotation":     "value",
+		}, velerov1.RestoreSpec{}))
+		assert.NoError(t, err)
+		annotations := getAnnotations(output)
+		assert.NotContains(t, annotations, AnnCloneToken)
+		assert.NotContains(t, annotations, AnnExtendedCloneToken)
+		assert.NotContains(t, annotations, AnnUsePopulator)
+		assert.Contains(t, annotations, "user-annotation")
+		status, _ := output.UpdatedItem.UnstructuredContent()["status"].(map[string]interface{})
+		assert.Empty(t, status["phase"])
+	})
+
+	t.Run("Storage class should be remapped", func(t *testing.T) {
+		util.GetStorageClassMapping = func() (map[string]string, error) { return map[string]string{"old-class": "new-class"}, nil }
+		util.GetStorageProfile = func(name string) (*cdiv1.StorageProfile, error) { return &cdiv1.StorageProfile{}, nil }
+		defer func() { util.GetStorageClassMapping = func() (map[string]string, error) { return nil, nil } }()
+
+		input := newInput(nil, velerov1.RestoreSpec{})
+		input.Item.UnstructuredContent()["spec"] = map[string]interface{}{
+			"storage": map[string]interface{}{"storageClassName": "old-class"},
+		}
+		output, err := action.Execute(input)
+		assert.NoError(t, err)
+		class, _, _ := unstructured.NestedString(output.UpdatedItem.UnstructuredContent(), "spec", "storage", "storageClassName")
+		assert.Equal(t, "new-class", class)
+	})
+
+	t.Run("Pre-populated DV should keep the volume mode of its PVC", func(t *testing.T) {
+		util.GetStorageClassMapping = func() (map[string]string, error) { return map[string]string{"old-class": "new-class"}, nil }
+		util.GetStorageProfile = func(name string) (*cdiv1.StorageProfile, error) {
+			return &cdiv1.StorageProfile{Status: cdiv1.StorageProfileStatus{
+				ClaimPropertySets: []cdiv1.ClaimPropertySet{
+					{AccessModes: []k8sv1.PersistentVolumeAccessMode{k8sv1.ReadWriteMany}, VolumeMode: ptr.To(k8sv1.PersistentVolumeBlock)},
+					{AccessModes: []k8sv1.PersistentVolumeAccessMode{k8sv1.ReadWriteMany}, VolumeMode: ptr.To(k8sv1.PersistentVolumeFilesystem)},
+				},
+			}}, nil
+		}
+		defer func() { util.GetStorageClassMapping = func() (map[string]string, error) { return nil, nil } }()
+
+		input := newInput(map[string]interface{}{AnnPrePopulated: "test-dv"}, velerov1.RestoreSpec{})
+		input.Item.UnstructuredContent()["spec"] = map[string]interface{}{
+			"pvc": map[string]interface{}{
+				"storageClassName": "old-class",
+				"accessModes":      []interface{}{"ReadWriteOnce"},
+				"volumeMode":       "Filesystem",
+			},
+		}
+		output, err := action.Execute(input)
+		assert.NoError(t, err)
+		accessModes, _, _ := unstructured.NestedStringSlice(output.UpdatedItem.UnstructuredContent(), "spec", "pvc", "accessModes")
+		assert.Equal(t, []string{"ReadWriteMany"}, accessModes)
+		volumeMode, _, _ := unstructured.NestedString(output.UpdatedItem.UnstructuredContent(), "spec", "pvc", "volumeMode")
+		assert.Equal(t, "Filesystem", volumeMode)
+	})
+
+	t.Run("DV owned by a renamed VM should be renamed", func(t *testing.T) {
+		input := newInput(map[string]interface{}{AnnPrePopulated: "test-dv", util.OwnerVMAnnotation: "test-vm"}, velerov1.RestoreSpec{})
+		input.Restore.Labels = map[string]string{util.RenamePrefixLabel: "clone-"}
+		output, err := action.Execute(input)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "clone-test-vm-test-dv", output.UpdatedItem.(*unstructured.Unstructured).GetName())
+		assert.Equal(t, "clone-test-vm-test-dv", getAnnotations(output)[AnnPrePopulated])
+		assert.NotContains(t, getAnnotations(output), util.OwnerVMAnnotation)
+		// The PVC is looked up in the backup under its backed up name
+		assert.Equal(t, []velero.ResourceIdentifier{pvc}, output.AdditionalItems)
+	})
+}
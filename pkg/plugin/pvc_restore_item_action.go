@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 
 	corev1api "k8s.io/api/core/v1"
@@ -30,6 +32,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 
 	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util/kvgraph"
 )
 
 
@@ -92,6 +95,18 @@ func (p *PVCRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInp
 		}
 	}
 
+	// Velero remaps the storage class of every PVC, the backend storage PVC of a VM also needs
+	// its access modes to fit the new class. Its volume mode is kept, it is restored with its data.
+	if kvgraph.IsBackendStoragePVC(&pvc) {
+		if class := util.RemapPVCStorageClass(&pvc.Spec, util.LoadStorageClassMapping(input.Restore.UID, p.log), p.log); class != "" {
+			p.log.Infof("Setting storage class of PVC %s/%s to %s", pvc.Namespace, pvc.Name, class)
+		}
+	}
+
+	if err := p.renamePVC(&pvc, input.Restore); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
 	// Convert back to unstructured
 	item, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pvc)
 	if err != nil {
@@ -101,3 +116,29 @@ func (p *PVCRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInp
 	return velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: item}), nil
 }
 
+// renamePVC renames the PVC of a DataVolume owned by a renamed VM, or the backend storage PVC of a renamed VM
+func (p *PVCRestoreItemAction) renamePVC(pvc *corev1api.PersistentVolumeClaim, restore *velerov1.Restore) error {
+	config := util.LoadPluginConfig(common.PluginKindRestoreItemAction, restore.ObjectMeta, p.log)
+	renamer, err := util.GetVMRenamer(restore, config, pvc.Namespace)
+	if err != nil {
+		return err
+	}
+
+	oldName := pvc.Name
+	if kvgraph.IsBackendStoragePVC(pvc) {
+		vmName, _ := kvgraph.GetBackendStorageVMName(pvc)
+		if newVMName, renamed := renamer.NewName(vmName); renamed {
+			kvgraph.RenameBackendStoragePVC(pvc, newVMName)
+			p.log.Infof("Renaming PVC %s/%s to %s", pvc.Namespace, oldName, pvc.Name)
+		}
+		return nil
+	}
+
+	if newName := renamer.RenameOwnedObject(pvc); newName != "" {
+		p.log.Infof("Renaming PVC %s/%s to %s", pvc.Namespace, oldName, newName)
+		if _, populated := pvc.Annotations[AnnPopulatedFor]; populated {
+			pvc.Annotations[AnnPopulatedFor] = newName
+		}
+	}
+	return nil
+}
@@ -5,8 +5,11 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 
@@ -149,6 +152,10 @@ func TestPvcRestoreExecute(t *testing.T) {
 	action := NewPVCRestoreItemAction(logrus.StandardLogger())
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
+			// Velero always passes the restore
+			if tc.input.Restore == nil {
+				tc.input.Restore = &velerov1.Restore{}
+			}
 			result, err := action.Execute(&tc.input)
 			if !assert.NoError(t, err) {
 				return
@@ -198,3 +205,53 @@ func TestPvcRestoreExecute(t *testing.T) {
 	}
 }
 
+func TestPVCRestoreRename(t *testing.T) {
+	restore := func(pvc *corev1api.PersistentVolumeClaim) *corev1api.PersistentVolumeClaim {
+		item, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pvc)
+		assert.NoError(t, err)
+
+		action := NewPVCRestoreItemAction(logrus.StandardLogger())
+		output, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+			Item:    &unstructured.Unstructured{Object: item},
+			Restore: &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{util.RenameSuffixLabel: "-copy"}}},
+		})
+		assert.NoError(t, err)
+
+		restored := new(corev1api.PersistentVolumeClaim)
+		assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), restored))
+		return restored
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+	util.GetStorageClassMapping = func() (map[string]string, error) { return nil, nil }
+
+	t.Run("PVC of a DV owned by a renamed VM should be renamed", func(t *testing.T) {
+		pvc := restore(&corev1api.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-vm-disk",
+			Namespace:   testNamespace,
+			Annotations: map[string]string{AnnPopulatedFor: "test-vm-disk", util.OwnerVMAnnotation: "test-vm"},
+		}})
+
+		assert.Equal(t, "test-vm-copy-disk", pvc.Name)
+		assert.Equal(t, "test-vm-copy-disk", pvc.Annotations[AnnPopulatedFor])
+		assert.NotContains(t, pvc.Annotations, util.OwnerVMAnnotation)
+	})
+
+	t.Run("Backend storage PVC of a renamed VM should be renamed", func(t *testing.T) {
+		pvc := restore(&corev1api.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Name:      "persistent-state-for-test-vm-abcde",
+			Namespace: testNamespace,
+			Labels:    map[string]string{"persistent-state-for": "test-vm"},
+		}})
+
+		assert.Equal(t, "persistent-state-for-test-vm-copy", pvc.Name)
+		assert.Equal(t, "test-vm-copy", pvc.Labels["persistent-state-for"])
+	})
+
+	t.Run("PVC without owner VM should keep its name", func(t *testing.T) {
+		pvc := restore(&corev1api.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "shared-pvc", Namespace: testNamespace}})
+
+		assert.Equal(t, "shared-pvc", pvc.Name)
+	})
+}
@@ -0,0 +1,308 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	biav2 "github.com/vmware-tanzu/velero/pkg/plugin/velero/backupitemaction/v2"
+	k8score "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kvcore "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+)
+
+const (
+	freezeOperation = "freeze"
+	pauseOperation  = "pause"
+)
+
+// guestQuiesce is the outcome of quiescing the guest of a VMI for a backup
+type guestQuiesce struct {
+	// operationID tracks the freeze or pause, it is empty when the guest is not quiesced
+	operationID string
+	// crashConsistent is the reason the guest is backed up without being quiesced, if any
+	crashConsistent string
+	// timeout bounds how long the guest stays frozen or paused
+	timeout time.Duration
+}
+
+// quiesceTracker keeps the guests quiesced by the backups of the plugin process. Velero builds the
+// item block of a VMI, calling VMItemBlockAction, before backing up any of its items, so the guest
+// is quiesced from the item block action, and VMIBackupItemAction returns the operation tracking it.
+// Velero may snapshot the volumes at any point of the backup, and backs up pod volumes once the
+// item block is backed up, so only the Progress of the operation releases the guest, once its
+// volumes are captured or the freeze timeout elapsed. Progress and Cancel only rely on the operation
+// ID and the quiesce marker of the live VMI, the tracker just keeps a guest from being quiesced twice.
+type quiesceTracker struct {
+	lock    sync.Mutex
+	backups []types.UID
+	guests  map[types.UID]map[string]*guestQuiesce
+}
+
+var quiescedGuests = &quiesceTracker{guests: map[types.UID]map[string]*guestQuiesce{}}
+
+// quiesce quiesces the guest of the VMI once per backup, and returns the outcome
+func (t *quiesceTracker) quiesce(log logrus.FieldLogger, vmi *kvcore.VirtualMachineInstance, backup *v1.Backup, config *util.PluginConfig) guestQuiesce {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	key := vmi.Namespace + "/" + vmi.Name
+	if quiesce, ok := t.guests[backup.UID][key]; ok {
+		return *quiesce
+	}
+
+	if _, ok := t.guests[backup.UID]; !ok {
+		if len(t.backups) == util.MaxCachedBackups {
+			delete(t.guests, t.backups[0])
+			t.backups = t.backups[1:]
+		}
+		t.backups = append(t.backups, backup.UID)
+		t.guests[backup.UID] = map[string]*guestQuiesce{}
+	}
+	quiesce := quiesceGuest(log, vmi, backup, config)
+	t.guests[backup.UID][key] = quiesce
+	return *quiesce
+}
+
+// release releases the guest of a VMI which the backup quiesced while building its item block,
+// when VMIBackupItemAction then leaves the VMI out, so no operation tracks the guest
+func (t *quiesceTracker) release(log logrus.FieldLogger, vmi *kvcore.VirtualMachineInstance, backup *v1.Backup) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	quiesce, ok := t.guests[backup.UID][vmi.Namespace+"/"+vmi.Name]
+	if !ok || quiesce.operationID == "" {
+		return
+	}
+	operation, _, _, _, _ := parseQuiesceOperationID(quiesce.operationID)
+	if err := releaseGuest(operation, vmi.Namespace, vmi.Name); err != nil {
+		// Deleting the backup releases the guest, see VMIDeleteItemAction
+		log.Warnf("Failed to release VMI %s/%s left out of backup %s: %v", vmi.Namespace, vmi.Name, backup.Name, err)
+		return
+	}
+	log.Infof("Released VMI %s/%s, it is left out of backup %s", vmi.Namespace, vmi.Name, backup.Name)
+	quiesce.operationID = ""
+}
+
+// quiesceGuest freezes the guest file systems of a running VMI, so the volume snapshots taken
+// during the backup are application consistent. Guests without a connected agent are paused
+// instead when the backup asks for it. Other guests are backed up crash consistent.
+// VMIs without PVC volumes have nothing to snapshot and are not quiesced. The freeze timeout also
+// bounds a pause: KubeVirt never ends a pause on its own, Progress unpauses the guest at the latest
+// on its first check after the timeout elapsed.
+func quiesceGuest(log logrus.FieldLogger, vmi *kvcore.VirtualMachineInstance, backup *v1.Backup, config *util.PluginConfig) *guestQuiesce {
+	quiesce := &guestQuiesce{}
+	if len(getVolumeClaims(vmi)) == 0 || util.IsMetadataBackup(backup, config, vmi.Namespace) {
+		return quiesce
+	}
+	if vmi.Status.Phase != kvcore.Running || util.IsVMIPaused(vmi) {
+		return quiesce
+	}
+	// Operations are not supported for items backed up while finalizing
+	if backup.Status.Phase == v1.BackupPhaseFinalizing || backup.Status.Phase == v1.BackupPhaseFinalizingPartiallyFailed {
+		return quiesce
+	}
+
+	timeout, err := util.GetFreezeTimeout(backup, config, vmi.Namespace)
+	if err != nil {
+		log.Warnf("%v, using the default freeze timeout %s", err, timeout)
+	}
+	quiesce.timeout = timeout
+
+	if !util.IsGuestAgentConnected(vmi) {
+		if util.ShouldPauseWithoutGuestAgent(backup, config, vmi.Namespace) {
+			pauseGuest(log, vmi, backup, quiesce)
+			return quiesce
+		}
+		log.Warnf("Guest agent of VMI %s/%s is not connected, the backup is crash consistent", vmi.Namespace, vmi.Name)
+		recordCrashConsistent(log, vmi, backup, quiesce, "guest agent not connected")
+		return quiesce
+	}
+
+	if util.ShouldSkipGuestFreeze(backup, config, vmi.Namespace) {
+		return quiesce
+	}
+
+	started := time.Now()
+	if err := util.FreezeVMI(vmi.Namespace, vmi.Name, timeout); err != nil {
+		log.Warnf("Failed to freeze VMI %s/%s, the backup is crash consistent: %v", vmi.Namespace, vmi.Name, err)
+		recordCrashConsistent(log, vmi, backup, quiesce, "failed to freeze guest")
+		return quiesce
+	}
+
+	log.Infof("Froze VMI %s/%s for at most %s", vmi.Namespace, vmi.Name, timeout)
+	recordQuiesceEvent(log, vmi, k8score.EventTypeNormal, util.EventGuestFrozen,
+		"Guest file systems frozen for backup %s, for at most %s", backup.Name, timeout)
+	markQuiesced(log, vmi, freezeOperation, backup)
+	quiesce.operationID = newQuiesceOperationID(freezeOperation, vmi, started)
+	return quiesce
+}
+
+func pauseGuest(log logrus.FieldLogger, vmi *kvcore.VirtualMachineInstance, backup *v1.Backup, quiesce *guestQuiesce) {
+	started := time.Now()
+	if err := util.PauseVMI(vmi.Namespace, vmi.Name); err != nil {
+		log.Warnf("Failed to pause VMI %s/%s, the backup is crash consistent: %v", vmi.Namespace, vmi.Name, err)
+		recordCrashConsistent(log, vmi, backup, quiesce, "failed to pause guest")
+		return
+	}
+
+	log.Infof("Paused VMI %s/%s for at most %s, its guest agent is not connected", vmi.Namespace, vmi.Name, quiesce.timeout)
+	recordQuiesceEvent(log, vmi, k8score.EventTypeNormal, util.EventGuestPaused,
+		"Paused for backup %s, for at most %s, its guest agent is not connected", backup.Name, quiesce.timeout)
+	markQuiesced(log, vmi, pauseOperation, backup)
+	quiesce.operationID = newQuiesceOperationID(pauseOperation, vmi, started)
+}
+
+func recordCrashConsistent(log logrus.FieldLogger, vmi *kvcore.VirtualMachineInstance, backup *v1.Backup, quiesce *guestQuiesce, reason string) {
+	quiesce.crashConsistent = reason
+	recordQuiesceEvent(log, vmi, k8score.EventTypeWarning, util.EventCrashConsistent,
+		"Backup %s is crash consistent: %s", backup.Name, reason)
+}
+
+// recordQuiesceEvent records an event about quiescing a VMI on the VMI and on the VM owning it,
+// which is the object users look at
+func recordQuiesceEvent(log logrus.FieldLogger, vmi *kvcore.VirtualMachineInstance, eventType, reason, messageFmt string, args ...interface{}) {
+	util.RecordEvent(log, kvcore.VirtualMachineInstanceGroupVersionKind, vmi, eventType, reason, messageFmt, args...)
+
+	owner := getVMIOwner(vmi)
+	if owner == nil || owner.Kind != kvcore.VirtualMachineGroupVersionKind.Kind {
+		return
+	}
+	vm := &metav1.ObjectMeta{Namespace: vmi.Namespace, Name: owner.Name, UID: owner.UID}
+	util.RecordEvent(log, kvcore.VirtualMachineGroupVersionKind, vm, eventType, reason, messageFmt, args...)
+}
+
+// markQuiesced records on the live VMI which backup froze or paused it, see VMIDeleteItemAction
+func markQuiesced(log logrus.FieldLogger, vmi *kvcore.VirtualMachineInstance, operation string, backup *v1.Backup) {
+	marker := fmt.Sprintf("%s/%s", operation, backup.Name)
+	if err := util.SetVMIAnnotation(vmi.Namespace, vmi.Name, util.QuiescedByBackupAnnotation, &marker); err != nil {
+		log.Warnf("Failed to mark VMI %s/%s as quiesced by backup %s: %v", vmi.Namespace, vmi.Name, backup.Name, err)
+	}
+}
+
+// isQuiescedBy checks whether the live VMI is still marked as quiesced by the operation of the backup
+func isQuiescedBy(vmi *kvcore.VirtualMachineInstance, operation string, backup *v1.Backup) bool {
+	return vmi.GetAnnotations()[util.QuiescedByBackupAnnotation] == fmt.Sprintf("%s/%s", operation, backup.Name)
+}
+
+// areVolumesCaptured checks whether Velero is done capturing the volumes of the VMI for the backup: the
+// volume snapshots of its claims are ready to use, and the pod volume backups of its launcher pod are
+// done. It also returns when the last of them was taken. Velero creates them while backing up the items,
+// so they all exist once it checks the progress of operations. Claims with neither were captured by a
+// volume snapshotter while backing up the items, or are not backed up at all.
+func areVolumesCaptured(vmi *kvcore.VirtualMachineInstance, backup *v1.Backup) (bool, time.Time, error) {
+	var capturedAt time.Time
+	claims := getVolumeClaims(vmi)
+	snapshots, err := util.ListBackupVolumeSnapshots(backup, vmi.Namespace)
+	if err != nil {
+		return false, capturedAt, err
+	}
+	for _, snapshot := range snapshots {
+		claim := snapshot.Spec.Source.PersistentVolumeClaimName
+		if claim == nil || !claims[*claim] {
+			continue
+		}
+		status := snapshot.Status
+		if status == nil || status.ReadyToUse == nil || !*status.ReadyToUse {
+			return false, capturedAt, nil
+		}
+		if status.CreationTime != nil && status.CreationTime.After(capturedAt) {
+			capturedAt = status.CreationTime.Time
+		}
+	}
+
+	podVolumeBackups, err := util.ListBackupPodVolumeBackups(backup)
+	if err != nil {
+		return false, capturedAt, err
+	}
+	for _, podVolumeBackup := range podVolumeBackups {
+		if _, ok := vmi.Status.ActivePods[podVolumeBackup.Spec.Pod.UID]; !ok {
+			continue
+		}
+		switch podVolumeBackup.Status.Phase {
+		case v1.PodVolumeBackupPhaseCompleted, v1.PodVolumeBackupPhaseFailed, v1.PodVolumeBackupPhaseCanceled:
+		default:
+			return false, capturedAt, nil
+		}
+		if completed := podVolumeBackup.Status.CompletionTimestamp; completed != nil && completed.After(capturedAt) {
+			capturedAt = completed.Time
+		}
+	}
+	return true, capturedAt, nil
+}
+
+// releaseGuest undoes a freeze or pause operation and removes the quiesce marker. A VMI which is gone needs no release.
+func releaseGuest(operation, namespace, name string) error {
+	var err error
+	switch operation {
+	case freezeOperation:
+		err = util.UnfreezeVMI(namespace, name)
+	case pauseOperation:
+		err = util.UnpauseVMI(namespace, name)
+	}
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to %s VMI %s/%s", "un"+operation, namespace, name)
+	}
+	err = util.SetVMIAnnotation(namespace, name, util.QuiescedByBackupAnnotation, nil)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to unmark VMI %s/%s", namespace, name)
+	}
+	return nil
+}
+
+// getVolumeClaims returns the names of the PVCs backing the volumes of the VMI
+func getVolumeClaims(vmi *kvcore.VirtualMachineInstance) map[string]bool {
+	claims := map[string]bool{}
+	for _, volume := range vmi.Spec.Volumes {
+		switch {
+		case volume.PersistentVolumeClaim != nil:
+			claims[volume.PersistentVolumeClaim.ClaimName] = true
+		case volume.DataVolume != nil:
+			claims[volume.DataVolume.Name] = true
+		}
+	}
+	return claims
+}
+
+func newQuiesceOperationID(operation string, vmi *kvcore.VirtualMachineInstance, started time.Time) string {
+	return fmt.Sprintf("%s/%s/%s/%d", operation, vmi.Namespace, vmi.Name, started.Unix())
+}
+
+func parseQuiesceOperationID(operationID string) (string, string, string, time.Time, error) {
+	parts := strings.Split(operationID, "/")
+	if len(parts) != 4 || (parts[0] != freezeOperation && parts[0] != pauseOperation) {
+		return "", "", "", time.Time{}, biav2.InvalidOperationIDError(operationID)
+	}
+	started, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return "", "", "", time.Time{}, biav2.InvalidOperationIDError(operationID)
+	}
+	return parts[0], parts[1], parts[2], time.Unix(started, 0), nil
+}
@@ -0,0 +1,75 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+)
+
+// SecretBackupItemAction is a backup item action for backing up the cloud-init secrets of VMs
+type SecretBackupItemAction struct {
+	log logrus.FieldLogger
+}
+
+// NewSecretBackupItemAction instantiates a SecretBackupItemAction.
+func NewSecretBackupItemAction(log logrus.FieldLogger) *SecretBackupItemAction {
+	return &SecretBackupItemAction{log: log}
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *SecretBackupItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+			IncludedResources: []string{
+				"Secret",
+			},
+		},
+		nil
+}
+
+// Execute annotates a secret with the VM owning it, so the restore can rename it together with the VM
+func (p *SecretBackupItemAction) Execute(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	p.log.Info("Executing SecretBackupItemAction")
+
+	if backup == nil {
+		return nil, nil, fmt.Errorf("backup object nil!")
+	}
+
+	metadata, err := meta.Accessor(item)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	if vmName, ok := util.GetSecretOwnerVM(backup, metadata.GetNamespace(), metadata.GetName(), p.log); ok {
+		p.log.Infof("Secret %s/%s is owned by VM %s", metadata.GetNamespace(), metadata.GetName(), vmName)
+		util.AddAnnotation(item, util.OwnerVMAnnotation, vmName)
+	}
+
+	return item, nil, nil
+}
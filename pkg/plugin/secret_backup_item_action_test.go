@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kvcore "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+)
+
+func TestSecretBackupItemAction(t *testing.T) {
+	newVM := func(name, secret string) kvcore.VirtualMachine {
+		return kvcore.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+			Spec: kvcore.VirtualMachineSpec{
+				Template: &kvcore.VirtualMachineInstanceTemplateSpec{
+					Spec: kvcore.VirtualMachineInstanceSpec{
+						Volumes: []kvcore.Volume{
+							{Name: "cloudinit", VolumeSource: kvcore.VolumeSource{CloudInitConfigDrive: &kvcore.CloudInitConfigDriveSource{
+								UserDataSecretRef: &corev1.LocalObjectReference{Name: secret},
+							}}},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name          string
+		secret        string
+		expectedOwner string
+	}{
+		{"Secret used by a single VM should be owned by it", "test-vm-cloud-init", "test-vm"},
+		{"Secret shared by several VMs should have no owner", "shared", ""},
+		{"Secret not used by a VM should have no owner", "unused", ""},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	listVMs := util.ListVMs
+	defer func() { util.ListVMs = listVMs }()
+	util.ListVMs = func(labelSelector, namespace string) (*kvcore.VirtualMachineList, error) {
+		return &kvcore.VirtualMachineList{Items: []kvcore.VirtualMachine{
+			newVM("test-vm", "test-vm-cloud-init"),
+			newVM("other-vm", "shared"),
+			newVM("third-vm", "shared"),
+		}}, nil
+	}
+
+	action := NewSecretBackupItemAction(logrus.StandardLogger())
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			item := &unstructured.Unstructured{
+				Object: map[string]interface{}{
+					"apiVersion": "v1",
+					"kind":       "Secret",
+					"metadata": map[string]interface{}{
+						"name":      tc.secret,
+						"namespace": testNamespace,
+					},
+				},
+			}
+
+			output, extra, err := action.Execute(item, &velerov1.Backup{})
+			assert.NoError(t, err)
+			assert.Empty(t, extra)
+			owner, ok := output.(*unstructured.Unstructured).GetAnnotations()[util.OwnerVMAnnotation]
+			assert.Equal(t, tc.expectedOwner != "", ok)
+			assert.Equal(t, tc.expectedOwner, owner)
+		})
+	}
+	t.Run("Failed VM lookup should not fail the backup", func(t *testing.T) {
+		util.ListVMs = func(labelSelector, namespace string) (*kvcore.VirtualMachineList, error) {
+			return nil, fmt.Errorf("list failed")
+		}
+		item := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Secret",
+				"metadata": map[string]interface{}{
+					"name":      "test-vm-cloud-init",
+					"namespace": testNamespace,
+				},
+			},
+		}
+
+		output, _, err := action.Execute(item, &velerov1.Backup{ObjectMeta: metav1.ObjectMeta{UID: "failed-lookup"}})
+		assert.NoError(t, err)
+		assert.NotContains(t, output.(*unstructured.Unstructured).GetAnnotations(), util.OwnerVMAnnotation)
+	})
+}
@@ -0,0 +1,76 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+)
+
+// SecretRestoreItemAction is a restore item action for restoring the cloud-init secrets of VMs
+type SecretRestoreItemAction struct {
+	log logrus.FieldLogger
+}
+
+// NewSecretRestoreItemAction instantiates a SecretRestoreItemAction.
+func NewSecretRestoreItemAction(log logrus.FieldLogger) *SecretRestoreItemAction {
+	return &SecretRestoreItemAction{log: log}
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *SecretRestoreItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+			IncludedResources: []string{"Secret"},
+		},
+		nil
+}
+
+// Execute renames the secret owned by a renamed VM, the way the VM restore rewrites its cloud-init references
+func (p *SecretRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	p.log.Info("Executing SecretRestoreItemAction")
+
+	if input == nil {
+		return nil, fmt.Errorf("input object nil!")
+	}
+
+	secret := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+	if _, ok := secret.GetAnnotations()[util.OwnerVMAnnotation]; !ok {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	config := util.LoadPluginConfig(common.PluginKindRestoreItemAction, input.Restore.ObjectMeta, p.log)
+	renamer, err := util.GetVMRenamer(input.Restore, config, secret.GetNamespace())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	oldName := secret.GetName()
+	if newName := renamer.RenameOwnedObject(secret); newName != "" {
+		p.log.Infof("Renaming secret %s/%s to %s", secret.GetNamespace(), oldName, newName)
+	}
+	return velero.NewRestoreItemActionExecuteOutput(secret), nil
+}
@@ -0,0 +1,57 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+)
+
+func TestSecretRestoreItemAction(t *testing.T) {
+	testCases := []struct {
+		name         string
+		annotations  map[string]interface{}
+		restoreLabel map[string]string
+		expectedName string
+	}{
+		{"Secret owned by a renamed VM should be renamed",
+			map[string]interface{}{util.OwnerVMAnnotation: "test-vm"}, map[string]string{util.RenamePrefixLabel: "clone-"}, "clone-test-vm-cloud-init"},
+		{"Secret should keep its name when VMs are not renamed",
+			map[string]interface{}{util.OwnerVMAnnotation: "test-vm"}, nil, "test-vm-cloud-init"},
+		{"Secret not owned by a VM should keep its name",
+			nil, map[string]string{util.RenamePrefixLabel: "clone-"}, "test-vm-cloud-init"},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+	action := NewSecretRestoreItemAction(logrus.StandardLogger())
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+				Item: &unstructured.Unstructured{
+					Object: map[string]interface{}{
+						"apiVersion": "v1",
+						"kind":       "Secret",
+						"metadata": map[string]interface{}{
+							"name":        "test-vm-cloud-init",
+							"namespace":   testNamespace,
+							"annotations": tc.annotations,
+						},
+					},
+				},
+				Restore: &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{Labels: tc.restoreLabel}},
+			})
+
+			assert.NoError(t, err)
+			secret := output.UpdatedItem.(*unstructured.Unstructured)
+			assert.Equal(t, tc.expectedName, secret.GetName())
+			assert.NotContains(t, secret.GetAnnotations(), util.OwnerVMAnnotation)
+		})
+	}
+}
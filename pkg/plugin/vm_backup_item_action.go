@@ -21,16 +21,22 @@ package plugin
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
+	k8score "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 
 	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	kvcore "kubevirt.io/api/core/v1"
 	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
@@ -74,35 +80,25 @@ func (p *VMBackupItemAction) Execute(item runtime.Unstructured, backup *v1.Backu
 		return nil, nil, errors.WithStack(err)
 	}
 
-	safe, err := p.canBeSafelyBackedUp(vm, backup)
+	config := util.LoadPluginConfig(common.PluginKindBackupItemAction, backup.ObjectMeta, p.log)
+	failure, err := checkVMBackupPossible(vm, backup, config, p.log)
 	if err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
-	if !safe {
-		return nil, nil, fmt.Errorf("VM cannot be safely backed up")
+	if failure != nil {
+		item, err := handleUnsafeItem(p.log, backup, config, kvcore.VirtualMachineGroupVersionKind, vm, item, util.NewSafetyCheckError("VM", vm, failure))
+		return item, nil, err
 	}
 
-	// we can skip all checks that ensure consistency
-	// if we just want to backup for metadata purposes
-	if !util.IsMetadataBackup(backup) {
-		skipVolume := func(volume kvcore.Volume) bool {
-			return volumeInDVTemplates(volume, vm)
-		}
-
-		restore, err := util.RestorePossible(vm.Spec.Template.Spec.Volumes, backup, vm.Namespace, skipVolume, p.log)
-		if err != nil {
-			return nil, nil, errors.WithStack(err)
-		}
-		if !restore {
-			return nil, nil, fmt.Errorf("VM would not be restored correctly")
-		}
-	}
-
-	extra, err := kvgraph.NewVirtualMachineBackupGraph(vm)
+	extra, err := kvgraph.NewVirtualMachineBackupGraph(vm, backup)
 	if err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
 
+	if util.ShouldBackupClusterInstancetypes(backup, config, vm.Namespace) {
+		extra = append(extra, kvgraph.NewVirtualMachineClusterInstancetypeGraph(vm)...)
+	}
+
 	// By default velero will remove the status field of an object before restore:
 	//
 	// https://velero.io/docs/main/restore-reference/#restore-status-field-of-objects
@@ -120,42 +116,119 @@ func (p *VMBackupItemAction) Execute(item runtime.Unstructured, backup *v1.Backu
 		vm.Spec.Preference.RevisionName = vm.Status.PreferenceRef.ControllerRevisionRef.Name
 	}
 
+	// Owner references are not restored, remember the owning pool so the
+	// restore can decide between letting the pool adopt the VM or skipping it
+	if poolName, ok := util.GetPoolOwner(vm); ok {
+		if vm.Annotations == nil {
+			vm.Annotations = make(map[string]string)
+		}
+		vm.Annotations[util.PoolOwnerAnnotation] = poolName
+	}
+
+	// Volumes hotplugged without being persisted are not part of the VM spec. Store them
+	// on the backed up VM so the restore can either re-apply or drop them.
+	if err := p.annotateHotplugVolumes(vm); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	// Secrets have no owner references, remember the cloud-init secrets only this VM uses
+	// so the restore can rename them together with it
+	ownedSecrets := util.GetOwnedSecrets(backup, vm, p.log)
+	if len(ownedSecrets) > 0 {
+		if vm.Annotations == nil {
+			vm.Annotations = make(map[string]string)
+		}
+		vm.Annotations[util.OwnedSecretsAnnotation] = strings.Join(ownedSecrets, ",")
+	}
+
 	vmMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vm)
 	if err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
 
-	return &unstructured.Unstructured{Object: vmMap}, extra, nil
+	output := &unstructured.Unstructured{Object: vmMap}
+	util.RecordClusterVersions(output, p.log)
+	return output, extra, nil
 }
 
-// returns false for all cases when backup might end up with a broken PVC snapshot
-func (p *VMBackupItemAction) canBeSafelyBackedUp(vm *kvcore.VirtualMachine, backup *v1.Backup) (bool, error) {
+// checkVMBackupPossible returns why backing up the VM is not safe, or nil when it is
+func checkVMBackupPossible(vm *kvcore.VirtualMachine, backup *v1.Backup, config *util.PluginConfig, log logrus.FieldLogger) (*util.SafetyCheckFailure, error) {
+	failure, err := canBeSafelyBackedUp(vm, backup)
+	if err != nil || failure != nil {
+		return failure, err
+	}
+
+	// we can skip all checks that ensure consistency
+	// if we just want to backup for metadata purposes
+	if util.IsMetadataBackup(backup, config, vm.Namespace) {
+		return nil, nil
+	}
+	return checkVMRestorePossible(vm, backup, config, log)
+}
+
+// returns the failure for all cases when backup might end up with a broken PVC snapshot
+func canBeSafelyBackedUp(vm *kvcore.VirtualMachine, backup *v1.Backup) (*util.SafetyCheckFailure, error) {
 	isRuning := vm.Status.PrintableStatus == kvcore.VirtualMachineStatusStarting || vm.Status.PrintableStatus == kvcore.VirtualMachineStatusRunning
 	if !isRuning {
-		return true, nil
+		return nil, nil
 	}
 
+	vmi := fmt.Sprintf("virtualmachineinstances %s/%s", vm.Namespace, vm.Name)
 	if !util.IsResourceInBackup("virtualmachineinstances", backup) {
-		p.log.Info("Backup of a running VM does not contain VMI.")
-		return false, nil
+		return &util.SafetyCheckFailure{
+			Reason: util.RunningWithoutVMI,
+			Object: vmi,
+			Hint:   util.ResourceNotInBackupHint("virtualmachineinstances"),
+		}, nil
 	}
 
-	excluded, err := isVMIExcludedByLabel(vm)
+	excluded, err := util.CachedLookup(labelLookups, backup, "virtualmachineinstance/"+vm.Namespace+"/"+vm.Name, func() (bool, error) {
+		return isVMIExcludedByLabel(vm)
+	})
 	if err != nil {
-		return false, errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
 	if excluded {
-		p.log.Info("VM is running but VMI is not included in the backup")
-		return false, nil
+		return &util.SafetyCheckFailure{
+			Reason: util.VMIExcluded,
+			Object: vmi,
+			Hint:   util.ExcludedByLabelHint(),
+		}, nil
 	}
 
 	if !util.IsResourceInBackup("pods", backup) && util.IsResourceInBackup("persistentvolumeclaims", backup) {
-		p.log.Info("Backup of a running VM does not contain Pod but contains PVC")
-		return false, nil
+		return util.NewLauncherPodNotInBackupFailure(vm.Namespace, vm.Name), nil
 	}
 
-	return true, nil
+	return nil, nil
+}
+
+func (p *VMBackupItemAction) annotateHotplugVolumes(vm *kvcore.VirtualMachine) error {
+	var vmi *kvcore.VirtualMachineInstance
+	if vm.Status.Created {
+		var err error
+		vmi, err = util.GetVMI(vm.Namespace, vm.Name)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	hotplugVolumes := util.GetHotplugVolumes(vm, vmi)
+	if len(hotplugVolumes) == 0 {
+		return nil
+	}
+
+	p.log.Infof("VM %s/%s has %d hotplugged volumes", vm.Namespace, vm.Name, len(hotplugVolumes))
+	value, err := json.Marshal(hotplugVolumes)
+	if err != nil {
+		return err
+	}
+	if vm.Annotations == nil {
+		vm.Annotations = make(map[string]string)
+	}
+	vm.Annotations[util.HotplugVolumesAnnotation] = string(value)
+	return nil
 }
 
 // This is assigned to a variable so it can be replaced by a mock function in tests
@@ -179,6 +252,32 @@ var isVMIExcludedByLabel = func(vm *kvcore.VirtualMachine) (bool, error) {
 	return ok && label == "true", nil
 }
 
+// checkVMRestorePossible returns the failure when the volumes of the VM, other than its DataVolume
+// templates, would not be restored from the backup
+func checkVMRestorePossible(vm *kvcore.VirtualMachine, backup *v1.Backup, config *util.PluginConfig, log logrus.FieldLogger) (*util.SafetyCheckFailure, error) {
+	skipVolume := func(volume kvcore.Volume) bool {
+		return volumeInDVTemplates(volume, vm)
+	}
+
+	return util.RestorePossible(vm.Spec.Template.Spec.Volumes, backup, config, vm.Namespace, skipVolume, log)
+}
+
+// handleUnsafeItem returns the error failing an item that cannot be safely backed up. When the backup
+// skips unsafe VMs, the error is logged as a warning instead, and the item is returned marked with the
+// SkippedUnsafeAnnotation and without its graph: Velero backs up the item returned by an action which
+// does not fail, the restore actions then leave it out. Either way, an event is recorded on the item.
+func handleUnsafeItem(log logrus.FieldLogger, backup *v1.Backup, config *util.PluginConfig, gvk schema.GroupVersionKind, obj metav1.Object, item runtime.Unstructured, err *util.SafetyCheckError) (runtime.Unstructured, error) {
+	if !util.ShouldSkipUnsafe(backup, config, err.Namespace) {
+		util.RecordEvent(log, gvk, obj, k8score.EventTypeWarning, util.EventBackupRefused, "Backup %s failed: %v", backup.Name, err)
+		return nil, err
+	}
+
+	log.Warnf("Skipping unsafe item, it is backed up but will not be restored: %v", err)
+	util.RecordEvent(log, gvk, obj, k8score.EventTypeWarning, util.EventUnsafeSkipped, "Stored by backup %s but not restored from it: %v", backup.Name, err)
+	util.AddAnnotation(item, util.SkippedUnsafeAnnotation, err.Error())
+	return item, nil
+}
+
 func volumeInDVTemplates(volume kvcore.Volume, vm *kvcore.VirtualMachine) bool {
 	for _, template := range vm.Spec.DataVolumeTemplates {
 		if template.Name == volume.VolumeSource.DataVolume.Name {
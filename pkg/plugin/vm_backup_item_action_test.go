@@ -7,10 +7,14 @@ import (
 	"github.com/stretchr/testify/assert"
 	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/kuberesource"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	k8sv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	kvcore "kubevirt.io/api/core/v1"
 	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
@@ -29,7 +33,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 		vm                   kvcore.VirtualMachine
 		backup               v1.Backup
 		isVMIExcludedByLabel func(vm *kvcore.VirtualMachine) (bool, error)
-		expected             bool
+		expected             util.SafetyCheckReason
 	}{
 		{"Stopped VM can be safely backed up",
 			kvcore.VirtualMachine{
@@ -39,7 +43,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 			},
 			v1.Backup{},
 			returnFalse,
-			true,
+			"",
 		},
 		{"Provisioning VM can be safely backed up",
 			kvcore.VirtualMachine{
@@ -49,7 +53,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 			},
 			v1.Backup{},
 			returnFalse,
-			true,
+			"",
 		},
 		{"Paused VM can be safely backed up",
 			kvcore.VirtualMachine{
@@ -59,7 +63,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 			},
 			v1.Backup{},
 			returnFalse,
-			true,
+			"",
 		},
 		{"Stopping VM can be safely backed up", // TODO: Can it really!?
 			kvcore.VirtualMachine{
@@ -69,7 +73,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 			},
 			v1.Backup{},
 			returnFalse,
-			true,
+			"",
 		},
 		{"Terminating VM can be safely backed up",
 			kvcore.VirtualMachine{
@@ -79,7 +83,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 			},
 			v1.Backup{},
 			returnFalse,
-			true,
+			"",
 		},
 		{"Migrating VM can be safely backed up", // TODO: Can it really?
 			kvcore.VirtualMachine{
@@ -89,7 +93,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 			},
 			v1.Backup{},
 			returnFalse,
-			true,
+			"",
 		},
 		{"VM with unknown status can be safely backed up",
 			kvcore.VirtualMachine{
@@ -99,7 +103,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 			},
 			v1.Backup{},
 			returnFalse,
-			true,
+			"",
 		},
 		{"Running VM can be safely backed up when IncludeResources and ExcludedResources is empty and VMI not excluded by label",
 			kvcore.VirtualMachine{
@@ -109,7 +113,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 			},
 			v1.Backup{},
 			returnFalse,
-			true,
+			"",
 		},
 		{"Starting VM can be safely backed up when IncludeResources and ExcludedResrouces is empty and VMI not excluded by label",
 			kvcore.VirtualMachine{
@@ -119,7 +123,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 			},
 			v1.Backup{},
 			returnFalse,
-			true,
+			"",
 		},
 		{"Running VM can be safely backed up when IncludeResources and ExcludedResources is empty and VMI is excluded by label",
 			kvcore.VirtualMachine{
@@ -129,7 +133,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 			},
 			v1.Backup{},
 			returnTrue,
-			false,
+			util.VMIExcluded,
 		},
 		{"Running VM can be safely backed up when IncludeResource contains both pods and VMIs",
 			kvcore.VirtualMachine{
@@ -143,7 +147,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 				},
 			},
 			returnFalse,
-			true,
+			"",
 		},
 		{"Running VM can be safely backed up when ExcludeResource contains both pods and PVCs",
 			kvcore.VirtualMachine{
@@ -157,7 +161,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 				},
 			},
 			returnFalse,
-			true,
+			"",
 		},
 		{"Running VM cannot be safely backed up when IncludeResource do not contain pods",
 			kvcore.VirtualMachine{
@@ -171,7 +175,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 				},
 			},
 			returnFalse,
-			false,
+			util.LauncherPodExcluded,
 		},
 		{"Running VM can be safely backed up when IncludeResource do not contain pods or PVCs",
 			kvcore.VirtualMachine{
@@ -185,7 +189,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 				},
 			},
 			returnFalse,
-			true,
+			"",
 		},
 		{"Running VM cannot be safely backed up when IncludeResource do not contain VMIs",
 			kvcore.VirtualMachine{
@@ -199,7 +203,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 				},
 			},
 			returnFalse,
-			false,
+			util.RunningWithoutVMI,
 		},
 		{"Running VM cannot be safely backed up when ExcludeResource contains pods",
 			kvcore.VirtualMachine{
@@ -213,7 +217,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 				},
 			},
 			returnFalse,
-			false,
+			util.LauncherPodExcluded,
 		},
 		{"Running VM cannot be safely backed up when ExcludeResource contains VMIs",
 			kvcore.VirtualMachine{
@@ -227,7 +231,7 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 				},
 			},
 			returnFalse,
-			false,
+			util.RunningWithoutVMI,
 		},
 		{"Running VM cannot be safely backed up when VMI is excluded by label",
 			kvcore.VirtualMachine{
@@ -237,18 +241,22 @@ func TestCanBeSafelyBackedUp(t *testing.T) {
 			},
 			v1.Backup{},
 			returnTrue,
-			false,
+			util.VMIExcluded,
 		},
 	}
 
 	logrus.SetLevel(logrus.ErrorLevel)
-	action := NewVMBackupItemAction(logrus.StandardLogger())
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
 	for _, tc := range testCases {
 		isVMIExcludedByLabel = tc.isVMIExcludedByLabel
 		t.Run(tc.name, func(t *testing.T) {
-			actual, err := action.canBeSafelyBackedUp(&tc.vm, &tc.backup)
+			failure, err := canBeSafelyBackedUp(&tc.vm, &tc.backup)
 			assert.NoError(t, err)
-			assert.Equal(t, tc.expected, actual)
+			if tc.expected == "" {
+				assert.Nil(t, failure)
+			} else if assert.NotNil(t, failure) {
+				assert.Equal(t, tc.expected, failure.Reason)
+			}
 		})
 	}
 }
@@ -547,11 +555,72 @@ func TestVMBackupAction(t *testing.T) {
 				},
 			},
 		},
+		{"VM with cluster instancetype and preference should include them with backup-cluster-instancetypes label",
+			unstructured.Unstructured{
+				Object: map[string]interface{}{
+					"apiVersion": "kubevirt.io",
+					"kind":       "VirtualMachine",
+					"metadata": map[string]interface{}{
+						"name":      "test-vm",
+						"namespace": testNamespace,
+					},
+					"spec": map[string]interface{}{
+						"template": map[string]interface{}{
+							"spec": map[string]interface{}{
+								"volumes": []map[string]interface{}{},
+							},
+						},
+						"instancetype": map[string]interface{}{
+							"kind":         "virtualmachineclusterinstancetype",
+							"name":         "test-instancetype",
+							"revisionName": "test-revision1",
+						},
+						"preference": map[string]interface{}{
+							"kind":         "virtualmachineclusterpreference",
+							"name":         "test-preference",
+							"revisionName": "test-revision2",
+						},
+					},
+				},
+			},
+			v1.Backup{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						util.BackupClusterInstancetypesLabel: "true",
+					},
+				},
+			},
+			false,
+			[]velero.ResourceIdentifier{
+				{
+					GroupResource: schema.GroupResource{Group: "apps", Resource: "controllerrevisions"},
+					Namespace:     testNamespace,
+					Name:          "test-revision1",
+				},
+				{
+					GroupResource: schema.GroupResource{Group: "apps", Resource: "controllerrevisions"},
+					Namespace:     testNamespace,
+					Name:          "test-revision2",
+				},
+				{
+					GroupResource: schema.GroupResource{Group: "instancetype.kubevirt.io", Resource: "virtualmachineclusterinstancetypes"},
+					Name:          "test-instancetype",
+				},
+				{
+					GroupResource: schema.GroupResource{Group: "instancetype.kubevirt.io", Resource: "virtualmachineclusterpreferences"},
+					Name:          "test-preference",
+				},
+			},
+		},
 	}
 
 	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
 	action := NewVMBackupItemAction(logrus.StandardLogger())
 	isVMIExcludedByLabel = returnFalse
+	util.GetVMI = func(ns, name string) (*kvcore.VirtualMachineInstance, error) {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Group: "kubevirt.io", Resource: "virtualmachineinstances"}, name)
+	}
 	for _, tc := range testCases {
 		util.IsDVExcludedByLabel = func(namespace, pvcName string) (bool, error) { return false, nil }
 		util.IsPVCExcludedByLabel = func(namespace, pvcName string) (bool, error) { return false, nil }
@@ -559,6 +628,9 @@ func TestVMBackupAction(t *testing.T) {
 			util.ListPods = func(name, ns string) (*k8sv1.PodList, error) {
 				return &k8sv1.PodList{}, nil
 			}
+			util.ListLauncherPods = func(ns string) (*k8sv1.PodList, error) {
+				return &k8sv1.PodList{}, nil
+			}
 			_, extra, err := action.Execute(&tc.vm, &tc.backup)
 
 			if tc.errorExpected {
@@ -577,6 +649,159 @@ func TestVMBackupAction(t *testing.T) {
 	}
 }
 
+func TestVMBackupActionSkipUnsafe(t *testing.T) {
+	runningVM := func(volumes ...kvcore.Volume) *unstructured.Unstructured {
+		vm := &kvcore.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-vm",
+				Namespace: testNamespace,
+			},
+			Spec: kvcore.VirtualMachineSpec{
+				Template: &kvcore.VirtualMachineInstanceTemplateSpec{
+					Spec: kvcore.VirtualMachineInstanceSpec{Volumes: volumes},
+				},
+			},
+			Status: kvcore.VirtualMachineStatus{
+				PrintableStatus: kvcore.VirtualMachineStatusRunning,
+			},
+		}
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vm)
+		assert.NoError(t, err)
+		return &unstructured.Unstructured{Object: obj}
+	}
+	pvcVolume := kvcore.Volume{
+		Name: "disk",
+		VolumeSource: kvcore.VolumeSource{
+			PersistentVolumeClaim: &kvcore.PersistentVolumeClaimVolumeSource{
+				PersistentVolumeClaimVolumeSource: k8sv1.PersistentVolumeClaimVolumeSource{ClaimName: "test-pvc"},
+			},
+		},
+	}
+	skipUnsafe := map[string]string{util.SkipUnsafeLabel: "true"}
+	namespaceConfig, err := util.NewPluginConfig(common.PluginKindBackupItemAction, map[string]string{testNamespace + ".skip-unsafe": "true"})
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		vm            *unstructured.Unstructured
+		labels        map[string]string
+		resources     []string
+		config        *util.PluginConfig
+		errorExpected bool
+	}{
+		{"Running VM without its VMI fails the item", runningVM(), nil, []string{"virtualmachines"}, nil, true},
+		{"Running VM without its VMI is skipped", runningVM(), skipUnsafe, []string{"virtualmachines"}, nil, false},
+		{"VM missing a PVC fails the item", runningVM(pvcVolume), nil, []string{"virtualmachines", "virtualmachineinstances", "pods"}, nil, true},
+		{"VM missing a PVC is skipped", runningVM(pvcVolume), skipUnsafe, []string{"virtualmachines", "virtualmachineinstances", "pods"}, nil, false},
+		{"VM missing a PVC is skipped by the namespace config", runningVM(pvcVolume), nil, []string{"virtualmachines", "virtualmachineinstances", "pods"}, namespaceConfig, false},
+		{"Backup label overrides the config", runningVM(pvcVolume), map[string]string{util.SkipUnsafeLabel: "false"}, []string{"virtualmachines", "virtualmachineinstances", "pods"}, namespaceConfig, true},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	action := NewVMBackupItemAction(logrus.StandardLogger())
+	isVMIExcludedByLabel = func(vm *kvcore.VirtualMachine) (bool, error) { return false, nil }
+	util.IsPVCExcludedByLabel = func(namespace, pvcName string) (bool, error) { return false, nil }
+	for _, tc := range testCases {
+		util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return tc.config, nil }
+		backup := &v1.Backup{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-backup", Labels: tc.labels},
+			Spec:       v1.BackupSpec{IncludedResources: tc.resources},
+		}
+
+		t.Run(tc.name, func(t *testing.T) {
+			events := []string{}
+			util.CreateEvent = func(event *k8sv1.Event) error {
+				events = append(events, event.InvolvedObject.Kind+"/"+event.Reason)
+				return nil
+			}
+
+			output, extra, err := action.Execute(tc.vm, backup)
+			if tc.errorExpected {
+				assert.Error(t, err)
+				assert.Equal(t, []string{"VirtualMachine/" + util.EventBackupRefused}, events)
+				return
+			}
+			assert.NoError(t, err)
+			metadata, err := meta.Accessor(output)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, metadata.GetAnnotations()[util.SkippedUnsafeAnnotation])
+			assert.Empty(t, extra)
+			assert.Equal(t, []string{"VirtualMachine/" + util.EventUnsafeSkipped}, events)
+
+			// Velero stores the returned item, the restore action must leave it out
+			restoreOutput, err := NewVMRestoreItemAction(logrus.StandardLogger()).Execute(&velero.RestoreItemActionExecuteInput{
+				Item:           output,
+				ItemFromBackup: output,
+				Restore:        &v1.Restore{},
+			})
+			assert.NoError(t, err)
+			assert.True(t, restoreOutput.SkipRestore)
+		})
+	}
+}
+
+func TestVMBackupActionOwnedSecrets(t *testing.T) {
+	vm := &kvcore.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-vm", Namespace: testNamespace},
+		Spec: kvcore.VirtualMachineSpec{
+			Template: &kvcore.VirtualMachineInstanceTemplateSpec{
+				Spec: kvcore.VirtualMachineInstanceSpec{
+					Volumes: []kvcore.Volume{
+						{Name: "cloudinit", VolumeSource: kvcore.VolumeSource{CloudInitNoCloud: &kvcore.CloudInitNoCloudSource{
+							UserDataSecretRef:    &k8sv1.LocalObjectReference{Name: "test-vm-cloud-init"},
+							NetworkDataSecretRef: &k8sv1.LocalObjectReference{Name: "shared"},
+						}}},
+					},
+				},
+			},
+		},
+	}
+	otherVM := vm.DeepCopy()
+	otherVM.Name = "other-vm"
+	otherVM.Spec.Template.Spec.Volumes[0].CloudInitNoCloud.UserDataSecretRef = nil
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+	util.IsSecretExcludedByLabel = func(namespace, name string) (bool, error) { return false, nil }
+	listVMs := util.ListVMs
+	defer func() { util.ListVMs = listVMs }()
+	util.ListVMs = func(labelSelector, namespace string) (*kvcore.VirtualMachineList, error) {
+		return &kvcore.VirtualMachineList{Items: []kvcore.VirtualMachine{*vm, *otherVM}}, nil
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vm)
+	assert.NoError(t, err)
+	output, _, err := NewVMBackupItemAction(logrus.StandardLogger()).Execute(&unstructured.Unstructured{Object: obj}, &v1.Backup{})
+	assert.NoError(t, err)
+	metadata, err := meta.Accessor(output)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-vm-cloud-init", metadata.GetAnnotations()[util.OwnedSecretsAnnotation])
+
+	// The restore only renames the references to the owned secrets
+	restoreOutput, err := NewVMRestoreItemAction(logrus.StandardLogger()).Execute(&velero.RestoreItemActionExecuteInput{
+		Item:    output,
+		Restore: &v1.Restore{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{util.RenameSuffixLabel: "-copy"}}},
+	})
+	assert.NoError(t, err)
+	restored := new(kvcore.VirtualMachine)
+	assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(restoreOutput.UpdatedItem.UnstructuredContent(), restored))
+	cloudInit := restored.Spec.Template.Spec.Volumes[0].CloudInitNoCloud
+	assert.Equal(t, "test-vm-copy-cloud-init", cloudInit.UserDataSecretRef.Name)
+	assert.Equal(t, "shared", cloudInit.NetworkDataSecretRef.Name)
+
+	// Secrets left out of the restore keep their names
+	restoreOutput, err = NewVMRestoreItemAction(logrus.StandardLogger()).Execute(&velero.RestoreItemActionExecuteInput{
+		Item: output,
+		Restore: &v1.Restore{
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{util.RenameSuffixLabel: "-copy"}},
+			Spec:       v1.RestoreSpec{ExcludedResources: []string{"secrets"}},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(restoreOutput.UpdatedItem.UnstructuredContent(), restored))
+	assert.Equal(t, "test-vm-cloud-init", restored.Spec.Template.Spec.Volumes[0].CloudInitNoCloud.UserDataSecretRef.Name)
+}
+
 func TestRestorePossible_VM(t *testing.T) {
 
 }
@@ -0,0 +1,153 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	kvcore "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util/kvgraph"
+)
+
+// VMItemBlockAction is an item block action grouping VirtualMachines and VirtualMachineInstances
+// with their object graph, so Velero backs them up together. It also quiesces the guest of the
+// VMIs before their item block is backed up.
+type VMItemBlockAction struct {
+	log logrus.FieldLogger
+}
+
+// NewVMItemBlockAction instantiates a VMItemBlockAction.
+func NewVMItemBlockAction(log logrus.FieldLogger) *VMItemBlockAction {
+	return &VMItemBlockAction{log: log}
+}
+
+// Name returns the name of this item block action.
+func (p *VMItemBlockAction) Name() string {
+	return "VMItemBlockAction"
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *VMItemBlockAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+			IncludedResources: []string{
+				"VirtualMachine",
+				"VirtualMachineInstance",
+				"Pod",
+			},
+		},
+		nil
+}
+
+// GetRelatedItems returns the VM or VMI object graph: the VMI, launcher pod, volumes, backend storage PVC,
+// secrets, controller revisions, etc. Those items are then kept in the same item block as the VM.
+// Launcher pods return their VMI, so the block is the same when Velero reaches the pod first.
+// VMs skipped as unsafe and VMIs which VMIBackupItemAction leaves out of the backup return no related items.
+// Velero calls the action while building the item block, before backing up any of its items, so the
+// guest of a VMI is quiesced here, before the snapshots of its volumes.
+func (p *VMItemBlockAction) GetRelatedItems(item runtime.Unstructured, backup *v1.Backup) ([]velero.ResourceIdentifier, error) {
+	p.log.Info("Executing VMItemBlockAction")
+
+	switch item.GetObjectKind().GroupVersionKind().Kind {
+	case "Pod":
+		return p.getLauncherPodVMI(item)
+	case "VirtualMachineInstance":
+		vmi := new(kvcore.VirtualMachineInstance)
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), vmi); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		config := util.LoadPluginConfig(common.PluginKindBackupItemAction, backup.ObjectMeta, p.log)
+		// Same checks as VMIBackupItemAction, a VMI it does not back up pulls in no related items
+		leftOut, err := isVMILeftOut(vmi, backup, config, p.log)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if leftOut {
+			p.log.Infof("VMI %s/%s is not backed up, it has no related items", vmi.Namespace, vmi.Name)
+			return nil, nil
+		}
+		related, err := kvgraph.NewVirtualMachineInstanceBackupGraph(vmi, backup)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		// Only VMIs passing the checks are quiesced, VMIBackupItemAction releases the guest when it
+		// leaves the VMI out after all, and VMIDeleteItemAction when the VMI item itself failed
+		quiescedGuests.quiesce(p.log, vmi, backup, config)
+		return related, nil
+	}
+
+	related, err := kvgraph.NewObjectBackupGraph(item, backup)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if item.GetObjectKind().GroupVersionKind().Kind == "VirtualMachine" {
+		vm := new(kvcore.VirtualMachine)
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), vm); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		config := util.LoadPluginConfig(common.PluginKindBackupItemAction, backup.ObjectMeta, p.log)
+		if util.ShouldSkipUnsafe(backup, config, vm.Namespace) {
+			// Same checks as VMBackupItemAction, a VM skipped as unsafe pulls in no related items
+			failure, err := checkVMBackupPossible(vm, backup, config, p.log)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if failure != nil {
+				p.log.Infof("VM %s/%s is skipped as unsafe, it has no related items", vm.Namespace, vm.Name)
+				return nil, nil
+			}
+		}
+		if util.ShouldBackupClusterInstancetypes(backup, config, vm.Namespace) {
+			related = append(related, kvgraph.NewVirtualMachineClusterInstancetypeGraph(vm)...)
+		}
+	}
+
+	return related, nil
+}
+
+// getLauncherPodVMI returns the VMI running in a launcher pod, other pods have no related items
+func (p *VMItemBlockAction) getLauncherPodVMI(item runtime.Unstructured) ([]velero.ResourceIdentifier, error) {
+	pod, err := meta.Accessor(item)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if pod.GetLabels()[kvcore.AppLabel] != "virt-launcher" {
+		return nil, nil
+	}
+
+	for _, owner := range pod.GetOwnerReferences() {
+		if owner.Kind == kvcore.VirtualMachineInstanceGroupVersionKind.Kind {
+			return []velero.ResourceIdentifier{{
+				GroupResource: kvgraph.KVObjectGraph["virtualmachineinstances"],
+				Namespace:     pod.GetNamespace(),
+				Name:          owner.Name,
+			}}, nil
+		}
+	}
+	return nil, nil
+}
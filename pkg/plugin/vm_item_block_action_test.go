@@ -0,0 +1,263 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+)
+
+func TestVMItemBlockActionGetRelatedItems(t *testing.T) {
+	volumes := []interface{}{
+		map[string]interface{}{
+			"name": "rootdisk",
+			"persistentVolumeClaim": map[string]interface{}{
+				"claimName": "test-pvc",
+			},
+		},
+	}
+	vm := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "kubevirt.io/v1",
+			"kind":       "VirtualMachine",
+			"metadata": map[string]interface{}{
+				"name":      "test-vm",
+				"namespace": testNamespace,
+			},
+			"spec": map[string]interface{}{
+				"instancetype": map[string]interface{}{
+					"name": "test-instancetype",
+				},
+				"template": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"volumes": volumes,
+					},
+				},
+			},
+		},
+	}
+	vmi := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "kubevirt.io/v1",
+			"kind":       "VirtualMachineInstance",
+			"metadata": map[string]interface{}{
+				"name":      "test-vm",
+				"namespace": testNamespace,
+			},
+			"spec": map[string]interface{}{
+				"volumes": volumes,
+			},
+		},
+	}
+	launcherPod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   testNamespace,
+			Name:        "test-vm-launcher-pod",
+			Annotations: map[string]string{"kubevirt.io/domain": "test-vm"},
+		},
+	}
+	pvc := velero.ResourceIdentifier{
+		GroupResource: schema.GroupResource{Group: "", Resource: "persistentvolumeclaims"},
+		Namespace:     testNamespace,
+		Name:          "test-pvc",
+	}
+	clusterInstancetype := velero.ResourceIdentifier{
+		GroupResource: schema.GroupResource{Group: "instancetype.kubevirt.io", Resource: "virtualmachineclusterinstancetypes"},
+		Name:          "test-instancetype",
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	action := NewVMItemBlockAction(logrus.StandardLogger())
+	util.ListPods = func(name, ns string) (*v1.PodList, error) { return &v1.PodList{Items: []v1.Pod{launcherPod}}, nil }
+
+	t.Run("VM should return its object graph", func(t *testing.T) {
+		related, err := action.GetRelatedItems(vm, &velerov1.Backup{})
+		assert.NoError(t, err)
+		assert.Contains(t, related, pvc)
+		assert.NotContains(t, related, clusterInstancetype)
+	})
+
+	t.Run("VM should return cluster instancetypes when using appropriate label", func(t *testing.T) {
+		backup := &velerov1.Backup{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{util.BackupClusterInstancetypesLabel: "true"},
+			},
+		}
+		related, err := action.GetRelatedItems(vm, backup)
+		assert.NoError(t, err)
+		assert.Contains(t, related, pvc)
+		assert.Contains(t, related, clusterInstancetype)
+	})
+
+	t.Run("VM skipped as unsafe should return no related items", func(t *testing.T) {
+		backup := &velerov1.Backup{
+			ObjectMeta: metav1.ObjectMeta{
+				UID:    "test-unsafe-vm",
+				Labels: map[string]string{util.SkipUnsafeLabel: "true"},
+			},
+			Spec: velerov1.BackupSpec{ExcludedResources: []string{"persistentvolumeclaims"}},
+		}
+		util.IsPVCExcludedByLabel = func(namespace, pvcName string) (bool, error) { return false, nil }
+		related, err := action.GetRelatedItems(vm, backup)
+		assert.NoError(t, err)
+		assert.Empty(t, related)
+	})
+
+	t.Run("VMI should return its object graph including launcher pod", func(t *testing.T) {
+		related, err := action.GetRelatedItems(vmi, &velerov1.Backup{})
+		assert.NoError(t, err)
+		assert.Contains(t, related, pvc)
+		assert.Contains(t, related, velero.ResourceIdentifier{
+			GroupResource: schema.GroupResource{Group: "", Resource: "pods"},
+			Namespace:     testNamespace,
+			Name:          "test-vm-launcher-pod",
+		})
+	})
+	t.Run("VMI left out of the backup should return no related items", func(t *testing.T) {
+		util.FreezeVMI = func(ns, name string, timeout time.Duration) error {
+			t.Fatalf("VMI %s/%s left out of the backup should not be frozen", ns, name)
+			return nil
+		}
+		running := func() *unstructured.Unstructured {
+			running := vmi.DeepCopy()
+			running.Object["status"] = map[string]interface{}{
+				"phase": "Running",
+				"conditions": []interface{}{
+					map[string]interface{}{"type": "AgentConnected", "status": "True"},
+				},
+			}
+			return running
+		}
+
+		excluded := running()
+		excluded.SetLabels(map[string]string{util.VeleroExcludeLabel: "true"})
+		related, err := action.GetRelatedItems(excluded, &velerov1.Backup{ObjectMeta: metav1.ObjectMeta{UID: "test-excluded-vmi"}})
+		assert.NoError(t, err)
+		assert.Empty(t, related)
+
+		owned := running()
+		owned.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "kubevirt.io/v1", Kind: "VirtualMachine", Name: "test-vm"}})
+		backup := &velerov1.Backup{
+			ObjectMeta: metav1.ObjectMeta{UID: "test-owned-vmi"},
+			Spec:       velerov1.BackupSpec{ExcludedResources: []string{"virtualmachines"}},
+		}
+		related, err = action.GetRelatedItems(owned, backup)
+		assert.NoError(t, err)
+		assert.Empty(t, related)
+	})
+
+	t.Run("Launcher pod should return its VMI", func(t *testing.T) {
+		pod := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Pod",
+				"metadata": map[string]interface{}{
+					"name":      "test-vm-launcher-pod",
+					"namespace": testNamespace,
+					"labels":    map[string]interface{}{"kubevirt.io": "virt-launcher"},
+					"ownerReferences": []interface{}{
+						map[string]interface{}{
+							"apiVersion": "kubevirt.io/v1",
+							"kind":       "VirtualMachineInstance",
+							"name":       "test-vm",
+						},
+					},
+				},
+			},
+		}
+		related, err := action.GetRelatedItems(pod, &velerov1.Backup{})
+		assert.NoError(t, err)
+		assert.Equal(t, []velero.ResourceIdentifier{{
+			GroupResource: schema.GroupResource{Group: "kubevirt.io", Resource: "virtualmachineinstances"},
+			Namespace:     testNamespace,
+			Name:          "test-vm",
+		}}, related)
+
+		pod.SetLabels(nil)
+		related, err = action.GetRelatedItems(pod, &velerov1.Backup{})
+		assert.NoError(t, err)
+		assert.Empty(t, related)
+	})
+
+	t.Run("Running VMI should be frozen once per backup", func(t *testing.T) {
+		running := vmi.DeepCopy()
+		running.Object["status"] = map[string]interface{}{
+			"phase": "Running",
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "AgentConnected", "status": "True"},
+			},
+		}
+		backup := &velerov1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "test-backup", UID: "test-item-block-freeze"}}
+		util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+		util.SetVMIAnnotation = func(ns, name, key string, value *string) error { return nil }
+		frozen, unfrozen := 0, 0
+		util.FreezeVMI = func(ns, name string, timeout time.Duration) error {
+			frozen++
+			return nil
+		}
+		util.UnfreezeVMI = func(ns, name string) error {
+			unfrozen++
+			return nil
+		}
+
+		related, err := action.GetRelatedItems(running, backup)
+		assert.NoError(t, err)
+		assert.Contains(t, related, pvc)
+		assert.Equal(t, 1, frozen)
+
+		// Building the item block again does not freeze the guest twice
+		_, err = action.GetRelatedItems(running, backup)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, frozen)
+
+		// The backup item action returns the operation releasing the guest once its volumes are captured
+		_, _, operationID, _, err := NewVMIBackupItemAction(logrus.StandardLogger(), k8sfake.NewSimpleClientset()).Execute(running, backup)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(operationID, "freeze/"+testNamespace+"/test-vm/"))
+		assert.Equal(t, 1, frozen)
+		assert.Equal(t, 0, unfrozen)
+	})
+
+	t.Run("Running VMI left out by the backup item action should be released", func(t *testing.T) {
+		running := vmi.DeepCopy()
+		running.Object["status"] = map[string]interface{}{
+			"phase": "Running",
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "AgentConnected", "status": "True"},
+			},
+		}
+		backup := &velerov1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "test-backup", UID: "test-item-block-left-out"}}
+		util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+		util.SetVMIAnnotation = func(ns, name, key string, value *string) error { return nil }
+		util.FreezeVMI = func(ns, name string, timeout time.Duration) error { return nil }
+		unfrozen := 0
+		util.UnfreezeVMI = func(ns, name string) error {
+			unfrozen++
+			return nil
+		}
+
+		_, err := action.GetRelatedItems(running, backup)
+		assert.NoError(t, err)
+
+		// The launcher pod is gone by the time the VMI is backed up
+		listPods, listLauncherPods := util.ListPods, util.ListLauncherPods
+		defer func() { util.ListPods, util.ListLauncherPods = listPods, listLauncherPods }()
+		util.ListPods = func(name, ns string) (*v1.PodList, error) { return &v1.PodList{}, nil }
+		util.ListLauncherPods = func(ns string) (*v1.PodList, error) { return &v1.PodList{}, nil }
+		_, _, operationID, _, err := NewVMIBackupItemAction(logrus.StandardLogger(), k8sfake.NewSimpleClientset()).Execute(running, backup)
+		assert.Error(t, err)
+		assert.Empty(t, operationID)
+		assert.Equal(t, 1, unfrozen)
+	})
+}
@@ -20,11 +20,21 @@
 package plugin
 
 import (
+	"encoding/json"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	riav2 "github.com/vmware-tanzu/velero/pkg/plugin/velero/restoreitemaction/v2"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/utils/ptr"
@@ -43,6 +53,11 @@ func NewVMRestoreItemAction(log logrus.FieldLogger) *VMRestorePlugin {
 	return &VMRestorePlugin{log: log}
 }
 
+// Name returns the name of this restore item action.
+func (p *VMRestorePlugin) Name() string {
+	return "VMRestorePlugin"
+}
+
 // AppliesTo returns information about which resources this action should be invoked for.
 func (p *VMRestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
 	return velero.ResourceSelector{
@@ -65,33 +80,329 @@ func (p *VMRestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (
 		return nil, errors.WithStack(err)
 	}
 
-	if runStrategy, ok := util.GetRestoreRunStrategy(input.Restore); ok {
+	if reason, ok := vm.Annotations[util.SkippedUnsafeAnnotation]; ok {
+		p.log.Infof("VM was skipped as unsafe by the backup, it is not restored: %s", reason)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
+	config := util.LoadPluginConfig(common.PluginKindRestoreItemAction, input.Restore.ObjectMeta, p.log)
+	if poolName, ok := vm.Annotations[util.PoolOwnerAnnotation]; ok {
+		if util.ShouldSkipPoolOwnedVMs(input.Restore, config, vm.Namespace) {
+			p.log.Infof("VM is owned by pool %s, it doesn't need to be restored", poolName)
+			return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+		}
+		// The pool adopts the restored VM through its selector
+		delete(vm.Annotations, util.PoolOwnerAnnotation)
+	}
+
+	if err := p.handleHotplugVolumes(vm, util.ShouldRestoreHotplugVolumes(input.Restore, config, vm.Namespace)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// The additional items are looked up in the backup, under the names they were backed up with
+	additionalItems, err := kvgraph.NewVirtualMachineRestoreGraph(vm)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	renamer, err := util.GetVMRenamer(input.Restore, config, vm.Namespace)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Secrets excluded from the restore keep their names
+	p.renameVM(vm, renamer, util.IsResourceInRestore("secrets", input.Restore))
+
+	if runStrategy, ok := util.GetRestoreRunStrategy(input.Restore, config, vm.Namespace); ok {
 		p.log.Infof("Setting virtual machine run strategy to %s", runStrategy)
 		vm.Spec.RunStrategy = ptr.To(runStrategy)
 		vm.Spec.Running = nil
 	}
 
-	if util.ShouldClearMacAddress(input.Restore) {
+	if util.ShouldClearMacAddress(input.Restore, config, vm.Namespace) {
 		p.log.Info("Clear virtual machine MAC addresses")
 		util.ClearMacAddress(&vm.Spec.Template.Spec)
+		if err := util.AddRestoreEvent(vm, corev1.EventTypeNormal, util.EventMacAddressCleared, "MAC addresses cleared by restore %s", input.Restore.Name); err != nil {
+			return nil, errors.WithStack(err)
+		}
 	}
 
-	if util.ShouldGenerateNewFirmwareUUID(input.Restore) {
+	if util.ShouldGenerateNewFirmwareUUID(input.Restore, config, vm.Namespace) {
 		p.log.Info("Generate new firmware UUID")
 		util.GenerateNewFirmwareUUID(&vm.Spec.Template.Spec, vm.Name, vm.Namespace, string(vm.UID))
+		if err := util.AddRestoreEvent(vm, corev1.EventTypeNormal, util.EventFirmwareUUIDGenerated, "New firmware UUID generated by restore %s", input.Restore.Name); err != nil {
+			return nil, errors.WithStack(err)
+		}
 	}
 
-	item, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vm)
+	if len(vm.Spec.DataVolumeTemplates) > 0 {
+		mapping := util.LoadStorageClassMapping(input.Restore.UID, p.log)
+		// The DataVolumes created from the templates adopt the PVCs restored with their data
+		withData := util.IsResourceInRestore("persistentvolumeclaims", input.Restore)
+		for i := range vm.Spec.DataVolumeTemplates {
+			template := &vm.Spec.DataVolumeTemplates[i]
+			if class := util.RemapDataVolumeStorageClass(&template.Spec, mapping, withData, p.log); class != "" {
+				p.log.Infof("Setting storage class of DataVolume template %s to %s", template.Name, class)
+			}
+		}
+	}
+
+	mappedNetworks, err := remapNetworks(&vm.Spec.Template.Spec, input.Restore, config, vm.Namespace, p.log)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	output := velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: item})
-	output.AdditionalItems, err = kvgraph.NewVirtualMachineRestoreGraph(vm)
+	changes, err := rewriteHostDevices(&vm.Spec.Template.Spec, input.Restore, config, vm.Namespace, mappedNetworks, p.log)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, change := range changes {
+		if err := util.AddRestoreEvent(vm, corev1.EventTypeWarning, util.EventHostDevicesRewritten, "%s by restore %s", change, input.Restore.Name); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if err := rewriteNodePlacement(&vm.Spec.Template.Spec, input.Restore, config, vm.Namespace, p.log); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for _, network := range util.GetCrossNamespaceNetworks(&vm.Spec.Template.Spec, vm.Namespace) {
+		p.log.Warnf("VM %s/%s references NetworkAttachmentDefinition %s from another namespace, it is not restored and must exist in the target cluster", vm.Namespace, vm.Name, network)
+	}
+
+	item, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vm)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
+	output := velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: item})
+	output.AdditionalItems = additionalItems
+
+	// The restore events are recorded by Progress, once the VM exists
+	_, hasEvents := vm.Annotations[util.RestoreEventsAnnotation]
+	if hasEvents || util.ShouldWaitForHealthyVMs(input.Restore, config, vm.Namespace) {
+		output.OperationID = fmt.Sprintf("%s/%s/%d", vm.Namespace, vm.Name, time.Now().Unix())
+	}
+
 	return output, nil
 }
 
+// Progress records the restore events of a restored VM once it exists, and tracks it until it reaches the steady
+// state of its run strategy, or the health timeout. The VM printable status is reported as the operation description.
+func (p *VMRestorePlugin) Progress(operationID string, restore *velerov1.Restore) (velero.OperationProgress, error) {
+	namespace, name, started, err := parseVMHealthOperationID(operationID)
+	if err != nil {
+		return velero.OperationProgress{}, err
+	}
+
+	progress := velero.OperationProgress{
+		Started: started,
+		Updated: time.Now(),
+	}
+
+	config := util.LoadPluginConfig(common.PluginKindRestoreItemAction, restore.ObjectMeta, p.log)
+	timeout, err := util.GetVMHealthTimeout(restore, config, namespace)
+	if err != nil {
+		p.log.Warnf("%v, using the default VM health timeout %s", err, timeout)
+	}
+
+	waitForHealthy := util.ShouldWaitForHealthyVMs(restore, config, namespace)
+
+	var status kvcore.VirtualMachinePrintableStatus
+	vm, err := util.GetVM(namespace, name)
+	switch {
+	case k8serrors.IsNotFound(err) && !waitForHealthy:
+		// Progress is only called once all the items are restored, a VM missing by then never shows up
+		progress.Completed = true
+		progress.Description = "VM status: NotFound"
+		p.log.Warnf("VM %s/%s was not restored, its restore events are not recorded", namespace, name)
+		return progress, nil
+	case k8serrors.IsNotFound(err):
+		status = "NotFound"
+	case err != nil:
+		// Retry on the next poll
+		p.log.Warnf("Failed to get VM %s/%s: %v", namespace, name, err)
+		return progress, nil
+	case !p.recordRestoreEvents(vm):
+		// Retry on the next poll
+		return progress, nil
+	case !waitForHealthy || util.IsVMInSteadyState(vm):
+		progress.Completed = true
+		progress.Description = fmt.Sprintf("VM status: %s", vm.Status.PrintableStatus)
+		return progress, nil
+	default:
+		status = vm.Status.PrintableStatus
+	}
+
+	progress.Description = fmt.Sprintf("VM status: %s", status)
+	if time.Since(started) < timeout {
+		return progress, nil
+	}
+
+	progress.Completed = true
+	message := fmt.Sprintf("VM %s/%s did not become healthy within %s, its status is %s", namespace, name, timeout, status)
+	if util.ShouldWarnOnUnhealthyVMs(restore, config, namespace) {
+		p.log.Warn(message)
+	} else {
+		progress.Err = message
+	}
+	return progress, nil
+}
+
+// recordRestoreEvents records the restore events noted on the VM with its UID, once: the annotation holding them
+// is removed first, and the events are recorded on the next poll when that fails
+func (p *VMRestorePlugin) recordRestoreEvents(vm *kvcore.VirtualMachine) bool {
+	if _, ok := vm.Annotations[util.RestoreEventsAnnotation]; !ok {
+		return true
+	}
+	if err := util.SetVMAnnotation(vm.Namespace, vm.Name, util.RestoreEventsAnnotation, nil); err != nil {
+		p.log.Warnf("Failed to clear the restore events of VM %s/%s: %v", vm.Namespace, vm.Name, err)
+		return false
+	}
+	util.RecordRestoreEvents(p.log, kvcore.VirtualMachineGroupVersionKind, vm)
+	return true
+}
+
+// Cancel stops tracking the VM, there is nothing to undo.
+func (p *VMRestorePlugin) Cancel(operationID string, restore *velerov1.Restore) error {
+	return nil
+}
+
+// AreAdditionalItemsReady returns true, the VM does not wait for its additional items.
+func (p *VMRestorePlugin) AreAdditionalItemsReady(additionalItems []velero.ResourceIdentifier, restore *velerov1.Restore) (bool, error) {
+	return true, nil
+}
+
+func parseVMHealthOperationID(operationID string) (string, string, time.Time, error) {
+	parts := strings.Split(operationID, "/")
+	if len(parts) != 3 {
+		return "", "", time.Time{}, riav2.InvalidOperationIDError(operationID)
+	}
+	started, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", "", time.Time{}, riav2.InvalidOperationIDError(operationID)
+	}
+	return parts[0], parts[1], time.Unix(started, 0), nil
+}
+
+// remapNetworks applies the network mapping of the restore to the Multus networks of a restored VM or VMI
+func remapNetworks(vmiSpec *kvcore.VirtualMachineInstanceSpec, restore *velerov1.Restore, config *util.PluginConfig, namespace string, log logrus.FieldLogger) ([]string, error) {
+	mapping, err := util.GetNetworkMapping(restore, config, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return util.RemapNetworks(vmiSpec, util.GetBackupNamespace(restore, namespace), namespace, mapping, util.ShouldFallBackToPodNetwork(restore, config, namespace), log), nil
+}
+
+// rewriteHostDevices applies the host device policy and device mapping of the restore to a restored VM or VMI, and
+// returns the changes made. It runs after the network remapping: SR-IOV interfaces of the mapped networks stay on them.
+func rewriteHostDevices(vmiSpec *kvcore.VirtualMachineInstanceSpec, restore *velerov1.Restore, config *util.PluginConfig, namespace string, mappedNetworks []string, log logrus.FieldLogger) ([]string, error) {
+	mapping, err := util.GetDeviceMapping(restore, config, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return util.RewriteHostDevices(vmiSpec, util.GetHostDevicePolicy(restore, config, namespace), mapping, util.GetSRIOVBinding(restore, config, namespace), mappedNetworks, log), nil
+}
+
+// rewriteNodePlacement applies the node placement policy and node label mapping of the restore to a restored VM or VMI
+func rewriteNodePlacement(vmiSpec *kvcore.VirtualMachineInstanceSpec, restore *velerov1.Restore, config *util.PluginConfig, namespace string, log logrus.FieldLogger) error {
+	mapping, err := util.GetNodeLabelMapping(restore, config, namespace)
+	if err != nil {
+		return err
+	}
+	util.RewriteNodePlacement(vmiSpec, util.GetNodePlacementPolicy(restore, config, namespace), mapping, log)
+	return nil
+}
+
+// handleHotplugVolumes either re-applies the volumes hotplugged at backup time as persistent volumes or drops them
+func (p *VMRestorePlugin) handleHotplugVolumes(vm *kvcore.VirtualMachine, persist bool) error {
+	value, ok := vm.Annotations[util.HotplugVolumesAnnotation]
+	if !ok {
+		return nil
+	}
+	delete(vm.Annotations, util.HotplugVolumesAnnotation)
+
+	if !persist {
+		p.log.Infof("Dropping hotplugged volumes of VM %s/%s", vm.Namespace, vm.Name)
+		return nil
+	}
+
+	var hotplugVolumes []kvcore.AddVolumeOptions
+	if err := json.Unmarshal([]byte(value), &hotplugVolumes); err != nil {
+		return err
+	}
+	p.log.Infof("Restoring %d hotplugged volumes of VM %s/%s as persistent volumes", len(hotplugVolumes), vm.Namespace, vm.Name)
+	util.ApplyHotplugVolumes(&vm.Spec.Template.Spec, hotplugVolumes)
+	return nil
+}
+
+// renameVM renames the VM and rewrites the names of the objects restored with it. The restore actions of
+// its DataVolumes, PVCs, ControllerRevisions and owned cloud-init secrets rename them the same way.
+// Volumes and secrets the VM does not own keep their names.
+func (p *VMRestorePlugin) renameVM(vm *kvcore.VirtualMachine, renamer *util.VMRenamer, renameSecrets bool) {
+	var ownedSecrets []string
+	if value, ok := vm.Annotations[util.OwnedSecretsAnnotation]; ok {
+		ownedSecrets = strings.Split(value, ",")
+		delete(vm.Annotations, util.OwnedSecretsAnnotation)
+	}
+
+	oldName := vm.Name
+	newName, renamed := renamer.NewName(oldName)
+	if !renamed {
+		return
+	}
+	p.log.Infof("Renaming VM %s/%s to %s", vm.Namespace, oldName, newName)
+	vm.Name = newName
+
+	templates := map[string]string{}
+	for i := range vm.Spec.DataVolumeTemplates {
+		template := &vm.Spec.DataVolumeTemplates[i]
+		templates[template.Name] = renamer.DependentName(oldName, template.Name)
+		template.Name = templates[template.Name]
+	}
+
+	renameVolume := func(name *string) {
+		if templateName, ok := templates[*name]; ok {
+			*name = templateName
+			return
+		}
+		p.log.Warnf("Volume %s is not owned by VM %s/%s, the renamed VM keeps using it", *name, vm.Namespace, oldName)
+	}
+	renameSecret := func(ref *corev1.LocalObjectReference) {
+		if ref == nil {
+			return
+		}
+		if !renameSecrets || !slices.Contains(ownedSecrets, ref.Name) {
+			p.log.Warnf("Secret %s is not owned by VM %s/%s, the renamed VM keeps using it", ref.Name, vm.Namespace, oldName)
+			return
+		}
+		ref.Name = renamer.DependentName(oldName, ref.Name)
+	}
+
+	spec := &vm.Spec.Template.Spec
+	for _, volume := range spec.Volumes {
+		switch {
+		case volume.DataVolume != nil:
+			renameVolume(&volume.DataVolume.Name)
+		case volume.PersistentVolumeClaim != nil:
+			renameVolume(&volume.PersistentVolumeClaim.ClaimName)
+		case volume.CloudInitNoCloud != nil:
+			renameSecret(volume.CloudInitNoCloud.UserDataSecretRef)
+			renameSecret(volume.CloudInitNoCloud.NetworkDataSecretRef)
+		case volume.CloudInitConfigDrive != nil:
+			renameSecret(volume.CloudInitConfigDrive.UserDataSecretRef)
+			renameSecret(volume.CloudInitConfigDrive.NetworkDataSecretRef)
+		}
+	}
+
+	if spec.Hostname == oldName {
+		spec.Hostname = newName
+	}
+
+	// Revisions are named after the VM, the ControllerRevision restore action renames them the same way
+	if vm.Spec.Instancetype != nil && vm.Spec.Instancetype.RevisionName != "" {
+		vm.Spec.Instancetype.RevisionName = renamer.DependentName(oldName, vm.Spec.Instancetype.RevisionName)
+	}
+	if vm.Spec.Preference != nil && vm.Spec.Preference.RevisionName != "" {
+		vm.Spec.Preference.RevisionName = renamer.DependentName(oldName, vm.Spec.Preference.RevisionName)
+	}
+}
@@ -1,14 +1,28 @@
 package plugin
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/kuberesource"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	kvcore "kubevirt.io/api/core/v1"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
 )
 
 func TestVmRestoreExecute(t *testing.T) {
@@ -69,6 +83,8 @@ func TestVmRestoreExecute(t *testing.T) {
 
 	logrus.SetLevel(logrus.InfoLevel)
 	action := NewVMRestoreItemAction(logrus.StandardLogger())
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+	util.GetStorageClassMapping = func() (map[string]string, error) { return nil, nil }
 	t.Run("Running VM should be restored running", func(t *testing.T) {
 		output, err := action.Execute(&input)
 		assert.Nil(t, err)
@@ -122,6 +138,29 @@ func TestVmRestoreExecute(t *testing.T) {
 		assert.Nil(t, spec["running"])
 	})
 
+	t.Run("Run strategy should be taken from the plugin config", func(t *testing.T) {
+		util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) {
+			return util.NewPluginConfig(kind, map[string]string{"restore-run-strategy": "Halted"})
+		}
+		defer func() {
+			util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+		}()
+		spec := input.Item.UnstructuredContent()["spec"].(map[string]interface{})
+		spec["runStrategy"] = "Always"
+
+		input.Restore.Labels = map[string]string{}
+		output, err := action.Execute(&input)
+		assert.Nil(t, err)
+		spec = output.UpdatedItem.UnstructuredContent()["spec"].(map[string]interface{})
+		assert.Equal(t, "Halted", spec["runStrategy"])
+
+		input.Restore.Labels = map[string]string{"velero.kubevirt.io/restore-run-strategy": "Always"}
+		output, err = action.Execute(&input)
+		assert.Nil(t, err)
+		spec = output.UpdatedItem.UnstructuredContent()["spec"].(map[string]interface{})
+		assert.Equal(t, "Always", spec["runStrategy"])
+	})
+
 	t.Run("New firmware UUID should be generated when using appropriate label", func(t *testing.T) {
 		input.Restore.Labels = map[string]string{"velero.kubevirt.io/generate-new-firmware-uuid": "true"}
 		originalUUID := input.Item.UnstructuredContent()["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["domain"].(map[string]interface{})["firmware"].(map[string]interface{})["uuid"].(string)
@@ -137,6 +176,249 @@ func TestVmRestoreExecute(t *testing.T) {
 		assert.NotEmpty(t, newUUID)
 	})
 
+	t.Run("Hotplugged volumes should be dropped by default", func(t *testing.T) {
+		input.Restore.Labels = map[string]string{}
+		metadata := input.Item.UnstructuredContent()["metadata"].(map[string]interface{})
+		metadata["annotations"] = map[string]interface{}{
+			util.HotplugVolumesAnnotation: `[{"name":"hotplug","disk":{"name":"hotplug","disk":{"bus":"scsi"}},"volumeSource":{"persistentVolumeClaim":{"claimName":"hotplug-pvc","hotpluggable":true}}}]`,
+		}
+		defer delete(metadata, "annotations")
+		output, err := action.Execute(&input)
+		assert.Nil(t, err)
+
+		annotations, _ := output.UpdatedItem.UnstructuredContent()["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+		assert.NotContains(t, annotations, util.HotplugVolumesAnnotation)
+		templateSpec := output.UpdatedItem.UnstructuredContent()["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})
+		assert.Equal(t, 2, len(templateSpec["volumes"].([]interface{})))
+	})
+
+	t.Run("Hotplugged volumes should be restored as persistent volumes when using appropriate label", func(t *testing.T) {
+		input.Restore.Labels = map[string]string{util.RestoreHotplugVolumesLabel: "true"}
+		metadata := input.Item.UnstructuredContent()["metadata"].(map[string]interface{})
+		metadata["annotations"] = map[string]interface{}{
+			util.HotplugVolumesAnnotation: `[{"name":"hotplug","disk":{"name":"hotplug","disk":{"bus":"scsi"}},"volumeSource":{"persistentVolumeClaim":{"claimName":"hotplug-pvc","hotpluggable":true}}}]`,
+		}
+		defer delete(metadata, "annotations")
+		output, err := action.Execute(&input)
+		assert.Nil(t, err)
+
+		templateSpec := output.UpdatedItem.UnstructuredContent()["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})
+		volumes := templateSpec["volumes"].([]interface{})
+		assert.Equal(t, 3, len(volumes))
+		assert.Equal(t, "hotplug", volumes[2].(map[string]interface{})["name"])
+		disks := templateSpec["domain"].(map[string]interface{})["devices"].(map[string]interface{})["disks"].([]interface{})
+		assert.Equal(t, "hotplug", disks[0].(map[string]interface{})["name"])
+		assert.Contains(t, output.AdditionalItems, velero.ResourceIdentifier{
+			GroupResource: kuberesource.PersistentVolumeClaims,
+			Name:          "hotplug-pvc",
+		})
+	})
+
+	t.Run("Storage class of DataVolume templates should be remapped", func(t *testing.T) {
+		util.GetStorageClassMapping = func() (map[string]string, error) { return map[string]string{"old-class": "new-class"}, nil }
+		util.GetStorageProfile = func(name string) (*cdiv1.StorageProfile, error) { return &cdiv1.StorageProfile{}, nil }
+		defer func() { util.GetStorageClassMapping = func() (map[string]string, error) { return nil, nil } }()
+
+		vm := &kvcore.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-vm"},
+			Spec: kvcore.VirtualMachineSpec{
+				DataVolumeTemplates: []kvcore.DataVolumeTemplateSpec{
+					{
+						ObjectMeta: metav1.ObjectMeta{Name: "test-dv"},
+						Spec:       cdiv1.DataVolumeSpec{Storage: &cdiv1.StorageSpec{StorageClassName: ptr.To("old-class")}},
+					},
+				},
+				Template: &kvcore.VirtualMachineInstanceTemplateSpec{},
+			},
+		}
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vm)
+		assert.NoError(t, err)
+
+		output, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: &unstructured.Unstructured{Object: obj}, Restore: &velerov1.Restore{}})
+		assert.NoError(t, err)
+		restored := new(kvcore.VirtualMachine)
+		assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), restored))
+		assert.Equal(t, "new-class", *restored.Spec.DataVolumeTemplates[0].Spec.Storage.StorageClassName)
+	})
+
+	t.Run("VM should be renamed with the objects it owns when using appropriate label", func(t *testing.T) {
+		vm := &kvcore.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "test-vm",
+				Namespace:   testNamespace,
+				Annotations: map[string]string{util.OwnedSecretsAnnotation: "cloud-init"},
+			},
+			Spec: kvcore.VirtualMachineSpec{
+				Instancetype: &kvcore.InstancetypeMatcher{Name: "u1.small", RevisionName: "test-vm-u1.small-uid-1"},
+				DataVolumeTemplates: []kvcore.DataVolumeTemplateSpec{
+					{ObjectMeta: metav1.ObjectMeta{Name: "test-vm-disk"}},
+					{ObjectMeta: metav1.ObjectMeta{Name: "rootdisk"}},
+				},
+				Template: &kvcore.VirtualMachineInstanceTemplateSpec{
+					Spec: kvcore.VirtualMachineInstanceSpec{
+						Hostname: "test-vm",
+						Volumes: []kvcore.Volume{
+							{Name: "disk", VolumeSource: kvcore.VolumeSource{DataVolume: &kvcore.DataVolumeSource{Name: "test-vm-disk"}}},
+							{Name: "root", VolumeSource: kvcore.VolumeSource{PersistentVolumeClaim: &kvcore.PersistentVolumeClaimVolumeSource{
+								PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{ClaimName: "rootdisk"},
+							}}},
+							{Name: "shared", VolumeSource: kvcore.VolumeSource{PersistentVolumeClaim: &kvcore.PersistentVolumeClaimVolumeSource{
+								PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{ClaimName: "shared-pvc"},
+							}}},
+							{Name: "cloudinit", VolumeSource: kvcore.VolumeSource{CloudInitNoCloud: &kvcore.CloudInitNoCloudSource{
+								UserDataSecretRef:    &corev1.LocalObjectReference{Name: "cloud-init"},
+								NetworkDataSecretRef: &corev1.LocalObjectReference{Name: "shared-network-data"},
+							}}},
+						},
+					},
+				},
+			},
+		}
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vm)
+		assert.NoError(t, err)
+
+		output, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+			Item:    &unstructured.Unstructured{Object: obj},
+			Restore: &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{util.RenamePrefixLabel: "clone-"}}},
+		})
+		assert.NoError(t, err)
+		restored := new(kvcore.VirtualMachine)
+		assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), restored))
+
+		assert.Equal(t, "clone-test-vm", restored.Name)
+		assert.Equal(t, "clone-test-vm-disk", restored.Spec.DataVolumeTemplates[0].Name)
+		assert.Equal(t, "clone-test-vm-rootdisk", restored.Spec.DataVolumeTemplates[1].Name)
+		volumes := restored.Spec.Template.Spec.Volumes
+		assert.Equal(t, "clone-test-vm-disk", volumes[0].DataVolume.Name)
+		assert.Equal(t, "clone-test-vm-rootdisk", volumes[1].PersistentVolumeClaim.ClaimName)
+		assert.Equal(t, "shared-pvc", volumes[2].PersistentVolumeClaim.ClaimName)
+		assert.Equal(t, "clone-test-vm-cloud-init", volumes[3].CloudInitNoCloud.UserDataSecretRef.Name)
+		assert.Equal(t, "shared-network-data", volumes[3].CloudInitNoCloud.NetworkDataSecretRef.Name)
+		assert.NotContains(t, restored.Annotations, util.OwnedSecretsAnnotation)
+		assert.Equal(t, "clone-test-vm", restored.Spec.Template.Spec.Hostname)
+		assert.Equal(t, "clone-test-vm-u1.small-uid-1", restored.Spec.Instancetype.RevisionName)
+
+		// The additional items are looked up in the backup under their backed up names
+		assert.Contains(t, output.AdditionalItems, velero.ResourceIdentifier{
+			GroupResource: kuberesource.PersistentVolumeClaims,
+			Namespace:     testNamespace,
+			Name:          "rootdisk",
+		})
+		assert.Contains(t, output.AdditionalItems, velero.ResourceIdentifier{
+			GroupResource: kuberesource.Secrets,
+			Namespace:     testNamespace,
+			Name:          "cloud-init",
+		})
+	})
+
+	t.Run("Multus networks should be remapped when using appropriate annotation", func(t *testing.T) {
+		vm := &kvcore.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-vm", Namespace: testNamespace},
+			Spec: kvcore.VirtualMachineSpec{
+				Template: &kvcore.VirtualMachineInstanceTemplateSpec{
+					Spec: kvcore.VirtualMachineInstanceSpec{
+						Networks: []kvcore.Network{
+							{Name: "blue", NetworkSource: kvcore.NetworkSource{Multus: &kvcore.MultusNetwork{NetworkName: "blue"}}},
+						},
+					},
+				},
+			},
+		}
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vm)
+		assert.NoError(t, err)
+
+		output, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+			Item: &unstructured.Unstructured{Object: obj},
+			Restore: &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{util.NetworkMappingAnnotation: testNamespace + "/blue=" + testNamespace + "/green"},
+			}},
+		})
+		assert.NoError(t, err)
+		restored := new(kvcore.VirtualMachine)
+		assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), restored))
+		assert.Equal(t, "green", restored.Spec.Template.Spec.Networks[0].Multus.NetworkName)
+	})
+
+	t.Run("Node name pins should be removed when using appropriate label", func(t *testing.T) {
+		vm := &kvcore.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-vm", Namespace: testNamespace},
+			Spec: kvcore.VirtualMachineSpec{
+				Template: &kvcore.VirtualMachineInstanceTemplateSpec{
+					Spec: kvcore.VirtualMachineInstanceSpec{
+						NodeSelector: map[string]string{corev1.LabelHostname: "node01", "rack": "r1"},
+					},
+				},
+			},
+		}
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vm)
+		assert.NoError(t, err)
+
+		output, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+			Item: &unstructured.Unstructured{Object: obj},
+			Restore: &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{
+				Labels:      map[string]string{util.NodePlacementLabel: "strip-node-names"},
+				Annotations: map[string]string{util.NodeLabelMappingAnnotation: "rack=example.com/rack"},
+			}},
+		})
+		assert.NoError(t, err)
+		restored := new(kvcore.VirtualMachine)
+		assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), restored))
+		assert.Equal(t, map[string]string{"example.com/rack": "r1"}, restored.Spec.Template.Spec.NodeSelector)
+	})
+
+	t.Run("Host devices and SR-IOV interfaces should be remapped when using appropriate label", func(t *testing.T) {
+		vm := &kvcore.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-vm", Namespace: testNamespace},
+			Spec: kvcore.VirtualMachineSpec{
+				Template: &kvcore.VirtualMachineInstanceTemplateSpec{
+					Spec: kvcore.VirtualMachineInstanceSpec{
+						Networks: []kvcore.Network{
+							{Name: "fast", NetworkSource: kvcore.NetworkSource{Multus: &kvcore.MultusNetwork{NetworkName: "sriov"}}},
+							{Name: "slow", NetworkSource: kvcore.NetworkSource{Multus: &kvcore.MultusNetwork{NetworkName: "legacy-sriov"}}},
+						},
+					},
+				},
+			},
+		}
+		vm.Spec.Template.Spec.Domain.Devices.Interfaces = []kvcore.Interface{
+			{Name: "fast", InterfaceBindingMethod: kvcore.InterfaceBindingMethod{SRIOV: &kvcore.InterfaceSRIOV{}}},
+			{Name: "slow", InterfaceBindingMethod: kvcore.InterfaceBindingMethod{SRIOV: &kvcore.InterfaceSRIOV{}}},
+		}
+		vm.Spec.Template.Spec.Domain.Devices.GPUs = []kvcore.GPU{{Name: "gpu1", DeviceName: "nvidia.com/TU104GL_Tesla_T4"}}
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vm)
+		assert.NoError(t, err)
+
+		output, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+			Item: &unstructured.Unstructured{Object: obj},
+			Restore: &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{util.HostDevicePolicyLabel: "remap"},
+				Annotations: map[string]string{
+					util.DeviceMappingAnnotation:  "nvidia.com/TU104GL_Tesla_T4=nvidia.com/GA102GL_A10",
+					util.NetworkMappingAnnotation: testNamespace + "/sriov=" + testNamespace + "/dr-sriov",
+				},
+			}},
+		})
+		assert.NoError(t, err)
+		restored := new(kvcore.VirtualMachine)
+		assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), restored))
+		assert.Equal(t, "nvidia.com/GA102GL_A10", restored.Spec.Template.Spec.Domain.Devices.GPUs[0].DeviceName)
+		assert.Equal(t, "dr-sriov", restored.Spec.Template.Spec.Networks[0].Multus.NetworkName)
+		// The mapped interface is bridged on the mapped network, the other one is removed with its network
+		interfaces := restored.Spec.Template.Spec.Domain.Devices.Interfaces
+		if assert.Len(t, interfaces, 1) {
+			assert.Equal(t, "fast", interfaces[0].Name)
+			assert.NotNil(t, interfaces[0].Bridge)
+		}
+		assert.Len(t, restored.Spec.Template.Spec.Networks, 1)
+
+		// The changes are recorded as events once the VM exists
+		assert.NotEmpty(t, output.OperationID)
+		events := restored.Annotations[util.RestoreEventsAnnotation]
+		assert.Equal(t, 3, strings.Count(events, util.EventHostDevicesRewritten))
+		assert.Contains(t, events, "Switched SR-IOV interface fast to the bridge binding on the mapped network dr-sriov")
+		assert.Contains(t, events, "Removed SR-IOV interface slow and its unmapped network")
+	})
+
 	t.Run("VM should return DVs as additional items", func(t *testing.T) {
 		output, _ := action.Execute(&input)
 
@@ -149,3 +431,164 @@ func TestVmRestoreExecute(t *testing.T) {
 	})
 }
 
+func TestVMRestoreHealthOperation(t *testing.T) {
+	newRestore := func(labels map[string]string) *velerov1.Restore {
+		return &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{Labels: labels}}
+	}
+	newVM := func(status kvcore.VirtualMachinePrintableStatus, ready bool) *kvcore.VirtualMachine {
+		return &kvcore.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-vm", Namespace: testNamespace},
+			Spec:       kvcore.VirtualMachineSpec{RunStrategy: ptr.To(kvcore.RunStrategyAlways)},
+			Status:     kvcore.VirtualMachineStatus{PrintableStatus: status, Ready: ready},
+		}
+	}
+	recentID := fmt.Sprintf("%s/test-vm/%d", testNamespace, time.Now().Unix())
+	expiredID := fmt.Sprintf("%s/test-vm/%d", testNamespace, time.Now().Add(-2*util.DefaultVMHealthTimeout).Unix())
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+	action := NewVMRestoreItemAction(logrus.StandardLogger())
+
+	t.Run("Execute should return an operation when using appropriate label", func(t *testing.T) {
+		input := &velero.RestoreItemActionExecuteInput{
+			Item: &unstructured.Unstructured{
+				Object: map[string]interface{}{
+					"apiVersion": "kubevirt.io/v1",
+					"kind":       "VirtualMachine",
+					"metadata": map[string]interface{}{
+						"name":      "test-vm",
+						"namespace": testNamespace,
+					},
+					"spec": map[string]interface{}{
+						"template": map[string]interface{}{},
+					},
+				},
+			},
+			Restore: newRestore(nil),
+		}
+		output, err := action.Execute(input)
+		assert.NoError(t, err)
+		assert.Empty(t, output.OperationID)
+
+		input.Restore = newRestore(map[string]string{util.WaitForHealthyVMsLabel: "true"})
+		output, err = action.Execute(input)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(output.OperationID, testNamespace+"/test-vm/"))
+	})
+
+	testCases := []struct {
+		name              string
+		operationID       string
+		labels            map[string]string
+		vm                *kvcore.VirtualMachine
+		getErr            error
+		expectCompleted   bool
+		expectErr         bool
+		expectDescription string
+	}{
+		{"Healthy VM should complete", recentID, nil, newVM(kvcore.VirtualMachineStatusRunning, true), nil, true, false, "VM status: Running"},
+		{"Starting VM should be in progress", recentID, nil, newVM(kvcore.VirtualMachineStatusStarting, false), nil, false, false, "VM status: Starting"},
+		{"Failing VM should be in progress before timeout", recentID, nil, newVM(kvcore.VirtualMachineStatusDataVolumeError, false), nil, false, false, "VM status: DataVolumeError"},
+		{"Failing VM should fail after timeout", expiredID, nil, newVM(kvcore.VirtualMachineStatusUnschedulable, false), nil, true, true, "VM status: ErrorUnschedulable"},
+		{"Failing VM should only warn after timeout when using warn policy", expiredID, map[string]string{util.WaitForHealthyVMsLabel: "warn"}, newVM(kvcore.VirtualMachineStatusUnschedulable, false), nil, true, false, "VM status: ErrorUnschedulable"},
+		{"Health timeout should be taken from the restore", recentID, map[string]string{util.VMHealthTimeoutLabel: "1ns"}, newVM(kvcore.VirtualMachineStatusStarting, false), nil, true, true, "VM status: Starting"},
+		{"Missing VM should fail after timeout", expiredID, nil, nil, k8serrors.NewNotFound(schema.GroupResource{Group: "kubevirt.io", Resource: "virtualmachines"}, "test-vm"), true, true, "VM status: NotFound"},
+		{"Failing get should be retried", expiredID, nil, nil, fmt.Errorf("get failed"), false, false, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			util.GetVM = func(ns, name string) (*kvcore.VirtualMachine, error) { return tc.vm, tc.getErr }
+
+			labels := map[string]string{util.WaitForHealthyVMsLabel: "true"}
+			for key, value := range tc.labels {
+				labels[key] = value
+			}
+			progress, err := action.Progress(tc.operationID, newRestore(labels))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectCompleted, progress.Completed)
+			assert.Equal(t, tc.expectErr, progress.Err != "")
+			assert.Equal(t, tc.expectDescription, progress.Description)
+		})
+	}
+
+	t.Run("Invalid operation ID should return an error", func(t *testing.T) {
+		_, err := action.Progress("test-vm", newRestore(nil))
+		assert.Error(t, err)
+	})
+}
+
+func TestVMRestoreEvents(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+	action := NewVMRestoreItemAction(logrus.StandardLogger())
+	restore := &velerov1.Restore{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "test-restore",
+			Labels: map[string]string{util.ClearMacAddressLabel: "true"},
+		},
+	}
+
+	events := []corev1.Event{}
+	util.CreateEvent = func(event *corev1.Event) error {
+		events = append(events, *event)
+		return nil
+	}
+
+	output, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+		Item: &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "kubevirt.io/v1",
+				"kind":       "VirtualMachine",
+				"metadata": map[string]interface{}{
+					"name":      "test-vm",
+					"namespace": testNamespace,
+					"uid":       "test-backed-up-uid",
+				},
+				"spec": map[string]interface{}{
+					"template": map[string]interface{}{},
+				},
+			},
+		},
+		Restore: restore,
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	assert.True(t, strings.HasPrefix(output.OperationID, testNamespace+"/test-vm/"))
+
+	// A VM missing once the items are restored is never created, there is nothing to wait for
+	util.GetVM = func(ns, name string) (*kvcore.VirtualMachine, error) {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Group: "kubevirt.io", Resource: "virtualmachines"}, name)
+	}
+	progress, err := action.Progress(output.OperationID, restore)
+	assert.NoError(t, err)
+	assert.True(t, progress.Completed)
+	assert.Empty(t, progress.Err)
+	assert.Empty(t, events)
+
+	restored := &kvcore.VirtualMachine{}
+	assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), restored))
+	restored.UID = "test-restored-uid"
+	util.GetVM = func(ns, name string) (*kvcore.VirtualMachine, error) { return restored, nil }
+
+	// Events are recorded on the next poll when the annotation cannot be cleared
+	util.SetVMAnnotation = func(ns, name, key string, value *string) error { return fmt.Errorf("conflict") }
+	progress, err = action.Progress(output.OperationID, restore)
+	assert.NoError(t, err)
+	assert.False(t, progress.Completed)
+	assert.Empty(t, events)
+
+	util.SetVMAnnotation = func(ns, name, key string, value *string) error {
+		assert.Equal(t, util.RestoreEventsAnnotation, key)
+		assert.Nil(t, value)
+		return nil
+	}
+	progress, err = action.Progress(output.OperationID, restore)
+	assert.NoError(t, err)
+	assert.True(t, progress.Completed)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, util.EventMacAddressCleared, events[0].Reason)
+		assert.Equal(t, "MAC addresses cleared by restore test-restore", events[0].Message)
+		assert.Equal(t, types.UID("test-restored-uid"), events[0].InvolvedObject.UID)
+	}
+}
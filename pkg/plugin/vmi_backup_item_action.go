@@ -22,6 +22,7 @@ package plugin
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -29,10 +30,14 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 
 	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	k8score "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	kvcore "kubevirt.io/api/core/v1"
+	poolv1 "kubevirt.io/api/pool/v1beta1"
 	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
 	"kubevirt.io/kubevirt-velero-plugin/pkg/util/kvgraph"
 )
@@ -44,7 +49,8 @@ type VMIBackupItemAction struct {
 }
 
 const (
-	AnnIsOwned = "cdi.kubevirt.io/velero.isOwned"
+	AnnIsOwned   = "cdi.kubevirt.io/velero.isOwned"
+	AnnOwnerKind = "cdi.kubevirt.io/velero.ownerKind"
 )
 
 // NewVMIBackupItemAction instantiates a VMIBackupItemAction.
@@ -66,84 +72,237 @@ func (p *VMIBackupItemAction) AppliesTo() (velero.ResourceSelector, error) {
 		nil
 }
 
+// Name returns the name of this backup item action.
+func (p *VMIBackupItemAction) Name() string {
+	return "VMIBackupItemAction"
+}
+
 // Execute returns VM's DataVolumes as extra items to back up.
-func (p *VMIBackupItemAction) Execute(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+// The guest of a running VMI is frozen, or paused, until its volumes are captured, the returned
+// operation ID tracks it until it is released. A guest quiesced by VMItemBlockAction is released
+// right away when the VMI ends up without an operation.
+func (p *VMIBackupItemAction) Execute(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, string, []velero.ResourceIdentifier, error) {
 	p.log.Info("Executing VMIBackupItemAction")
 
 	if backup == nil {
-		return nil, nil, fmt.Errorf("backup object nil!")
+		return nil, nil, "", nil, fmt.Errorf("backup object nil!")
 	}
 
 	vmi := new(kvcore.VirtualMachineInstance)
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), vmi); err != nil {
-		return nil, nil, errors.WithStack(err)
+		return nil, nil, "", nil, errors.WithStack(err)
 	}
 
+	operationID := ""
+	defer func() {
+		if operationID == "" {
+			quiescedGuests.release(p.log, vmi, backup)
+		}
+	}()
+
 	// There's no point in backing up a VMI when it's owned by a VM excluded from the backup
 	shouldExclude, err := shouldExcludeVMI(vmi, backup)
 	if err != nil {
-		return nil, nil, errors.WithStack(err)
+		return nil, nil, "", nil, errors.WithStack(err)
 	}
 	if shouldExclude {
-		return nil, nil, nil
+		owner := getVMIOwner(vmi)
+		util.RecordEvent(p.log, kvcore.VirtualMachineInstanceGroupVersionKind, vmi, k8score.EventTypeNormal, util.EventOwnedVMISkipped,
+			"Not backed up by backup %s, its %s %s is not part of the backup", backup.Name, owner.Kind, owner.Name)
+		return nil, nil, "", nil, nil
 	}
 
-	if !util.IsVMIPaused(vmi) {
-		if !util.IsResourceInBackup("pods", backup) && util.IsResourceInBackup("persistentvolumeclaims", backup) {
-			return nil, nil, fmt.Errorf("VM is running but launcher pod is not included in the backup")
-		}
-
-		excluded, err := p.isPodExcludedByLabel(vmi)
+	config := util.LoadPluginConfig(common.PluginKindBackupItemAction, backup.ObjectMeta, p.log)
+	if util.ShouldSkipUnsafe(backup, config, vmi.Namespace) {
+		// The VM skipped as unsafe is not restored, so neither should its VMI be
+		unsafe, err := isOwnerVMUnsafe(vmi, backup, config, p.log)
 		if err != nil {
-			return nil, nil, errors.WithStack(err)
+			return nil, nil, "", nil, errors.WithStack(err)
 		}
-
-		if excluded {
-			return nil, nil, fmt.Errorf("VM is running but launcher pod is not included in the backup")
+		if unsafe {
+			p.log.Infof("Skipping VMI %s/%s, its VM is left out of the backup", vmi.Namespace, vmi.Name)
+			util.AddAnnotation(item, util.SkippedUnsafeAnnotation, "its VM is left out of the backup")
+			return item, nil, "", nil, nil
 		}
 	}
 
-	if isVMIOwned(vmi) {
+	failure, err := checkVMIBackupPossible(vmi, backup, config, p.log)
+	if err != nil {
+		return nil, nil, "", nil, errors.WithStack(err)
+	}
+	if failure != nil {
+		item, err := handleUnsafeItem(p.log, backup, config, kvcore.VirtualMachineInstanceGroupVersionKind, vmi, item, util.NewSafetyCheckError("VMI", vmi, failure))
+		return item, nil, "", nil, err
+	}
+
+	if owner := getVMIOwner(vmi); owner != nil {
 		util.AddAnnotation(item, AnnIsOwned, "true")
-	} else if !util.IsMetadataBackup(backup) {
-		restore, err := util.RestorePossible(vmi.Spec.Volumes, backup, vmi.Namespace, func(volume kvcore.Volume) bool { return false }, p.log)
-		if err != nil {
-			return nil, nil, errors.WithStack(err)
-		}
-		if !restore {
-			return nil, nil, fmt.Errorf("VM has DataVolume or PVC volumes and DataVolumes/PVCs is not included in the backup")
+		util.AddAnnotation(item, AnnOwnerKind, owner.Kind)
+	}
+
+	extra, err := kvgraph.NewVirtualMachineInstanceBackupGraph(vmi, backup)
+	if err != nil {
+		return nil, nil, "", nil, errors.WithStack(err)
+	}
+
+	// The guest was quiesced by VMItemBlockAction before the item block was backed up, only
+	// Velero versions without item blocks quiesce it here
+	quiesce := quiescedGuests.quiesce(p.log, vmi, backup, config)
+	if quiesce.crashConsistent != "" {
+		util.AddAnnotation(item, util.CrashConsistentAnnotation, quiesce.crashConsistent)
+	}
+	util.RecordClusterVersions(item, p.log)
+	operationID = quiesce.operationID
+	return item, extra, operationID, nil, nil
+}
+
+// Progress releases the guest quiesced for the backup once its volumes are captured, or once the freeze
+// timeout elapsed. It is only called once all the items of the backup are processed.
+func (p *VMIBackupItemAction) Progress(operationID string, backup *v1.Backup) (velero.OperationProgress, error) {
+	operation, namespace, name, started, err := parseQuiesceOperationID(operationID)
+	if err != nil {
+		return velero.OperationProgress{}, err
+	}
+
+	progress := velero.OperationProgress{
+		Started: started,
+		Updated: time.Now(),
+	}
+
+	vmi, err := util.GetVMI(namespace, name)
+	if k8serrors.IsNotFound(err) {
+		progress.Completed = true
+		return progress, nil
+	} else if err != nil {
+		p.log.Warnf("Failed to get VMI %s/%s: %v", namespace, name, err)
+		return progress, nil
+	}
+	if !isQuiescedBy(vmi, operation, backup) {
+		progress.Completed = true
+		return progress, nil
+	}
+
+	config := util.LoadPluginConfig(common.PluginKindBackupItemAction, backup.ObjectMeta, p.log)
+	timeout, _ := util.GetFreezeTimeout(backup, config, namespace)
+	deadline := started.Add(timeout)
+	expired := time.Now().After(deadline)
+	captured, capturedAt, err := areVolumesCaptured(vmi, backup)
+	if err != nil {
+		p.log.Warnf("Failed to check whether the volumes of VMI %s/%s are captured: %v", namespace, name, err)
+	}
+	if !captured && !expired {
+		return progress, nil
+	}
+
+	if err := releaseGuest(operation, namespace, name); err != nil && (operation == pauseOperation || !expired) {
+		// Retry on the next poll, the guest is still quiesced
+		p.log.Warnf("Failed to %s VMI %s/%s: %v", "un"+operation, namespace, name, err)
+		return progress, nil
+	}
+	if !captured || capturedAt.After(deadline) {
+		// Not an operation error, the backup itself succeeded
+		state := "frozen"
+		if operation == pauseOperation {
+			state = "paused"
 		}
+		p.log.Warnf("VMI %s/%s was %s for longer than the %s freeze timeout before its volumes were captured, they may be crash consistent",
+			namespace, name, state, timeout)
+		recordQuiesceEvent(p.log, vmi, k8score.EventTypeWarning, util.EventCrashConsistent,
+			"Backup %s may be crash consistent: the guest was %s for longer than the %s freeze timeout before its volumes were captured",
+			backup.Name, state, timeout)
+	} else {
+		p.log.Infof("Released VMI %s/%s, its volumes are captured", namespace, name)
 	}
 
-	extra, err := kvgraph.NewVirtualMachineInstanceBackupGraph(vmi)
+	progress.Completed = true
+	return progress, nil
+}
+
+// Cancel thaws or unpauses the guest quiesced for the backup.
+func (p *VMIBackupItemAction) Cancel(operationID string, backup *v1.Backup) error {
+	operation, namespace, name, _, err := parseQuiesceOperationID(operationID)
 	if err != nil {
-		return nil, nil, errors.WithStack(err)
+		return err
 	}
-	return item, extra, nil
+
+	return releaseGuest(operation, namespace, name)
 }
 
-// shouldExcludeVMI checks wether a VMI owned by VM should be backed up or ignored
+// shouldExcludeVMI checks wether a VMI owned by a VM, a VMI replica set or a VM pool should be backed up or ignored
 func shouldExcludeVMI(vmi *kvcore.VirtualMachineInstance, backup *v1.Backup) (bool, error) {
-	if !isVMIOwned(vmi) {
+	owner := getVMIOwner(vmi)
+	if owner == nil {
 		return false, nil
 	}
 
-	if !util.IsResourceInBackup("virtualmachines", backup) {
-		return true, nil
+	switch owner.Kind {
+	case kvcore.VirtualMachineGroupVersionKind.Kind:
+		if !util.IsResourceInBackup("virtualmachines", backup) {
+			return true, nil
+		}
+		return util.CachedLookup(labelLookups, backup, "virtualmachine/"+vmi.Namespace+"/"+vmi.Name, func() (bool, error) {
+			return isVMExcludedByLabel(vmi)
+		})
+	case kvcore.VirtualMachineInstanceReplicaSetGroupVersionKind.Kind:
+		if !util.IsResourceInBackup("virtualmachineinstancereplicasets", backup) {
+			return true, nil
+		}
+		return util.CachedLookup(labelLookups, backup, "virtualmachineinstancereplicaset/"+vmi.Namespace+"/"+owner.Name, func() (bool, error) {
+			return isVMIReplicaSetExcludedByLabel(vmi.Namespace, owner.Name)
+		})
+	case poolv1.VirtualMachinePoolKind:
+		if !util.IsResourceInBackup("virtualmachinepools", backup) {
+			return true, nil
+		}
+		return util.CachedLookup(labelLookups, backup, "virtualmachinepool/"+vmi.Namespace+"/"+owner.Name, func() (bool, error) {
+			return isVMPoolExcludedByLabel(vmi.Namespace, owner.Name)
+		})
+	}
+
+	return false, nil
+}
+
+// isOwnerVMUnsafe checks whether the VM owning the VMI fails the checks of the VM backup action,
+// which leaves it out of backups that skip unsafe VMs
+func isOwnerVMUnsafe(vmi *kvcore.VirtualMachineInstance, backup *v1.Backup, config *util.PluginConfig, log logrus.FieldLogger) (bool, error) {
+	owner := getVMIOwner(vmi)
+	if owner == nil || owner.Kind != kvcore.VirtualMachineGroupVersionKind.Kind {
+		return false, nil
+	}
+
+	vm, err := util.GetVM(vmi.Namespace, owner.Name)
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
 	}
 
-	excluded, err := isVMExcludedByLabel(vmi)
+	failure, err := checkVMBackupPossible(vm, backup, config, log)
 	if err != nil {
 		return false, err
 	}
 
-	return excluded, nil
+	return failure != nil, nil
 }
 
-func isVMIOwned(vmi *kvcore.VirtualMachineInstance) bool {
-	return len(vmi.OwnerReferences) > 0
+// getVMIOwner returns the owner reference of the KubeVirt controller managing the VMI, if any
+func getVMIOwner(vmi *kvcore.VirtualMachineInstance) *metav1.OwnerReference {
+	for i, owner := range vmi.OwnerReferences {
+		switch owner.Kind {
+		case kvcore.VirtualMachineGroupVersionKind.Kind,
+			kvcore.VirtualMachineInstanceReplicaSetGroupVersionKind.Kind,
+			poolv1.VirtualMachinePoolKind:
+			return &vmi.OwnerReferences[i]
+		}
+	}
+	return nil
 }
 
+// labelLookups caches the exclusion labels looked up by the VM and VMI backup checks, which run
+// several times per backup, and for every VMI of a pool or replica set
+var labelLookups = util.NewBackupCache()
+
 // This is assigned to a variable so it can be replaced by a mock function in tests
 var isVMExcludedByLabel = func(vmi *kvcore.VirtualMachineInstance) (bool, error) {
 	client, err := util.GetKubeVirtclient()
@@ -160,21 +319,102 @@ var isVMExcludedByLabel = func(vmi *kvcore.VirtualMachineInstance) (bool, error)
 	return ok && label == "true", nil
 }
 
-func (p *VMIBackupItemAction) isPodExcludedByLabel(vmi *kvcore.VirtualMachineInstance) (bool, error) {
-	pod, err := util.GetLauncherPod(vmi.GetName(), vmi.GetNamespace())
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var isVMIReplicaSetExcludedByLabel = func(namespace, name string) (bool, error) {
+	client, err := util.GetKubeVirtclient()
 	if err != nil {
 		return false, err
 	}
-	if pod == nil {
-		return false, fmt.Errorf("pod for running VMI not found")
+
+	replicaSet, err := (*client).ReplicaSet(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
 	}
 
-	labels := pod.GetLabels()
-	if labels == nil {
-		return false, nil
+	label, ok := replicaSet.GetLabels()[util.VeleroExcludeLabel]
+	return ok && label == "true", nil
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var isVMPoolExcludedByLabel = func(namespace, name string) (bool, error) {
+	client, err := util.GetKubeVirtclient()
+	if err != nil {
+		return false, err
 	}
 
-	label, ok := labels[util.VeleroExcludeLabel]
+	pool, err := (*client).VirtualMachinePool(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	label, ok := pool.GetLabels()[util.VeleroExcludeLabel]
 	return ok && label == "true", nil
 }
 
+// checkVMIBackupPossible returns why backing up the VMI is not safe, or nil when it is
+func checkVMIBackupPossible(vmi *kvcore.VirtualMachineInstance, backup *v1.Backup, config *util.PluginConfig, log logrus.FieldLogger) (*util.SafetyCheckFailure, error) {
+	if !util.IsVMIPaused(vmi) {
+		if !util.IsResourceInBackup("pods", backup) && util.IsResourceInBackup("persistentvolumeclaims", backup) {
+			return util.NewLauncherPodNotInBackupFailure(vmi.Namespace, vmi.Name), nil
+		}
+
+		failure, err := checkLauncherPod(vmi, backup)
+		if err != nil || failure != nil {
+			return failure, err
+		}
+	}
+
+	if getVMIOwner(vmi) != nil || util.IsMetadataBackup(backup, config, vmi.Namespace) {
+		return nil, nil
+	}
+	return util.RestorePossible(vmi.Spec.Volumes, backup, config, vmi.Namespace, func(volume kvcore.Volume) bool { return false }, log)
+}
+
+// isVMILeftOut checks whether the VMI is left out of the backup: excluded by label, owned by an object
+// which is not backed up, or unsafe to back up
+func isVMILeftOut(vmi *kvcore.VirtualMachineInstance, backup *v1.Backup, config *util.PluginConfig, log logrus.FieldLogger) (bool, error) {
+	if vmi.GetLabels()[util.VeleroExcludeLabel] == "true" {
+		return true, nil
+	}
+
+	excluded, err := shouldExcludeVMI(vmi, backup)
+	if err != nil || excluded {
+		return excluded, err
+	}
+
+	if util.ShouldSkipUnsafe(backup, config, vmi.Namespace) {
+		unsafe, err := isOwnerVMUnsafe(vmi, backup, config, log)
+		if err != nil || unsafe {
+			return unsafe, err
+		}
+	}
+
+	failure, err := checkVMIBackupPossible(vmi, backup, config, log)
+	return failure != nil, err
+}
+
+// checkLauncherPod returns the failure when the launcher pod of a running VMI is missing or excluded by label
+func checkLauncherPod(vmi *kvcore.VirtualMachineInstance, backup *v1.Backup) (*util.SafetyCheckFailure, error) {
+	pod, err := util.GetLauncherPod(vmi.GetName(), vmi.GetNamespace(), backup)
+	if err != nil {
+		return nil, err
+	}
+	if pod == nil {
+		return &util.SafetyCheckFailure{
+			Reason: util.LauncherPodNotFound,
+			Object: "launcher pod of virtualmachineinstances " + vmi.Namespace + "/" + vmi.Name,
+			Hint:   "retry the backup once the VMI is scheduled",
+		}, nil
+	}
+
+	label, ok := pod.GetLabels()[util.VeleroExcludeLabel]
+	if ok && label == "true" {
+		return &util.SafetyCheckFailure{
+			Reason: util.LauncherPodExcluded,
+			Object: "pods " + pod.Namespace + "/" + pod.Name,
+			Hint:   util.ExcludedByLabelHint(),
+		}, nil
+	}
+	return nil, nil
+}
+
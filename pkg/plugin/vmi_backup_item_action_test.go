@@ -1,19 +1,26 @@
 package plugin
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v7/apis/volumesnapshot/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/kuberesource"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
 	kvcore "kubevirt.io/api/core/v1"
 	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
@@ -25,29 +32,33 @@ func TestVMIBackupItemAction(t *testing.T) {
 
 	nullValidator := func(runtime.Unstructured, []velero.ResourceIdentifier) bool { return true }
 
-	ownedVMI := map[string]interface{}{
-		"apiVersion": "kubevirt.io",
-		"kind":       "VirtualMachineInterface",
-		"metadata": map[string]interface{}{
-			"name":      "test-vmi",
-			"namespace": "test-namespace",
-			"ownerReferences": []interface{}{
-				map[string]interface{}{
-					"name": "test-owner",
+	newOwnedVMI := func() map[string]interface{} {
+		return map[string]interface{}{
+			"apiVersion": "kubevirt.io",
+			"kind":       "VirtualMachineInterface",
+			"metadata": map[string]interface{}{
+				"name":      "test-vmi",
+				"namespace": "test-namespace",
+				"ownerReferences": []interface{}{
+					map[string]interface{}{
+						"kind": "VirtualMachine",
+						"name": "test-owner",
+					},
 				},
 			},
-		},
-		"spec": map[string]interface{}{
-			"template": map[string]interface{}{
-				"spec": map[string]interface{}{
-					"volumes": []map[string]interface{}{},
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"volumes": []map[string]interface{}{},
+					},
 				},
 			},
-		},
-		"status": map[string]interface{}{
-			"phase": "running",
-		},
+			"status": map[string]interface{}{
+				"phase": "running",
+			},
+		}
 	}
+	ownedVMI := newOwnedVMI()
 	nonOwnedVMI := map[string]interface{}{
 		"apiVersion": "kubevirt.io",
 		"kind":       "VirtualMachineInterface",
@@ -74,6 +85,7 @@ func TestVMIBackupItemAction(t *testing.T) {
 			"namespace": "test-namespace",
 			"ownerReferences": []interface{}{
 				map[string]interface{}{
+					"kind": "VirtualMachine",
 					"name": "test-owner",
 				},
 			},
@@ -195,7 +207,7 @@ func TestVMIBackupItemAction(t *testing.T) {
 			returnFalse,
 			returnFalse,
 			true,
-			"VM is running but launcher pod is not included in the backup",
+			"VMI test-namespace/test-vmi is running but its launcher pod is not included in the backup (LauncherPodExcluded: launcher pod of virtualmachineinstances test-namespace/test-vmi): include pods with --include-resources and do not list it in --exclude-resources, or exclude persistentvolumeclaims as well",
 			nullValidator,
 		},
 		{"Running VMI must not exclude Pods",
@@ -212,7 +224,7 @@ func TestVMIBackupItemAction(t *testing.T) {
 			returnFalse,
 			returnFalse,
 			true,
-			"VM is running but launcher pod is not included in the backup",
+			"VMI test-namespace/test-vmi is running but its launcher pod is not included in the backup (LauncherPodExcluded: launcher pod of virtualmachineinstances test-namespace/test-vmi): include pods with --include-resources and do not list it in --exclude-resources, or exclude persistentvolumeclaims as well",
 			nullValidator,
 		},
 		{"Running VMI must not exclude its Pod by label",
@@ -228,9 +240,34 @@ func TestVMIBackupItemAction(t *testing.T) {
 			returnFalse,
 			returnFalse,
 			true,
-			"VM is running but launcher pod is not included in the backup",
+			"VMI test-namespace/test-vmi is running but its launcher pod is not included in the backup (LauncherPodExcluded: pods test-namespace/test-vmi-launcher-pod): remove the velero.io/exclude-from-backup label from it",
 			nullValidator,
 		},
+		{"Running VMI excluding its Pod by label is skipped when the backup skips unsafe VMs",
+			unstructured.Unstructured{
+				Object: newOwnedVMI(),
+			},
+			velerov1.Backup{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{util.SkipUnsafeLabel: "true"},
+				},
+				Spec: velerov1.BackupSpec{
+					IncludedResources: []string{"virtualmachineinstances", "virtualmachines"},
+				},
+			},
+			excludedPod,
+			returnFalse,
+			returnFalse,
+			false,
+			"",
+			func(output runtime.Unstructured, extra []velero.ResourceIdentifier) bool {
+				metadata, err := meta.Accessor(output)
+				assert.NoError(t, err)
+				assert.Contains(t, metadata.GetAnnotations()[util.SkippedUnsafeAnnotation], "LauncherPodExcluded")
+				assert.Empty(t, extra)
+				return true
+			},
+		},
 		{"Running VMI must include Pod in backup unless it does not include PVCs",
 			unstructured.Unstructured{
 				Object: ownedVMI,
@@ -311,7 +348,7 @@ func TestVMIBackupItemAction(t *testing.T) {
 				metadata, err := meta.Accessor(item)
 				assert.NoError(t, err)
 
-				return assert.Equal(t, map[string]string{"cdi.kubevirt.io/velero.isOwned": "true"}, metadata.GetAnnotations())
+				return assert.Equal(t, map[string]string{"cdi.kubevirt.io/velero.isOwned": "true", "cdi.kubevirt.io/velero.ownerKind": "VirtualMachine"}, metadata.GetAnnotations())
 			},
 		},
 		{"Not owned VMI with DV volumes must include DataVolumes in backup",
@@ -341,7 +378,7 @@ func TestVMIBackupItemAction(t *testing.T) {
 			returnFalse,
 			returnFalse,
 			true,
-			"VM has DataVolume or PVC volumes and DataVolumes/PVCs is not included in the backup",
+			"VMI test-namespace/test-vmi uses a DataVolume which is not included in the backup (DVExcluded: datavolumes test-namespace/): include datavolumes with --include-resources and do not list it in --exclude-resources",
 			nullValidator,
 		},
 		{"Not owned VMI with DV volumes must not exclude DataVolumes from backup",
@@ -371,7 +408,7 @@ func TestVMIBackupItemAction(t *testing.T) {
 			returnFalse,
 			returnFalse,
 			true,
-			"VM has DataVolume or PVC volumes and DataVolumes/PVCs is not included in the backup",
+			"VMI test-namespace/test-vmi uses a DataVolume which is not included in the backup (DVExcluded: datavolumes test-namespace/): include datavolumes with --include-resources and do not list it in --exclude-resources",
 			nullValidator,
 		},
 		{"Not owned VMI with DV volumes can exclude DataVolumes from backup when using metadataBackup label",
@@ -436,7 +473,7 @@ func TestVMIBackupItemAction(t *testing.T) {
 			returnFalse,
 			returnFalse,
 			true,
-			"VM has DataVolume or PVC volumes and DataVolumes/PVCs is not included in the backup",
+			"VMI test-namespace/test-vmi uses a PVC which is not included in the backup (PVCMissing: persistentvolumeclaims test-namespace/): include persistentvolumeclaims with --include-resources and do not list it in --exclude-resources",
 			nullValidator,
 		},
 		{"Not owned VMI with PVC volumes must not exclude PVCs from backup",
@@ -466,7 +503,7 @@ func TestVMIBackupItemAction(t *testing.T) {
 			returnFalse,
 			returnFalse,
 			true,
-			"VM has DataVolume or PVC volumes and DataVolumes/PVCs is not included in the backup",
+			"VMI test-namespace/test-vmi uses a PVC which is not included in the backup (PVCMissing: persistentvolumeclaims test-namespace/): include persistentvolumeclaims with --include-resources and do not list it in --exclude-resources",
 			nullValidator,
 		},
 		{"Launcher pod included in extra resources",
@@ -498,6 +535,7 @@ func TestVMIBackupItemAction(t *testing.T) {
 						"namespace": "test-namespace",
 						"ownerReferences": []interface{}{
 							map[string]interface{}{
+								"kind": "VirtualMachine",
 								"name": "test-owner",
 							},
 						},
@@ -547,6 +585,14 @@ func TestVMIBackupItemAction(t *testing.T) {
 	}
 
 	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+	util.CreateEvent = func(event *v1.Event) error { return nil }
+	util.GetVM = func(ns, name string) (*kvcore.VirtualMachine, error) {
+		return &kvcore.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+			Spec:       kvcore.VirtualMachineSpec{Template: &kvcore.VirtualMachineInstanceTemplateSpec{}},
+		}, nil
+	}
 	for _, tc := range testCases {
 		kubeobjects := []runtime.Object{}
 		kubeobjects = append(kubeobjects, &tc.pod)
@@ -558,7 +604,7 @@ func TestVMIBackupItemAction(t *testing.T) {
 		util.ListPods = func(name, ns string) (*v1.PodList, error) { return &v1.PodList{Items: []v1.Pod{tc.pod}}, nil }
 
 		t.Run(tc.name, func(t *testing.T) {
-			output, extra, err := action.Execute(&tc.item, &tc.backup)
+			output, extra, _, _, err := action.Execute(&tc.item, &tc.backup)
 
 			if tc.expectError {
 				assert.Error(t, err)
@@ -571,3 +617,618 @@ func TestVMIBackupItemAction(t *testing.T) {
 	}
 }
 
+func TestShouldExcludeVMI(t *testing.T) {
+	newVMI := func(ownerKind string) *kvcore.VirtualMachineInstance {
+		vmi := &kvcore.VirtualMachineInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-vmi",
+				Namespace: "test-namespace",
+			},
+		}
+		if ownerKind != "" {
+			vmi.OwnerReferences = []metav1.OwnerReference{{Kind: ownerKind, Name: "test-owner"}}
+		}
+		return vmi
+	}
+	backupWith := func(resources ...string) *velerov1.Backup {
+		return &velerov1.Backup{Spec: velerov1.BackupSpec{IncludedResources: resources}}
+	}
+
+	testCases := []struct {
+		name               string
+		vmi                *kvcore.VirtualMachineInstance
+		backup             *velerov1.Backup
+		vmExcluded         bool
+		replicaSetExcluded bool
+		poolExcluded       bool
+		expectedExclude    bool
+	}{
+		{"Standalone VMI should not be excluded", newVMI(""), backupWith(), false, false, false, false},
+		{"VMI with unknown owner should not be excluded", newVMI("SomethingElse"), backupWith("virtualmachineinstances"), false, false, false, false},
+		{"VM owned VMI should be excluded when VMs are not backed up", newVMI("VirtualMachine"), backupWith("virtualmachineinstances"), false, false, false, true},
+		{"VM owned VMI should be excluded when VM is excluded", newVMI("VirtualMachine"), backupWith(), true, false, false, true},
+		{"VM owned VMI should not be excluded", newVMI("VirtualMachine"), backupWith(), false, false, false, false},
+		{"Replica set owned VMI should be excluded when replica sets are not backed up", newVMI("VirtualMachineInstanceReplicaSet"), backupWith("virtualmachineinstances", "virtualmachines"), false, false, false, true},
+		{"Replica set owned VMI should be excluded when replica set is excluded", newVMI("VirtualMachineInstanceReplicaSet"), backupWith(), false, true, false, true},
+		{"Replica set owned VMI should not be excluded", newVMI("VirtualMachineInstanceReplicaSet"), backupWith(), true, false, false, false},
+		{"Pool owned VMI should be excluded when pools are not backed up", newVMI("VirtualMachinePool"), backupWith("virtualmachineinstances", "virtualmachines"), false, false, false, true},
+		{"Pool owned VMI should be excluded when pool is excluded", newVMI("VirtualMachinePool"), backupWith(), false, false, true, true},
+		{"Pool owned VMI should not be excluded", newVMI("VirtualMachinePool"), backupWith(), true, true, false, false},
+	}
+
+	for _, tc := range testCases {
+		isVMExcludedByLabel = func(vmi *kvcore.VirtualMachineInstance) (bool, error) { return tc.vmExcluded, nil }
+		isVMIReplicaSetExcludedByLabel = func(namespace, name string) (bool, error) { return tc.replicaSetExcluded, nil }
+		isVMPoolExcludedByLabel = func(namespace, name string) (bool, error) { return tc.poolExcluded, nil }
+
+		t.Run(tc.name, func(t *testing.T) {
+			excluded, err := shouldExcludeVMI(tc.vmi, tc.backup)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedExclude, excluded)
+		})
+	}
+
+	t.Run("Owner labels should be looked up once per backup", func(t *testing.T) {
+		lookups := 0
+		isVMPoolExcludedByLabel = func(namespace, name string) (bool, error) {
+			lookups++
+			return false, nil
+		}
+		backup := backupWith()
+		backup.UID = "test-owner-lookups"
+		for i := 0; i < 3; i++ {
+			excluded, err := shouldExcludeVMI(newVMI("VirtualMachinePool"), backup)
+			assert.NoError(t, err)
+			assert.False(t, excluded)
+		}
+		assert.Equal(t, 1, lookups)
+	})
+}
+
+func TestIsOwnerVMUnsafe(t *testing.T) {
+	newVMI := func(ownerKind string) *kvcore.VirtualMachineInstance {
+		vmi := &kvcore.VirtualMachineInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-vmi",
+				Namespace: "test-namespace",
+			},
+		}
+		if ownerKind != "" {
+			vmi.OwnerReferences = []metav1.OwnerReference{{Kind: ownerKind, Name: "test-owner"}}
+		}
+		return vmi
+	}
+	vmWithPVC := &kvcore.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-owner",
+			Namespace: "test-namespace",
+		},
+		Spec: kvcore.VirtualMachineSpec{
+			Template: &kvcore.VirtualMachineInstanceTemplateSpec{
+				Spec: kvcore.VirtualMachineInstanceSpec{
+					Volumes: []kvcore.Volume{{
+						Name: "disk",
+						VolumeSource: kvcore.VolumeSource{
+							PersistentVolumeClaim: &kvcore.PersistentVolumeClaimVolumeSource{
+								PersistentVolumeClaimVolumeSource: v1.PersistentVolumeClaimVolumeSource{ClaimName: "test-pvc"},
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+	backupWith := func(resources ...string) *velerov1.Backup {
+		return &velerov1.Backup{Spec: velerov1.BackupSpec{IncludedResources: resources}}
+	}
+
+	testCases := []struct {
+		name           string
+		vmi            *kvcore.VirtualMachineInstance
+		vmErr          error
+		backup         *velerov1.Backup
+		expectedUnsafe bool
+	}{
+		{"Standalone VMI has no unsafe owner", newVMI(""), nil, backupWith("virtualmachineinstances"), false},
+		{"Replica set owned VMI has no unsafe owner", newVMI("VirtualMachineInstanceReplicaSet"), nil, backupWith("virtualmachineinstances"), false},
+		{"VM owner missing a PVC is unsafe", newVMI("VirtualMachine"), nil, backupWith("virtualmachineinstances", "virtualmachines"), true},
+		{"VM owner with its PVC is safe", newVMI("VirtualMachine"), nil, backupWith(), false},
+		{"Deleted VM owner is safe", newVMI("VirtualMachine"), k8serrors.NewNotFound(schema.GroupResource{Resource: "virtualmachines"}, "test-owner"), backupWith("virtualmachineinstances"), false},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	util.IsPVCExcludedByLabel = func(namespace, pvcName string) (bool, error) { return false, nil }
+	for _, tc := range testCases {
+		util.GetVM = func(ns, name string) (*kvcore.VirtualMachine, error) {
+			if tc.vmErr != nil {
+				return nil, tc.vmErr
+			}
+			return vmWithPVC, nil
+		}
+
+		t.Run(tc.name, func(t *testing.T) {
+			unsafe, err := isOwnerVMUnsafe(tc.vmi, tc.backup, nil, logrus.StandardLogger())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedUnsafe, unsafe)
+		})
+	}
+}
+
+func TestVMIBackupItemActionFreeze(t *testing.T) {
+	newItem := func(agentConnected bool) *unstructured.Unstructured {
+		vmi := &kvcore.VirtualMachineInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-vmi",
+				Namespace: "test-namespace",
+			},
+			Spec: kvcore.VirtualMachineInstanceSpec{
+				Volumes: []kvcore.Volume{{
+					Name:         "rootdisk",
+					VolumeSource: kvcore.VolumeSource{DataVolume: &kvcore.DataVolumeSource{Name: "test-dv"}},
+				}},
+			},
+			Status: kvcore.VirtualMachineInstanceStatus{
+				Phase: kvcore.Running,
+			},
+		}
+		if agentConnected {
+			vmi.Status.Conditions = []kvcore.VirtualMachineInstanceCondition{
+				{Type: kvcore.VirtualMachineInstanceAgentConnected, Status: v1.ConditionTrue},
+			}
+		}
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vmi)
+		assert.NoError(t, err)
+		return &unstructured.Unstructured{Object: obj}
+	}
+	launcherPod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test-namespace",
+			Name:        "test-vmi-launcher-pod",
+			Labels:      map[string]string{"kubevirt.io": "virt-launcher"},
+			Annotations: map[string]string{"kubevirt.io/domain": "test-vmi"},
+		},
+	}
+
+	testCases := []struct {
+		name               string
+		agentConnected     bool
+		labels             map[string]string
+		freezeErr          error
+		expectFreeze       bool
+		expectTimeout      time.Duration
+		expectCrashWarning bool
+	}{
+		{"Running VMI with guest agent should be frozen", true, nil, nil, true, util.DefaultFreezeTimeout, false},
+		{"Freeze timeout should be taken from the backup", true, map[string]string{util.FreezeTimeoutLabel: "2m"}, nil, true, 2 * time.Minute, false},
+		{"Invalid freeze timeout should fall back to the default", true, map[string]string{util.FreezeTimeoutLabel: "soon"}, nil, true, util.DefaultFreezeTimeout, false},
+		{"Running VMI without guest agent should be crash consistent", false, nil, nil, false, 0, true},
+		{"Failing freeze should be crash consistent", true, nil, fmt.Errorf("freeze failed"), true, util.DefaultFreezeTimeout, true},
+		{"Freeze should be skipped when using appropriate label", true, map[string]string{util.SkipGuestFreezeLabel: "true"}, nil, false, 0, false},
+		{"Freeze should be skipped for metadata backups", true, map[string]string{util.MetadataBackupLabel: "true"}, nil, false, 0, false},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+	client := k8sfake.NewSimpleClientset(&launcherPod)
+	action := NewVMIBackupItemAction(logrus.StandardLogger(), client)
+	util.ListPods = func(name, ns string) (*v1.PodList, error) { return &v1.PodList{Items: []v1.Pod{launcherPod}}, nil }
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			frozen := false
+			var frozenTimeout time.Duration
+			util.FreezeVMI = func(ns, name string, unfreezeTimeout time.Duration) error {
+				frozen = true
+				frozenTimeout = unfreezeTimeout
+				return tc.freezeErr
+			}
+			marker := ""
+			util.SetVMIAnnotation = func(ns, name, key string, value *string) error {
+				assert.Equal(t, util.QuiescedByBackupAnnotation, key)
+				marker = *value
+				return nil
+			}
+
+			events := []string{}
+			util.CreateEvent = func(event *v1.Event) error {
+				events = append(events, event.Reason)
+				return nil
+			}
+
+			backup := &velerov1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "test-backup", UID: types.UID(tc.name), Labels: tc.labels}}
+			output, _, operationID, _, err := action.Execute(newItem(tc.agentConnected), backup)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectFreeze, frozen)
+			assert.Equal(t, tc.expectTimeout, frozenTimeout)
+			if tc.expectFreeze && tc.freezeErr == nil {
+				assert.NotEmpty(t, operationID)
+				assert.Equal(t, "freeze/test-backup", marker)
+				assert.Equal(t, []string{util.EventGuestFrozen}, events)
+			} else {
+				assert.Empty(t, operationID)
+				assert.Empty(t, marker)
+				assert.NotContains(t, events, util.EventGuestFrozen)
+			}
+			if tc.expectCrashWarning {
+				assert.Contains(t, events, util.EventCrashConsistent)
+			}
+
+			metadata, err := meta.Accessor(output)
+			assert.NoError(t, err)
+			_, crashConsistent := metadata.GetAnnotations()[util.CrashConsistentAnnotation]
+			assert.Equal(t, tc.expectCrashWarning, crashConsistent)
+		})
+	}
+
+	t.Run("Freeze event should be mirrored on the owning VM", func(t *testing.T) {
+		util.FreezeVMI = func(ns, name string, unfreezeTimeout time.Duration) error { return nil }
+		util.SetVMIAnnotation = func(ns, name, key string, value *string) error { return nil }
+		isVMExcludedByLabel = func(vmi *kvcore.VirtualMachineInstance) (bool, error) { return false, nil }
+		events := []*v1.Event{}
+		util.CreateEvent = func(event *v1.Event) error {
+			events = append(events, event)
+			return nil
+		}
+
+		item := newItem(true)
+		item.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "kubevirt.io/v1", Kind: "VirtualMachine", Name: "test-vmi", UID: "test-vm-uid"}})
+		backup := &velerov1.Backup{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-backup", UID: "test-mirrored-freeze"},
+			Spec:       velerov1.BackupSpec{IncludedResources: []string{"virtualmachineinstances", "virtualmachines", "pods"}},
+		}
+		_, _, _, _, err := action.Execute(item, backup)
+		assert.NoError(t, err)
+		if assert.Len(t, events, 2) {
+			assert.Equal(t, util.EventGuestFrozen, events[0].Reason)
+			assert.Equal(t, util.EventGuestFrozen, events[1].Reason)
+			assert.Equal(t, "VirtualMachineInstance", events[0].InvolvedObject.Kind)
+			assert.Equal(t, v1.ObjectReference{
+				APIVersion: "kubevirt.io/v1",
+				Kind:       "VirtualMachine",
+				Namespace:  "test-namespace",
+				Name:       "test-vmi",
+				UID:        "test-vm-uid",
+			}, events[1].InvolvedObject)
+		}
+	})
+}
+
+func TestVMIBackupItemActionUnfreeze(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+	action := NewVMIBackupItemAction(logrus.StandardLogger(), k8sfake.NewSimpleClientset())
+	backup := &velerov1.Backup{}
+
+	var unfrozen []string
+	util.UnfreezeVMI = func(ns, name string) error {
+		unfrozen = append(unfrozen, ns+"/"+name)
+		return nil
+	}
+	var unmarked []string
+	util.SetVMIAnnotation = func(ns, name, key string, value *string) error {
+		assert.Nil(t, value)
+		unmarked = append(unmarked, ns+"/"+name)
+		return nil
+	}
+	marker := "freeze/"
+	util.GetVMI = func(ns, name string) (*kvcore.VirtualMachineInstance, error) {
+		return &kvcore.VirtualMachineInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{util.QuiescedByBackupAnnotation: marker},
+			},
+			Spec: kvcore.VirtualMachineInstanceSpec{
+				Volumes: []kvcore.Volume{{
+					Name:         "rootdisk",
+					VolumeSource: kvcore.VolumeSource{DataVolume: &kvcore.DataVolumeSource{Name: "test-dv"}},
+				}},
+			},
+			Status: kvcore.VirtualMachineInstanceStatus{
+				ActivePods: map[types.UID]string{"test-launcher-uid": "test-node"},
+			},
+		}, nil
+	}
+	var snapshots []snapshotv1.VolumeSnapshot
+	util.ListBackupVolumeSnapshots = func(backup *velerov1.Backup, ns string) ([]snapshotv1.VolumeSnapshot, error) {
+		return snapshots, nil
+	}
+	var podVolumeBackups []velerov1.PodVolumeBackup
+	util.ListBackupPodVolumeBackups = func(backup *velerov1.Backup) ([]velerov1.PodVolumeBackup, error) {
+		return podVolumeBackups, nil
+	}
+	var events []string
+	util.CreateEvent = func(event *v1.Event) error {
+		events = append(events, event.Reason)
+		return nil
+	}
+	newSnapshot := func(claim string, ready bool, created time.Time) snapshotv1.VolumeSnapshot {
+		return snapshotv1.VolumeSnapshot{
+			Spec: snapshotv1.VolumeSnapshotSpec{Source: snapshotv1.VolumeSnapshotSource{PersistentVolumeClaimName: &claim}},
+			Status: &snapshotv1.VolumeSnapshotStatus{
+				ReadyToUse:   &ready,
+				CreationTime: &metav1.Time{Time: created},
+			},
+		}
+	}
+
+	t.Run("Progress should unfreeze the guest", func(t *testing.T) {
+		unfrozen = nil
+		unmarked = nil
+		operationID := fmt.Sprintf("freeze/test-namespace/test-vmi/%d", time.Now().Unix())
+		progress, err := action.Progress(operationID, backup)
+		assert.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Empty(t, progress.Err)
+		assert.Equal(t, []string{"test-namespace/test-vmi"}, unfrozen)
+		assert.Equal(t, []string{"test-namespace/test-vmi"}, unmarked)
+	})
+
+	t.Run("Progress should wait for the volume snapshots to be ready", func(t *testing.T) {
+		unfrozen = nil
+		events = nil
+		snapshots = []snapshotv1.VolumeSnapshot{newSnapshot("test-dv", false, time.Now()), newSnapshot("other-pvc", true, time.Now())}
+		defer func() { snapshots = nil }()
+		operationID := fmt.Sprintf("freeze/test-namespace/test-vmi/%d", time.Now().Unix())
+		progress, err := action.Progress(operationID, backup)
+		assert.NoError(t, err)
+		assert.False(t, progress.Completed)
+		assert.Empty(t, unfrozen)
+
+		snapshots[0] = newSnapshot("test-dv", true, time.Now())
+		progress, err = action.Progress(operationID, backup)
+		assert.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Equal(t, []string{"test-namespace/test-vmi"}, unfrozen)
+		assert.Empty(t, events)
+	})
+
+	t.Run("Progress should wait for the pod volume backups of the launcher pod", func(t *testing.T) {
+		unfrozen = nil
+		podVolumeBackups = []velerov1.PodVolumeBackup{
+			{
+				Spec:   velerov1.PodVolumeBackupSpec{Pod: v1.ObjectReference{UID: "test-launcher-uid"}},
+				Status: velerov1.PodVolumeBackupStatus{Phase: velerov1.PodVolumeBackupPhaseInProgress},
+			},
+			{
+				Spec:   velerov1.PodVolumeBackupSpec{Pod: v1.ObjectReference{UID: "other-pod-uid"}},
+				Status: velerov1.PodVolumeBackupStatus{Phase: velerov1.PodVolumeBackupPhaseInProgress},
+			},
+		}
+		defer func() { podVolumeBackups = nil }()
+		operationID := fmt.Sprintf("freeze/test-namespace/test-vmi/%d", time.Now().Unix())
+		progress, err := action.Progress(operationID, backup)
+		assert.NoError(t, err)
+		assert.False(t, progress.Completed)
+		assert.Empty(t, unfrozen)
+
+		podVolumeBackups[0].Status.Phase = velerov1.PodVolumeBackupPhaseCompleted
+		progress, err = action.Progress(operationID, backup)
+		assert.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Equal(t, []string{"test-namespace/test-vmi"}, unfrozen)
+	})
+
+	t.Run("Progress should release the guest and not fail the backup on a freeze timeout", func(t *testing.T) {
+		unfrozen = nil
+		events = nil
+		started := time.Now().Add(-2 * util.DefaultFreezeTimeout)
+		snapshots = []snapshotv1.VolumeSnapshot{newSnapshot("test-dv", false, time.Now())}
+		defer func() { snapshots = nil }()
+		operationID := fmt.Sprintf("freeze/test-namespace/test-vmi/%d", started.Unix())
+		progress, err := action.Progress(operationID, backup)
+		assert.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Empty(t, progress.Err)
+		assert.Equal(t, []string{"test-namespace/test-vmi"}, unfrozen)
+		assert.Equal(t, []string{util.EventCrashConsistent}, events)
+	})
+
+	t.Run("Progress should flag volumes captured after the freeze timeout", func(t *testing.T) {
+		events = nil
+		started := time.Now().Add(-2 * util.DefaultFreezeTimeout)
+		snapshots = []snapshotv1.VolumeSnapshot{newSnapshot("test-dv", true, time.Now())}
+		defer func() { snapshots = nil }()
+		operationID := fmt.Sprintf("freeze/test-namespace/test-vmi/%d", started.Unix())
+		progress, err := action.Progress(operationID, backup)
+		assert.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Equal(t, []string{util.EventCrashConsistent}, events)
+
+		// A snapshot taken while the guest was frozen is consistent, however late Progress is called
+		events = nil
+		snapshots = []snapshotv1.VolumeSnapshot{newSnapshot("test-dv", true, started.Add(time.Minute))}
+		progress, err = action.Progress(operationID, backup)
+		assert.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Empty(t, events)
+	})
+
+	t.Run("Progress should complete when the guest was already released", func(t *testing.T) {
+		marker = ""
+		defer func() { marker = "freeze/" }()
+		unfrozen = nil
+		operationID := fmt.Sprintf("freeze/test-namespace/test-vmi/%d", time.Now().Unix())
+		progress, err := action.Progress(operationID, backup)
+		assert.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Empty(t, unfrozen)
+	})
+
+	t.Run("Progress should retry a failed unfreeze", func(t *testing.T) {
+		util.UnfreezeVMI = func(ns, name string) error { return fmt.Errorf("unfreeze failed") }
+		operationID := fmt.Sprintf("freeze/test-namespace/test-vmi/%d", time.Now().Unix())
+		progress, err := action.Progress(operationID, backup)
+		assert.NoError(t, err)
+		assert.False(t, progress.Completed)
+	})
+
+	t.Run("Cancel should unfreeze the guest", func(t *testing.T) {
+		unfrozen = nil
+		util.UnfreezeVMI = func(ns, name string) error {
+			unfrozen = append(unfrozen, ns+"/"+name)
+			return nil
+		}
+		err := action.Cancel(fmt.Sprintf("freeze/test-namespace/test-vmi/%d", time.Now().Unix()), backup)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"test-namespace/test-vmi"}, unfrozen)
+	})
+
+	t.Run("Progress should unpause the guest", func(t *testing.T) {
+		marker = "pause/"
+		var unpaused []string
+		util.UnpauseVMI = func(ns, name string) error {
+			unpaused = append(unpaused, ns+"/"+name)
+			return nil
+		}
+		operationID := fmt.Sprintf("pause/test-namespace/test-vmi/%d", time.Now().Add(-2*util.DefaultFreezeTimeout).Unix())
+		progress, err := action.Progress(operationID, backup)
+		assert.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Empty(t, progress.Err)
+		assert.Equal(t, []string{"test-namespace/test-vmi"}, unpaused)
+	})
+
+	t.Run("Progress should retry a failed unpause", func(t *testing.T) {
+		util.UnpauseVMI = func(ns, name string) error { return fmt.Errorf("unpause failed") }
+		operationID := fmt.Sprintf("pause/test-namespace/test-vmi/%d", time.Now().Add(-2*util.DefaultFreezeTimeout).Unix())
+		progress, err := action.Progress(operationID, backup)
+		assert.NoError(t, err)
+		assert.False(t, progress.Completed)
+	})
+
+	t.Run("Cancel should unpause the guest", func(t *testing.T) {
+		unpaused := false
+		util.UnpauseVMI = func(ns, name string) error {
+			unpaused = true
+			return nil
+		}
+		err := action.Cancel(fmt.Sprintf("pause/test-namespace/test-vmi/%d", time.Now().Unix()), backup)
+		assert.NoError(t, err)
+		assert.True(t, unpaused)
+	})
+
+	t.Run("Invalid operation ID should return an error", func(t *testing.T) {
+		_, err := action.Progress("test-vmi", backup)
+		assert.Error(t, err)
+		_, err = action.Progress("unknown/test-namespace/test-vmi/0", backup)
+		assert.Error(t, err)
+	})
+}
+
+func TestVMIBackupItemActionPause(t *testing.T) {
+	vmi := &kvcore.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-vmi",
+			Namespace: "test-namespace",
+		},
+		Spec: kvcore.VirtualMachineInstanceSpec{
+			Volumes: []kvcore.Volume{{
+				Name:         "rootdisk",
+				VolumeSource: kvcore.VolumeSource{PersistentVolumeClaim: &kvcore.PersistentVolumeClaimVolumeSource{PersistentVolumeClaimVolumeSource: v1.PersistentVolumeClaimVolumeSource{ClaimName: "test-pvc"}}},
+			}},
+		},
+		Status: kvcore.VirtualMachineInstanceStatus{
+			Phase: kvcore.Running,
+		},
+	}
+	launcherPod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test-namespace",
+			Name:        "test-vmi-launcher-pod",
+			Labels:      map[string]string{"kubevirt.io": "virt-launcher"},
+			Annotations: map[string]string{"kubevirt.io/domain": "test-vmi"},
+		},
+	}
+	backup := &velerov1.Backup{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:    "test-pause",
+			Labels: map[string]string{util.PauseWithoutGuestAgentLabel: "true"},
+		},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+	action := NewVMIBackupItemAction(logrus.StandardLogger(), k8sfake.NewSimpleClientset(&launcherPod))
+	util.ListPods = func(name, ns string) (*v1.PodList, error) { return &v1.PodList{Items: []v1.Pod{launcherPod}}, nil }
+	util.SetVMIAnnotation = func(ns, name, key string, value *string) error { return nil }
+
+	t.Run("Running VMI without guest agent should be paused", func(t *testing.T) {
+		paused := false
+		util.PauseVMI = func(ns, name string) error {
+			paused = true
+			return nil
+		}
+
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vmi)
+		assert.NoError(t, err)
+		_, _, operationID, _, err := action.Execute(&unstructured.Unstructured{Object: obj}, backup)
+		assert.NoError(t, err)
+		assert.True(t, paused)
+		assert.True(t, strings.HasPrefix(operationID, "pause/test-namespace/test-vmi/"))
+	})
+
+	t.Run("Failing pause should be crash consistent", func(t *testing.T) {
+		util.PauseVMI = func(ns, name string) error { return fmt.Errorf("pause failed") }
+		backup := backup.DeepCopy()
+		backup.UID = "test-pause-failure"
+
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vmi)
+		assert.NoError(t, err)
+		output, _, operationID, _, err := action.Execute(&unstructured.Unstructured{Object: obj}, backup)
+		assert.NoError(t, err)
+		assert.Empty(t, operationID)
+
+		metadata, err := meta.Accessor(output)
+		assert.NoError(t, err)
+		assert.Contains(t, metadata.GetAnnotations(), util.CrashConsistentAnnotation)
+	})
+
+	t.Run("Paused VMI should be unpaused by Progress once the freeze timeout elapsed", func(t *testing.T) {
+		backup := backup.DeepCopy()
+		backup.Name = "test-pause-deadline"
+		backup.UID = "test-pause-deadline"
+		util.PauseVMI = func(ns, name string) error { return nil }
+		util.GetVMI = func(ns, name string) (*kvcore.VirtualMachineInstance, error) {
+			paused := vmi.DeepCopy()
+			paused.Annotations = map[string]string{util.QuiescedByBackupAnnotation: "pause/test-pause-deadline"}
+			return paused, nil
+		}
+		claim := "test-pvc"
+		ready := false
+		util.ListBackupVolumeSnapshots = func(backup *velerov1.Backup, ns string) ([]snapshotv1.VolumeSnapshot, error) {
+			return []snapshotv1.VolumeSnapshot{{
+				Spec:   snapshotv1.VolumeSnapshotSpec{Source: snapshotv1.VolumeSnapshotSource{PersistentVolumeClaimName: &claim}},
+				Status: &snapshotv1.VolumeSnapshotStatus{ReadyToUse: &ready},
+			}}, nil
+		}
+		util.ListBackupPodVolumeBackups = func(backup *velerov1.Backup) ([]velerov1.PodVolumeBackup, error) { return nil, nil }
+		util.CreateEvent = func(event *v1.Event) error { return nil }
+		unpaused, unmarked := false, false
+		util.UnpauseVMI = func(ns, name string) error {
+			unpaused = true
+			return nil
+		}
+		util.SetVMIAnnotation = func(ns, name, key string, value *string) error {
+			unmarked = value == nil
+			return nil
+		}
+
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vmi)
+		assert.NoError(t, err)
+		_, _, operationID, _, err := action.Execute(&unstructured.Unstructured{Object: obj}, backup)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, operationID)
+
+		// The guest stays paused while its volume snapshot is not ready
+		progress, err := action.Progress(operationID, backup)
+		assert.NoError(t, err)
+		assert.False(t, progress.Completed)
+		assert.False(t, unpaused)
+
+		expiredID := fmt.Sprintf("pause/test-namespace/test-vmi/%d", time.Now().Add(-2*util.DefaultFreezeTimeout).Unix())
+		progress, err = action.Progress(expiredID, backup)
+		assert.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.True(t, unpaused)
+		assert.True(t, unmarked)
+	})
+}
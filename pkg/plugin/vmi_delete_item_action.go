@@ -0,0 +1,92 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package plugin
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+)
+
+// VMIDeleteItemAction is a delete item action releasing VirtualMachineInstances which are
+// still frozen or paused by the backup being deleted. It also applies to VirtualMachines, whose
+// VMI may be quiesced with its item block but never backed up when backing it up failed.
+type VMIDeleteItemAction struct {
+	log logrus.FieldLogger
+}
+
+// NewVMIDeleteItemAction instantiates a VMIDeleteItemAction.
+func NewVMIDeleteItemAction(log logrus.FieldLogger) *VMIDeleteItemAction {
+	return &VMIDeleteItemAction{log: log}
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *VMIDeleteItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+			IncludedResources: []string{
+				"VirtualMachineInstance",
+				"VirtualMachine",
+			},
+		},
+		nil
+}
+
+// Execute unfreezes or unpauses the live VMI, or the VMI of the VM, if the deleted backup quiesced it
+// and never released it. A VM and its VMI share their name.
+func (p *VMIDeleteItemAction) Execute(input *velero.DeleteItemActionExecuteInput) error {
+	p.log.Info("Executing VMIDeleteItemAction")
+
+	if input == nil || input.Backup == nil {
+		return errors.New("input or backup object is nil")
+	}
+
+	metadata, err := meta.Accessor(input.Item)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	namespace, name := metadata.GetNamespace(), metadata.GetName()
+
+	vmi, err := util.GetVMI(namespace, name)
+	if k8serrors.IsNotFound(err) {
+		p.log.Debugf("VMI %s/%s no longer exists, nothing to release", namespace, name)
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+
+	marker, ok := vmi.GetAnnotations()[util.QuiescedByBackupAnnotation]
+	if !ok {
+		return nil
+	}
+	operation, backupName, found := strings.Cut(marker, "/")
+	if !found || backupName != input.Backup.Name {
+		return nil
+	}
+
+	p.log.Infof("Releasing VMI %s/%s left %sd by backup %s", namespace, name, operation, backupName)
+	return releaseGuest(operation, namespace, name)
+}
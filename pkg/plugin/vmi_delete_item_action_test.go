@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kvcore "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+)
+
+func TestVMIDeleteItemAction(t *testing.T) {
+	item := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "kubevirt.io/v1",
+			"kind":       "VirtualMachineInstance",
+			"metadata": map[string]interface{}{
+				"name":      "test-vmi",
+				"namespace": testNamespace,
+			},
+		},
+	}
+	backup := &velerov1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "test-backup"}}
+
+	testCases := []struct {
+		name           string
+		annotations    map[string]string
+		notFound       bool
+		expectUnfreeze bool
+		expectUnpause  bool
+	}{
+		{"VMI frozen by the deleted backup should be unfrozen", map[string]string{util.QuiescedByBackupAnnotation: "freeze/test-backup"}, false, true, false},
+		{"VMI paused by the deleted backup should be unpaused", map[string]string{util.QuiescedByBackupAnnotation: "pause/test-backup"}, false, false, true},
+		{"VMI quiesced by another backup should be left alone", map[string]string{util.QuiescedByBackupAnnotation: "freeze/other-backup"}, false, false, false},
+		{"VMI without marker should be left alone", nil, false, false, false},
+		{"Deleted VMI should be ignored", nil, true, false, false},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	action := NewVMIDeleteItemAction(logrus.StandardLogger())
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			unfrozen, unpaused, unmarked := false, false, false
+			util.GetVMI = func(ns, name string) (*kvcore.VirtualMachineInstance, error) {
+				if tc.notFound {
+					return nil, k8serrors.NewNotFound(schema.GroupResource{Group: "kubevirt.io", Resource: "virtualmachineinstances"}, name)
+				}
+				return &kvcore.VirtualMachineInstance{
+					ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, Annotations: tc.annotations},
+				}, nil
+			}
+			util.UnfreezeVMI = func(ns, name string) error {
+				unfrozen = true
+				return nil
+			}
+			util.UnpauseVMI = func(ns, name string) error {
+				unpaused = true
+				return nil
+			}
+			util.SetVMIAnnotation = func(ns, name, key string, value *string) error {
+				assert.Nil(t, value)
+				unmarked = true
+				return nil
+			}
+
+			err := action.Execute(&velero.DeleteItemActionExecuteInput{Item: item, Backup: backup})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectUnfreeze, unfrozen)
+			assert.Equal(t, tc.expectUnpause, unpaused)
+			assert.Equal(t, tc.expectUnfreeze || tc.expectUnpause, unmarked)
+		})
+	}
+
+	t.Run("VM whose VMI is frozen by the deleted backup should release it", func(t *testing.T) {
+		vm := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "kubevirt.io/v1",
+				"kind":       "VirtualMachine",
+				"metadata": map[string]interface{}{
+					"name":      "test-vm",
+					"namespace": testNamespace,
+				},
+			},
+		}
+		var released []string
+		util.GetVMI = func(ns, name string) (*kvcore.VirtualMachineInstance, error) {
+			return &kvcore.VirtualMachineInstance{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, Annotations: map[string]string{util.QuiescedByBackupAnnotation: "freeze/test-backup"}},
+			}, nil
+		}
+		util.UnfreezeVMI = func(ns, name string) error {
+			released = append(released, ns+"/"+name)
+			return nil
+		}
+		util.SetVMIAnnotation = func(ns, name, key string, value *string) error { return nil }
+
+		err := action.Execute(&velero.DeleteItemActionExecuteInput{Item: vm, Backup: backup})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{testNamespace + "/test-vm"}, released)
+	})
+}
@@ -21,10 +21,15 @@ package plugin
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
 	kvcore "kubevirt.io/api/core/v1"
@@ -54,6 +59,11 @@ func NewVMIRestoreItemAction(log logrus.FieldLogger) *VMIRestorePlugin {
 	return &VMIRestorePlugin{log: log}
 }
 
+// Name returns the name of this restore item action.
+func (p *VMIRestorePlugin) Name() string {
+	return "VMIRestorePlugin"
+}
+
 // AppliesTo returns information about which resources this action should be invoked for.
 func (p *VMIRestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
 	return velero.ResourceSelector{
@@ -75,9 +85,18 @@ func (p *VMIRestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput)
 		return nil, errors.WithStack(err)
 	}
 
+	if reason, ok := vmi.Annotations[util.SkippedUnsafeAnnotation]; ok {
+		p.log.Infof("VMI was skipped as unsafe by the backup, it is not restored: %s", reason)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
 	owned, ok := vmi.Annotations[AnnIsOwned]
 	if ok && owned == "true" {
-		p.log.Info("VMI is owned by a VM, it doesn't need to be restored")
+		ownerKind, ok := vmi.Annotations[AnnOwnerKind]
+		if !ok {
+			ownerKind = "VirtualMachine"
+		}
+		p.log.Infof("VMI is owned by a %s, it doesn't need to be restored", ownerKind)
 		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
 	}
 
@@ -86,30 +105,122 @@ func (p *VMIRestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput)
 		return nil, err
 	}
 
-	if util.ShouldClearMacAddress(input.Restore) {
+	// The additional items are looked up in the backup, under the names they were backed up with
+	additionalItems, err := kvgraph.NewVirtualMachineInstanceRestoreGraph(vmi)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	config := util.LoadPluginConfig(common.PluginKindRestoreItemAction, input.Restore.ObjectMeta, p.log)
+	if util.ShouldClearMacAddress(input.Restore, config, vmi.Namespace) {
 		p.log.Info("Clear virtual machine instance MAC addresses")
 		util.ClearMacAddress(&vmi.Spec)
 	}
 
-	if util.ShouldGenerateNewFirmwareUUID(input.Restore) {
+	if util.ShouldGenerateNewFirmwareUUID(input.Restore, config, vmi.Namespace) {
 		p.log.Info("Generate new firmware UUID")
 		util.GenerateNewFirmwareUUID(&vmi.Spec, vmi.Name, vmi.Namespace, string(vmi.UID))
 	}
 
+	mappedNetworks, err := remapNetworks(&vmi.Spec, input.Restore, config, vmi.Namespace, p.log)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	changes, err := rewriteHostDevices(&vmi.Spec, input.Restore, config, vmi.Namespace, mappedNetworks, p.log)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, change := range changes {
+		if err := util.AddRestoreEvent(vmi, corev1.EventTypeWarning, util.EventHostDevicesRewritten, "%s by restore %s", change, input.Restore.Name); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if err := rewriteNodePlacement(&vmi.Spec, input.Restore, config, vmi.Namespace, p.log); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for _, network := range util.GetCrossNamespaceNetworks(&vmi.Spec, vmi.Namespace) {
+		p.log.Warnf("VMI %s/%s references NetworkAttachmentDefinition %s from another namespace, it is not restored and must exist in the target cluster", vmi.Namespace, vmi.Name, network)
+	}
+
 	// Restricted labels must be cleared otherwise the VMI will be rejected.
 	// The restricted labels contain runtime information about the underlying KVM object.
 	labels := removeRestrictedLabels(vmi.GetLabels())
 	metadata.SetLabels(labels)
+	metadata.SetAnnotations(vmi.Annotations)
 
-	output := velero.NewRestoreItemActionExecuteOutput(input.Item)
-	output.AdditionalItems, err = kvgraph.NewVirtualMachineInstanceRestoreGraph(vmi)
+	// Write the spec changes back to the item
+	spec, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&vmi.Spec)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	input.Item.UnstructuredContent()["spec"] = spec
+
+	output := velero.NewRestoreItemActionExecuteOutput(input.Item)
+	output.AdditionalItems = additionalItems
 
+	// The restore events are recorded by Progress, once the VMI exists
+	if _, hasEvents := vmi.Annotations[util.RestoreEventsAnnotation]; hasEvents {
+		output.OperationID = fmt.Sprintf("%s/%s/%d", vmi.Namespace, vmi.Name, time.Now().Unix())
+	}
 	return output, nil
 }
 
+// Progress records the restore events of a restored VMI once it exists, the way VMRestorePlugin does for VMs.
+func (p *VMIRestorePlugin) Progress(operationID string, restore *velerov1.Restore) (velero.OperationProgress, error) {
+	namespace, name, started, err := parseVMHealthOperationID(operationID)
+	if err != nil {
+		return velero.OperationProgress{}, err
+	}
+
+	progress := velero.OperationProgress{
+		Started: started,
+		Updated: time.Now(),
+	}
+
+	vmi, err := util.GetVMI(namespace, name)
+	switch {
+	case k8serrors.IsNotFound(err):
+		// Progress is only called once all the items are restored, a VMI missing by then never shows up
+		p.log.Warnf("VMI %s/%s was not restored, its restore events are not recorded", namespace, name)
+		progress.Completed = true
+	case err != nil:
+		// Retry on the next poll
+		p.log.Warnf("Failed to get VMI %s/%s: %v", namespace, name, err)
+	case !p.recordRestoreEvents(vmi):
+		// Retry on the next poll
+	default:
+		progress.Completed = true
+	}
+	return progress, nil
+}
+
+// recordRestoreEvents records the restore events noted on the VMI with its UID, once: the annotation holding them
+// is removed first, and the events are recorded on the next poll when that fails
+func (p *VMIRestorePlugin) recordRestoreEvents(vmi *kvcore.VirtualMachineInstance) bool {
+	if _, ok := vmi.Annotations[util.RestoreEventsAnnotation]; !ok {
+		return true
+	}
+	if err := util.SetVMIAnnotation(vmi.Namespace, vmi.Name, util.RestoreEventsAnnotation, nil); err != nil {
+		p.log.Warnf("Failed to clear the restore events of VMI %s/%s: %v", vmi.Namespace, vmi.Name, err)
+		return false
+	}
+	util.RecordRestoreEvents(p.log, kvcore.VirtualMachineInstanceGroupVersionKind, vmi)
+	return true
+}
+
+// Cancel stops tracking the VMI, there is nothing to undo.
+func (p *VMIRestorePlugin) Cancel(operationID string, restore *velerov1.Restore) error {
+	return nil
+}
+
+// AreAdditionalItemsReady returns true, the VMI does not wait for its additional items.
+func (p *VMIRestorePlugin) AreAdditionalItemsReady(additionalItems []velero.ResourceIdentifier, restore *velerov1.Restore) (bool, error) {
+	return true, nil
+}
+
 func removeRestrictedLabels(labels map[string]string) map[string]string {
 	for _, label := range restrictedVmiLabels {
 		delete(labels, label)
@@ -1,15 +1,26 @@
 package plugin
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	kvcore "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util/kvgraph"
 )
 
 func TestVmiRestoreExecute(t *testing.T) {
@@ -104,6 +115,7 @@ func TestVmiRestoreExecute(t *testing.T) {
 	}
 
 	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
 	action := NewVMIRestoreItemAction(logrus.StandardLogger())
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -120,3 +132,121 @@ func TestVmiRestoreExecute(t *testing.T) {
 	}
 }
 
+
+func TestVMIRestoreRemapsNetworks(t *testing.T) {
+	vmi := &kvcore.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-vmi", Namespace: "target"},
+		Spec: kvcore.VirtualMachineInstanceSpec{
+			Networks: []kvcore.Network{
+				{Name: "blue", NetworkSource: kvcore.NetworkSource{Multus: &kvcore.MultusNetwork{NetworkName: "blue"}}},
+				{Name: "red", NetworkSource: kvcore.NetworkSource{Multus: &kvcore.MultusNetwork{NetworkName: "red"}}},
+			},
+		},
+	}
+	vmi.Spec.Domain.Devices.Interfaces = []kvcore.Interface{
+		{Name: "blue", InterfaceBindingMethod: kvcore.InterfaceBindingMethod{Bridge: &kvcore.InterfaceBridge{}}},
+		{Name: "red", InterfaceBindingMethod: kvcore.InterfaceBindingMethod{SRIOV: &kvcore.InterfaceSRIOV{}}},
+	}
+	item, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vmi)
+	assert.NoError(t, err)
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+	action := NewVMIRestoreItemAction(logrus.StandardLogger())
+	output, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+		Item: &unstructured.Unstructured{Object: item},
+		Restore: &velerov1.Restore{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels:      map[string]string{util.PodNetworkFallbackLabel: "true"},
+				Annotations: map[string]string{util.NetworkMappingAnnotation: "source/blue=infra/green"},
+			},
+			Spec: velerov1.RestoreSpec{NamespaceMapping: map[string]string{"source": "target"}},
+		},
+	})
+	assert.NoError(t, err)
+
+	restored := new(kvcore.VirtualMachineInstance)
+	assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), restored))
+	assert.Equal(t, "infra/green", restored.Spec.Networks[0].Multus.NetworkName)
+	assert.NotNil(t, restored.Spec.Networks[1].Pod)
+	assert.NotNil(t, restored.Spec.Domain.Devices.Interfaces[1].Masquerade)
+	// The additional items are looked up in the backup under the backed up network names
+	assert.Contains(t, output.AdditionalItems, velero.ResourceIdentifier{
+		GroupResource: kvgraph.KVObjectGraph["network-attachment-definitions"],
+		Namespace:     "target",
+		Name:          "blue",
+	})
+}
+
+func TestVMIRestoreEvents(t *testing.T) {
+	vmi := &kvcore.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-vmi", Namespace: testNamespace, UID: "test-backed-up-uid"},
+		Spec: kvcore.VirtualMachineInstanceSpec{
+			Networks: []kvcore.Network{
+				{Name: "fast", NetworkSource: kvcore.NetworkSource{Multus: &kvcore.MultusNetwork{NetworkName: "sriov"}}},
+			},
+		},
+	}
+	vmi.Spec.Domain.Devices.Interfaces = []kvcore.Interface{
+		{Name: "fast", InterfaceBindingMethod: kvcore.InterfaceBindingMethod{SRIOV: &kvcore.InterfaceSRIOV{}}},
+	}
+	item, err := runtime.DefaultUnstructuredConverter.ToUnstructured(vmi)
+	assert.NoError(t, err)
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	util.GetPluginConfig = func(kind common.PluginKind) (*util.PluginConfig, error) { return nil, nil }
+	events := []corev1.Event{}
+	util.CreateEvent = func(event *corev1.Event) error {
+		events = append(events, *event)
+		return nil
+	}
+	getVMI, setVMIAnnotation := util.GetVMI, util.SetVMIAnnotation
+	defer func() { util.GetVMI, util.SetVMIAnnotation = getVMI, setVMIAnnotation }()
+
+	action := NewVMIRestoreItemAction(logrus.StandardLogger())
+	restore := &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{
+		Name:   "test-restore",
+		Labels: map[string]string{util.HostDevicePolicyLabel: "remap"},
+	}}
+	output, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+		Item:    &unstructured.Unstructured{Object: item},
+		Restore: restore,
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	assert.True(t, strings.HasPrefix(output.OperationID, testNamespace+"/test-vmi/"))
+
+	restored := new(kvcore.VirtualMachineInstance)
+	assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), restored))
+	assert.Empty(t, restored.Spec.Domain.Devices.Interfaces)
+	assert.Contains(t, restored.Annotations[util.RestoreEventsAnnotation], util.EventHostDevicesRewritten)
+
+	// Events are recorded on the next poll when the annotation cannot be cleared
+	restored.UID = "test-restored-uid"
+	util.GetVMI = func(ns, name string) (*kvcore.VirtualMachineInstance, error) { return restored, nil }
+	util.SetVMIAnnotation = func(ns, name, key string, value *string) error { return fmt.Errorf("conflict") }
+	progress, err := action.Progress(output.OperationID, restore)
+	assert.NoError(t, err)
+	assert.False(t, progress.Completed)
+	assert.Empty(t, events)
+
+	util.SetVMIAnnotation = func(ns, name, key string, value *string) error { return nil }
+	progress, err = action.Progress(output.OperationID, restore)
+	assert.NoError(t, err)
+	assert.True(t, progress.Completed)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, util.EventHostDevicesRewritten, events[0].Reason)
+		assert.Equal(t, "Removed SR-IOV interface fast and its unmapped network by restore test-restore", events[0].Message)
+		assert.Equal(t, types.UID("test-restored-uid"), events[0].InvolvedObject.UID)
+	}
+
+	// A VMI missing once the items are restored is never created, there is nothing to wait for
+	events = events[:0]
+	util.GetVMI = func(ns, name string) (*kvcore.VirtualMachineInstance, error) {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Group: "kubevirt.io", Resource: "virtualmachineinstances"}, name)
+	}
+	progress, err = action.Progress(output.OperationID, restore)
+	assert.NoError(t, err)
+	assert.True(t, progress.Completed)
+	assert.Empty(t, events)
+}
@@ -0,0 +1,76 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/runtime"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	kvcore "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util/kvgraph"
+)
+
+// VMIReplicaSetBackupItemAction is a backup item action for backing up VirtualMachineInstanceReplicaSets
+type VMIReplicaSetBackupItemAction struct {
+	log logrus.FieldLogger
+}
+
+// NewVMIReplicaSetBackupItemAction instantiates a VMIReplicaSetBackupItemAction.
+func NewVMIReplicaSetBackupItemAction(log logrus.FieldLogger) *VMIReplicaSetBackupItemAction {
+	return &VMIReplicaSetBackupItemAction{log: log}
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *VMIReplicaSetBackupItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+			IncludedResources: []string{
+				"VirtualMachineInstanceReplicaSet",
+			},
+		},
+		nil
+}
+
+// Execute returns the objects referenced by the replica set's VMI template as extra items to back up.
+// The VMIs themselves are recreated by the replica set, so they are not part of the graph.
+func (p *VMIReplicaSetBackupItemAction) Execute(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	p.log.Info("Executing VMIReplicaSetBackupItemAction")
+
+	if backup == nil {
+		return nil, nil, fmt.Errorf("backup object nil!")
+	}
+
+	replicaSet := new(kvcore.VirtualMachineInstanceReplicaSet)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), replicaSet); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	extra, err := kvgraph.NewVirtualMachineInstanceReplicaSetBackupGraph(replicaSet)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	return item, extra, nil
+}
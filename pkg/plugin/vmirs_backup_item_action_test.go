@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func newVMIReplicaSetItem() *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "kubevirt.io/v1",
+			"kind":       "VirtualMachineInstanceReplicaSet",
+			"metadata": map[string]interface{}{
+				"name":      "test-replicaset",
+				"namespace": testNamespace,
+			},
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"volumes": []interface{}{
+							map[string]interface{}{
+								"name": "cloudinit",
+								"cloudInitNoCloud": map[string]interface{}{
+									"secretRef": map[string]interface{}{
+										"name": "test-secret",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestVMIReplicaSetBackupExecute(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	action := NewVMIReplicaSetBackupItemAction(logrus.StandardLogger())
+
+	t.Run("Replica set should return template dependencies as extra items", func(t *testing.T) {
+		item := newVMIReplicaSetItem()
+		_, extra, err := action.Execute(item, &velerov1.Backup{})
+		assert.NoError(t, err)
+		assert.Equal(t, []velero.ResourceIdentifier{
+			{
+				GroupResource: schema.GroupResource{Group: "", Resource: "secrets"},
+				Namespace:     testNamespace,
+				Name:          "test-secret",
+			},
+		}, extra)
+	})
+
+	t.Run("Nil backup should return an error", func(t *testing.T) {
+		_, _, err := action.Execute(newVMIReplicaSetItem(), nil)
+		assert.Error(t, err)
+	})
+}
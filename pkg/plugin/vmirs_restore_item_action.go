@@ -0,0 +1,74 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/runtime"
+	kvcore "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util/kvgraph"
+)
+
+// VMIReplicaSetRestorePlugin is a VirtualMachineInstanceReplicaSet restore item action plugin for Velero
+type VMIReplicaSetRestorePlugin struct {
+	log logrus.FieldLogger
+}
+
+// NewVMIReplicaSetRestoreItemAction instantiates a VMIReplicaSetRestorePlugin.
+func NewVMIReplicaSetRestoreItemAction(log logrus.FieldLogger) *VMIReplicaSetRestorePlugin {
+	return &VMIReplicaSetRestorePlugin{log: log}
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *VMIReplicaSetRestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{
+			"VirtualMachineInstanceReplicaSet",
+		},
+	}, nil
+}
+
+// Execute – The objects referenced by the VMI template are restored before the replica set,
+// which then recreates its VMIs
+func (p *VMIReplicaSetRestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	p.log.Info("Running VMIReplicaSetRestorePlugin")
+
+	if input == nil {
+		return nil, fmt.Errorf("input object nil!")
+	}
+
+	replicaSet := new(kvcore.VirtualMachineInstanceReplicaSet)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), replicaSet); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	output := velero.NewRestoreItemActionExecuteOutput(input.Item)
+	var err error
+	output.AdditionalItems, err = kvgraph.NewVirtualMachineInstanceReplicaSetRestoreGraph(replicaSet)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return output, nil
+}
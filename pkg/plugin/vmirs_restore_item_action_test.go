@@ -0,0 +1,30 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestVMIReplicaSetRestoreExecute(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	action := NewVMIReplicaSetRestoreItemAction(logrus.StandardLogger())
+
+	output, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+		Item:    newVMIReplicaSetItem(),
+		Restore: &velerov1.Restore{},
+	})
+	assert.NoError(t, err)
+	assert.False(t, output.SkipRestore)
+	assert.Equal(t, []velero.ResourceIdentifier{
+		{
+			GroupResource: schema.GroupResource{Group: "", Resource: "secrets"},
+			Namespace:     testNamespace,
+			Name:          "test-secret",
+		},
+	}, output.AdditionalItems)
+}
@@ -0,0 +1,102 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	poolv1 "kubevirt.io/api/pool/v1beta1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util/kvgraph"
+)
+
+// VMPoolBackupItemAction is a backup item action for backing up VirtualMachinePools
+type VMPoolBackupItemAction struct {
+	log logrus.FieldLogger
+}
+
+// NewVMPoolBackupItemAction instantiates a VMPoolBackupItemAction.
+func NewVMPoolBackupItemAction(log logrus.FieldLogger) *VMPoolBackupItemAction {
+	return &VMPoolBackupItemAction{log: log}
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *VMPoolBackupItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+			IncludedResources: []string{
+				"VirtualMachinePool",
+			},
+		},
+		nil
+}
+
+// Execute returns the pool's VMs and their graphs as extra items to back up.
+func (p *VMPoolBackupItemAction) Execute(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	p.log.Info("Executing VMPoolBackupItemAction")
+
+	if backup == nil {
+		return nil, nil, fmt.Errorf("backup object nil!")
+	}
+
+	pool := new(poolv1.VirtualMachinePool)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), pool); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	extra, err := kvgraph.NewVirtualMachinePoolBackupGraph(pool, backup)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	// Record the owned VMs, so the restore can bring them back before the pool
+	// controller has a chance to create new ones
+	vmNames := []string{}
+	for _, resource := range extra {
+		if resource.GroupResource == kvgraph.KVObjectGraph["virtualmachines"] {
+			vmNames = append(vmNames, resource.Name)
+		}
+	}
+	value, err := json.Marshal(vmNames)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	annotations := pool.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[util.PoolVMsAnnotation] = string(value)
+	pool.SetAnnotations(annotations)
+
+	poolMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	return &unstructured.Unstructured{Object: poolMap}, extra, nil
+}
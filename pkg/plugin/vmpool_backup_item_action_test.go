@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
+	kvcore "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+)
+
+func TestVMPoolBackupAction(t *testing.T) {
+	pool := unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "pool.kubevirt.io/v1beta1",
+			"kind":       "VirtualMachinePool",
+			"metadata": map[string]interface{}{
+				"name":      "test-pool",
+				"namespace": testNamespace,
+			},
+			"spec": map[string]interface{}{
+				"selector": map[string]interface{}{
+					"matchLabels": map[string]interface{}{
+						"app": "test-pool",
+					},
+				},
+			},
+		},
+	}
+	poolVM := func(name, owner string) kvcore.VirtualMachine {
+		return kvcore.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: testNamespace,
+				Labels:    map[string]string{"app": "test-pool"},
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: "VirtualMachinePool", Name: owner, Controller: ptr.To(true)},
+				},
+			},
+			Spec: kvcore.VirtualMachineSpec{
+				Template: &kvcore.VirtualMachineInstanceTemplateSpec{
+					Spec: kvcore.VirtualMachineInstanceSpec{
+						Volumes: []kvcore.Volume{
+							{
+								Name: "rootdisk",
+								VolumeSource: kvcore.VolumeSource{
+									DataVolume: &kvcore.DataVolumeSource{Name: "rootdisk-" + name},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	var selector string
+	util.ListVMs = func(labelSelector, namespace string) (*kvcore.VirtualMachineList, error) {
+		selector = labelSelector
+		return &kvcore.VirtualMachineList{Items: []kvcore.VirtualMachine{
+			poolVM("test-pool-0", "test-pool"),
+			poolVM("test-pool-1", "test-pool"),
+			poolVM("other-pool-0", "other-pool"),
+		}}, nil
+	}
+	util.ListPods = func(name, ns string) (*k8sv1.PodList, error) {
+		return &k8sv1.PodList{}, nil
+	}
+	util.ListLauncherPods = func(ns string) (*k8sv1.PodList, error) {
+		return &k8sv1.PodList{}, nil
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	action := NewVMPoolBackupItemAction(logrus.StandardLogger())
+	output, extra, err := action.Execute(&pool, &v1.Backup{})
+	assert.NoError(t, err)
+	assert.Equal(t, "app=test-pool", selector)
+
+	vmResource := schema.GroupResource{Group: "kubevirt.io", Resource: "virtualmachines"}
+	dvResource := schema.GroupResource{Group: "cdi.kubevirt.io", Resource: "datavolumes"}
+	assert.Contains(t, extra, velero.ResourceIdentifier{GroupResource: vmResource, Namespace: testNamespace, Name: "test-pool-0"})
+	assert.Contains(t, extra, velero.ResourceIdentifier{GroupResource: vmResource, Namespace: testNamespace, Name: "test-pool-1"})
+	assert.Contains(t, extra, velero.ResourceIdentifier{GroupResource: dvResource, Namespace: testNamespace, Name: "rootdisk-test-pool-1"})
+	assert.NotContains(t, extra, velero.ResourceIdentifier{GroupResource: vmResource, Namespace: testNamespace, Name: "other-pool-0"})
+
+	annotations := output.UnstructuredContent()["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+	assert.Equal(t, `["test-pool-0","test-pool-1"]`, annotations[util.PoolVMsAnnotation])
+}
@@ -0,0 +1,90 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	poolv1 "kubevirt.io/api/pool/v1beta1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util/kvgraph"
+)
+
+// VMPoolRestorePlugin is a VirtualMachinePool restore item action plugin for Velero
+type VMPoolRestorePlugin struct {
+	log logrus.FieldLogger
+}
+
+// NewVMPoolRestoreItemAction instantiates a VMPoolRestorePlugin.
+func NewVMPoolRestoreItemAction(log logrus.FieldLogger) *VMPoolRestorePlugin {
+	return &VMPoolRestorePlugin{log: log}
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *VMPoolRestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{
+			"VirtualMachinePool",
+		},
+	}, nil
+}
+
+// Execute – The owned VMs are restored before the pool so the pool adopts them,
+// unless the restore asks to skip them and let the pool recreate its VMs
+func (p *VMPoolRestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	p.log.Info("Running VMPoolRestorePlugin")
+
+	if input == nil {
+		return nil, fmt.Errorf("input object nil!")
+	}
+
+	pool := new(poolv1.VirtualMachinePool)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), pool); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var additionalItems []velero.ResourceIdentifier
+	config := util.LoadPluginConfig(common.PluginKindRestoreItemAction, input.Restore.ObjectMeta, p.log)
+	if util.ShouldSkipPoolOwnedVMs(input.Restore, config, pool.Namespace) {
+		p.log.Infof("Skipping VMs owned by pool %s/%s, the pool will recreate them", pool.Namespace, pool.Name)
+	} else {
+		var err error
+		additionalItems, err = kvgraph.NewVirtualMachinePoolRestoreGraph(pool)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	delete(pool.Annotations, util.PoolVMsAnnotation)
+
+	item, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	output := velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: item})
+	output.AdditionalItems = additionalItems
+	return output, nil
+}
@@ -0,0 +1,113 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
+)
+
+func TestVMPoolRestoreExecute(t *testing.T) {
+	newInput := func(labels map[string]string) *velero.RestoreItemActionExecuteInput {
+		return &velero.RestoreItemActionExecuteInput{
+			Item: &unstructured.Unstructured{
+				Object: map[string]interface{}{
+					"apiVersion": "pool.kubevirt.io/v1beta1",
+					"kind":       "VirtualMachinePool",
+					"metadata": map[string]interface{}{
+						"name":      "test-pool",
+						"namespace": testNamespace,
+						"annotations": map[string]interface{}{
+							util.PoolVMsAnnotation: `["test-pool-0","test-pool-1"]`,
+						},
+					},
+				},
+			},
+			Restore: &velerov1.Restore{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+			},
+		}
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	action := NewVMPoolRestoreItemAction(logrus.StandardLogger())
+
+	t.Run("Pool should return owned VMs as additional items", func(t *testing.T) {
+		output, err := action.Execute(newInput(nil))
+		assert.NoError(t, err)
+		assert.Equal(t, []velero.ResourceIdentifier{
+			{
+				GroupResource: schema.GroupResource{Group: "kubevirt.io", Resource: "virtualmachines"},
+				Namespace:     testNamespace,
+				Name:          "test-pool-0",
+			},
+			{
+				GroupResource: schema.GroupResource{Group: "kubevirt.io", Resource: "virtualmachines"},
+				Namespace:     testNamespace,
+				Name:          "test-pool-1",
+			},
+		}, output.AdditionalItems)
+		annotations, _ := output.UpdatedItem.UnstructuredContent()["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+		assert.NotContains(t, annotations, util.PoolVMsAnnotation)
+	})
+
+	t.Run("Pool should not return owned VMs when skipping them", func(t *testing.T) {
+		output, err := action.Execute(newInput(map[string]string{util.SkipPoolOwnedVMsLabel: "true"}))
+		assert.NoError(t, err)
+		assert.Empty(t, output.AdditionalItems)
+		assert.False(t, output.SkipRestore)
+	})
+}
+
+func TestVMRestoreExecutePoolOwned(t *testing.T) {
+	newInput := func(labels map[string]string) *velero.RestoreItemActionExecuteInput {
+		return &velero.RestoreItemActionExecuteInput{
+			Item: &unstructured.Unstructured{
+				Object: map[string]interface{}{
+					"apiVersion": "kubevirt.io/v1",
+					"kind":       "VirtualMachine",
+					"metadata": map[string]interface{}{
+						"name":      "test-pool-0",
+						"namespace": testNamespace,
+						"annotations": map[string]interface{}{
+							util.PoolOwnerAnnotation: "test-pool",
+						},
+					},
+					"spec": map[string]interface{}{
+						"template": map[string]interface{}{},
+					},
+				},
+			},
+			Restore: &velerov1.Restore{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+			},
+		}
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	action := NewVMRestoreItemAction(logrus.StandardLogger())
+
+	t.Run("Pool owned VM should be restored for adoption", func(t *testing.T) {
+		output, err := action.Execute(newInput(nil))
+		assert.NoError(t, err)
+		assert.False(t, output.SkipRestore)
+		annotations, _ := output.UpdatedItem.UnstructuredContent()["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+		assert.NotContains(t, annotations, util.PoolOwnerAnnotation)
+	})
+
+	t.Run("Pool owned VM should be skipped when using appropriate label", func(t *testing.T) {
+		output, err := action.Execute(newInput(map[string]string{util.SkipPoolOwnedVMsLabel: "true"}))
+		assert.NoError(t, err)
+		assert.True(t, output.SkipRestore)
+	})
+}
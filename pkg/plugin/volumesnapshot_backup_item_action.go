@@ -22,6 +22,7 @@ package plugin
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -29,6 +30,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
 
@@ -37,11 +39,16 @@ import (
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 )
 
+// maxCachedPVCNamespaces bounds the PVC cache of a backup spanning many namespaces
+const maxCachedPVCNamespaces = 100
+
 // VolumeSnapshotBackupItemAction is a backup item action for backing up VolumeSnapshots
 type VolumeSnapshotBackupItemAction struct {
 	log    logrus.FieldLogger
 	client kubernetes.Interface
-	// Cache PVCs by namespace to avoid repeated API calls
+	// Cache PVCs by namespace to avoid repeated API calls, only for the backup in progress
+	lock          sync.Mutex
+	cacheBackup   types.UID
 	namespacePVCs map[string]map[string]string // namespace -> pvcName -> pvcUID
 }
 
@@ -98,7 +105,7 @@ func (p *VolumeSnapshotBackupItemAction) Execute(item runtime.Unstructured, back
 	pvcName := *volumeSnapshot.Spec.Source.PersistentVolumeClaimName
 
 	// Get the PVC UID efficiently using cache
-	pvcUID, err := p.getPVCUID(volumeSnapshot.GetNamespace(), pvcName)
+	pvcUID, err := p.getPVCUID(backup, volumeSnapshot.GetNamespace(), pvcName)
 	if err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
@@ -136,8 +143,17 @@ func (p *VolumeSnapshotBackupItemAction) Execute(item runtime.Unstructured, back
 	return &unstructured.Unstructured{Object: vsMap}, extra, nil
 }
 
-// getPVCUID efficiently retrieves the UID of a PVC using namespace-level caching
-func (p *VolumeSnapshotBackupItemAction) getPVCUID(namespace, pvcName string) (string, error) {
+// getPVCUID efficiently retrieves the UID of a PVC using namespace-level caching.
+// The cache is dropped when another backup starts, or when it holds too many namespaces.
+func (p *VolumeSnapshotBackupItemAction) getPVCUID(backup *v1.Backup, namespace, pvcName string) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if backup.UID != p.cacheBackup {
+		p.cacheBackup = backup.UID
+		p.namespacePVCs = make(map[string]map[string]string)
+	}
+
 	// Check if we have this namespace cached
 	if namespacePVCs, exists := p.namespacePVCs[namespace]; exists {
 		if pvcUID, found := namespacePVCs[pvcName]; found {
@@ -158,6 +174,9 @@ func (p *VolumeSnapshotBackupItemAction) getPVCUID(namespace, pvcName string) (s
 	}
 
 	// Initialize the namespace cache
+	if len(p.namespacePVCs) >= maxCachedPVCNamespaces {
+		p.namespacePVCs = make(map[string]map[string]string)
+	}
 	p.namespacePVCs[namespace] = make(map[string]string)
 
 	// Cache all PVCs in this namespace
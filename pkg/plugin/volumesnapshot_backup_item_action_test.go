@@ -1,14 +1,19 @@
 package plugin
 
 import (
+	"context"
+	"fmt"
 	"testing"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
 
 	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v7/apis/volumesnapshot/v1"
 	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
@@ -234,3 +239,44 @@ func stringPtr(s string) *string {
 	return &s
 }
 
+
+func TestVolumeSnapshotBackupPVCCache(t *testing.T) {
+	newPVC := func(name, uid string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name, UID: types.UID(uid)},
+		}
+	}
+	client := k8sfake.NewSimpleClientset(newPVC("test-pvc", "test-pvc-uid"))
+	action := &VolumeSnapshotBackupItemAction{
+		log:           logrus.StandardLogger(),
+		client:        client,
+		namespacePVCs: make(map[string]map[string]string),
+	}
+	backup1 := &v1.Backup{ObjectMeta: metav1.ObjectMeta{UID: "backup-1"}}
+	backup2 := &v1.Backup{ObjectMeta: metav1.ObjectMeta{UID: "backup-2"}}
+
+	uid, err := action.getPVCUID(backup1, testNamespace, "test-pvc")
+	assert.NoError(t, err)
+	assert.Equal(t, "test-pvc-uid", uid)
+
+	_, err = client.CoreV1().PersistentVolumeClaims(testNamespace).Create(context.TODO(), newPVC("new-pvc", "new-pvc-uid"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	t.Run("Namespace should be cached for the backup", func(t *testing.T) {
+		_, err := action.getPVCUID(backup1, testNamespace, "new-pvc")
+		assert.Error(t, err)
+	})
+
+	t.Run("Cache should be dropped for the next backup", func(t *testing.T) {
+		uid, err := action.getPVCUID(backup2, testNamespace, "new-pvc")
+		assert.NoError(t, err)
+		assert.Equal(t, "new-pvc-uid", uid)
+	})
+
+	t.Run("Cache should be bounded", func(t *testing.T) {
+		for i := 0; i < maxCachedPVCNamespaces+10; i++ {
+			_, _ = action.getPVCUID(backup2, fmt.Sprintf("namespace-%d", i), "test-pvc")
+		}
+		assert.LessOrEqual(t, len(action.namespacePVCs), maxCachedPVCNamespaces)
+	})
+}
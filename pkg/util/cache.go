@@ -0,0 +1,102 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package util
+
+import (
+	"sync"
+
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// MaxCachedBackups bounds the number of backups whose lookups are kept. Velero runs a single
+// backup at a time, a few more cover the asynchronous operations of the previous ones.
+const MaxCachedBackups = 4
+
+type lookupResult struct {
+	value interface{}
+	err   error
+}
+
+// BackupCache memoizes values per backup, or restore, so objects shared by many VMs of a backup
+// are only fetched once. Only the most recent MaxCachedBackups backups are kept.
+type BackupCache struct {
+	lock    sync.Mutex
+	backups []types.UID
+	entries map[types.UID]map[string]lookupResult
+}
+
+// NewBackupCache instantiates an empty BackupCache.
+func NewBackupCache() *BackupCache {
+	return &BackupCache{entries: map[types.UID]map[string]lookupResult{}}
+}
+
+// backupLookups caches the API lookups of the backup safety checks
+var backupLookups = NewBackupCache()
+
+func (c *BackupCache) get(backup types.UID, key string) (lookupResult, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	result, ok := c.entries[backup][key]
+	return result, ok
+}
+
+func (c *BackupCache) set(backup types.UID, key string, result lookupResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.entries[backup]; !ok {
+		if len(c.backups) == MaxCachedBackups {
+			delete(c.entries, c.backups[0])
+			c.backups = c.backups[1:]
+		}
+		c.backups = append(c.backups, backup)
+		c.entries[backup] = map[string]lookupResult{}
+	}
+	c.entries[backup][key] = result
+}
+
+// CachedLookup returns the result of lookup, calling it once per backup and key. Only successful
+// and not found results are cached, other errors are retried on the next call.
+func CachedLookup[T any](cache *BackupCache, backup *velerov1.Backup, key string, lookup func() (T, error)) (T, error) {
+	if backup == nil {
+		return lookup()
+	}
+	return cachedLookup(cache, backup.UID, key, lookup)
+}
+
+// cachedLookup is CachedLookup keyed on the UID of a backup or of a restore
+func cachedLookup[T any](cache *BackupCache, uid types.UID, key string, lookup func() (T, error)) (T, error) {
+	if uid == "" {
+		// Not a persisted backup or restore, nothing to key the cache on
+		return lookup()
+	}
+
+	if result, ok := cache.get(uid, key); ok {
+		value, _ := result.value.(T)
+		return value, result.err
+	}
+
+	value, err := lookup()
+	if err == nil || k8serrors.IsNotFound(err) {
+		cache.set(uid, key, lookupResult{value: value, err: err})
+	}
+	return value, err
+}
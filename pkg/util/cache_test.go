@@ -0,0 +1,88 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestCachedLookup(t *testing.T) {
+	newBackup := func(uid string) *velerov1.Backup {
+		return &velerov1.Backup{ObjectMeta: metav1.ObjectMeta{UID: types.UID(uid)}}
+	}
+
+	t.Run("Successful lookups should be cached per backup", func(t *testing.T) {
+		cache := NewBackupCache()
+		calls := 0
+		lookup := func() (bool, error) {
+			calls++
+			return true, nil
+		}
+
+		for i := 0; i < 3; i++ {
+			value, err := CachedLookup(cache, newBackup("backup-1"), "key", lookup)
+			assert.NoError(t, err)
+			assert.True(t, value)
+		}
+		assert.Equal(t, 1, calls)
+
+		_, _ = CachedLookup(cache, newBackup("backup-2"), "key", lookup)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("Not found should be cached, other errors retried", func(t *testing.T) {
+		cache := NewBackupCache()
+		calls := 0
+		notFound := func() (bool, error) {
+			calls++
+			return false, k8serrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, "test-secret")
+		}
+		failing := func() (bool, error) {
+			calls++
+			return false, fmt.Errorf("connection refused")
+		}
+
+		for i := 0; i < 2; i++ {
+			_, err := CachedLookup(cache, newBackup("backup-1"), "not-found", notFound)
+			assert.True(t, k8serrors.IsNotFound(err))
+		}
+		assert.Equal(t, 1, calls)
+
+		for i := 0; i < 2; i++ {
+			_, err := CachedLookup(cache, newBackup("backup-1"), "failing", failing)
+			assert.Error(t, err)
+		}
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("Backups without UID should not be cached", func(t *testing.T) {
+		cache := NewBackupCache()
+		calls := 0
+		lookup := func() (bool, error) {
+			calls++
+			return true, nil
+		}
+
+		_, _ = CachedLookup(cache, &velerov1.Backup{}, "key", lookup)
+		_, _ = CachedLookup(cache, &velerov1.Backup{}, "key", lookup)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("Only the most recent backups should be kept", func(t *testing.T) {
+		cache := NewBackupCache()
+		lookup := func() (bool, error) { return true, nil }
+
+		for i := 0; i <= MaxCachedBackups; i++ {
+			_, _ = CachedLookup(cache, newBackup(fmt.Sprintf("backup-%d", i)), "key", lookup)
+		}
+		assert.Len(t, cache.entries, MaxCachedBackups)
+		assert.NotContains(t, cache.entries, types.UID("backup-0"))
+		assert.Contains(t, cache.entries, types.UID(fmt.Sprintf("backup-%d", MaxCachedBackups)))
+	})
+}
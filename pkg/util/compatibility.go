@@ -0,0 +1,323 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// MinKubeVirtVersion is the oldest KubeVirt version supported by the plugin, see the compatibility matrix
+	MinKubeVirtVersion = "v1.1.0"
+	// MaxKubeVirtVersion is the newest KubeVirt minor version supported by the plugin, with any patch release
+	MaxKubeVirtVersion = "v1.7.0"
+	// MinCDIVersion is the oldest CDI version supported by the plugin, see the compatibility matrix
+	MinCDIVersion = "v1.57.0"
+	// MaxCDIVersion is the newest CDI minor version supported by the plugin, with any patch release
+	MaxCDIVersion = "v1.64.0"
+	// MinVeleroVersion is the oldest Velero version supported by the plugin, see the compatibility matrix
+	MinVeleroVersion = "v1.18.0"
+	// MaxVeleroVersion is the newest Velero minor version supported by the plugin, with any patch release
+	MaxVeleroVersion = "v1.18.0"
+
+	// veleroDeployment is the name of the Velero server deployment and container
+	veleroDeployment = "velero"
+
+	// KubeVirtVersionAnnotation records on the backed up VMs and VMIs the KubeVirt version of the cluster
+	KubeVirtVersionAnnotation = "velero.kubevirt.io/kubevirt-version"
+	// CDIVersionAnnotation records on the backed up VMs and VMIs the CDI version of the cluster
+	CDIVersionAnnotation = "velero.kubevirt.io/cdi-version"
+)
+
+// requiredAPIVersions are the KubeVirt and CDI API versions the plugin reads and writes
+var requiredAPIVersions = []string{
+	"kubevirt.io/v1",
+	"cdi.kubevirt.io/v1beta1",
+}
+
+// ClusterVersions are the KubeVirt, CDI and Velero versions deployed in the cluster, empty when unknown
+type ClusterVersions struct {
+	KubeVirt string
+	CDI      string
+	Velero   string
+}
+
+var (
+	compatibilityOnce sync.Once
+	clusterVersions   ClusterVersions
+)
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var GetClusterVersions = func() (ClusterVersions, error) {
+	versions := ClusterVersions{}
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return versions, err
+	}
+
+	kubevirts, err := (*client).KubeVirt(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return versions, err
+	}
+	for _, kv := range kubevirts.Items {
+		if kv.Status.ObservedKubeVirtVersion != "" {
+			versions.KubeVirt = kv.Status.ObservedKubeVirtVersion
+			break
+		}
+	}
+
+	cdis, err := (*client).CdiClient().CdiV1beta1().CDIs().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return versions, err
+	}
+	for _, cdi := range cdis.Items {
+		if cdi.Status.ObservedVersion != "" {
+			versions.CDI = cdi.Status.ObservedVersion
+			break
+		}
+	}
+
+	return versions, nil
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var GetVeleroVersion = func() (string, error) {
+	client, err := GetK8sClient()
+	if err != nil {
+		return "", err
+	}
+
+	deployment, err := client.AppsV1().Deployments(GetVeleroNamespace()).Get(context.TODO(), veleroDeployment, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		if container.Name == veleroDeployment {
+			return imageTag(container.Image), nil
+		}
+	}
+	return "", nil
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var GetServedAPIVersions = func() ([]string, error) {
+	client, err := GetK8sClient()
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := client.Discovery().ServerGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	served := []string{}
+	for _, group := range groups.Groups {
+		for _, version := range group.Versions {
+			served = append(served, version.GroupVersion)
+		}
+	}
+	return served, nil
+}
+
+// CheckCompatibility detects the KubeVirt, CDI and Velero versions and the API versions served by the cluster,
+// and logs when they are outside of what the plugin supports. Detection runs once per plugin process, later
+// calls return the versions detected by the first one.
+func CheckCompatibility(log logrus.FieldLogger) ClusterVersions {
+	compatibilityOnce.Do(func() {
+		versions, err := GetClusterVersions()
+		if err != nil {
+			log.Warnf("Failed to detect the KubeVirt and CDI versions: %v", err)
+		}
+		// The Velero version is read from the image of the server, the plugin is built separately
+		if versions.Velero, err = GetVeleroVersion(); err != nil {
+			log.Warnf("Failed to detect the Velero version: %v", err)
+		}
+		clusterVersions = versions
+
+		for _, warning := range versionWarnings(versions) {
+			log.Warn(warning)
+		}
+
+		served, err := GetServedAPIVersions()
+		if err != nil {
+			log.Warnf("Failed to discover the served API versions: %v", err)
+			return
+		}
+		for _, apiVersion := range missingAPIVersions(served) {
+			log.Errorf("API version %s is not served by the cluster, the plugin cannot back up or restore VMs", apiVersion)
+		}
+	})
+
+	return clusterVersions
+}
+
+// RecordClusterVersions annotates a backed up VM or VMI with the KubeVirt and CDI versions of the cluster. The
+// items are stored with the backup in object storage, so the versions survive syncing the backup to another
+// cluster, unlike annotations on the live Backup.
+func RecordClusterVersions(item runtime.Unstructured, log logrus.FieldLogger) {
+	versions := CheckCompatibility(log)
+	if versions.KubeVirt != "" {
+		AddAnnotation(item, KubeVirtVersionAnnotation, versions.KubeVirt)
+	}
+	if versions.CDI != "" {
+		AddAnnotation(item, CDIVersionAnnotation, versions.CDI)
+	}
+}
+
+// versionWarnings reports the versions which are unknown or outside of the supported ranges
+func versionWarnings(versions ClusterVersions) []string {
+	warnings := []string{}
+	for _, component := range []struct {
+		name, version, min, max string
+	}{
+		{"KubeVirt", versions.KubeVirt, MinKubeVirtVersion, MaxKubeVirtVersion},
+		{"CDI", versions.CDI, MinCDIVersion, MaxCDIVersion},
+		{"Velero", versions.Velero, MinVeleroVersion, MaxVeleroVersion},
+	} {
+		supported := supportedVersions(component.min, component.max)
+		if component.version == "" {
+			warnings = append(warnings, fmt.Sprintf("%s version could not be detected, supported versions are %s", component.name, supported))
+			continue
+		}
+
+		older, err := isOlderVersion(component.version, component.min)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s version %s could not be parsed: %v", component.name, component.version, err))
+			continue
+		}
+		newer, err := isNewerMinorVersion(component.version, component.max)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s version %s could not be parsed: %v", component.name, component.version, err))
+			continue
+		}
+		if older || newer {
+			warnings = append(warnings, fmt.Sprintf("%s version %s is not supported by the plugin, supported versions are %s", component.name, component.version, supported))
+		}
+	}
+
+	return warnings
+}
+
+// supportedVersions describes the range from the min version to any patch release of the max minor version
+func supportedVersions(min, max string) string {
+	parsed, err := parseVersion(max)
+	if err != nil {
+		return fmt.Sprintf("%s to %s", min, max)
+	}
+	return fmt.Sprintf("%s to v%d.%d.x", min, parsed[0], parsed[1])
+}
+
+// imageTag returns the tag of a container image, or an empty string when it has none
+func imageTag(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return ""
+	}
+	return image[i+1:]
+}
+
+// missingAPIVersions returns the required API versions which are not served
+func missingAPIVersions(served []string) []string {
+	missing := []string{}
+	for _, required := range requiredAPIVersions {
+		found := false
+		for _, apiVersion := range served {
+			if apiVersion == required {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, required)
+		}
+	}
+
+	return missing
+}
+
+// isOlderVersion compares two vX.Y.Z versions, ignoring pre-release and build suffixes
+func isOlderVersion(version, than string) (bool, error) {
+	v, err := parseVersion(version)
+	if err != nil {
+		return false, err
+	}
+	t, err := parseVersion(than)
+	if err != nil {
+		return false, err
+	}
+
+	for i := range v {
+		if v[i] != t[i] {
+			return v[i] < t[i], nil
+		}
+	}
+	return false, nil
+}
+
+// isNewerMinorVersion compares the major and minor parts of two vX.Y.Z versions
+func isNewerMinorVersion(version, than string) (bool, error) {
+	v, err := parseVersion(version)
+	if err != nil {
+		return false, err
+	}
+	t, err := parseVersion(than)
+	if err != nil {
+		return false, err
+	}
+
+	if v[0] != t[0] {
+		return v[0] > t[0], nil
+	}
+	return v[1] > t[1], nil
+}
+
+func parseVersion(version string) ([3]int, error) {
+	parsed := [3]int{}
+	core := strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(core, "-+"); i >= 0 {
+		core = core[:i]
+	}
+
+	parts := strings.Split(core, ".")
+	if len(parts) != len(parsed) {
+		return parsed, fmt.Errorf("expected a vX.Y.Z version")
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return parsed, fmt.Errorf("expected a vX.Y.Z version")
+		}
+		parsed[i] = n
+	}
+
+	return parsed, nil
+}
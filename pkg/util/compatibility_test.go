@@ -0,0 +1,157 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// levelCounter counts the log entries per level
+type levelCounter map[logrus.Level]int
+
+func (c levelCounter) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (c levelCounter) Fire(entry *logrus.Entry) error {
+	c[entry.Level]++
+	return nil
+}
+
+func TestIsOlderVersion(t *testing.T) {
+	testCases := []struct {
+		version       string
+		than          string
+		expected      bool
+		errorExpected bool
+	}{
+		{"v1.1.0", "v1.1.0", false, false},
+		{"v1.0.9", "v1.1.0", true, false},
+		{"v1.5.2", "v1.1.0", false, false},
+		{"v0.59.0", "v1.1.0", true, false},
+		{"v1.56.1", "v1.57.0", true, false},
+		{"v1.61.0-rc.1", "v1.57.0", false, false},
+		{"1.2.0+build", "v1.1.0", false, false},
+		{"latest", "v1.1.0", false, true},
+		{"v1.1", "v1.1.0", false, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s older than %s", tc.version, tc.than), func(t *testing.T) {
+			older, err := isOlderVersion(tc.version, tc.than)
+			if tc.errorExpected {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, older)
+		})
+	}
+}
+
+func TestIsNewerMinorVersion(t *testing.T) {
+	testCases := []struct {
+		version  string
+		than     string
+		expected bool
+	}{
+		{"v1.7.0", "v1.7.0", false},
+		{"v1.7.5", "v1.7.0", false},
+		{"v1.6.3", "v1.7.0", false},
+		{"v1.8.0", "v1.7.0", true},
+		{"v2.0.0", "v1.7.0", true},
+		{"v0.9.0", "v1.7.0", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s newer than %s", tc.version, tc.than), func(t *testing.T) {
+			newer, err := isNewerMinorVersion(tc.version, tc.than)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, newer)
+		})
+	}
+}
+
+func TestImageTag(t *testing.T) {
+	assert.Equal(t, "v1.18.0", imageTag("velero/velero:v1.18.0"))
+	assert.Equal(t, "v1.18.0", imageTag("registry.example.com:5000/velero/velero:v1.18.0"))
+	assert.Equal(t, "v1.18.0", imageTag("velero/velero:v1.18.0@sha256:abc"))
+	assert.Empty(t, imageTag("registry.example.com:5000/velero/velero"))
+	assert.Empty(t, imageTag("velero/velero@sha256:abc"))
+}
+
+func TestCheckCompatibility(t *testing.T) {
+	servedAll := []string{"v1", "kubevirt.io/v1", "kubevirt.io/v1alpha3", "cdi.kubevirt.io/v1beta1"}
+
+	testCases := []struct {
+		name             string
+		versions         ClusterVersions
+		versionsErr      error
+		served           []string
+		expectedWarnings int
+		expectedErrors   int
+	}{
+		{"Supported versions", ClusterVersions{KubeVirt: "v1.5.0", CDI: "v1.61.0", Velero: "v1.18.1"}, nil, servedAll, 0, 0},
+		{"Newest supported versions", ClusterVersions{KubeVirt: "v1.7.4", CDI: "v1.64.2", Velero: "v1.18.0"}, nil, servedAll, 0, 0},
+		{"Old KubeVirt", ClusterVersions{KubeVirt: "v1.0.0", CDI: "v1.61.0", Velero: "v1.18.0"}, nil, servedAll, 1, 0},
+		{"Old KubeVirt and CDI", ClusterVersions{KubeVirt: "v0.59.0", CDI: "v1.56.0", Velero: "v1.18.0"}, nil, servedAll, 2, 0},
+		{"New KubeVirt and CDI", ClusterVersions{KubeVirt: "v1.8.0", CDI: "v1.65.0", Velero: "v1.18.0"}, nil, servedAll, 2, 0},
+		{"Old Velero", ClusterVersions{KubeVirt: "v1.5.0", CDI: "v1.61.0", Velero: "v1.16.2"}, nil, servedAll, 1, 0},
+		{"New Velero", ClusterVersions{KubeVirt: "v1.5.0", CDI: "v1.61.0", Velero: "v1.19.0"}, nil, servedAll, 1, 0},
+		{"Unparsable version", ClusterVersions{KubeVirt: "devel", CDI: "v1.61.0", Velero: "v1.18.0"}, nil, servedAll, 1, 0},
+		{"Undetected versions", ClusterVersions{}, fmt.Errorf("forbidden"), servedAll, 5, 0},
+		{"CDI API not served", ClusterVersions{KubeVirt: "v1.5.0", CDI: "v1.61.0", Velero: "v1.18.0"}, nil, []string{"v1", "kubevirt.io/v1"}, 0, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			compatibilityOnce = sync.Once{}
+			GetClusterVersions = func() (ClusterVersions, error) {
+				return ClusterVersions{KubeVirt: tc.versions.KubeVirt, CDI: tc.versions.CDI}, tc.versionsErr
+			}
+			GetVeleroVersion = func() (string, error) { return tc.versions.Velero, tc.versionsErr }
+			GetServedAPIVersions = func() ([]string, error) { return tc.served, nil }
+			counter := levelCounter{}
+			log := logrus.New()
+			log.SetOutput(io.Discard)
+			log.AddHook(counter)
+
+			assert.Equal(t, tc.versions, CheckCompatibility(log))
+
+			assert.Equal(t, tc.expectedWarnings, counter[logrus.WarnLevel])
+			assert.Equal(t, tc.expectedErrors, counter[logrus.ErrorLevel])
+
+			// Detection only runs once per plugin process
+			GetClusterVersions = func() (ClusterVersions, error) { return ClusterVersions{KubeVirt: "v9.9.9"}, nil }
+			assert.Equal(t, tc.versions, CheckCompatibility(log))
+		})
+	}
+}
+
+func TestRecordClusterVersions(t *testing.T) {
+	compatibilityOnce = sync.Once{}
+	GetClusterVersions = func() (ClusterVersions, error) { return ClusterVersions{KubeVirt: "v1.5.0", CDI: "v1.61.0"}, nil }
+	GetVeleroVersion = func() (string, error) { return "v1.18.0", nil }
+	GetServedAPIVersions = func() ([]string, error) { return requiredAPIVersions, nil }
+	logrus.SetLevel(logrus.ErrorLevel)
+	defer func() { compatibilityOnce = sync.Once{} }()
+
+	item := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachine",
+		"metadata": map[string]interface{}{
+			"name":        "test-vm",
+			"namespace":   "test-namespace",
+			"annotations": map[string]interface{}{"test": "kept"},
+		},
+	}}
+	RecordClusterVersions(item, logrus.StandardLogger())
+	assert.Equal(t, map[string]string{
+		"test":                    "kept",
+		KubeVirtVersionAnnotation: "v1.5.0",
+		CDIVersionAnnotation:      "v1.61.0",
+	}, item.GetAnnotations())
+}
@@ -0,0 +1,190 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+package util
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+// GetDeviceMapping returns the device name mapping of the restore, from the device names of the source cluster to
+// the ones of the target cluster. The Restore annotation wins over the config.
+func GetDeviceMapping(restore *velerov1.Restore, config *PluginConfig, namespace string) (map[string]string, error) {
+	value, ok := restore.Annotations[DeviceMappingAnnotation]
+	if !ok {
+		value, ok = config.Get(namespace, settingName(DeviceMappingAnnotation))
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	mapping, err := parseDeviceMapping(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation", DeviceMappingAnnotation)
+	}
+	return mapping, nil
+}
+
+// parseDeviceMapping parses a comma separated list of old=new device names
+func parseDeviceMapping(value string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		oldName, newName, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, errors.Errorf("%q is not an old=new pair", pair)
+		}
+		oldName, newName = strings.TrimSpace(oldName), strings.TrimSpace(newName)
+		for _, name := range []string{oldName, newName} {
+			if errs := validation.IsQualifiedName(name); len(errs) > 0 {
+				return nil, errors.Errorf("invalid device name %q: %s", name, strings.Join(errs, ", "))
+			}
+		}
+		mapping[oldName] = newName
+	}
+	return mapping, nil
+}
+
+// RewriteHostDevices applies the host device policy to the host devices, GPUs and SR-IOV interfaces of the VMI spec.
+// The remove policy drops them, SR-IOV interfaces together with their networks. The remap policy rewrites the device
+// names found in the mapping, keeping the other devices, and replaces the SR-IOV binding of the interfaces with
+// sriovBinding. SR-IOV interfaces whose network is in mappedNetworks stay on the network of the target cluster picked
+// by the network mapping. As masquerade is only supported on the pod network, they use the bridge binding there. The
+// other SR-IOV interfaces would keep the SR-IOV network of the source cluster: with masquerade they move to the pod
+// network when the VMI has none, otherwise they are removed together with their networks.
+// Every change is logged as a warning and returned, the restored VM no longer matches the backed up one.
+func RewriteHostDevices(vmiSpec *kvv1.VirtualMachineInstanceSpec, policy HostDevicePolicy, mapping map[string]string, sriovBinding SRIOVBinding, mappedNetworks []string, log logrus.FieldLogger) []string {
+	var changes []string
+	change := func(messageFmt string, args ...interface{}) {
+		message := fmt.Sprintf(messageFmt, args...)
+		log.Warn(message)
+		changes = append(changes, message)
+	}
+
+	devices := &vmiSpec.Domain.Devices
+	switch policy {
+	case HostDevicePolicyRemove:
+		for _, hostDevice := range devices.HostDevices {
+			change("Removed host device %s (%s)", hostDevice.Name, hostDevice.DeviceName)
+		}
+		devices.HostDevices = nil
+		for _, gpu := range devices.GPUs {
+			change("Removed GPU %s (%s)", gpu.Name, gpu.DeviceName)
+		}
+		devices.GPUs = nil
+		for _, iface := range getSRIOVInterfaces(devices.Interfaces) {
+			change("Removed SR-IOV interface %s and its network", iface)
+			devices.Interfaces = removeInterface(devices.Interfaces, iface)
+			vmiSpec.Networks = removeNetwork(vmiSpec.Networks, iface)
+		}
+	case HostDevicePolicyRemap:
+		for i, hostDevice := range devices.HostDevices {
+			if deviceName, ok := mapping[hostDevice.DeviceName]; ok {
+				change("Remapped host device %s from %s to %s", hostDevice.Name, hostDevice.DeviceName, deviceName)
+				devices.HostDevices[i].DeviceName = deviceName
+			}
+		}
+		for i, gpu := range devices.GPUs {
+			if deviceName, ok := mapping[gpu.DeviceName]; ok {
+				change("Remapped GPU %s from %s to %s", gpu.Name, gpu.DeviceName, deviceName)
+				devices.GPUs[i].DeviceName = deviceName
+			}
+		}
+		for _, iface := range getSRIOVInterfaces(devices.Interfaces) {
+			switch {
+			case slices.Contains(mappedNetworks, iface) && sriovBinding == SRIOVBindingMasquerade:
+				setBridgeBinding(devices.Interfaces, iface)
+				change("Switched SR-IOV interface %s to the bridge binding instead of masquerade on the mapped network %s", iface, getMultusNetworkName(vmiSpec.Networks, iface))
+			case slices.Contains(mappedNetworks, iface):
+				setBridgeBinding(devices.Interfaces, iface)
+				change("Switched SR-IOV interface %s to the bridge binding on the mapped network %s", iface, getMultusNetworkName(vmiSpec.Networks, iface))
+			case sriovBinding == SRIOVBindingMasquerade && !hasPodNetwork(vmiSpec.Networks):
+				for i := range vmiSpec.Networks {
+					if vmiSpec.Networks[i].Name == iface {
+						vmiSpec.Networks[i].NetworkSource = kvv1.NetworkSource{Pod: &kvv1.PodNetwork{}}
+					}
+				}
+				setPodNetworkBinding(devices.Interfaces, iface)
+				change("Switched SR-IOV interface %s of an unmapped network to the masquerade binding on the pod network", iface)
+			default:
+				devices.Interfaces = removeInterface(devices.Interfaces, iface)
+				vmiSpec.Networks = removeNetwork(vmiSpec.Networks, iface)
+				change("Removed SR-IOV interface %s and its unmapped network", iface)
+			}
+		}
+	}
+	return changes
+}
+
+func getSRIOVInterfaces(interfaces []kvv1.Interface) []string {
+	var names []string
+	for _, iface := range interfaces {
+		if iface.SRIOV != nil {
+			names = append(names, iface.Name)
+		}
+	}
+	return names
+}
+
+func setBridgeBinding(interfaces []kvv1.Interface, name string) {
+	for i := range interfaces {
+		if interfaces[i].Name == name {
+			interfaces[i].InterfaceBindingMethod = kvv1.InterfaceBindingMethod{Bridge: &kvv1.InterfaceBridge{}}
+		}
+	}
+}
+
+func hasPodNetwork(networks []kvv1.Network) bool {
+	for _, network := range networks {
+		if network.Pod != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// getMultusNetworkName returns the NetworkAttachmentDefinition of the network, empty when it is not a Multus network
+func getMultusNetworkName(networks []kvv1.Network, name string) string {
+	for _, network := range networks {
+		if network.Name == name && network.Multus != nil {
+			return network.Multus.NetworkName
+		}
+	}
+	return ""
+}
+
+func removeNetwork(networks []kvv1.Network, name string) []kvv1.Network {
+	kept := networks[:0]
+	for _, network := range networks {
+		if network.Name != name {
+			kept = append(kept, network)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,138 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+func TestGetHostDevicePolicy(t *testing.T) {
+	restore := &velerov1.Restore{}
+	assert.Equal(t, HostDevicePolicyKeep, GetHostDevicePolicy(restore, nil, "target"))
+	assert.Equal(t, SRIOVBindingBridge, GetSRIOVBinding(restore, nil, "target"))
+
+	restore.Labels = map[string]string{HostDevicePolicyLabel: "remove", SRIOVBindingLabel: "masquerade"}
+	assert.Equal(t, HostDevicePolicyRemove, GetHostDevicePolicy(restore, nil, "target"))
+	assert.Equal(t, SRIOVBindingMasquerade, GetSRIOVBinding(restore, nil, "target"))
+
+	config, err := NewPluginConfig(common.PluginKindRestoreItemAction, map[string]string{"host-device-policy": "remap"})
+	assert.NoError(t, err)
+	assert.Equal(t, HostDevicePolicyRemap, GetHostDevicePolicy(&velerov1.Restore{}, config, "target"))
+
+	_, err = NewPluginConfig(common.PluginKindRestoreItemAction, map[string]string{"host-device-policy": "unknown"})
+	assert.Error(t, err)
+	_, err = NewPluginConfig(common.PluginKindRestoreItemAction, map[string]string{"sriov-binding": "sriov"})
+	assert.Error(t, err)
+}
+
+func TestGetDeviceMapping(t *testing.T) {
+	restore := &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		DeviceMappingAnnotation: "nvidia.com/TU104GL_Tesla_T4=nvidia.com/GA102GL_A10, intel.com/qat=intel.com/qat_vf",
+	}}}
+	mapping, err := GetDeviceMapping(restore, nil, "target")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"nvidia.com/TU104GL_Tesla_T4": "nvidia.com/GA102GL_A10", "intel.com/qat": "intel.com/qat_vf"}, mapping)
+
+	config, err := NewPluginConfig(common.PluginKindRestoreItemAction, map[string]string{"device-mapping": "intel.com/qat=intel.com/qat_vf"})
+	assert.NoError(t, err)
+	mapping, err = GetDeviceMapping(&velerov1.Restore{}, config, "target")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"intel.com/qat": "intel.com/qat_vf"}, mapping)
+
+	for _, value := range []string{"intel.com/qat", "intel.com/qat=", "intel.com/qat=not a device"} {
+		restore.Annotations[DeviceMappingAnnotation] = value
+		_, err = GetDeviceMapping(restore, nil, "target")
+		assert.Error(t, err, value)
+	}
+}
+
+func TestRewriteHostDevices(t *testing.T) {
+	pod := kvv1.Network{Name: "default", NetworkSource: kvv1.NetworkSource{Pod: &kvv1.PodNetwork{}}}
+	sriovNetwork := kvv1.Network{Name: "fast", NetworkSource: kvv1.NetworkSource{Multus: &kvv1.MultusNetwork{NetworkName: "fast"}}}
+	mappedNetwork := kvv1.Network{Name: "fast", NetworkSource: kvv1.NetworkSource{Multus: &kvv1.MultusNetwork{NetworkName: "target-fast"}}}
+	sriov := kvv1.Interface{Name: "fast", InterfaceBindingMethod: kvv1.InterfaceBindingMethod{SRIOV: &kvv1.InterfaceSRIOV{}}}
+	bridge := kvv1.Interface{Name: "fast", InterfaceBindingMethod: kvv1.InterfaceBindingMethod{Bridge: &kvv1.InterfaceBridge{}}}
+	masquerade := kvv1.Interface{Name: "default", InterfaceBindingMethod: kvv1.InterfaceBindingMethod{Masquerade: &kvv1.InterfaceMasquerade{}}}
+	hostDevice := kvv1.HostDevice{Name: "qat", DeviceName: "intel.com/qat"}
+	gpu := kvv1.GPU{Name: "gpu1", DeviceName: "nvidia.com/TU104GL_Tesla_T4"}
+	otherGPU := kvv1.GPU{Name: "gpu2", DeviceName: "nvidia.com/GV100GL_Tesla_V100"}
+	mapping := map[string]string{"intel.com/qat": "intel.com/qat_vf", "nvidia.com/TU104GL_Tesla_T4": "nvidia.com/GA102GL_A10"}
+
+	testCases := []struct {
+		name               string
+		policy             HostDevicePolicy
+		sriovBinding       SRIOVBinding
+		mappedNetworks     []string
+		networks           []kvv1.Network
+		interfaces         []kvv1.Interface
+		expectedNetworks   []kvv1.Network
+		expectedInterfaces []kvv1.Interface
+		expectedDevices    []kvv1.HostDevice
+		expectedGPUs       []kvv1.GPU
+		expectedChanges    int
+	}{
+		{"Devices are kept by default",
+			HostDevicePolicyKeep, SRIOVBindingBridge, nil,
+			[]kvv1.Network{sriovNetwork}, []kvv1.Interface{sriov},
+			[]kvv1.Network{sriovNetwork}, []kvv1.Interface{sriov},
+			[]kvv1.HostDevice{hostDevice}, []kvv1.GPU{gpu, otherGPU}, 0},
+		{"Devices and SR-IOV interfaces are removed",
+			HostDevicePolicyRemove, SRIOVBindingBridge, nil,
+			[]kvv1.Network{pod, sriovNetwork}, []kvv1.Interface{masquerade, sriov},
+			[]kvv1.Network{pod}, []kvv1.Interface{masquerade},
+			nil, nil, 4},
+		{"Devices are remapped and SR-IOV interfaces without a mapped network are removed",
+			HostDevicePolicyRemap, SRIOVBindingBridge, nil,
+			[]kvv1.Network{sriovNetwork}, []kvv1.Interface{sriov},
+			[]kvv1.Network{}, []kvv1.Interface{},
+			[]kvv1.HostDevice{{Name: "qat", DeviceName: "intel.com/qat_vf"}},
+			[]kvv1.GPU{{Name: "gpu1", DeviceName: "nvidia.com/GA102GL_A10"}, otherGPU}, 3},
+		{"SR-IOV interfaces move to the pod network with masquerade",
+			HostDevicePolicyRemap, SRIOVBindingMasquerade, nil,
+			[]kvv1.Network{sriovNetwork}, []kvv1.Interface{sriov},
+			[]kvv1.Network{{Name: "fast", NetworkSource: kvv1.NetworkSource{Pod: &kvv1.PodNetwork{}}}},
+			[]kvv1.Interface{{Name: "fast", InterfaceBindingMethod: kvv1.InterfaceBindingMethod{Masquerade: &kvv1.InterfaceMasquerade{}}}},
+			[]kvv1.HostDevice{{Name: "qat", DeviceName: "intel.com/qat_vf"}},
+			[]kvv1.GPU{{Name: "gpu1", DeviceName: "nvidia.com/GA102GL_A10"}, otherGPU}, 3},
+		{"SR-IOV interfaces without a mapped network are removed when the pod network is taken",
+			HostDevicePolicyRemap, SRIOVBindingMasquerade, nil,
+			[]kvv1.Network{pod, sriovNetwork}, []kvv1.Interface{masquerade, sriov},
+			[]kvv1.Network{pod}, []kvv1.Interface{masquerade},
+			[]kvv1.HostDevice{{Name: "qat", DeviceName: "intel.com/qat_vf"}},
+			[]kvv1.GPU{{Name: "gpu1", DeviceName: "nvidia.com/GA102GL_A10"}, otherGPU}, 3},
+		{"SR-IOV interfaces of mapped networks are bridged on the mapped network",
+			HostDevicePolicyRemap, SRIOVBindingBridge, []string{"fast"},
+			[]kvv1.Network{mappedNetwork}, []kvv1.Interface{sriov},
+			[]kvv1.Network{mappedNetwork}, []kvv1.Interface{bridge},
+			[]kvv1.HostDevice{{Name: "qat", DeviceName: "intel.com/qat_vf"}},
+			[]kvv1.GPU{{Name: "gpu1", DeviceName: "nvidia.com/GA102GL_A10"}, otherGPU}, 3},
+		{"SR-IOV interfaces of mapped networks fall back to bridge with masquerade",
+			HostDevicePolicyRemap, SRIOVBindingMasquerade, []string{"fast"},
+			[]kvv1.Network{mappedNetwork}, []kvv1.Interface{sriov},
+			[]kvv1.Network{mappedNetwork}, []kvv1.Interface{bridge},
+			[]kvv1.HostDevice{{Name: "qat", DeviceName: "intel.com/qat_vf"}},
+			[]kvv1.GPU{{Name: "gpu1", DeviceName: "nvidia.com/GA102GL_A10"}, otherGPU}, 3},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := &kvv1.VirtualMachineInstanceSpec{Networks: append([]kvv1.Network{}, tc.networks...)}
+			spec.Domain.Devices.Interfaces = append([]kvv1.Interface{}, tc.interfaces...)
+			spec.Domain.Devices.HostDevices = []kvv1.HostDevice{hostDevice}
+			spec.Domain.Devices.GPUs = []kvv1.GPU{gpu, otherGPU}
+
+			changes := RewriteHostDevices(spec, tc.policy, mapping, tc.sriovBinding, tc.mappedNetworks, logrus.StandardLogger())
+			assert.Len(t, changes, tc.expectedChanges)
+			assert.Equal(t, tc.expectedNetworks, spec.Networks)
+			assert.Equal(t, tc.expectedInterfaces, spec.Domain.Devices.Interfaces)
+			assert.Equal(t, tc.expectedDevices, spec.Domain.Devices.HostDevices)
+			assert.Equal(t, tc.expectedGPUs, spec.Domain.Devices.GPUs)
+		})
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	k8score "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+// EventSource is the component recording the plugin events
+const EventSource = "kubevirt-velero-plugin"
+
+// Reasons of the events recorded on the objects the plugin makes a decision about
+const (
+	// EventGuestFrozen means the guest file systems of a VMI were frozen for the backup
+	EventGuestFrozen = "GuestFrozen"
+	// EventGuestPaused means a VMI without a connected guest agent was paused for the backup
+	EventGuestPaused = "GuestPaused"
+	// EventCrashConsistent means a running VMI is backed up without quiescing its guest
+	EventCrashConsistent = "CrashConsistentBackup"
+	// EventOwnedVMISkipped means a VMI is not backed up because its owner is not part of the backup
+	EventOwnedVMISkipped = "OwnedVMISkipped"
+	// EventBackupRefused means a VM or VMI failed a safety check and failed the backup
+	EventBackupRefused = "BackupRefused"
+	// EventUnsafeSkipped means a VM or VMI failed a safety check and was left out of the backup
+	EventUnsafeSkipped = "UnsafeSkipped"
+	// EventDataVolumeInProgress means the PVC of an unfinished DataVolume is backed up but will not be restored
+	EventDataVolumeInProgress = "DataVolumeInProgress"
+	// EventMacAddressCleared means the MAC addresses of a restored VM or VMI were cleared
+	EventMacAddressCleared = "MacAddressCleared"
+	// EventFirmwareUUIDGenerated means a restored VM or VMI was given a new firmware UUID
+	EventFirmwareUUIDGenerated = "FirmwareUUIDGenerated"
+	// EventHostDevicesRewritten means a host device, GPU or SR-IOV interface of a restored VM was removed or remapped
+	EventHostDevicesRewritten = "HostDevicesRewritten"
+)
+
+// Kinds of the objects events are recorded on, besides the KubeVirt ones
+var (
+	DataVolumeGroupVersionKind            = cdiv1.SchemeGroupVersion.WithKind("DataVolume")
+	PersistentVolumeClaimGroupVersionKind = k8score.SchemeGroupVersion.WithKind("PersistentVolumeClaim")
+)
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var CreateEvent = func(event *k8score.Event) error {
+	client, err := GetK8sClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CoreV1().Events(event.Namespace).Create(context.TODO(), event, metav1.CreateOptions{})
+	return err
+}
+
+// RecordEvent records an event about a backup or restore decision on the object, so namespace owners
+// can see it. Events are informative only, failing to record one is logged and otherwise ignored.
+func RecordEvent(log logrus.FieldLogger, gvk schema.GroupVersionKind, obj metav1.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	now := metav1.Now()
+	event := &k8score.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", obj.GetName(), now.UnixNano()),
+			Namespace: obj.GetNamespace(),
+		},
+		InvolvedObject: k8score.ObjectReference{
+			APIVersion: gvk.GroupVersion().String(),
+			Kind:       gvk.Kind,
+			Namespace:  obj.GetNamespace(),
+			Name:       obj.GetName(),
+			UID:        obj.GetUID(),
+		},
+		Reason:         reason,
+		Message:        fmt.Sprintf(messageFmt, args...),
+		Type:           eventType,
+		Source:         k8score.EventSource{Component: EventSource},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if err := CreateEvent(event); err != nil {
+		log.Infof("Failed to record %s event on %s %s/%s: %v", reason, gvk.Kind, obj.GetNamespace(), obj.GetName(), err)
+	}
+}
+
+// restoreEvent is an event noted on a restored object by AddRestoreEvent
+type restoreEvent struct {
+	Type    string `json:"type"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// AddRestoreEvent notes an event about a restore decision on an object being restored, in its RestoreEventsAnnotation.
+// Its UID is not known before it is created and the one in the backup is the UID of the backed up object, so the
+// event is recorded by RecordRestoreEvents once the object exists.
+func AddRestoreEvent(obj metav1.Object, eventType, reason, messageFmt string, args ...interface{}) error {
+	events := []restoreEvent{}
+	if value, ok := obj.GetAnnotations()[RestoreEventsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &events); err != nil {
+			return err
+		}
+	}
+	events = append(events, restoreEvent{Type: eventType, Reason: reason, Message: fmt.Sprintf(messageFmt, args...)})
+
+	value, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[RestoreEventsAnnotation] = string(value)
+	obj.SetAnnotations(annotations)
+	return nil
+}
+
+// RecordRestoreEvents records the events noted by AddRestoreEvent on a restored object, which must carry its live UID
+func RecordRestoreEvents(log logrus.FieldLogger, gvk schema.GroupVersionKind, obj metav1.Object) {
+	value, ok := obj.GetAnnotations()[RestoreEventsAnnotation]
+	if !ok {
+		return
+	}
+
+	events := []restoreEvent{}
+	if err := json.Unmarshal([]byte(value), &events); err != nil {
+		log.Infof("Failed to read the restore events of %s %s/%s: %v", gvk.Kind, obj.GetNamespace(), obj.GetName(), err)
+		return
+	}
+	for _, event := range events {
+		RecordEvent(log, gvk, obj, event.Type, event.Reason, "%s", event.Message)
+	}
+}
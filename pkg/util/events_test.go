@@ -0,0 +1,79 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	k8score "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kvcore "kubevirt.io/api/core/v1"
+)
+
+func TestRecordEvent(t *testing.T) {
+	vm := &kvcore.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "test-namespace", Name: "test-vm", UID: "test-uid"}}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+
+	t.Run("Event refers to the object", func(t *testing.T) {
+		var recorded *k8score.Event
+		CreateEvent = func(event *k8score.Event) error {
+			recorded = event
+			return nil
+		}
+
+		RecordEvent(logrus.StandardLogger(), kvcore.VirtualMachineGroupVersionKind, vm, k8score.EventTypeWarning, EventBackupRefused, "Backup %s failed", "test-backup")
+		if assert.NotNil(t, recorded) {
+			assert.Equal(t, "test-namespace", recorded.Namespace)
+			assert.Contains(t, recorded.Name, "test-vm.")
+			assert.Equal(t, k8score.ObjectReference{
+				APIVersion: "kubevirt.io/v1",
+				Kind:       "VirtualMachine",
+				Namespace:  "test-namespace",
+				Name:       "test-vm",
+				UID:        "test-uid",
+			}, recorded.InvolvedObject)
+			assert.Equal(t, k8score.EventTypeWarning, recorded.Type)
+			assert.Equal(t, EventBackupRefused, recorded.Reason)
+			assert.Equal(t, "Backup test-backup failed", recorded.Message)
+			assert.Equal(t, EventSource, recorded.Source.Component)
+			assert.Equal(t, int32(1), recorded.Count)
+		}
+	})
+
+	t.Run("Restore events are recorded once the restored object exists", func(t *testing.T) {
+		recorded := []*k8score.Event{}
+		CreateEvent = func(event *k8score.Event) error {
+			recorded = append(recorded, event)
+			return nil
+		}
+
+		restored := vm.DeepCopy()
+		restored.UID = "test-backed-up-uid"
+		assert.NoError(t, AddRestoreEvent(restored, k8score.EventTypeNormal, EventMacAddressCleared, "MAC addresses cleared by restore %s", "test-restore"))
+		assert.NoError(t, AddRestoreEvent(restored, k8score.EventTypeNormal, EventFirmwareUUIDGenerated, "New firmware UUID generated by restore %s", "test-restore"))
+		assert.Empty(t, recorded)
+
+		restored.UID = "test-restored-uid"
+		RecordRestoreEvents(logrus.StandardLogger(), kvcore.VirtualMachineGroupVersionKind, restored)
+		if assert.Len(t, recorded, 2) {
+			assert.Equal(t, EventMacAddressCleared, recorded[0].Reason)
+			assert.Equal(t, "MAC addresses cleared by restore test-restore", recorded[0].Message)
+			assert.Equal(t, EventFirmwareUUIDGenerated, recorded[1].Reason)
+			for _, event := range recorded {
+				assert.Equal(t, types.UID("test-restored-uid"), event.InvolvedObject.UID)
+				assert.Equal(t, k8score.EventTypeNormal, event.Type)
+			}
+		}
+	})
+
+	t.Run("Failing to record an event is ignored", func(t *testing.T) {
+		CreateEvent = func(event *k8score.Event) error { return fmt.Errorf("forbidden") }
+
+		assert.NotPanics(t, func() {
+			RecordEvent(logrus.StandardLogger(), DataVolumeGroupVersionKind, vm, k8score.EventTypeNormal, EventDataVolumeInProgress, "in progress")
+		})
+	})
+}
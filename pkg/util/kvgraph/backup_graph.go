@@ -21,16 +21,21 @@ package kvgraph
 
 import (
 	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	k8serrors "k8s.io/apimachinery/pkg/util/errors"
 	v1 "kubevirt.io/api/core/v1"
+	poolv1 "kubevirt.io/api/pool/v1beta1"
 	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
 )
 
-// NewObjectBackupGraph returns the backup object graph for the passed item
-func NewObjectBackupGraph(item runtime.Unstructured) ([]velero.ResourceIdentifier, error) {
+// NewObjectBackupGraph returns the backup object graph for the passed item. The launcher pod lookups
+// are cached per backup.
+func NewObjectBackupGraph(item runtime.Unstructured, backup *velerov1.Backup) ([]velero.ResourceIdentifier, error) {
 	kind := item.GetObjectKind().GroupVersionKind().Kind
 
 	switch kind {
@@ -39,19 +44,31 @@ func NewObjectBackupGraph(item runtime.Unstructured) ([]velero.ResourceIdentifie
 		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), vm); err != nil {
 			return []velero.ResourceIdentifier{}, errors.WithStack(err)
 		}
-		return NewVirtualMachineBackupGraph(vm)
+		return NewVirtualMachineBackupGraph(vm, backup)
 	case "VirtualMachineInstance":
 		vmi := new(v1.VirtualMachineInstance)
 		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), vmi); err != nil {
 			return []velero.ResourceIdentifier{}, errors.WithStack(err)
 		}
-		return NewVirtualMachineInstanceBackupGraph(vmi)
+		return NewVirtualMachineInstanceBackupGraph(vmi, backup)
 	case "DataVolume":
 		dv := new(cdiv1.DataVolume)
 		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), dv); err != nil {
 			return []velero.ResourceIdentifier{}, errors.WithStack(err)
 		}
-		return NewDataVolumeBackupGraph(dv), nil
+		return NewDataVolumeBackupGraph(dv, backup)
+	case "VirtualMachinePool":
+		pool := new(poolv1.VirtualMachinePool)
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), pool); err != nil {
+			return []velero.ResourceIdentifier{}, errors.WithStack(err)
+		}
+		return NewVirtualMachinePoolBackupGraph(pool, backup)
+	case "VirtualMachineInstanceReplicaSet":
+		replicaSet := new(v1.VirtualMachineInstanceReplicaSet)
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), replicaSet); err != nil {
+			return []velero.ResourceIdentifier{}, errors.WithStack(err)
+		}
+		return NewVirtualMachineInstanceReplicaSetBackupGraph(replicaSet)
 	default:
 		// No specific backup graph for the passed object
 		return []velero.ResourceIdentifier{}, nil
@@ -59,7 +76,7 @@ func NewObjectBackupGraph(item runtime.Unstructured) ([]velero.ResourceIdentifie
 }
 
 // NewVirtualMachineBackupGraph returns the backup object graph for a specific VM
-func NewVirtualMachineBackupGraph(vm *v1.VirtualMachine) ([]velero.ResourceIdentifier, error) {
+func NewVirtualMachineBackupGraph(vm *v1.VirtualMachine, backup *velerov1.Backup) ([]velero.ResourceIdentifier, error) {
 	var resources []velero.ResourceIdentifier
 	var err error
 	namespace := vm.GetNamespace()
@@ -71,7 +88,7 @@ func NewVirtualMachineBackupGraph(vm *v1.VirtualMachine) ([]velero.ResourceIdent
 		resources = addVeleroResource(vm.GetName(), namespace, "virtualmachineinstances", resources)
 		// Returning full backup even if there was an error retrieving the launcher pod.
 		// The caller can decide whether to use the backup without launcher pod or handle the error.
-		resources, err = addLauncherPod(vm.GetName(), vm.GetNamespace(), resources)
+		resources, err = addLauncherPod(vm.GetName(), vm.GetNamespace(), backup, resources)
 		if err != nil {
 			errs = append(errs, err)
 		}
@@ -81,6 +98,24 @@ func NewVirtualMachineBackupGraph(vm *v1.VirtualMachine) ([]velero.ResourceIdent
 	if err != nil {
 		errs = append(errs, err)
 	}
+	resources = addHotplugVolumes(util.GetHotplugVolumes(vm, nil), namespace, resources)
+
+	for _, template := range vm.Spec.DataVolumeTemplates {
+		// A DataVolume restored with its PVC is pre-populated, it only needs its source to populate again.
+		// The backup graph of an existing DataVolume adds the source while it has not succeeded.
+		pvcInBackup, err := util.IsPVCInBackup(backup, namespace, template.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if pvcInBackup {
+			continue
+		}
+		resources, err = addDataVolumeSourceGraph(template.Spec, namespace, resources)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
 	if len(errs) > 0 {
 		return resources, k8serrors.NewAggregate(errs)
 	}
@@ -88,17 +123,27 @@ func NewVirtualMachineBackupGraph(vm *v1.VirtualMachine) ([]velero.ResourceIdent
 	return resources, nil
 }
 
+// NewVirtualMachineClusterInstancetypeGraph returns the cluster scoped instancetype and preference referenced by a specific VM
+func NewVirtualMachineClusterInstancetypeGraph(vm *v1.VirtualMachine) []velero.ResourceIdentifier {
+	resources := []velero.ResourceIdentifier{}
+	resources = addClusterInstanceType(vm, resources)
+	resources = addClusterPreference(vm, resources)
+	return resources
+}
+
 // NewVirtualMachineInstanceBackupGraph returns the backup object graph for a specific VMI
-func NewVirtualMachineInstanceBackupGraph(vmi *v1.VirtualMachineInstance) ([]velero.ResourceIdentifier, error) {
+func NewVirtualMachineInstanceBackupGraph(vmi *v1.VirtualMachineInstance, backup *velerov1.Backup) ([]velero.ResourceIdentifier, error) {
 	var resources []velero.ResourceIdentifier
 	var errs []error
 	// Returning full backup even if there was an error retrieving the launcher pod.
 	// The caller can decide wether to use the backup without launcher pod or handle the error.
-	resources, err := addLauncherPod(vmi.GetName(), vmi.GetNamespace(), resources)
+	resources, err := addLauncherPod(vmi.GetName(), vmi.GetNamespace(), backup, resources)
 	if err != nil {
 		errs = append(errs, err)
 	}
 
+	resources = addHotplugAttachmentPods(vmi.Status.VolumeStatus, vmi.GetNamespace(), resources)
+
 	resources, err = addCommonVMIObjectGraph(vmi.Spec, vmi.GetName(), vmi.GetNamespace(), resources)
 	if err != nil {
 		errs = append(errs, err)
@@ -110,11 +155,58 @@ func NewVirtualMachineInstanceBackupGraph(vmi *v1.VirtualMachineInstance) ([]vel
 	return resources, nil
 }
 
-// NewDataVolumeBackupGraph returns the backup object graph for a specific DataVolume
-func NewDataVolumeBackupGraph(dv *cdiv1.DataVolume) []velero.ResourceIdentifier {
+// NewDataVolumeBackupGraph returns the backup object graph for a specific DataVolume. The objects it is populated
+// from are only added when it populates again on restore, as it has not succeeded or its PVC is not backed up.
+func NewDataVolumeBackupGraph(dv *cdiv1.DataVolume, backup *velerov1.Backup) ([]velero.ResourceIdentifier, error) {
 	resources := []velero.ResourceIdentifier{}
 	if dv.Status.Phase == cdiv1.Succeeded {
 		resources = addVeleroResource(dv.Name, dv.Namespace, "persistentvolumeclaims", resources)
+		pvcInBackup, err := util.IsPVCInBackup(backup, dv.Namespace, dv.Name)
+		if err != nil || pvcInBackup {
+			return resources, err
+		}
 	}
-	return resources
+	return addDataVolumeSourceGraph(dv.Spec, dv.Namespace, resources)
+}
+
+// NewVirtualMachinePoolBackupGraph returns the backup object graph for a specific VirtualMachinePool
+func NewVirtualMachinePoolBackupGraph(pool *poolv1.VirtualMachinePool, backup *velerov1.Backup) ([]velero.ResourceIdentifier, error) {
+	resources := []velero.ResourceIdentifier{}
+	selector, err := metav1.LabelSelectorAsSelector(pool.Spec.Selector)
+	if err != nil {
+		return resources, errors.WithStack(err)
+	}
+
+	vms, err := util.ListVMs(selector.String(), pool.GetNamespace())
+	if err != nil {
+		return resources, err
+	}
+
+	var errs []error
+	for i := range vms.Items {
+		vm := &vms.Items[i]
+		if owner, ok := util.GetPoolOwner(vm); !ok || owner != pool.GetName() {
+			continue
+		}
+		resources = addVeleroResource(vm.GetName(), vm.GetNamespace(), "virtualmachines", resources)
+		// Returning full backup even if there was an error in the graph of a single VM.
+		vmResources, err := NewVirtualMachineBackupGraph(vm, backup)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		resources = append(resources, vmResources...)
+	}
+	if len(errs) > 0 {
+		return resources, k8serrors.NewAggregate(errs)
+	}
+
+	return resources, nil
+}
+
+// NewVirtualMachineInstanceReplicaSetBackupGraph returns the backup object graph for a specific VMI replica set
+func NewVirtualMachineInstanceReplicaSetBackupGraph(replicaSet *v1.VirtualMachineInstanceReplicaSet) ([]velero.ResourceIdentifier, error) {
+	if replicaSet.Spec.Template == nil {
+		return []velero.ResourceIdentifier{}, nil
+	}
+	return addCommonVMIObjectGraph(replicaSet.Spec.Template.Spec, "", replicaSet.GetNamespace(), []velero.ResourceIdentifier{})
 }
@@ -5,13 +5,16 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/kuberesource"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
 	kvcore "kubevirt.io/api/core/v1"
 	"kubevirt.io/client-go/kubecli"
 	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
@@ -64,7 +67,7 @@ func TestNewObjectBackupGraph(t *testing.T) {
 				},
 			},
 			expectedResult: func(obj interface{}) ([]velero.ResourceIdentifier, error) {
-				return NewVirtualMachineBackupGraph(obj.(*kvcore.VirtualMachine))
+				return NewVirtualMachineBackupGraph(obj.(*kvcore.VirtualMachine), &velerov1.Backup{})
 			},
 		},
 		{
@@ -121,7 +124,7 @@ func TestNewObjectBackupGraph(t *testing.T) {
 				},
 			},
 			expectedResult: func(obj interface{}) ([]velero.ResourceIdentifier, error) {
-				return NewVirtualMachineInstanceBackupGraph(obj.(*kvcore.VirtualMachineInstance))
+				return NewVirtualMachineInstanceBackupGraph(obj.(*kvcore.VirtualMachineInstance), &velerov1.Backup{})
 			},
 		},
 		{
@@ -139,7 +142,7 @@ func TestNewObjectBackupGraph(t *testing.T) {
 				},
 			},
 			expectedResult: func(obj interface{}) ([]velero.ResourceIdentifier, error) {
-				return NewDataVolumeBackupGraph(obj.(*cdiv1.DataVolume)), nil
+				return NewDataVolumeBackupGraph(obj.(*cdiv1.DataVolume), &velerov1.Backup{})
 			},
 		},
 		{
@@ -165,6 +168,10 @@ func TestNewObjectBackupGraph(t *testing.T) {
 			util.ListPods = func(name, ns string) (*v1.PodList, error) {
 				return &v1.PodList{Items: []v1.Pod{}}, nil
 			}
+			util.ListLauncherPods = func(ns string) (*v1.PodList, error) {
+				return &v1.PodList{Items: []v1.Pod{}}, nil
+			}
+			util.IsPVCExcludedByLabel = func(namespace, claimName string) (bool, error) { return false, nil }
 
 			unstructuredObj, err := toUnstructured(tc.object)
 			assert.NoError(t, err)
@@ -172,7 +179,7 @@ func TestNewObjectBackupGraph(t *testing.T) {
 			expected, err := tc.expectedResult(tc.object)
 			assert.NoError(t, err)
 
-			actual, err := NewObjectBackupGraph(unstructuredObj)
+			actual, err := NewObjectBackupGraph(unstructuredObj, &velerov1.Backup{})
 			assert.NoError(t, err)
 			assert.Equal(t, expected, actual)
 		})
@@ -400,13 +407,58 @@ func TestNewVirtualMachineBackupGraph(t *testing.T) {
 					},
 				}}, nil
 			}
-			resources, err := NewVirtualMachineBackupGraph(&tc.vm)
+			resources, err := NewVirtualMachineBackupGraph(&tc.vm, &velerov1.Backup{})
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expected, resources)
 		})
 	}
 }
 
+func TestNewVirtualMachineBackupGraphDataVolumeTemplates(t *testing.T) {
+	vm := &kvcore.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test-namespace", Name: "test-vm"},
+		Spec: kvcore.VirtualMachineSpec{
+			DataVolumeTemplates: []kvcore.DataVolumeTemplateSpec{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "populated-disk"},
+					Spec: cdiv1.DataVolumeSpec{
+						SourceRef: &cdiv1.DataVolumeSourceRef{Kind: cdiv1.DataVolumeDataSource, Name: "golden-image"},
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "missing-disk"},
+					Spec: cdiv1.DataVolumeSpec{
+						Source: &cdiv1.DataVolumeSource{PVC: &cdiv1.DataVolumeSourcePVC{Name: "source-pvc"}},
+					},
+				},
+			},
+			Template: &kvcore.VirtualMachineInstanceTemplateSpec{},
+		},
+	}
+
+	util.IsPVCExcludedByLabel = func(namespace, claimName string) (bool, error) {
+		if claimName == "missing-disk" {
+			return false, k8serrors.NewNotFound(v1.Resource("persistentvolumeclaims"), claimName)
+		}
+		return false, nil
+	}
+	followed := []string{}
+	getDataSource := util.GetDataSource
+	defer func() { util.GetDataSource = getDataSource }()
+	util.GetDataSource = func(ns, name string) (*cdiv1.DataSource, error) {
+		followed = append(followed, name)
+		return &cdiv1.DataSource{}, nil
+	}
+
+	// Only the DataVolume without a backed up PVC populates again on restore
+	resources, err := NewVirtualMachineBackupGraph(vm, &velerov1.Backup{})
+	assert.NoError(t, err)
+	assert.Empty(t, followed)
+	assert.Equal(t, []velero.ResourceIdentifier{
+		{GroupResource: kuberesource.PersistentVolumeClaims, Namespace: "test-namespace", Name: "source-pvc"},
+	}, resources)
+}
+
 func TestNewVirtualMachineInstanceBackupGraph(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -517,6 +569,153 @@ func TestNewVirtualMachineInstanceBackupGraph(t *testing.T) {
 				},
 			},
 		},
+		{"Should include hotplug attachment pods",
+			kvcore.VirtualMachineInstance{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test-namespace",
+				},
+				Spec: kvcore.VirtualMachineInstanceSpec{
+					Volumes: []kvcore.Volume{
+						{
+							Name: "hotplug",
+							VolumeSource: kvcore.VolumeSource{
+								PersistentVolumeClaim: &kvcore.PersistentVolumeClaimVolumeSource{
+									PersistentVolumeClaimVolumeSource: v1.PersistentVolumeClaimVolumeSource{
+										ClaimName: "test-hotplug-pvc",
+									},
+									Hotpluggable: true,
+								},
+							},
+						},
+					},
+				},
+				Status: kvcore.VirtualMachineInstanceStatus{
+					VolumeStatus: []kvcore.VolumeStatus{
+						{
+							Name: "hotplug",
+							HotplugVolume: &kvcore.HotplugVolumeStatus{
+								AttachPodName: "hp-volume-test",
+							},
+						},
+					},
+				},
+			},
+			[]velero.ResourceIdentifier{
+				{
+					GroupResource: kuberesource.Pods,
+					Namespace:     "test-namespace",
+					Name:          "hp-volume-test",
+				},
+				{
+					GroupResource: kuberesource.PersistentVolumeClaims,
+					Namespace:     "test-namespace",
+					Name:          "test-hotplug-pvc",
+				},
+			},
+		},
+		{"Should include Sysprep sources",
+			kvcore.VirtualMachineInstance{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test-namespace",
+				},
+				Spec: kvcore.VirtualMachineInstanceSpec{
+					Volumes: []kvcore.Volume{
+						{
+							VolumeSource: kvcore.VolumeSource{
+								Sysprep: &kvcore.SysprepSource{
+									ConfigMap: &v1.LocalObjectReference{
+										Name: "test-sysprep-cm",
+									},
+								},
+							},
+						},
+						{
+							VolumeSource: kvcore.VolumeSource{
+								Sysprep: &kvcore.SysprepSource{
+									Secret: &v1.LocalObjectReference{
+										Name: "test-sysprep-secret",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			[]velero.ResourceIdentifier{
+				{
+					GroupResource: schema.GroupResource{
+						Group:    "",
+						Resource: "configmaps",
+					},
+					Namespace: "test-namespace",
+					Name:      "test-sysprep-cm",
+				},
+				{
+					GroupResource: kuberesource.Secrets,
+					Namespace:     "test-namespace",
+					Name:          "test-sysprep-secret",
+				},
+			},
+		},
+		{"Should include same-namespace NetworkAttachmentDefinitions",
+			kvcore.VirtualMachineInstance{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test-namespace",
+				},
+				Spec: kvcore.VirtualMachineInstanceSpec{
+					Networks: []kvcore.Network{
+						{
+							Name: "default",
+							NetworkSource: kvcore.NetworkSource{
+								Pod: &kvcore.PodNetwork{},
+							},
+						},
+						{
+							Name: "secondary",
+							NetworkSource: kvcore.NetworkSource{
+								Multus: &kvcore.MultusNetwork{
+									NetworkName: "test-nad",
+								},
+							},
+						},
+						{
+							Name: "explicit-namespace",
+							NetworkSource: kvcore.NetworkSource{
+								Multus: &kvcore.MultusNetwork{
+									NetworkName: "test-namespace/test-nad-2",
+								},
+							},
+						},
+						{
+							Name: "other-namespace",
+							NetworkSource: kvcore.NetworkSource{
+								Multus: &kvcore.MultusNetwork{
+									NetworkName: "other-namespace/test-nad-3",
+								},
+							},
+						},
+					},
+				},
+			},
+			[]velero.ResourceIdentifier{
+				{
+					GroupResource: schema.GroupResource{
+						Group:    "k8s.cni.cncf.io",
+						Resource: "network-attachment-definitions",
+					},
+					Namespace: "test-namespace",
+					Name:      "test-nad",
+				},
+				{
+					GroupResource: schema.GroupResource{
+						Group:    "k8s.cni.cncf.io",
+						Resource: "network-attachment-definitions",
+					},
+					Namespace: "test-namespace",
+					Name:      "test-nad-2",
+				},
+			},
+		},
 		{"Should include all access credentials",
 			kvcore.VirtualMachineInstance{
 				ObjectMeta: metav1.ObjectMeta{
@@ -562,7 +761,7 @@ func TestNewVirtualMachineInstanceBackupGraph(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			output, err := NewVirtualMachineInstanceBackupGraph(&tc.vmi)
+			output, err := NewVirtualMachineInstanceBackupGraph(&tc.vmi, &velerov1.Backup{})
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expected, output)
 		})
@@ -654,8 +853,11 @@ func TestAddLauncherPod(t *testing.T) {
 			util.ListPods = func(name, ns string) (*v1.PodList, error) {
 				return &v1.PodList{Items: tc.pods}, nil
 			}
+			util.ListLauncherPods = func(ns string) (*v1.PodList, error) {
+				return &v1.PodList{Items: tc.pods}, nil
+			}
 			vmi := &tc.vmi
-			output, err := addLauncherPod(vmi.GetName(), vmi.GetNamespace(), []velero.ResourceIdentifier{})
+			output, err := addLauncherPod(vmi.GetName(), vmi.GetNamespace(), &velerov1.Backup{}, []velero.ResourceIdentifier{})
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expected, output)
 		})
@@ -663,9 +865,22 @@ func TestAddLauncherPod(t *testing.T) {
 }
 
 func TestNewDataVolumeBackupGraph(t *testing.T) {
+	goldenImageSource := cdiv1.DataVolumeSpec{
+		SourceRef: &cdiv1.DataVolumeSourceRef{
+			Kind: cdiv1.DataVolumeDataSource,
+			Name: "test-datasource",
+		},
+	}
+	dvPVC := velero.ResourceIdentifier{
+		GroupResource: kuberesource.PersistentVolumeClaims,
+		Namespace:     "default",
+		Name:          "test-dv",
+	}
+
 	tests := []struct {
 		name           string
 		dataVolume     *cdiv1.DataVolume
+		pvcExcluded    bool
 		expectedResult []velero.ResourceIdentifier
 	}{
 		{
@@ -703,12 +918,246 @@ func TestNewDataVolumeBackupGraph(t *testing.T) {
 			},
 			expectedResult: []velero.ResourceIdentifier{},
 		},
+		{
+			name: "DataVolume with same-namespace PVC and snapshot sources",
+			dataVolume: &cdiv1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-dv",
+					Namespace: "default",
+				},
+				Spec: cdiv1.DataVolumeSpec{
+					Source: &cdiv1.DataVolumeSource{
+						PVC: &cdiv1.DataVolumeSourcePVC{
+							Namespace: "default",
+							Name:      "source-pvc",
+						},
+						Snapshot: &cdiv1.DataVolumeSourceSnapshot{
+							Namespace: "other-namespace",
+							Name:      "source-snapshot",
+						},
+					},
+				},
+				Status: cdiv1.DataVolumeStatus{
+					Phase: cdiv1.CloneScheduled,
+				},
+			},
+			expectedResult: []velero.ResourceIdentifier{
+				{
+					GroupResource: kuberesource.PersistentVolumeClaims,
+					Namespace:     "default",
+					Name:          "source-pvc",
+				},
+			},
+		},
+		{
+			name: "DataVolume with DataSource sourceRef",
+			dataVolume: &cdiv1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-dv",
+					Namespace: "default",
+				},
+				Spec: cdiv1.DataVolumeSpec{
+					SourceRef: &cdiv1.DataVolumeSourceRef{
+						Kind: cdiv1.DataVolumeDataSource,
+						Name: "test-datasource",
+					},
+				},
+				Status: cdiv1.DataVolumeStatus{
+					Phase: cdiv1.Pending,
+				},
+			},
+			expectedResult: []velero.ResourceIdentifier{
+				{
+					GroupResource: schema.GroupResource{
+						Group:    "cdi.kubevirt.io",
+						Resource: "datasources",
+					},
+					Namespace: "default",
+					Name:      "test-datasource",
+				},
+				{
+					GroupResource: schema.GroupResource{
+						Group:    "snapshot.storage.k8s.io",
+						Resource: "volumesnapshots",
+					},
+					Namespace: "default",
+					Name:      "golden-snapshot",
+				},
+			},
+		},
+		{
+			name: "Succeeded DataVolume restored with its PVC does not need its source",
+			dataVolume: &cdiv1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-dv",
+					Namespace: "default",
+				},
+				Spec: goldenImageSource,
+				Status: cdiv1.DataVolumeStatus{
+					Phase: cdiv1.Succeeded,
+				},
+			},
+			expectedResult: []velero.ResourceIdentifier{dvPVC},
+		},
+		{
+			name: "Succeeded DataVolume with an excluded PVC needs its source",
+			dataVolume: &cdiv1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-dv",
+					Namespace: "default",
+				},
+				Spec: goldenImageSource,
+				Status: cdiv1.DataVolumeStatus{
+					Phase: cdiv1.Succeeded,
+				},
+			},
+			pvcExcluded: true,
+			expectedResult: []velero.ResourceIdentifier{
+				dvPVC,
+				{
+					GroupResource: schema.GroupResource{Group: "cdi.kubevirt.io", Resource: "datasources"},
+					Namespace:     "default",
+					Name:          "test-datasource",
+				},
+				{
+					GroupResource: schema.GroupResource{Group: "snapshot.storage.k8s.io", Resource: "volumesnapshots"},
+					Namespace:     "default",
+					Name:          "golden-snapshot",
+				},
+			},
+		},
+		{
+			name: "DataVolume with cross-namespace DataSource sourceRef",
+			dataVolume: &cdiv1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-dv",
+					Namespace: "default",
+				},
+				Spec: cdiv1.DataVolumeSpec{
+					SourceRef: &cdiv1.DataVolumeSourceRef{
+						Kind:      cdiv1.DataVolumeDataSource,
+						Namespace: ptr.To("os-images"),
+						Name:      "test-datasource",
+					},
+				},
+			},
+			expectedResult: []velero.ResourceIdentifier{},
+		},
 	}
 
+	util.GetDataSource = func(ns, name string) (*cdiv1.DataSource, error) {
+		return &cdiv1.DataSource{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: ns,
+			},
+			Spec: cdiv1.DataSourceSpec{
+				Source: cdiv1.DataSourceSource{
+					Snapshot: &cdiv1.DataVolumeSourceSnapshot{
+						Namespace: ns,
+						Name:      "golden-snapshot",
+					},
+				},
+			},
+		}, nil
+	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := NewDataVolumeBackupGraph(tt.dataVolume)
+			util.IsPVCExcludedByLabel = func(namespace, claimName string) (bool, error) { return tt.pvcExcluded, nil }
+			result, err := NewDataVolumeBackupGraph(tt.dataVolume, &velerov1.Backup{})
+			assert.NoError(t, err)
 			assert.Equal(t, tt.expectedResult, result)
 		})
 	}
 }
+
+func TestNewVirtualMachineClusterInstancetypeGraph(t *testing.T) {
+	clusterInstancetype := velero.ResourceIdentifier{
+		GroupResource: schema.GroupResource{Group: "instancetype.kubevirt.io", Resource: "virtualmachineclusterinstancetypes"},
+		Name:          "test-instancetype",
+	}
+	clusterPreference := velero.ResourceIdentifier{
+		GroupResource: schema.GroupResource{Group: "instancetype.kubevirt.io", Resource: "virtualmachineclusterpreferences"},
+		Name:          "test-preference",
+	}
+
+	testCases := []struct {
+		name             string
+		instancetypeKind string
+		preferenceKind   string
+		expected         []velero.ResourceIdentifier
+	}{
+		{"Should include cluster instancetype and preference",
+			"VirtualMachineClusterInstancetype",
+			"virtualmachineclusterpreferences",
+			[]velero.ResourceIdentifier{clusterInstancetype, clusterPreference},
+		},
+		{"Should default to cluster kinds when kind is not set",
+			"",
+			"",
+			[]velero.ResourceIdentifier{clusterInstancetype, clusterPreference},
+		},
+		{"Should not include namespaced instancetype and preference",
+			"virtualmachineinstancetype",
+			"VirtualMachinePreference",
+			[]velero.ResourceIdentifier{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := &kvcore.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test-namespace",
+					Name:      "test-vm",
+				},
+				Spec: kvcore.VirtualMachineSpec{
+					Instancetype: &kvcore.InstancetypeMatcher{
+						Name: "test-instancetype",
+						Kind: tc.instancetypeKind,
+					},
+					Preference: &kvcore.PreferenceMatcher{
+						Name: "test-preference",
+						Kind: tc.preferenceKind,
+					},
+				},
+			}
+			resources := NewVirtualMachineClusterInstancetypeGraph(vm)
+			assert.Equal(t, tc.expected, resources)
+		})
+	}
+}
+
+func TestNewVirtualMachineInstanceReplicaSetBackupGraph(t *testing.T) {
+	persistent := true
+	replicaSet := &kvcore.VirtualMachineInstanceReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test-namespace", Name: "test-replicaset"},
+		Spec: kvcore.VirtualMachineInstanceReplicaSetSpec{
+			Template: &kvcore.VirtualMachineInstanceTemplateSpec{
+				Spec: kvcore.VirtualMachineInstanceSpec{
+					Domain: kvcore.DomainSpec{
+						Firmware: &kvcore.Firmware{
+							Bootloader: &kvcore.Bootloader{EFI: &kvcore.EFI{Persistent: &persistent}},
+						},
+					},
+					Volumes: []kvcore.Volume{
+						{Name: "config", VolumeSource: kvcore.VolumeSource{ConfigMap: &kvcore.ConfigMapVolumeSource{
+							LocalObjectReference: v1.LocalObjectReference{Name: "test-configmap"},
+						}}},
+					},
+				},
+			},
+		},
+	}
+	util.ListPVCs = func(labelSelector, namespace string) (*v1.PersistentVolumeClaimList, error) {
+		t.Fatalf("unexpected backend storage PVC lookup %s", labelSelector)
+		return nil, nil
+	}
+
+	// The template has no VM, so there is no backend storage PVC to look up
+	output, err := NewVirtualMachineInstanceReplicaSetBackupGraph(replicaSet)
+	assert.NoError(t, err)
+	assert.Equal(t, []velero.ResourceIdentifier{
+		{GroupResource: schema.GroupResource{Resource: "configmaps"}, Namespace: "test-namespace", Name: "test-configmap"},
+	}, output)
+}
@@ -20,11 +20,16 @@
 package kvgraph
 
 import (
+	"encoding/json"
+
 	"github.com/pkg/errors"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	v1 "kubevirt.io/api/core/v1"
+	poolv1 "kubevirt.io/api/pool/v1beta1"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
 )
 
 // NewObjectRestoreGraph returns the restore object graph for the passed item
@@ -44,6 +49,18 @@ func NewObjectRestoreGraph(item runtime.Unstructured) ([]velero.ResourceIdentifi
 			return []velero.ResourceIdentifier{}, errors.WithStack(err)
 		}
 		return NewVirtualMachineInstanceRestoreGraph(vmi)
+	case "VirtualMachinePool":
+		pool := new(poolv1.VirtualMachinePool)
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), pool); err != nil {
+			return []velero.ResourceIdentifier{}, errors.WithStack(err)
+		}
+		return NewVirtualMachinePoolRestoreGraph(pool)
+	case "VirtualMachineInstanceReplicaSet":
+		replicaSet := new(v1.VirtualMachineInstanceReplicaSet)
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), replicaSet); err != nil {
+			return []velero.ResourceIdentifier{}, errors.WithStack(err)
+		}
+		return NewVirtualMachineInstanceReplicaSetRestoreGraph(replicaSet)
 	default:
 		// No specific restore graph for the passed object
 		return []velero.ResourceIdentifier{}, nil
@@ -56,6 +73,9 @@ func NewVirtualMachineRestoreGraph(vm *v1.VirtualMachine) ([]velero.ResourceIden
 
 	resources = addInstanceType(vm, resources)
 	resources = addPreference(vm, resources)
+	for _, template := range vm.Spec.DataVolumeTemplates {
+		resources = addDataVolumeSource(template.Spec, vm.GetNamespace(), resources)
+	}
 	return addCommonVMIObjectGraph(vm.Spec.Template.Spec, vm.GetName(), vm.GetNamespace(), resources)
 }
 
@@ -63,3 +83,34 @@ func NewVirtualMachineRestoreGraph(vm *v1.VirtualMachine) ([]velero.ResourceIden
 func NewVirtualMachineInstanceRestoreGraph(vmi *v1.VirtualMachineInstance) ([]velero.ResourceIdentifier, error) {
 	return addCommonVMIObjectGraph(vmi.Spec, vmi.GetName(), vmi.GetNamespace(), []velero.ResourceIdentifier{})
 }
+
+// NewDataVolumeRestoreGraph returns the restore object graph for a specific pre-populated DataVolume
+func NewDataVolumeRestoreGraph(dv *cdiv1.DataVolume) []velero.ResourceIdentifier {
+	return addVeleroResource(dv.GetName(), dv.GetNamespace(), "persistentvolumeclaims", []velero.ResourceIdentifier{})
+}
+
+// NewVirtualMachinePoolRestoreGraph returns the restore object graph for a specific VirtualMachinePool
+func NewVirtualMachinePoolRestoreGraph(pool *poolv1.VirtualMachinePool) ([]velero.ResourceIdentifier, error) {
+	resources := []velero.ResourceIdentifier{}
+	value, ok := pool.GetAnnotations()[util.PoolVMsAnnotation]
+	if !ok {
+		return resources, nil
+	}
+
+	var vmNames []string
+	if err := json.Unmarshal([]byte(value), &vmNames); err != nil {
+		return resources, errors.WithStack(err)
+	}
+	for _, name := range vmNames {
+		resources = addVeleroResource(name, pool.GetNamespace(), "virtualmachines", resources)
+	}
+	return resources, nil
+}
+
+// NewVirtualMachineInstanceReplicaSetRestoreGraph returns the restore object graph for a specific VMI replica set
+func NewVirtualMachineInstanceReplicaSetRestoreGraph(replicaSet *v1.VirtualMachineInstanceReplicaSet) ([]velero.ResourceIdentifier, error) {
+	if replicaSet.Spec.Template == nil {
+		return []velero.ResourceIdentifier{}, nil
+	}
+	return addCommonVMIObjectGraph(replicaSet.Spec.Template.Spec, "", replicaSet.GetNamespace(), []velero.ResourceIdentifier{})
+}
@@ -438,3 +438,37 @@ func TestNewVirtualMachineInstanceRestoreGraph(t *testing.T) {
 		})
 	}
 }
+
+func TestNewVirtualMachineInstanceReplicaSetRestoreGraph(t *testing.T) {
+	persistent := true
+	replicaSet := &kvcore.VirtualMachineInstanceReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test-namespace", Name: "test-replicaset"},
+		Spec: kvcore.VirtualMachineInstanceReplicaSetSpec{
+			Template: &kvcore.VirtualMachineInstanceTemplateSpec{
+				Spec: kvcore.VirtualMachineInstanceSpec{
+					Domain: kvcore.DomainSpec{
+						Firmware: &kvcore.Firmware{
+							Bootloader: &kvcore.Bootloader{EFI: &kvcore.EFI{Persistent: &persistent}},
+						},
+					},
+					Volumes: []kvcore.Volume{
+						{Name: "config", VolumeSource: kvcore.VolumeSource{ConfigMap: &kvcore.ConfigMapVolumeSource{
+							LocalObjectReference: v1.LocalObjectReference{Name: "test-configmap"},
+						}}},
+					},
+				},
+			},
+		},
+	}
+	util.ListPVCs = func(labelSelector, namespace string) (*v1.PersistentVolumeClaimList, error) {
+		t.Fatalf("unexpected backend storage PVC lookup %s", labelSelector)
+		return nil, nil
+	}
+
+	// The template has no VM, so there is no backend storage PVC to look up
+	output, err := NewVirtualMachineInstanceReplicaSetRestoreGraph(replicaSet)
+	assert.NoError(t, err)
+	assert.Equal(t, []velero.ResourceIdentifier{
+		{GroupResource: schema.GroupResource{Resource: "configmaps"}, Namespace: "test-namespace", Name: "test-configmap"},
+	}, output)
+}
@@ -21,11 +21,17 @@ package kvgraph
 
 import (
 	"fmt"
+	"strings"
 
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/kuberesource"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	v1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/api/instancetype"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
 	"kubevirt.io/kubevirt-velero-plugin/pkg/util"
 )
 
@@ -35,14 +41,21 @@ const (
 
 // KVObjectGraph represents the graph of objects that can be potentially related to a KubeVirt resource
 var KVObjectGraph = map[string]schema.GroupResource{
-	"virtualmachineinstances": {Group: "kubevirt.io", Resource: "virtualmachineinstances"},
-	"datavolumes":             {Group: "cdi.kubevirt.io", Resource: "datavolumes"},
-	"controllerrevisions":     {Group: "apps", Resource: "controllerrevisions"},
-	"configmaps":              {Group: "", Resource: "configmaps"},
-	"persistentvolumeclaims":  kuberesource.PersistentVolumeClaims,
-	"serviceaccounts":         kuberesource.ServiceAccounts,
-	"secrets":                 kuberesource.Secrets,
-	"pods":                    kuberesource.Pods,
+	"virtualmachines":                    {Group: "kubevirt.io", Resource: "virtualmachines"},
+	"virtualmachineinstances":            {Group: "kubevirt.io", Resource: "virtualmachineinstances"},
+	"virtualmachineinstancereplicasets":  {Group: "kubevirt.io", Resource: "virtualmachineinstancereplicasets"},
+	"datavolumes":                        {Group: "cdi.kubevirt.io", Resource: "datavolumes"},
+	"controllerrevisions":                {Group: "apps", Resource: "controllerrevisions"},
+	"configmaps":                         {Group: "", Resource: "configmaps"},
+	"persistentvolumeclaims":             kuberesource.PersistentVolumeClaims,
+	"serviceaccounts":                    kuberesource.ServiceAccounts,
+	"secrets":                            kuberesource.Secrets,
+	"pods":                               kuberesource.Pods,
+	"datasources":                        {Group: "cdi.kubevirt.io", Resource: "datasources"},
+	"volumesnapshots":                    {Group: "snapshot.storage.k8s.io", Resource: "volumesnapshots"},
+	"network-attachment-definitions":     {Group: "k8s.cni.cncf.io", Resource: "network-attachment-definitions"},
+	"virtualmachineclusterinstancetypes": {Group: "instancetype.kubevirt.io", Resource: "virtualmachineclusterinstancetypes"},
+	"virtualmachineclusterpreferences":   {Group: "instancetype.kubevirt.io", Resource: "virtualmachineclusterpreferences"},
 }
 
 func addVeleroResource(name, namespace, resource string, resources []velero.ResourceIdentifier) []velero.ResourceIdentifier {
@@ -59,6 +72,7 @@ func addVeleroResource(name, namespace, resource string, resources []velero.Reso
 func addCommonVMIObjectGraph(spec v1.VirtualMachineInstanceSpec, vmName, namespace string, resources []velero.ResourceIdentifier) ([]velero.ResourceIdentifier, error) {
 	resources, err := addVolumeGraph(spec, vmName, namespace, resources)
 	resources = addAccessCredentials(spec.AccessCredentials, namespace, resources)
+	resources = addNetworkAttachmentDefinitions(spec.Networks, namespace, resources)
 	return resources, err
 }
 
@@ -92,17 +106,99 @@ func addVolumeGraph(vmiSpec v1.VirtualMachineInstanceSpec, vmName, namespace str
 			if volume.CloudInitConfigDrive.NetworkDataSecretRef != nil {
 				resources = addVeleroResource(volume.CloudInitConfigDrive.NetworkDataSecretRef.Name, namespace, "secrets", resources)
 			}
+		case volume.Sysprep != nil:
+			if volume.Sysprep.ConfigMap != nil {
+				resources = addVeleroResource(volume.Sysprep.ConfigMap.Name, namespace, "configmaps", resources)
+			}
+			if volume.Sysprep.Secret != nil {
+				resources = addVeleroResource(volume.Sysprep.Secret.Name, namespace, "secrets", resources)
+			}
 		}
 	}
 	// Returning full backup even if there was an error retrieving the backend PVC.
 	// The caller can decide wether to use the backup or handle the error.
+	// The backend PVC is named after the VM, VMI templates of replica sets have none.
 	var err error
-	if IsBackendStorageNeededForVMI(&vmiSpec) {
+	if vmName != "" && IsBackendStorageNeededForVMI(&vmiSpec) {
 		resources, err = addBackendPVC(vmName, namespace, resources)
 	}
 	return resources, err
 }
 
+// addDataVolumeSource adds the same-namespace objects a DataVolume is populated from
+func addDataVolumeSource(spec cdiv1.DataVolumeSpec, namespace string, resources []velero.ResourceIdentifier) []velero.ResourceIdentifier {
+	if spec.SourceRef != nil && spec.SourceRef.Kind == cdiv1.DataVolumeDataSource {
+		if spec.SourceRef.Namespace == nil || *spec.SourceRef.Namespace == namespace {
+			resources = addVeleroResource(spec.SourceRef.Name, namespace, "datasources", resources)
+		}
+	}
+	if spec.Source != nil {
+		resources = addDataSourceSource(spec.Source.PVC, spec.Source.Snapshot, namespace, resources)
+	}
+	return resources
+}
+
+// addDataVolumeSourceGraph adds the same-namespace objects a DataVolume is populated from,
+// following the DataSource referenced by the DataVolume to its source PVC or snapshot
+func addDataVolumeSourceGraph(spec cdiv1.DataVolumeSpec, namespace string, resources []velero.ResourceIdentifier) ([]velero.ResourceIdentifier, error) {
+	resources = addDataVolumeSource(spec, namespace, resources)
+	if spec.SourceRef == nil || spec.SourceRef.Kind != cdiv1.DataVolumeDataSource {
+		return resources, nil
+	}
+	if spec.SourceRef.Namespace != nil && *spec.SourceRef.Namespace != namespace {
+		return resources, nil
+	}
+
+	dataSource, err := util.GetDataSource(namespace, spec.SourceRef.Name)
+	if k8serrors.IsNotFound(err) {
+		// Nothing to follow, the DataVolume will wait for the DataSource after restore
+		return resources, nil
+	}
+	if err != nil {
+		return resources, err
+	}
+
+	source := dataSource.Spec.Source
+	if source.DataSource != nil {
+		// The DataSource points to another DataSource, rely on the resolved source
+		source = dataSource.Status.Source
+	}
+	return addDataSourceSource(source.PVC, source.Snapshot, namespace, resources), nil
+}
+
+func addDataSourceSource(pvc *cdiv1.DataVolumeSourcePVC, snapshot *cdiv1.DataVolumeSourceSnapshot, namespace string, resources []velero.ResourceIdentifier) []velero.ResourceIdentifier {
+	if pvc != nil && (pvc.Namespace == "" || pvc.Namespace == namespace) {
+		resources = addVeleroResource(pvc.Name, namespace, "persistentvolumeclaims", resources)
+	}
+	if snapshot != nil && (snapshot.Namespace == "" || snapshot.Namespace == namespace) {
+		resources = addVeleroResource(snapshot.Name, namespace, "volumesnapshots", resources)
+	}
+	return resources
+}
+
+func addHotplugVolumes(hotplugVolumes []v1.AddVolumeOptions, namespace string, resources []velero.ResourceIdentifier) []velero.ResourceIdentifier {
+	for _, options := range hotplugVolumes {
+		switch {
+		case options.VolumeSource.DataVolume != nil:
+			resources = addVeleroResource(options.VolumeSource.DataVolume.Name, namespace, "datavolumes", resources)
+			resources = addVeleroResource(options.VolumeSource.DataVolume.Name, namespace, "persistentvolumeclaims", resources)
+		case options.VolumeSource.PersistentVolumeClaim != nil:
+			resources = addVeleroResource(options.VolumeSource.PersistentVolumeClaim.ClaimName, namespace, "persistentvolumeclaims", resources)
+		}
+	}
+	return resources
+}
+
+// The hotplugged volumes are already part of the VMI spec, only the hotplug-disk pods attaching them are added
+func addHotplugAttachmentPods(volumeStatuses []v1.VolumeStatus, namespace string, resources []velero.ResourceIdentifier) []velero.ResourceIdentifier {
+	for _, volumeStatus := range volumeStatuses {
+		if volumeStatus.HotplugVolume != nil && volumeStatus.HotplugVolume.AttachPodName != "" {
+			resources = addVeleroResource(volumeStatus.HotplugVolume.AttachPodName, namespace, "pods", resources)
+		}
+	}
+	return resources
+}
+
 func addAccessCredentials(acs []v1.AccessCredential, namespace string, resources []velero.ResourceIdentifier) []velero.ResourceIdentifier {
 	for _, ac := range acs {
 		if ac.SSHPublicKey != nil && ac.SSHPublicKey.Source.Secret != nil {
@@ -114,8 +210,23 @@ func addAccessCredentials(acs []v1.AccessCredential, namespace string, resources
 	return resources
 }
 
-func addLauncherPod(vmiName, vmiNamespace string, resources []velero.ResourceIdentifier) ([]velero.ResourceIdentifier, error) {
-	pod, err := util.GetLauncherPod(vmiName, vmiNamespace)
+// Only NetworkAttachmentDefinitions in the VM namespace are part of the graph.
+// Cross-namespace references are reported as warnings by the restore actions.
+func addNetworkAttachmentDefinitions(networks []v1.Network, namespace string, resources []velero.ResourceIdentifier) []velero.ResourceIdentifier {
+	for _, network := range networks {
+		if network.Multus == nil {
+			continue
+		}
+		nadNamespace, nadName := util.GetNamespaceAndNetworkName(namespace, network.Multus.NetworkName)
+		if nadNamespace == namespace {
+			resources = addVeleroResource(nadName, namespace, "network-attachment-definitions", resources)
+		}
+	}
+	return resources
+}
+
+func addLauncherPod(vmiName, vmiNamespace string, backup *velerov1.Backup, resources []velero.ResourceIdentifier) ([]velero.ResourceIdentifier, error) {
+	pod, err := util.GetLauncherPod(vmiName, vmiNamespace, backup)
 	if err != nil || pod == nil {
 		// Still return the list of the resources even if we couldn't get the launcher pod
 		return resources, err
@@ -148,6 +259,28 @@ func addInstanceTypeMatcherResource(matcher v1.Matcher, statusRef *v1.Instancety
 	return resources
 }
 
+func addClusterInstanceType(vm *v1.VirtualMachine, resources []velero.ResourceIdentifier) []velero.ResourceIdentifier {
+	if vm.Spec.Instancetype != nil && isClusterMatcherKind(vm.Spec.Instancetype.Kind, instancetype.ClusterSingularResourceName) {
+		resources = addVeleroResource(vm.Spec.Instancetype.Name, "", "virtualmachineclusterinstancetypes", resources)
+	}
+	return resources
+}
+
+func addClusterPreference(vm *v1.VirtualMachine, resources []velero.ResourceIdentifier) []velero.ResourceIdentifier {
+	if vm.Spec.Preference != nil && isClusterMatcherKind(vm.Spec.Preference.Kind, instancetype.ClusterSingularPreferenceResourceName) {
+		resources = addVeleroResource(vm.Spec.Preference.Name, "", "virtualmachineclusterpreferences", resources)
+	}
+	return resources
+}
+
+// KubeVirt defaults to the cluster scoped kind when the matcher kind is not set
+func isClusterMatcherKind(kind, clusterSingularResourceName string) bool {
+	if kind == "" {
+		return true
+	}
+	return strings.EqualFold(kind, clusterSingularResourceName) || strings.EqualFold(kind, clusterSingularResourceName+"s")
+}
+
 func addBackendPVC(vmName, namespace string, resources []velero.ResourceIdentifier) ([]velero.ResourceIdentifier, error) {
 	labelSelector := fmt.Sprintf("%s=%s", backendStoragePrefix, vmName)
 	pvcs, err := util.ListPVCs(labelSelector, namespace)
@@ -170,6 +303,32 @@ func addBackendPVC(vmName, namespace string, resources []velero.ResourceIdentifi
 	return resources, nil
 }
 
+// IsBackendStoragePVC checks whether the PVC holds the persistent TPM or EFI state of a VM
+func IsBackendStoragePVC(pvc metav1.Object) bool {
+	if _, ok := pvc.GetLabels()[backendStoragePrefix]; ok {
+		return true
+	}
+	return strings.HasPrefix(pvc.GetName(), backendStoragePrefix+"-")
+}
+
+// GetBackendStorageVMName returns the name of the VM whose persistent state the PVC holds
+func GetBackendStorageVMName(pvc metav1.Object) (string, bool) {
+	if vmName, ok := pvc.GetLabels()[backendStoragePrefix]; ok {
+		return vmName, true
+	}
+	return strings.CutPrefix(pvc.GetName(), backendStoragePrefix+"-")
+}
+
+// RenameBackendStoragePVC renames the backend storage PVC after the new name of its VM
+func RenameBackendStoragePVC(pvc metav1.Object, vmName string) {
+	pvc.SetName(fmt.Sprintf("%s-%s", backendStoragePrefix, vmName))
+	if labels := pvc.GetLabels(); labels != nil {
+		if _, ok := labels[backendStoragePrefix]; ok {
+			labels[backendStoragePrefix] = vmName
+		}
+	}
+}
+
 func IsBackendStorageNeededForVMI(vmiSpec *v1.VirtualMachineInstanceSpec) bool {
 	return HasPersistentTPMDevice(vmiSpec) || HasPersistentEFI(vmiSpec)
 }
@@ -0,0 +1,165 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+package util
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+// GetNetworkMapping returns the Multus network mapping of the restore, from the <namespace>/<name> of the backed up
+// NetworkAttachmentDefinition to the one of the restored VM. The Restore annotation wins over the config.
+func GetNetworkMapping(restore *velerov1.Restore, config *PluginConfig, namespace string) (map[string]string, error) {
+	value, ok := restore.Annotations[NetworkMappingAnnotation]
+	if !ok {
+		value, ok = config.Get(namespace, settingName(NetworkMappingAnnotation))
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	mapping, err := parseNetworkMapping(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation", NetworkMappingAnnotation)
+	}
+	return mapping, nil
+}
+
+// parseNetworkMapping parses a comma separated list of <namespace>/<name>=<namespace>/<name> pairs
+func parseNetworkMapping(value string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		source, target, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, errors.Errorf("%q is not a source=target pair", pair)
+		}
+		source, target = strings.TrimSpace(source), strings.TrimSpace(target)
+		for _, network := range []string{source, target} {
+			if err := validateNetworkName(network); err != nil {
+				return nil, errors.Wrapf(err, "invalid network %q", network)
+			}
+		}
+		mapping[source] = target
+	}
+	return mapping, nil
+}
+
+func validateNetworkName(network string) error {
+	namespace, name, ok := strings.Cut(network, "/")
+	if !ok {
+		return errors.New("must be <namespace>/<name>")
+	}
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return validateName(name)
+}
+
+func ShouldFallBackToPodNetwork(restore *velerov1.Restore, config *PluginConfig, namespace string) bool {
+	return isSettingEnabled(restore.ObjectMeta, config, namespace, PodNetworkFallbackLabel)
+}
+
+// GetBackupNamespace returns the namespace a restored object was backed up from, following the namespace mapping of the restore
+func GetBackupNamespace(restore *velerov1.Restore, namespace string) string {
+	for source, target := range restore.Spec.NamespaceMapping {
+		if target == namespace {
+			return source
+		}
+	}
+	return namespace
+}
+
+// RemapNetworks rewrites the Multus networks of the VMI spec following the mapping. Network names without a namespace
+// are resolved in backupNamespace, the namespace the VMI was backed up from. Networks without a mapping are kept, or
+// replaced by the pod network with podFallback. A VMI has a single pod network, so once it has one the networks
+// without a mapping are removed together with their interfaces instead. Returns the names of the mapped networks.
+func RemapNetworks(vmiSpec *kvv1.VirtualMachineInstanceSpec, backupNamespace, namespace string, mapping map[string]string, podFallback bool, log logrus.FieldLogger) []string {
+	hasPodNetwork := false
+	for _, network := range vmiSpec.Networks {
+		if network.Pod != nil {
+			hasPodNetwork = true
+		}
+	}
+
+	var mapped []string
+	networks := vmiSpec.Networks[:0]
+	for _, network := range vmiSpec.Networks {
+		if network.Multus == nil {
+			networks = append(networks, network)
+			continue
+		}
+
+		sourceNamespace, sourceName := GetNamespaceAndNetworkName(backupNamespace, network.Multus.NetworkName)
+		if target, ok := mapping[sourceNamespace+"/"+sourceName]; ok {
+			targetNamespace, targetName := GetNamespaceAndNetworkName(namespace, target)
+			if targetNamespace != namespace {
+				targetName = targetNamespace + "/" + targetName
+			}
+			log.Infof("Remapping network %s from %s to %s", network.Name, network.Multus.NetworkName, targetName)
+			network.Multus.NetworkName = targetName
+			networks = append(networks, network)
+			mapped = append(mapped, network.Name)
+			continue
+		}
+
+		switch {
+		case !podFallback:
+			networks = append(networks, network)
+		case !hasPodNetwork:
+			log.Warnf("Network %s has no mapping for %s, switching it to the pod network", network.Name, network.Multus.NetworkName)
+			network.NetworkSource = kvv1.NetworkSource{Pod: &kvv1.PodNetwork{}}
+			setPodNetworkBinding(vmiSpec.Domain.Devices.Interfaces, network.Name)
+			networks = append(networks, network)
+			hasPodNetwork = true
+		default:
+			log.Warnf("Network %s has no mapping for %s and the pod network is taken, removing it", network.Name, network.Multus.NetworkName)
+			vmiSpec.Domain.Devices.Interfaces = removeInterface(vmiSpec.Domain.Devices.Interfaces, network.Name)
+		}
+	}
+	vmiSpec.Networks = networks
+	return mapped
+}
+
+// setPodNetworkBinding makes the binding of the interface valid for the pod network
+func setPodNetworkBinding(interfaces []kvv1.Interface, name string) {
+	for i := range interfaces {
+		if interfaces[i].Name == name && interfaces[i].SRIOV != nil {
+			interfaces[i].InterfaceBindingMethod = kvv1.InterfaceBindingMethod{Masquerade: &kvv1.InterfaceMasquerade{}}
+		}
+	}
+}
+
+func removeInterface(interfaces []kvv1.Interface, name string) []kvv1.Interface {
+	kept := interfaces[:0]
+	for _, iface := range interfaces {
+		if iface.Name != name {
+			kept = append(kept, iface)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,101 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+func TestGetNetworkMapping(t *testing.T) {
+	restore := &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		NetworkMappingAnnotation: "source/blue=target/green, source/red=other/red",
+	}}}
+	mapping, err := GetNetworkMapping(restore, nil, "target")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"source/blue": "target/green", "source/red": "other/red"}, mapping)
+
+	config, err := NewPluginConfig(common.PluginKindRestoreItemAction, map[string]string{"network-mapping": "source/blue=target/blue"})
+	assert.NoError(t, err)
+	mapping, err = GetNetworkMapping(&velerov1.Restore{}, config, "target")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"source/blue": "target/blue"}, mapping)
+
+	for _, value := range []string{"source/blue", "blue=target/green", "source/blue=Target/green"} {
+		restore.Annotations[NetworkMappingAnnotation] = value
+		_, err = GetNetworkMapping(restore, nil, "target")
+		assert.Error(t, err, value)
+	}
+}
+
+func TestGetBackupNamespace(t *testing.T) {
+	restore := &velerov1.Restore{Spec: velerov1.RestoreSpec{NamespaceMapping: map[string]string{"source": "target"}}}
+
+	assert.Equal(t, "source", GetBackupNamespace(restore, "target"))
+	assert.Equal(t, "other", GetBackupNamespace(restore, "other"))
+}
+
+func TestRemapNetworks(t *testing.T) {
+	multus := func(name, networkName string) kvv1.Network {
+		return kvv1.Network{Name: name, NetworkSource: kvv1.NetworkSource{Multus: &kvv1.MultusNetwork{NetworkName: networkName}}}
+	}
+	pod := kvv1.Network{Name: "default", NetworkSource: kvv1.NetworkSource{Pod: &kvv1.PodNetwork{}}}
+	sriov := kvv1.InterfaceBindingMethod{SRIOV: &kvv1.InterfaceSRIOV{}}
+	bridge := kvv1.InterfaceBindingMethod{Bridge: &kvv1.InterfaceBridge{}}
+	masquerade := kvv1.InterfaceBindingMethod{Masquerade: &kvv1.InterfaceMasquerade{}}
+	mapping := map[string]string{
+		"source/blue":  "target/green",
+		"shared/red":   "infra/red",
+		"source/local": "target/local",
+	}
+
+	testCases := []struct {
+		name               string
+		networks           []kvv1.Network
+		interfaces         []kvv1.Interface
+		podFallback        bool
+		expectedNetworks   []kvv1.Network
+		expectedInterfaces []kvv1.Interface
+	}{
+		{"Networks are remapped in and across namespaces",
+			[]kvv1.Network{pod, multus("blue", "blue"), multus("red", "shared/red"), multus("local", "source/local")},
+			[]kvv1.Interface{{Name: "blue", InterfaceBindingMethod: bridge}},
+			false,
+			[]kvv1.Network{pod, multus("blue", "green"), multus("red", "infra/red"), multus("local", "local")},
+			[]kvv1.Interface{{Name: "blue", InterfaceBindingMethod: bridge}}},
+		{"Unmapped networks are kept without the fallback",
+			[]kvv1.Network{multus("yellow", "yellow")},
+			[]kvv1.Interface{{Name: "yellow", InterfaceBindingMethod: sriov}},
+			false,
+			[]kvv1.Network{multus("yellow", "yellow")},
+			[]kvv1.Interface{{Name: "yellow", InterfaceBindingMethod: sriov}}},
+		{"First unmapped network becomes the pod network",
+			[]kvv1.Network{multus("yellow", "yellow"), multus("purple", "purple")},
+			[]kvv1.Interface{{Name: "yellow", InterfaceBindingMethod: sriov}, {Name: "purple", InterfaceBindingMethod: bridge}},
+			true,
+			[]kvv1.Network{{Name: "yellow", NetworkSource: kvv1.NetworkSource{Pod: &kvv1.PodNetwork{}}}},
+			[]kvv1.Interface{{Name: "yellow", InterfaceBindingMethod: masquerade}}},
+		{"Unmapped networks are removed when the VM has a pod network",
+			[]kvv1.Network{pod, multus("yellow", "yellow"), multus("blue", "blue")},
+			[]kvv1.Interface{{Name: "default", InterfaceBindingMethod: masquerade}, {Name: "yellow", InterfaceBindingMethod: bridge}, {Name: "blue", InterfaceBindingMethod: bridge}},
+			true,
+			[]kvv1.Network{pod, multus("blue", "green")},
+			[]kvv1.Interface{{Name: "default", InterfaceBindingMethod: masquerade}, {Name: "blue", InterfaceBindingMethod: bridge}}},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := &kvv1.VirtualMachineInstanceSpec{Networks: tc.networks}
+			spec.Domain.Devices.Interfaces = tc.interfaces
+
+			RemapNetworks(spec, "source", "target", mapping, tc.podFallback, logrus.StandardLogger())
+			assert.Equal(t, tc.expectedNetworks, spec.Networks)
+			assert.Equal(t, tc.expectedInterfaces, spec.Domain.Devices.Interfaces)
+		})
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+package util
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+// nodeNameField is the node field selecting a node by name in node affinity terms
+const nodeNameField = "metadata.name"
+
+// GetNodeLabelMapping returns the node label key mapping of the restore. The Restore annotation wins over the config.
+func GetNodeLabelMapping(restore *velerov1.Restore, config *PluginConfig, namespace string) (map[string]string, error) {
+	value, ok := restore.Annotations[NodeLabelMappingAnnotation]
+	if !ok {
+		value, ok = config.Get(namespace, settingName(NodeLabelMappingAnnotation))
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	mapping, err := parseNodeLabelMapping(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation", NodeLabelMappingAnnotation)
+	}
+	return mapping, nil
+}
+
+// parseNodeLabelMapping parses a comma separated list of old=new label keys
+func parseNodeLabelMapping(value string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		oldKey, newKey, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, errors.Errorf("%q is not an old=new pair", pair)
+		}
+		oldKey, newKey = strings.TrimSpace(oldKey), strings.TrimSpace(newKey)
+		for _, key := range []string{oldKey, newKey} {
+			if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+				return nil, errors.Errorf("invalid label key %q: %s", key, strings.Join(errs, ", "))
+			}
+		}
+		mapping[oldKey] = newKey
+	}
+	return mapping, nil
+}
+
+// RewriteNodePlacement applies the node placement policy and the node label key mapping to the VMI spec. The strip
+// policy removes the node selector, affinity, tolerations, scheduler name and eviction strategy, which only make
+// sense in the source cluster. The strip-node-names policy only removes the selectors of a node by name, node label
+// keys are then rewritten in the node selector, the affinity terms and the tolerations.
+func RewriteNodePlacement(vmiSpec *kvv1.VirtualMachineInstanceSpec, policy NodePlacementPolicy, mapping map[string]string, log logrus.FieldLogger) {
+	if policy == NodePlacementStrip {
+		log.Info("Removing node placement")
+		vmiSpec.NodeSelector = nil
+		vmiSpec.Affinity = nil
+		vmiSpec.Tolerations = nil
+		vmiSpec.SchedulerName = ""
+		vmiSpec.EvictionStrategy = nil
+		return
+	}
+
+	placement := &nodePlacementRewriter{
+		stripNodeNames: policy == NodePlacementStripNodeNames,
+		mapping:        mapping,
+		log:            log,
+	}
+	vmiSpec.NodeSelector = placement.rewriteNodeSelector(vmiSpec.NodeSelector)
+	vmiSpec.Affinity = placement.rewriteAffinity(vmiSpec.Affinity)
+	for i := range vmiSpec.Tolerations {
+		vmiSpec.Tolerations[i].Key = placement.rewriteKey(vmiSpec.Tolerations[i].Key)
+	}
+}
+
+type nodePlacementRewriter struct {
+	stripNodeNames bool
+	mapping        map[string]string
+	log            logrus.FieldLogger
+}
+
+func (r *nodePlacementRewriter) rewriteKey(key string) string {
+	if newKey, ok := r.mapping[key]; ok {
+		r.log.Infof("Rewriting node label key %s to %s", key, newKey)
+		return newKey
+	}
+	return key
+}
+
+func (r *nodePlacementRewriter) isNodeNamePin(key string) bool {
+	if r.stripNodeNames && (key == k8score.LabelHostname || key == nodeNameField) {
+		r.log.Infof("Removing node name pin %s", key)
+		return true
+	}
+	return false
+}
+
+func (r *nodePlacementRewriter) rewriteNodeSelector(selector map[string]string) map[string]string {
+	if len(selector) == 0 {
+		return selector
+	}
+	rewritten := map[string]string{}
+	for key, value := range selector {
+		if !r.isNodeNamePin(key) {
+			rewritten[r.rewriteKey(key)] = value
+		}
+	}
+	if len(rewritten) == 0 {
+		return nil
+	}
+	return rewritten
+}
+
+func (r *nodePlacementRewriter) rewriteAffinity(affinity *k8score.Affinity) *k8score.Affinity {
+	if affinity == nil {
+		return nil
+	}
+
+	if nodeAffinity := affinity.NodeAffinity; nodeAffinity != nil {
+		if required := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution; required != nil {
+			var terms []k8score.NodeSelectorTerm
+			for _, term := range required.NodeSelectorTerms {
+				if term, ok := r.rewriteNodeSelectorTerm(term); ok {
+					terms = append(terms, term)
+				}
+			}
+			required.NodeSelectorTerms = terms
+			if len(terms) == 0 {
+				nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = nil
+			}
+		}
+
+		var preferred []k8score.PreferredSchedulingTerm
+		for _, term := range nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution {
+			if preference, ok := r.rewriteNodeSelectorTerm(term.Preference); ok {
+				term.Preference = preference
+				preferred = append(preferred, term)
+			}
+		}
+		nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = preferred
+
+		if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil && len(preferred) == 0 {
+			affinity.NodeAffinity = nil
+		}
+	}
+
+	// Pod affinities only refer to nodes through their topology keys
+	if podAffinity := affinity.PodAffinity; podAffinity != nil {
+		r.rewriteTopologyKeys(podAffinity.RequiredDuringSchedulingIgnoredDuringExecution, podAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+	}
+	if podAntiAffinity := affinity.PodAntiAffinity; podAntiAffinity != nil {
+		r.rewriteTopologyKeys(podAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, podAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+	}
+
+	if affinity.NodeAffinity == nil && affinity.PodAffinity == nil && affinity.PodAntiAffinity == nil {
+		return nil
+	}
+	return affinity
+}
+
+// rewriteNodeSelectorTerm returns the rewritten term, and false when nothing but node name pins was left in it.
+// An empty term matches no node, so it must be dropped rather than kept.
+func (r *nodePlacementRewriter) rewriteNodeSelectorTerm(term k8score.NodeSelectorTerm) (k8score.NodeSelectorTerm, bool) {
+	var expressions, fields []k8score.NodeSelectorRequirement
+	for _, expression := range term.MatchExpressions {
+		if !r.isNodeNamePin(expression.Key) {
+			expression.Key = r.rewriteKey(expression.Key)
+			expressions = append(expressions, expression)
+		}
+	}
+	for _, field := range term.MatchFields {
+		if !r.isNodeNamePin(field.Key) {
+			fields = append(fields, field)
+		}
+	}
+	return k8score.NodeSelectorTerm{MatchExpressions: expressions, MatchFields: fields}, len(expressions) > 0 || len(fields) > 0
+}
+
+func (r *nodePlacementRewriter) rewriteTopologyKeys(required []k8score.PodAffinityTerm, preferred []k8score.WeightedPodAffinityTerm) {
+	for i := range required {
+		required[i].TopologyKey = r.rewriteKey(required[i].TopologyKey)
+	}
+	for i := range preferred {
+		preferred[i].PodAffinityTerm.TopologyKey = r.rewriteKey(preferred[i].PodAffinityTerm.TopologyKey)
+	}
+}
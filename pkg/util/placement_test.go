@@ -0,0 +1,135 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	k8score "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+func TestGetNodePlacementPolicy(t *testing.T) {
+	restore := &velerov1.Restore{}
+	assert.Equal(t, NodePlacementKeep, GetNodePlacementPolicy(restore, nil, "target"))
+
+	restore.Labels = map[string]string{NodePlacementLabel: "strip"}
+	assert.Equal(t, NodePlacementStrip, GetNodePlacementPolicy(restore, nil, "target"))
+
+	restore.Labels[NodePlacementLabel] = "unknown"
+	assert.Equal(t, NodePlacementKeep, GetNodePlacementPolicy(restore, nil, "target"))
+
+	config, err := NewPluginConfig(common.PluginKindRestoreItemAction, map[string]string{"node-placement": "strip-node-names"})
+	assert.NoError(t, err)
+	assert.Equal(t, NodePlacementStripNodeNames, GetNodePlacementPolicy(&velerov1.Restore{}, config, "target"))
+
+	_, err = NewPluginConfig(common.PluginKindRestoreItemAction, map[string]string{"node-placement": "unknown"})
+	assert.Error(t, err)
+}
+
+func TestGetNodeLabelMapping(t *testing.T) {
+	restore := &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		NodeLabelMappingAnnotation: "source.io/zone=topology.kubernetes.io/zone, gpu=example.com/gpu",
+	}}}
+	mapping, err := GetNodeLabelMapping(restore, nil, "target")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"source.io/zone": "topology.kubernetes.io/zone", "gpu": "example.com/gpu"}, mapping)
+
+	config, err := NewPluginConfig(common.PluginKindRestoreItemAction, map[string]string{"node-label-mapping": "rack=example.com/rack"})
+	assert.NoError(t, err)
+	mapping, err = GetNodeLabelMapping(&velerov1.Restore{}, config, "target")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"rack": "example.com/rack"}, mapping)
+
+	for _, value := range []string{"rack", "rack=", "rack=not a key"} {
+		restore.Annotations[NodeLabelMappingAnnotation] = value
+		_, err = GetNodeLabelMapping(restore, nil, "target")
+		assert.Error(t, err, value)
+	}
+}
+
+func TestRewriteNodePlacement(t *testing.T) {
+	requirement := func(key string, values ...string) k8score.NodeSelectorRequirement {
+		return k8score.NodeSelectorRequirement{Key: key, Operator: k8score.NodeSelectorOpIn, Values: values}
+	}
+	nodeAffinity := func(terms ...k8score.NodeSelectorTerm) *k8score.Affinity {
+		return &k8score.Affinity{NodeAffinity: &k8score.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &k8score.NodeSelector{NodeSelectorTerms: terms},
+		}}
+	}
+	evictionStrategy := kvv1.EvictionStrategyLiveMigrate
+	mapping := map[string]string{"rack": "example.com/rack"}
+
+	testCases := []struct {
+		name     string
+		policy   NodePlacementPolicy
+		spec     kvv1.VirtualMachineInstanceSpec
+		expected kvv1.VirtualMachineInstanceSpec
+	}{
+		{"Placement is kept and label keys are rewritten",
+			NodePlacementKeep,
+			kvv1.VirtualMachineInstanceSpec{
+				NodeSelector: map[string]string{k8score.LabelHostname: "node01", "rack": "r1"},
+				Tolerations:  []k8score.Toleration{{Key: "rack", Operator: k8score.TolerationOpExists}},
+			},
+			kvv1.VirtualMachineInstanceSpec{
+				NodeSelector: map[string]string{k8score.LabelHostname: "node01", "example.com/rack": "r1"},
+				Tolerations:  []k8score.Toleration{{Key: "example.com/rack", Operator: k8score.TolerationOpExists}},
+			}},
+		{"Node name pins are removed",
+			NodePlacementStripNodeNames,
+			kvv1.VirtualMachineInstanceSpec{
+				NodeSelector: map[string]string{k8score.LabelHostname: "node01"},
+				Affinity: nodeAffinity(
+					k8score.NodeSelectorTerm{MatchFields: []k8score.NodeSelectorRequirement{requirement("metadata.name", "node01")}},
+					k8score.NodeSelectorTerm{MatchExpressions: []k8score.NodeSelectorRequirement{requirement(k8score.LabelHostname, "node02"), requirement("rack", "r1")}},
+				),
+				SchedulerName: "custom",
+			},
+			kvv1.VirtualMachineInstanceSpec{
+				Affinity: nodeAffinity(
+					k8score.NodeSelectorTerm{MatchExpressions: []k8score.NodeSelectorRequirement{requirement("example.com/rack", "r1")}},
+				),
+				SchedulerName: "custom",
+			}},
+		{"Affinity is dropped when only node name pins were left",
+			NodePlacementStripNodeNames,
+			kvv1.VirtualMachineInstanceSpec{
+				Affinity: nodeAffinity(k8score.NodeSelectorTerm{MatchExpressions: []k8score.NodeSelectorRequirement{requirement(k8score.LabelHostname, "node01")}}),
+			},
+			kvv1.VirtualMachineInstanceSpec{}},
+		{"Topology keys of pod affinities are rewritten",
+			NodePlacementKeep,
+			kvv1.VirtualMachineInstanceSpec{
+				Affinity: &k8score.Affinity{PodAntiAffinity: &k8score.PodAntiAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: []k8score.PodAffinityTerm{{TopologyKey: "rack"}},
+				}},
+			},
+			kvv1.VirtualMachineInstanceSpec{
+				Affinity: &k8score.Affinity{PodAntiAffinity: &k8score.PodAntiAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: []k8score.PodAffinityTerm{{TopologyKey: "example.com/rack"}},
+				}},
+			}},
+		{"Placement is removed",
+			NodePlacementStrip,
+			kvv1.VirtualMachineInstanceSpec{
+				NodeSelector:     map[string]string{"rack": "r1"},
+				Affinity:         nodeAffinity(k8score.NodeSelectorTerm{MatchExpressions: []k8score.NodeSelectorRequirement{requirement("rack", "r1")}}),
+				Tolerations:      []k8score.Toleration{{Key: "rack", Operator: k8score.TolerationOpExists}},
+				SchedulerName:    "custom",
+				EvictionStrategy: &evictionStrategy,
+			},
+			kvv1.VirtualMachineInstanceSpec{}},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			RewriteNodePlacement(&tc.spec, tc.policy, mapping, logrus.StandardLogger())
+			assert.Equal(t, tc.expected, tc.spec)
+		})
+	}
+}
@@ -0,0 +1,381 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package util
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+// PluginConfigName is the plugin name of the Velero plugin ConfigMaps holding the defaults of the plugin.
+// A ConfigMap labeled with velero.io/plugin-config and kubevirt-velero-plugin: BackupItemAction holds the
+// backup settings, one labeled with kubevirt-velero-plugin: RestoreItemAction the restore settings.
+const PluginConfigName = "kubevirt-velero-plugin"
+
+const labelPrefix = "velero.kubevirt.io/"
+
+type settingValidator func(value string) error
+
+// setting is a setting of the plugin, given by a label on the Backup or Restore or by the plugin ConfigMap
+type setting struct {
+	validate settingValidator
+	// flag settings are enabled by their label whatever its value, except "false", see isSettingEnabled
+	flag bool
+}
+
+var backupSettings = map[string]setting{
+	settingName(MetadataBackupLabel):             {validate: validateBool, flag: true},
+	settingName(SkipGuestFreezeLabel):            {validate: validateBool, flag: true},
+	settingName(PauseWithoutGuestAgentLabel):     {validate: validateBool, flag: true},
+	settingName(FreezeTimeoutLabel):              {validate: validateTimeout},
+	settingName(LostVolumePolicyLabel):           {validate: validateLostVolumePolicy},
+	settingName(SkipUnsafeLabel):                 {validate: validateBool, flag: true},
+	settingName(BackupClusterInstancetypesLabel): {validate: validateBool, flag: true},
+}
+
+var restoreSettings = map[string]setting{
+	settingName(RestoreRunStrategy):           {validate: validateRunStrategy},
+	settingName(ClearMacAddressLabel):         {validate: validateBool, flag: true},
+	settingName(GenerateNewFirmwareUUIDLabel): {validate: validateBool, flag: true},
+	settingName(WaitForHealthyVMsLabel):       {validate: validateWaitForHealthyVMs, flag: true},
+	settingName(VMHealthTimeoutLabel):         {validate: validateTimeout},
+	settingName(RenamePrefixLabel):            {validate: validateRenamePrefix},
+	settingName(RenameSuffixLabel):            {validate: validateRenameSuffix},
+	settingName(RenameVMsAnnotation):          {validate: validateRenameVMs},
+	settingName(NetworkMappingAnnotation):     {validate: validateNetworkMapping},
+	settingName(PodNetworkFallbackLabel):      {validate: validateBool, flag: true},
+	settingName(NodePlacementLabel):           {validate: validateNodePlacementPolicy},
+	settingName(NodeLabelMappingAnnotation):   {validate: validateNodeLabelMapping},
+	settingName(HostDevicePolicyLabel):        {validate: validateHostDevicePolicy},
+	settingName(DeviceMappingAnnotation):      {validate: validateDeviceMapping},
+	settingName(SRIOVBindingLabel):            {validate: validateSRIOVBinding},
+	settingName(RestoreHotplugVolumesLabel):   {validate: validateBool, flag: true},
+	settingName(SkipPoolOwnedVMsLabel):        {validate: validateBool, flag: true},
+}
+
+// PluginConfig holds the plugin defaults set by the cluster admin. A setting is named after its
+// Backup or Restore label without the velero.kubevirt.io/ prefix (e.g. freeze-timeout), and can be
+// overridden for a single namespace with a <namespace>.<setting> key. Labels on the Backup or
+// Restore always win over the config. A nil PluginConfig holds no settings.
+type PluginConfig struct {
+	defaults   map[string]string
+	namespaces map[string]map[string]string
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var GetPluginConfig = func(kind common.PluginKind) (*PluginConfig, error) {
+	client, err := GetK8sClient()
+	if err != nil {
+		return nil, err
+	}
+
+	configMap, err := common.GetPluginConfig(kind, PluginConfigName, client.CoreV1().ConfigMaps(GetVeleroNamespace()))
+	if err != nil || configMap == nil {
+		return nil, err
+	}
+
+	return NewPluginConfig(kind, configMap.Data)
+}
+
+// pluginConfigs caches the plugin config, and the storage class mapping, of each backup and restore
+var pluginConfigs = NewBackupCache()
+
+// LoadPluginConfig returns the plugin config for the action kind, read once per backup or restore UID.
+// Lookup failures, invalid settings and invalid labels of the Backup or Restore are reported to the log,
+// the plugin then runs with the remaining settings. A failed lookup is retried by the next action.
+func LoadPluginConfig(kind common.PluginKind, meta metav1.ObjectMeta, log logrus.FieldLogger) *PluginConfig {
+	_, _ = cachedLookup(pluginConfigs, meta.UID, "labels/"+string(kind), func() (bool, error) {
+		if err := validateLabels(kind, meta); err != nil {
+			log.Warnf("Invalid %s labels of %s: %v", kind, meta.Name, err)
+		}
+		return true, nil
+	})
+
+	config, err := cachedLookup(pluginConfigs, meta.UID, "config/"+string(kind), func() (*PluginConfig, error) {
+		config, err := GetPluginConfig(kind)
+		if err != nil && config != nil {
+			// Invalid settings, they are only reported once
+			log.Warnf("Invalid %s configuration of the plugin: %v", kind, err)
+			return config, nil
+		}
+		return config, err
+	})
+	if err != nil {
+		log.Warnf("Failed to read the %s configuration of the plugin: %v", kind, err)
+	}
+	return config
+}
+
+// GetVeleroNamespace returns the namespace Velero, and therefore the plugin, runs in
+func GetVeleroNamespace() string {
+	if namespace := os.Getenv("VELERO_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	return "velero"
+}
+
+// validateLabels validates the values of the labels of a Backup or Restore holding settings of the action
+// kind, like NewPluginConfig validates the ConfigMap. Flag labels are valid whatever their value.
+func validateLabels(kind common.PluginKind, meta metav1.ObjectMeta) error {
+	settings := restoreSettings
+	if kind == common.PluginKindBackupItemAction {
+		settings = backupSettings
+	}
+
+	labels := make([]string, 0, len(meta.Labels))
+	for label := range meta.Labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var errs []error
+	for _, label := range labels {
+		if !strings.HasPrefix(label, labelPrefix) {
+			continue
+		}
+		if err := validateLabel(settings, label, meta.Labels[label]); err != nil {
+			errs = append(errs, errors.Wrapf(err, "invalid value %q of label %q", meta.Labels[label], label))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// validateLabel validates the value of a label holding a setting, labels of other settings are left alone
+func validateLabel(settings map[string]setting, label, value string) error {
+	definition, ok := settings[settingName(label)]
+	if !ok || definition.flag {
+		return nil
+	}
+	return definition.validate(value)
+}
+
+// NewPluginConfig validates the settings of a plugin ConfigMap for the given action kind.
+// Invalid settings are left out of the returned config and reported in the returned error.
+func NewPluginConfig(kind common.PluginKind, data map[string]string) (*PluginConfig, error) {
+	var settings map[string]setting
+	switch kind {
+	case common.PluginKindBackupItemAction:
+		settings = backupSettings
+	case common.PluginKindRestoreItemAction:
+		settings = restoreSettings
+	default:
+		return nil, errors.Errorf("plugin %s has no %s settings", PluginConfigName, kind)
+	}
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	config := &PluginConfig{
+		defaults:   map[string]string{},
+		namespaces: map[string]map[string]string{},
+	}
+	var errs []error
+	for _, key := range keys {
+		value := data[key]
+		namespace, setting, namespaced := strings.Cut(key, ".")
+		if !namespaced {
+			setting = key
+		}
+
+		definition, ok := settings[setting]
+		if !ok {
+			errs = append(errs, errors.Errorf("unknown %s setting %q", kind, key))
+			continue
+		}
+		if namespaced && len(validation.IsDNS1123Label(namespace)) > 0 {
+			errs = append(errs, errors.Errorf("invalid namespace in setting %q", key))
+			continue
+		}
+		if err := definition.validate(value); err != nil {
+			errs = append(errs, errors.Wrapf(err, "invalid value %q of setting %q", value, key))
+			continue
+		}
+
+		if !namespaced {
+			config.defaults[setting] = value
+			continue
+		}
+		if config.namespaces[namespace] == nil {
+			config.namespaces[namespace] = map[string]string{}
+		}
+		config.namespaces[namespace][setting] = value
+	}
+
+	return config, utilerrors.NewAggregate(errs)
+}
+
+// Get returns the value of a setting for objects in the namespace, the namespace override winning over the default
+func (c *PluginConfig) Get(namespace, setting string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	if value, ok := c.namespaces[namespace][setting]; ok {
+		return value, true
+	}
+	value, ok := c.defaults[setting]
+	return value, ok
+}
+
+func settingName(label string) string {
+	return strings.TrimPrefix(label, labelPrefix)
+}
+
+// lookupSetting returns the value of the label if set, otherwise the value from the config
+func lookupSetting(meta metav1.ObjectMeta, config *PluginConfig, namespace, label string) (string, bool) {
+	if value, ok := meta.Labels[label]; ok {
+		return value, true
+	}
+	return config.Get(namespace, settingName(label))
+}
+
+// isSettingEnabled tells if a boolean setting is on. Any value of the label enables it except "false",
+// which lets a Backup or Restore opt out of a default enabled in the config.
+func isSettingEnabled(meta metav1.ObjectMeta, config *PluginConfig, namespace, label string) bool {
+	value, ok := lookupSetting(meta, config, namespace, label)
+	return ok && value != "false"
+}
+
+// getTimeoutSetting returns a positive duration setting, or the default when it is unset or invalid
+func getTimeoutSetting(meta metav1.ObjectMeta, config *PluginConfig, namespace, label string, defaultTimeout time.Duration) (time.Duration, error) {
+	value, ok := lookupSetting(meta, config, namespace, label)
+	if !ok {
+		return defaultTimeout, nil
+	}
+	if err := validateTimeout(value); err != nil {
+		return defaultTimeout, errors.Wrapf(err, "invalid %s label", label)
+	}
+	timeout, _ := time.ParseDuration(value)
+	return timeout, nil
+}
+
+// validateBool only accepts true and false, which mean the same in the config as on a label
+func validateBool(value string) error {
+	if value != "true" && value != "false" {
+		return errors.New("must be true or false")
+	}
+	return nil
+}
+
+func validateTimeout(value string) error {
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		return errors.New("timeout must be positive")
+	}
+	return nil
+}
+
+func validateLostVolumePolicy(value string) error {
+	switch LostVolumePolicy(value) {
+	case LostVolumePolicyFail, LostVolumePolicyWarn, LostVolumePolicyIgnore:
+		return nil
+	}
+	return errors.Errorf("must be one of %s, %s or %s", LostVolumePolicyFail, LostVolumePolicyWarn, LostVolumePolicyIgnore)
+}
+
+func validateNodePlacementPolicy(value string) error {
+	switch NodePlacementPolicy(value) {
+	case NodePlacementKeep, NodePlacementStripNodeNames, NodePlacementStrip:
+		return nil
+	}
+	return errors.Errorf("must be one of %s, %s or %s", NodePlacementKeep, NodePlacementStripNodeNames, NodePlacementStrip)
+}
+
+func validateHostDevicePolicy(value string) error {
+	switch HostDevicePolicy(value) {
+	case HostDevicePolicyKeep, HostDevicePolicyRemove, HostDevicePolicyRemap:
+		return nil
+	}
+	return errors.Errorf("must be one of %s, %s or %s", HostDevicePolicyKeep, HostDevicePolicyRemove, HostDevicePolicyRemap)
+}
+
+func validateSRIOVBinding(value string) error {
+	switch SRIOVBinding(value) {
+	case SRIOVBindingBridge, SRIOVBindingMasquerade:
+		return nil
+	}
+	return errors.Errorf("must be %s or %s", SRIOVBindingBridge, SRIOVBindingMasquerade)
+}
+
+func validateRunStrategy(value string) error {
+	switch kvv1.VirtualMachineRunStrategy(value) {
+	case kvv1.RunStrategyAlways, kvv1.RunStrategyHalted, kvv1.RunStrategyManual,
+		kvv1.RunStrategyRerunOnFailure, kvv1.RunStrategyOnce:
+		return nil
+	}
+	return errors.New("unknown run strategy")
+}
+
+func validateWaitForHealthyVMs(value string) error {
+	if value == "warn" {
+		return nil
+	}
+	return validateBool(value)
+}
+
+func validateRenamePrefix(value string) error {
+	return validateName(value + "a")
+}
+
+func validateRenameSuffix(value string) error {
+	return validateName("a" + value)
+}
+
+func validateName(name string) error {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func validateRenameVMs(value string) error {
+	_, err := parseRenameVMs(value)
+	return err
+}
+
+func validateNetworkMapping(value string) error {
+	_, err := parseNetworkMapping(value)
+	return err
+}
+
+func validateNodeLabelMapping(value string) error {
+	_, err := parseNodeLabelMapping(value)
+	return err
+}
+
+func validateDeviceMapping(value string) error {
+	_, err := parseDeviceMapping(value)
+	return err
+}
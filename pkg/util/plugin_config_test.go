@@ -0,0 +1,254 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kvcore "kubevirt.io/api/core/v1"
+)
+
+func TestNewPluginConfig(t *testing.T) {
+	testCases := []struct {
+		name          string
+		kind          common.PluginKind
+		data          map[string]string
+		expectErr     bool
+		expectedValid map[string]string
+	}{
+		{"Valid backup settings should be accepted",
+			common.PluginKindBackupItemAction,
+			map[string]string{"freeze-timeout": "2m", "skip-guest-freeze": "true", "lost-volume-policy": "fail", "metadataBackup": "false"},
+			false,
+			map[string]string{"freeze-timeout": "2m", "skip-guest-freeze": "true", "lost-volume-policy": "fail", "metadataBackup": "false"},
+		},
+		{"Valid restore settings should be accepted",
+			common.PluginKindRestoreItemAction,
+			map[string]string{"restore-run-strategy": "Halted", "clear-mac-address": "true", "wait-for-healthy-vms": "warn", "vm-health-timeout": "30m"},
+			false,
+			map[string]string{"restore-run-strategy": "Halted", "clear-mac-address": "true", "wait-for-healthy-vms": "warn", "vm-health-timeout": "30m"},
+		},
+		{"Invalid values should be reported and dropped",
+			common.PluginKindBackupItemAction,
+			map[string]string{"freeze-timeout": "-1m", "skip-guest-freeze": "maybe", "lost-volume-policy": "ignore"},
+			true,
+			map[string]string{"lost-volume-policy": "ignore"},
+		},
+		{"Boolean values other than true and false should be reported",
+			common.PluginKindBackupItemAction,
+			map[string]string{"skip-guest-freeze": "0", "metadataBackup": "False", "skip-unsafe": "true"},
+			true,
+			map[string]string{"skip-unsafe": "true"},
+		},
+		{"Unknown run strategy should be reported",
+			common.PluginKindRestoreItemAction,
+			map[string]string{"restore-run-strategy": "Sometimes"},
+			true,
+			map[string]string{},
+		},
+		{"Restore settings should be unknown to backups",
+			common.PluginKindBackupItemAction,
+			map[string]string{"clear-mac-address": "true"},
+			true,
+			map[string]string{},
+		},
+		{"Invalid namespace should be reported",
+			common.PluginKindBackupItemAction,
+			map[string]string{"Not_A_Namespace.freeze-timeout": "2m"},
+			true,
+			map[string]string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := NewPluginConfig(tc.kind, tc.data)
+			if tc.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectedValid, config.defaults)
+		})
+	}
+
+	t.Run("Other plugin kinds have no settings", func(t *testing.T) {
+		_, err := NewPluginConfig(common.PluginKindDeleteItemAction, nil)
+		assert.Error(t, err)
+	})
+}
+
+func TestPluginConfigSettings(t *testing.T) {
+	config, err := NewPluginConfig(common.PluginKindBackupItemAction, map[string]string{
+		"freeze-timeout":                    "2m",
+		"skip-guest-freeze":                 "true",
+		"lost-volume-policy":                "fail",
+		"test-namespace.freeze-timeout":     "30s",
+		"test-namespace.metadataBackup":     "true",
+		"other-namespace.skip-guest-freeze": "false",
+	})
+	assert.NoError(t, err)
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	noLabels := &velerov1.Backup{}
+
+	t.Run("Config should apply when the backup has no labels", func(t *testing.T) {
+		timeout, err := GetFreezeTimeout(noLabels, config, "default")
+		assert.NoError(t, err)
+		assert.Equal(t, 2*time.Minute, timeout)
+		assert.True(t, ShouldSkipGuestFreeze(noLabels, config, "default"))
+		assert.False(t, IsMetadataBackup(noLabels, config, "default"))
+		assert.Equal(t, LostVolumePolicyFail, GetLostVolumePolicy(noLabels, config, "default"))
+	})
+
+	t.Run("Namespace overrides should win over the defaults", func(t *testing.T) {
+		timeout, err := GetFreezeTimeout(noLabels, config, "test-namespace")
+		assert.NoError(t, err)
+		assert.Equal(t, 30*time.Second, timeout)
+		assert.True(t, IsMetadataBackup(noLabels, config, "test-namespace"))
+		assert.False(t, ShouldSkipGuestFreeze(noLabels, config, "other-namespace"))
+	})
+
+	t.Run("Labels should win over the config", func(t *testing.T) {
+		backup := &velerov1.Backup{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{
+					FreezeTimeoutLabel:    "1m",
+					SkipGuestFreezeLabel:  "false",
+					LostVolumePolicyLabel: "warn",
+				},
+			},
+		}
+		timeout, err := GetFreezeTimeout(backup, config, "test-namespace")
+		assert.NoError(t, err)
+		assert.Equal(t, time.Minute, timeout)
+		assert.False(t, ShouldSkipGuestFreeze(backup, config, "default"))
+		assert.Equal(t, LostVolumePolicyWarn, GetLostVolumePolicy(backup, config, "default"))
+	})
+
+	t.Run("Label presence should enable a setting", func(t *testing.T) {
+		for _, value := range []string{"", "true", "0", "False", "FALSE", "f"} {
+			backup := &velerov1.Backup{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{MetadataBackupLabel: value}}}
+			assert.True(t, IsMetadataBackup(backup, config, "default"), value)
+		}
+		optOut := &velerov1.Backup{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{SkipGuestFreezeLabel: "false"}}}
+		assert.False(t, ShouldSkipGuestFreeze(optOut, config, "default"))
+	})
+
+	t.Run("Invalid label should fall back to the default timeout", func(t *testing.T) {
+		backup := &velerov1.Backup{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{FreezeTimeoutLabel: "soon"}}}
+		timeout, err := GetFreezeTimeout(backup, config, "default")
+		assert.Error(t, err)
+		assert.Equal(t, DefaultFreezeTimeout, timeout)
+	})
+
+	t.Run("Nil config should hold no settings", func(t *testing.T) {
+		timeout, err := GetFreezeTimeout(noLabels, nil, "default")
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultFreezeTimeout, timeout)
+		assert.False(t, ShouldSkipGuestFreeze(noLabels, nil, "default"))
+	})
+
+	t.Run("Restore settings should come from the config", func(t *testing.T) {
+		restoreConfig, err := NewPluginConfig(common.PluginKindRestoreItemAction, map[string]string{
+			"restore-run-strategy":             "Halted",
+			"test-namespace.clear-mac-address": "true",
+		})
+		assert.NoError(t, err)
+
+		restore := &velerov1.Restore{}
+		runStrategy, ok := GetRestoreRunStrategy(restore, restoreConfig, "default")
+		assert.True(t, ok)
+		assert.Equal(t, kvcore.RunStrategyHalted, runStrategy)
+		assert.False(t, ShouldClearMacAddress(restore, restoreConfig, "default"))
+		assert.True(t, ShouldClearMacAddress(restore, restoreConfig, "test-namespace"))
+
+		invalid := &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{RestoreRunStrategy: "Sometimes"}}}
+		_, ok = GetRestoreRunStrategy(invalid, restoreConfig, "default")
+		assert.False(t, ok)
+	})
+
+	t.Run("Former label only settings should come from the config", func(t *testing.T) {
+		backupConfig, err := NewPluginConfig(common.PluginKindBackupItemAction, map[string]string{
+			"backup-cluster-instancetypes": "true",
+		})
+		assert.NoError(t, err)
+		assert.True(t, ShouldBackupClusterInstancetypes(noLabels, backupConfig, "default"))
+		optOut := &velerov1.Backup{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{BackupClusterInstancetypesLabel: "false"}}}
+		assert.False(t, ShouldBackupClusterInstancetypes(optOut, backupConfig, "default"))
+
+		restoreConfig, err := NewPluginConfig(common.PluginKindRestoreItemAction, map[string]string{
+			"restore-hotplug-volumes":            "true",
+			"test-namespace.skip-pool-owned-vms": "true",
+		})
+		assert.NoError(t, err)
+		restore := &velerov1.Restore{}
+		assert.True(t, ShouldRestoreHotplugVolumes(restore, restoreConfig, "default"))
+		assert.False(t, ShouldSkipPoolOwnedVMs(restore, restoreConfig, "default"))
+		assert.True(t, ShouldSkipPoolOwnedVMs(restore, restoreConfig, "test-namespace"))
+	})
+}
+
+func TestLoadPluginConfig(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	defer func(getPluginConfig func(kind common.PluginKind) (*PluginConfig, error)) {
+		GetPluginConfig = getPluginConfig
+	}(GetPluginConfig)
+
+	t.Run("Config should be read once per backup", func(t *testing.T) {
+		calls := 0
+		GetPluginConfig = func(kind common.PluginKind) (*PluginConfig, error) {
+			calls++
+			return NewPluginConfig(kind, map[string]string{"freeze-timeout": "2m", "unknown": "true"})
+		}
+
+		for i := 0; i < 3; i++ {
+			config := LoadPluginConfig(common.PluginKindBackupItemAction, metav1.ObjectMeta{UID: "test-load-config"}, logrus.StandardLogger())
+			value, ok := config.Get("default", "freeze-timeout")
+			assert.True(t, ok)
+			assert.Equal(t, "2m", value)
+		}
+		assert.Equal(t, 1, calls)
+
+		LoadPluginConfig(common.PluginKindBackupItemAction, metav1.ObjectMeta{UID: "test-load-config-other"}, logrus.StandardLogger())
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("Invalid labels should be reported", func(t *testing.T) {
+		err := validateLabels(common.PluginKindBackupItemAction, metav1.ObjectMeta{Labels: map[string]string{
+			FreezeTimeoutLabel:    "soon",
+			MetadataBackupLabel:   "yes",
+			LostVolumePolicyLabel: "warn",
+			"app":                 "test",
+		}})
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), FreezeTimeoutLabel)
+			assert.NotContains(t, err.Error(), MetadataBackupLabel)
+		}
+
+		// Restore labels are not settings of a backup
+		assert.NoError(t, validateLabels(common.PluginKindBackupItemAction, metav1.ObjectMeta{Labels: map[string]string{
+			NodePlacementLabel: "somewhere",
+		}}))
+		assert.Error(t, validateLabels(common.PluginKindRestoreItemAction, metav1.ObjectMeta{Labels: map[string]string{
+			NodePlacementLabel: "somewhere",
+		}}))
+	})
+
+	t.Run("Failed lookups should be retried", func(t *testing.T) {
+		calls := 0
+		GetPluginConfig = func(kind common.PluginKind) (*PluginConfig, error) {
+			calls++
+			return nil, fmt.Errorf("failed to list configmaps")
+		}
+
+		assert.Nil(t, LoadPluginConfig(common.PluginKindBackupItemAction, metav1.ObjectMeta{UID: "test-load-config-failure"}, logrus.StandardLogger()))
+		assert.Nil(t, LoadPluginConfig(common.PluginKindBackupItemAction, metav1.ObjectMeta{UID: "test-load-config-failure"}, logrus.StandardLogger()))
+		assert.Equal(t, 2, calls)
+	})
+}
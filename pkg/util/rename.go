@@ -0,0 +1,260 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+package util
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	k8score "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kvv1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/api/instancetype"
+)
+
+// VMRenamer renames the VMs of a restore, and the objects restored with them. A nil VMRenamer renames nothing.
+type VMRenamer struct {
+	prefix string
+	suffix string
+	names  map[string]string
+}
+
+// GetVMRenamer returns the renamer for the VMs restored in the namespace, or nil when the restore keeps their names.
+// The RenameVMsAnnotation list wins over the RenamePrefixLabel and RenameSuffixLabel labels for the VMs it holds.
+func GetVMRenamer(restore *velerov1.Restore, config *PluginConfig, namespace string) (*VMRenamer, error) {
+	var meta metav1.ObjectMeta
+	if restore != nil {
+		meta = restore.ObjectMeta
+	}
+
+	renamer := &VMRenamer{}
+	if value, ok := lookupSetting(meta, config, namespace, RenamePrefixLabel); ok {
+		if err := validateRenamePrefix(value); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s label", RenamePrefixLabel)
+		}
+		renamer.prefix = value
+	}
+	if value, ok := lookupSetting(meta, config, namespace, RenameSuffixLabel); ok {
+		if err := validateRenameSuffix(value); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s label", RenameSuffixLabel)
+		}
+		renamer.suffix = value
+	}
+
+	value, ok := meta.Annotations[RenameVMsAnnotation]
+	if !ok {
+		value, ok = config.Get(namespace, settingName(RenameVMsAnnotation))
+	}
+	if ok {
+		names, err := parseRenameVMs(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s annotation", RenameVMsAnnotation)
+		}
+		renamer.names = names
+	}
+
+	if renamer.prefix == "" && renamer.suffix == "" && len(renamer.names) == 0 {
+		return nil, nil
+	}
+	return renamer, nil
+}
+
+// parseRenameVMs parses a comma separated list of old=new VM names
+func parseRenameVMs(value string) (map[string]string, error) {
+	names := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		oldName, newName, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, errors.Errorf("%q is not an old=new pair", pair)
+		}
+		oldName, newName = strings.TrimSpace(oldName), strings.TrimSpace(newName)
+		for _, name := range []string{oldName, newName} {
+			if err := validateName(name); err != nil {
+				return nil, errors.Wrapf(err, "invalid VM name %q", name)
+			}
+		}
+		names[oldName] = newName
+	}
+	return names, nil
+}
+
+// NewName returns the name the VM is restored with, and whether it differs from its backed up name
+func (r *VMRenamer) NewName(vmName string) (string, bool) {
+	if r == nil {
+		return vmName, false
+	}
+	if newName, ok := r.names[vmName]; ok {
+		return newName, newName != vmName
+	}
+	if r.prefix == "" && r.suffix == "" {
+		return vmName, false
+	}
+	return r.prefix + vmName + r.suffix, true
+}
+
+// DependentName returns the name of an object restored with the VM. Names starting with the VM name have
+// it replaced by the new VM name, other names are prefixed with the new VM name, so clones of a VM
+// restored in the same namespace never share an object.
+func (r *VMRenamer) DependentName(vmName, name string) string {
+	newVMName, renamed := r.NewName(vmName)
+	switch {
+	case !renamed:
+		return name
+	case name == vmName || strings.HasPrefix(name, vmName+"-"):
+		return newVMName + strings.TrimPrefix(name, vmName)
+	default:
+		return newVMName + "-" + name
+	}
+}
+
+// RenameOwnedObject renames an object the VM in its OwnerVMAnnotation owned at backup time, following
+// DependentName. The annotation is removed. Returns the new name, or "" when the object keeps its name.
+func (r *VMRenamer) RenameOwnedObject(obj metav1.Object) string {
+	annotations := obj.GetAnnotations()
+	vmName, ok := annotations[OwnerVMAnnotation]
+	if !ok {
+		return ""
+	}
+	delete(annotations, OwnerVMAnnotation)
+	obj.SetAnnotations(annotations)
+
+	newName := r.DependentName(vmName, obj.GetName())
+	if newName == obj.GetName() {
+		return ""
+	}
+	obj.SetName(newName)
+	return newName
+}
+
+// GetRevisionVMName returns the name of the VM an instancetype or preference ControllerRevision was created
+// for. KubeVirt names them <vm>-<object name>-<object uid>-<object generation>, the object fields being labels.
+func GetRevisionVMName(revision metav1.Object) (string, bool) {
+	labels := revision.GetLabels()
+	objectName, hasName := labels[instancetype.ControllerRevisionObjectNameLabel]
+	objectUID, hasUID := labels[instancetype.ControllerRevisionObjectUIDLabel]
+	generation, hasGeneration := labels[instancetype.ControllerRevisionObjectGenerationLabel]
+	if !hasName || !hasUID || !hasGeneration {
+		return "", false
+	}
+
+	vmName, ok := strings.CutSuffix(revision.GetName(), fmt.Sprintf("-%s-%s-%s", objectName, objectUID, generation))
+	return vmName, ok && vmName != ""
+}
+
+// GetCloudInitSecrets returns the names of the secrets holding the cloud-init user and network data of a VMI spec
+func GetCloudInitSecrets(spec *kvv1.VirtualMachineInstanceSpec) []string {
+	var names []string
+	addSecret := func(ref *k8score.LocalObjectReference) {
+		if ref != nil && !slices.Contains(names, ref.Name) {
+			names = append(names, ref.Name)
+		}
+	}
+	for _, volume := range spec.Volumes {
+		switch {
+		case volume.CloudInitNoCloud != nil:
+			addSecret(volume.CloudInitNoCloud.UserDataSecretRef)
+			addSecret(volume.CloudInitNoCloud.NetworkDataSecretRef)
+		case volume.CloudInitConfigDrive != nil:
+			addSecret(volume.CloudInitConfigDrive.UserDataSecretRef)
+			addSecret(volume.CloudInitConfigDrive.NetworkDataSecretRef)
+		}
+	}
+	return names
+}
+
+// GetSecretOwnerVM returns the VM owning a secret at backup time, the only VM of the backup using it
+// for cloud-init. Secrets used by several VMs, or by none, have no owner and keep their name on restore.
+// The owner is only a hint for renaming restores, so a failed lookup is logged and leaves the secret without owner.
+func GetSecretOwnerVM(backup *velerov1.Backup, namespace, name string, log logrus.FieldLogger) (string, bool) {
+	if !IsResourceInBackup("virtualmachines", backup) {
+		return "", false
+	}
+
+	users, _ := CachedLookup(backupLookups, backup, "cloud-init-secrets/"+namespace, func() (map[string][]string, error) {
+		users, err := listCloudInitSecretUsers(namespace)
+		if err != nil {
+			log.Warnf("Failed to list the VMs of namespace %s, their cloud-init secrets keep their name on restore: %v", namespace, err)
+			return map[string][]string{}, nil
+		}
+		return users, nil
+	})
+	if vms := users[name]; len(vms) == 1 {
+		return vms[0], true
+	}
+	return "", false
+}
+
+// listCloudInitSecretUsers maps the cloud-init secrets of a namespace to the VMs using them, leaving out
+// the VMs excluded from the backup by label
+func listCloudInitSecretUsers(namespace string) (map[string][]string, error) {
+	vms, err := ListVMs("", namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string][]string{}
+	for _, vm := range vms.Items {
+		if vm.Spec.Template == nil || vm.Labels[VeleroExcludeLabel] == "true" {
+			continue
+		}
+		for _, name := range GetCloudInitSecrets(&vm.Spec.Template.Spec) {
+			users[name] = append(users[name], vm.Name)
+		}
+	}
+	return users, nil
+}
+
+// GetOwnedSecrets returns the cloud-init secrets owned by the VM, as told by GetSecretOwnerVM, which are
+// backed up with it. The restore renames them together with the VM. Like the owner, failed lookups only
+// leave a secret out.
+func GetOwnedSecrets(backup *velerov1.Backup, vm *kvv1.VirtualMachine, log logrus.FieldLogger) []string {
+	if vm.Spec.Template == nil || !IsResourceInBackup("secrets", backup) {
+		return nil
+	}
+
+	var owned []string
+	for _, name := range GetCloudInitSecrets(&vm.Spec.Template.Spec) {
+		owner, ok := GetSecretOwnerVM(backup, vm.Namespace, name, log)
+		if !ok || owner != vm.Name {
+			continue
+		}
+
+		excluded, err := CachedLookup(backupLookups, backup, "secret/"+vm.Namespace+"/"+name, func() (bool, error) {
+			return IsSecretExcludedByLabel(vm.Namespace, name)
+		})
+		if k8serrors.IsNotFound(err) || excluded {
+			continue
+		}
+		if err != nil {
+			log.Warnf("Failed to check secret %s/%s, it keeps its name on restore: %v", vm.Namespace, name, err)
+			continue
+		}
+		owned = append(owned, name)
+	}
+	return owned
+}
@@ -0,0 +1,183 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	k8score "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kvv1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/api/instancetype"
+)
+
+func TestGetVMRenamer(t *testing.T) {
+	testCases := []struct {
+		name          string
+		labels        map[string]string
+		annotations   map[string]string
+		config        map[string]string
+		expectError   bool
+		expectedNames map[string]string
+	}{
+		{"No rename",
+			nil, nil, nil, false,
+			map[string]string{"test-vm": "test-vm"}},
+		{"Prefix and suffix labels",
+			map[string]string{RenamePrefixLabel: "clone-", RenameSuffixLabel: "-1"}, nil, nil, false,
+			map[string]string{"test-vm": "clone-test-vm-1"}},
+		{"Explicit list wins over the prefix",
+			map[string]string{RenamePrefixLabel: "clone-"}, map[string]string{RenameVMsAnnotation: "test-vm=renamed-vm, other-vm=other-vm"}, nil, false,
+			map[string]string{"test-vm": "renamed-vm", "other-vm": "other-vm", "third-vm": "clone-third-vm"}},
+		{"Explicit list alone",
+			nil, map[string]string{RenameVMsAnnotation: "test-vm=renamed-vm"}, nil, false,
+			map[string]string{"test-vm": "renamed-vm", "other-vm": "other-vm"}},
+		{"Settings from the config",
+			nil, nil, map[string]string{"rename-suffix": "-copy", "test-namespace.rename-vms": "test-vm=renamed-vm"}, false,
+			map[string]string{"test-vm": "renamed-vm", "other-vm": "other-vm-copy"}},
+		{"Label wins over the config",
+			map[string]string{RenameSuffixLabel: "-clone"}, nil, map[string]string{"rename-suffix": "-copy"}, false,
+			map[string]string{"test-vm": "test-vm-clone"}},
+		{"Invalid prefix",
+			map[string]string{RenamePrefixLabel: "-clone"}, nil, nil, true, nil},
+		{"Invalid list",
+			nil, map[string]string{RenameVMsAnnotation: "test-vm"}, nil, true, nil},
+		{"Invalid name in the list",
+			nil, map[string]string{RenameVMsAnnotation: "test-vm=Renamed_VM"}, nil, true, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := NewPluginConfig(common.PluginKindRestoreItemAction, tc.config)
+			assert.NoError(t, err)
+			restore := &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{Labels: tc.labels, Annotations: tc.annotations}}
+
+			renamer, err := GetVMRenamer(restore, config, "test-namespace")
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			for oldName, expectedName := range tc.expectedNames {
+				newName, renamed := renamer.NewName(oldName)
+				assert.Equal(t, expectedName, newName)
+				assert.Equal(t, expectedName != oldName, renamed)
+			}
+		})
+	}
+}
+
+func TestDependentName(t *testing.T) {
+	renamer := &VMRenamer{prefix: "clone-", names: map[string]string{"kept-vm": "kept-vm"}}
+
+	assert.Equal(t, "clone-test-vm-rootdisk", renamer.DependentName("test-vm", "test-vm-rootdisk"))
+	assert.Equal(t, "clone-test-vm", renamer.DependentName("test-vm", "test-vm"))
+	assert.Equal(t, "clone-test-vm-rootdisk", renamer.DependentName("test-vm", "rootdisk"))
+	assert.Equal(t, "clone-test-vm-test-vmx", renamer.DependentName("test-vm", "test-vmx"))
+	assert.Equal(t, "rootdisk", renamer.DependentName("kept-vm", "rootdisk"))
+
+	var noRename *VMRenamer
+	assert.Equal(t, "rootdisk", noRename.DependentName("test-vm", "rootdisk"))
+}
+
+func TestRenameOwnedObject(t *testing.T) {
+	renamer := &VMRenamer{suffix: "-copy"}
+
+	owned := &metav1.ObjectMeta{Name: "test-vm-disk", Annotations: map[string]string{OwnerVMAnnotation: "test-vm"}}
+	assert.Equal(t, "test-vm-copy-disk", renamer.RenameOwnedObject(owned))
+	assert.Equal(t, "test-vm-copy-disk", owned.Name)
+	assert.NotContains(t, owned.Annotations, OwnerVMAnnotation)
+
+	standalone := &metav1.ObjectMeta{Name: "test-vm-disk"}
+	assert.Empty(t, renamer.RenameOwnedObject(standalone))
+	assert.Equal(t, "test-vm-disk", standalone.Name)
+
+	var noRename *VMRenamer
+	kept := &metav1.ObjectMeta{Name: "test-vm-disk", Annotations: map[string]string{OwnerVMAnnotation: "test-vm"}}
+	assert.Empty(t, noRename.RenameOwnedObject(kept))
+	assert.Equal(t, "test-vm-disk", kept.Name)
+	assert.NotContains(t, kept.Annotations, OwnerVMAnnotation)
+}
+
+func TestGetRevisionVMName(t *testing.T) {
+	labels := map[string]string{
+		instancetype.ControllerRevisionObjectNameLabel:       "u1.small",
+		instancetype.ControllerRevisionObjectUIDLabel:        "1234",
+		instancetype.ControllerRevisionObjectGenerationLabel: "2",
+	}
+
+	vmName, ok := GetRevisionVMName(&metav1.ObjectMeta{Name: "test-vm-u1.small-1234-2", Labels: labels})
+	assert.True(t, ok)
+	assert.Equal(t, "test-vm", vmName)
+
+	_, ok = GetRevisionVMName(&metav1.ObjectMeta{Name: "test-vm-u1.medium-1234-2", Labels: labels})
+	assert.False(t, ok)
+
+	_, ok = GetRevisionVMName(&metav1.ObjectMeta{Name: "test-vm-u1.small-1234-2"})
+	assert.False(t, ok)
+}
+
+func TestOwnedSecrets(t *testing.T) {
+	newVM := func(name string, secrets ...string) kvv1.VirtualMachine {
+		vm := kvv1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test-namespace"},
+			Spec:       kvv1.VirtualMachineSpec{Template: &kvv1.VirtualMachineInstanceTemplateSpec{}},
+		}
+		for _, secret := range secrets {
+			vm.Spec.Template.Spec.Volumes = append(vm.Spec.Template.Spec.Volumes, kvv1.Volume{
+				VolumeSource: kvv1.VolumeSource{CloudInitNoCloud: &kvv1.CloudInitNoCloudSource{
+					UserDataSecretRef: &k8score.LocalObjectReference{Name: secret},
+				}},
+			})
+		}
+		return vm
+	}
+	excludedVM := newVM("excluded-vm", "shared-with-excluded")
+	excludedVM.Labels = map[string]string{VeleroExcludeLabel: "true"}
+	vms := []kvv1.VirtualMachine{
+		newVM("test-vm", "test-vm-cloud-init", "shared", "shared-with-excluded"),
+		newVM("other-vm", "shared", "excluded"),
+		excludedVM,
+		{ObjectMeta: metav1.ObjectMeta{Name: "no-template", Namespace: "test-namespace"}},
+	}
+
+	listVMs, isSecretExcluded := ListVMs, IsSecretExcludedByLabel
+	defer func() { ListVMs, IsSecretExcludedByLabel = listVMs, isSecretExcluded }()
+	ListVMs = func(labelSelector, namespace string) (*kvv1.VirtualMachineList, error) {
+		return &kvv1.VirtualMachineList{Items: vms}, nil
+	}
+	IsSecretExcludedByLabel = func(namespace, name string) (bool, error) { return name == "excluded", nil }
+
+	log := logrus.StandardLogger()
+	backup := &velerov1.Backup{}
+	for secret, expectedOwner := range map[string]string{
+		"test-vm-cloud-init": "test-vm", "excluded": "other-vm", "shared": "", "shared-with-excluded": "test-vm", "unused": "",
+	} {
+		owner, ok := GetSecretOwnerVM(backup, "test-namespace", secret, log)
+		assert.Equal(t, expectedOwner != "", ok, secret)
+		assert.Equal(t, expectedOwner, owner, secret)
+	}
+
+	owned := GetOwnedSecrets(backup, &vms[0], log)
+	assert.Equal(t, []string{"test-vm-cloud-init", "shared-with-excluded"}, owned)
+
+	// Excluded secrets are not restored, the VM keeps referencing them by name
+	assert.Empty(t, GetOwnedSecrets(backup, &vms[1], log))
+	assert.Empty(t, GetOwnedSecrets(&velerov1.Backup{Spec: velerov1.BackupSpec{ExcludedResources: []string{"secrets"}}}, &vms[0], log))
+
+	// Without VMs in the backup no secret has an owner, and no VM is listed
+	ListVMs = func(labelSelector, namespace string) (*kvv1.VirtualMachineList, error) {
+		return nil, fmt.Errorf("unexpected list")
+	}
+	_, ok := GetSecretOwnerVM(&velerov1.Backup{Spec: velerov1.BackupSpec{ExcludedResources: []string{"virtualmachines"}}}, "test-namespace", "test-vm-cloud-init", log)
+	assert.False(t, ok)
+
+	// A failed lookup leaves the secrets without owner instead of failing the backup
+	backup = &velerov1.Backup{ObjectMeta: metav1.ObjectMeta{UID: "failed-lookup"}}
+	_, ok = GetSecretOwnerVM(backup, "test-namespace", "test-vm-cloud-init", log)
+	assert.False(t, ok)
+	assert.Empty(t, GetOwnedSecrets(backup, &vms[0], log))
+}
@@ -0,0 +1,116 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package util
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SafetyCheckReason identifies why a VM cannot be safely backed up or would not be restored correctly
+type SafetyCheckReason string
+
+const (
+	// RunningWithoutVMI means a running VM is backed up without its VMI
+	RunningWithoutVMI SafetyCheckReason = "RunningWithoutVMI"
+	// VMIExcluded means the VMI of a running VM is excluded from the backup by label
+	VMIExcluded SafetyCheckReason = "VMIExcluded"
+	// LauncherPodExcluded means the launcher pod of a running VM is not backed up while its PVCs are
+	LauncherPodExcluded SafetyCheckReason = "LauncherPodExcluded"
+	// LauncherPodNotFound means the launcher pod of a running VM does not exist
+	LauncherPodNotFound SafetyCheckReason = "LauncherPodNotFound"
+	// DVExcluded means a DataVolume used by the VM is not backed up
+	DVExcluded SafetyCheckReason = "DVExcluded"
+	// PVCMissing means a PVC used by the VM is not backed up
+	PVCMissing SafetyCheckReason = "PVCMissing"
+	// ConfigMapMissing means the ConfigMap of a Sysprep volume is not backed up
+	ConfigMapMissing SafetyCheckReason = "ConfigMapMissing"
+	// SecretMissing means the Secret of a Sysprep volume is not backed up
+	SecretMissing SafetyCheckReason = "SecretMissing"
+	// VolumeDataLost means a volume holds data which is lost on restore, see LostVolumePolicyLabel
+	VolumeDataLost SafetyCheckReason = "VolumeDataLost"
+)
+
+var safetyCheckMessages = map[SafetyCheckReason]string{
+	RunningWithoutVMI:   "is running but its VMI is not included in the backup",
+	VMIExcluded:         "is running but its VMI is excluded from the backup",
+	LauncherPodExcluded: "is running but its launcher pod is not included in the backup",
+	LauncherPodNotFound: "is running but its launcher pod was not found",
+	DVExcluded:          "uses a DataVolume which is not included in the backup",
+	PVCMissing:          "uses a PVC which is not included in the backup",
+	ConfigMapMissing:    "uses a Sysprep ConfigMap which is not included in the backup",
+	SecretMissing:       "uses a Sysprep Secret which is not included in the backup",
+	VolumeDataLost:      "has a volume holding data which is lost on restore",
+}
+
+// SafetyCheckFailure describes a failed safety check: the reason, the object at fault and how to fix it
+type SafetyCheckFailure struct {
+	Reason SafetyCheckReason
+	// Object names the missing or excluded object
+	Object string
+	// Hint suggests the backup settings fixing the failure
+	Hint string
+}
+
+// SafetyCheckError is returned for a VM or VMI failing a safety check
+type SafetyCheckError struct {
+	Kind      string
+	Namespace string
+	Name      string
+	SafetyCheckFailure
+}
+
+// NewSafetyCheckError returns the error reported for the object failing a safety check
+func NewSafetyCheckError(kind string, obj metav1.Object, failure *SafetyCheckFailure) *SafetyCheckError {
+	return &SafetyCheckError{
+		Kind:               kind,
+		Namespace:          obj.GetNamespace(),
+		Name:               obj.GetName(),
+		SafetyCheckFailure: *failure,
+	}
+}
+
+func (e *SafetyCheckError) Error() string {
+	return fmt.Sprintf("%s %s/%s %s (%s: %s): %s", e.Kind, e.Namespace, e.Name, safetyCheckMessages[e.Reason], e.Reason, e.Object, e.Hint)
+}
+
+func objectRef(resource, namespace, name string) string {
+	return fmt.Sprintf("%s %s/%s", resource, namespace, name)
+}
+
+// ResourceNotInBackupHint is the fix for a resource left out by the backup resource filters
+func ResourceNotInBackupHint(resource string) string {
+	return fmt.Sprintf("include %s with --include-resources and do not list it in --exclude-resources", resource)
+}
+
+// ExcludedByLabelHint is the fix for an object carrying the Velero exclude label
+func ExcludedByLabelHint() string {
+	return fmt.Sprintf("remove the %s label from it", VeleroExcludeLabel)
+}
+
+// NewLauncherPodNotInBackupFailure reports a running VMI whose launcher pod is left out by the backup resource filters
+func NewLauncherPodNotInBackupFailure(namespace, name string) *SafetyCheckFailure {
+	return &SafetyCheckFailure{
+		Reason: LauncherPodExcluded,
+		Object: "launcher pod of " + objectRef("virtualmachineinstances", namespace, name),
+		Hint:   ResourceNotInBackupHint("pods") + ", or exclude persistentvolumeclaims as well",
+	}
+}
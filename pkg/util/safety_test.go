@@ -0,0 +1,53 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kvcore "kubevirt.io/api/core/v1"
+)
+
+func TestSafetyCheckError(t *testing.T) {
+	vm := &kvcore.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "test-namespace", Name: "test-vm"}}
+	volumes := []kvcore.Volume{
+		{
+			Name:         "rootdisk",
+			VolumeSource: kvcore.VolumeSource{DataVolume: &kvcore.DataVolumeSource{Name: "test-dv"}},
+		},
+	}
+	skipFalse := func(volume kvcore.Volume) bool { return false }
+
+	logrus.SetLevel(logrus.ErrorLevel)
+
+	t.Run("DataVolume left out by the resource filters", func(t *testing.T) {
+		IsDVExcludedByLabel = func(namespace, name string) (bool, error) { return false, nil }
+		backup := &velerov1.Backup{Spec: velerov1.BackupSpec{ExcludedResources: []string{"datavolumes"}}}
+
+		failure, err := RestorePossible(volumes, backup, nil, "test-namespace", skipFalse, logrus.StandardLogger())
+		assert.NoError(t, err)
+		if assert.NotNil(t, failure) {
+			assert.Equal(t, DVExcluded, failure.Reason)
+			assert.Equal(t,
+				"VM test-namespace/test-vm uses a DataVolume which is not included in the backup (DVExcluded: datavolumes test-namespace/test-dv): "+
+					"include datavolumes with --include-resources and do not list it in --exclude-resources",
+				NewSafetyCheckError("VM", vm, failure).Error())
+		}
+	})
+
+	t.Run("DataVolume excluded by label", func(t *testing.T) {
+		IsDVExcludedByLabel = func(namespace, name string) (bool, error) { return true, nil }
+
+		failure, err := RestorePossible(volumes, &velerov1.Backup{}, nil, "test-namespace", skipFalse, logrus.StandardLogger())
+		assert.NoError(t, err)
+		if assert.NotNil(t, failure) {
+			assert.Equal(t, DVExcluded, failure.Reason)
+			assert.Equal(t,
+				"VM test-namespace/test-vm uses a DataVolume which is not included in the backup (DVExcluded: datavolumes test-namespace/test-dv): "+
+					"remove the velero.io/exclude-from-backup label from it",
+				NewSafetyCheckError("VM", vm, failure).Error())
+		}
+	})
+}
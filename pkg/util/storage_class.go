@@ -0,0 +1,218 @@
+/*
+ * This file is part of the Kubevirt Velero Plugin project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright The KubeVirt Velero Plugin Authors.
+ *
+ */
+
+package util
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	k8score "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+// ChangeStorageClassConfigName is the plugin name of Velero's change-storage-class ConfigMap, which maps
+// the storage class names of the backup to the ones of the restore cluster
+const ChangeStorageClassConfigName = "velero.io/change-storage-class"
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var GetStorageClassMapping = func() (map[string]string, error) {
+	client, err := GetK8sClient()
+	if err != nil {
+		return nil, err
+	}
+
+	configMap, err := common.GetPluginConfig(common.PluginKindRestoreItemAction, ChangeStorageClassConfigName, client.CoreV1().ConfigMaps(GetVeleroNamespace()))
+	if err != nil || configMap == nil {
+		return nil, err
+	}
+
+	return configMap.Data, nil
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var GetStorageProfile = func(name string) (*cdiv1.StorageProfile, error) {
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return nil, err
+	}
+
+	return (*client).CdiClient().CdiV1beta1().StorageProfiles().Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+// LoadStorageClassMapping returns the storage class mapping the restore shares with Velero, empty
+// when it is not configured. It is read once per restore UID, lookup failures are reported to the log.
+func LoadStorageClassMapping(uid types.UID, log logrus.FieldLogger) map[string]string {
+	mapping, err := cachedLookup(pluginConfigs, uid, "storage-class-mapping", GetStorageClassMapping)
+	if err != nil {
+		log.Warnf("Failed to read the %s ConfigMap, storage classes are not remapped: %v", ChangeStorageClassConfigName, err)
+	}
+	return mapping
+}
+
+// RemapDataVolumeStorageClass rewrites the storage class of the DataVolume spec following the mapping,
+// and makes its access and volume modes fit the StorageProfile of the new class. Modes left empty in
+// the storage API are picked by CDI from the StorageProfile. When the PVC of the DataVolume is restored
+// with its data, only the access modes are changed, so the DataVolume keeps matching its PVC.
+// Returns the new class, or "" when unchanged.
+func RemapDataVolumeStorageClass(spec *cdiv1.DataVolumeSpec, mapping map[string]string, withData bool, log logrus.FieldLogger) string {
+	switch {
+	case spec.Storage != nil:
+		return remapStorageClass(&spec.Storage.StorageClassName, &spec.Storage.AccessModes, &spec.Storage.VolumeMode, false, withData, mapping, log)
+	case spec.PVC != nil:
+		return remapStorageClass(&spec.PVC.StorageClassName, &spec.PVC.AccessModes, &spec.PVC.VolumeMode, true, withData, mapping, log)
+	}
+	return ""
+}
+
+// RemapPVCStorageClass rewrites the storage class of the PVC spec following the mapping, and makes its
+// access modes fit the StorageProfile of the new class. The PVC is restored with its data, which only
+// fits its volume mode, so that is kept. Returns the new class, or "" when unchanged.
+func RemapPVCStorageClass(spec *k8score.PersistentVolumeClaimSpec, mapping map[string]string, log logrus.FieldLogger) string {
+	if newClass := remapStorageClass(&spec.StorageClassName, &spec.AccessModes, &spec.VolumeMode, true, true, mapping, log); newClass != "" {
+		return newClass
+	}
+
+	// Velero's change-storage-class action may have remapped the PVC already
+	if spec.StorageClassName != nil && isMappingTarget(mapping, *spec.StorageClassName) {
+		fitStorageProfile(*spec.StorageClassName, &spec.AccessModes, &spec.VolumeMode, true, true, log)
+	}
+	return ""
+}
+
+func remapStorageClass(className **string, accessModes *[]k8score.PersistentVolumeAccessMode, volumeMode **k8score.PersistentVolumeMode, required, keepVolumeMode bool, mapping map[string]string, log logrus.FieldLogger) string {
+	if *className == nil {
+		// The default storage class of the restore cluster is used
+		return ""
+	}
+	newClass, ok := mapping[**className]
+	if !ok || newClass == "" || newClass == **className {
+		return ""
+	}
+	*className = &newClass
+
+	fitStorageProfile(newClass, accessModes, volumeMode, required, keepVolumeMode, log)
+	return newClass
+}
+
+func isMappingTarget(mapping map[string]string, className string) bool {
+	for _, target := range mapping {
+		if target == className {
+			return true
+		}
+	}
+	return false
+}
+
+// fitStorageProfile makes the access and volume modes fit the StorageProfile of the storage class, if any
+func fitStorageProfile(className string, accessModes *[]k8score.PersistentVolumeAccessMode, volumeMode **k8score.PersistentVolumeMode, required, keepVolumeMode bool, log logrus.FieldLogger) {
+	profile, err := GetStorageProfile(className)
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			log.Warnf("Failed to get the StorageProfile of storage class %s, access and volume modes are kept: %v", className, err)
+		}
+		return
+	}
+
+	if !fitClaimPropertySets(profile.Status.ClaimPropertySets, accessModes, volumeMode, required, keepVolumeMode) {
+		log.Warnf("StorageProfile of storage class %s does not support volume mode %s, access modes are kept", className, claimVolumeMode(*volumeMode))
+	}
+}
+
+// fitClaimPropertySets replaces access and volume modes not supported by any of the claim property sets
+// by the first set. Modes which are not required may be left empty, for CDI to pick them. When the volume
+// mode is kept, only the access modes are replaced, by the first set with the same volume mode. Returns
+// false when no set has that volume mode.
+func fitClaimPropertySets(sets []cdiv1.ClaimPropertySet, accessModes *[]k8score.PersistentVolumeAccessMode, volumeMode **k8score.PersistentVolumeMode, required, keepVolumeMode bool) bool {
+	if len(sets) == 0 {
+		return true
+	}
+	if !required && len(*accessModes) == 0 && (*volumeMode == nil || **volumeMode == cdiv1.PersistentVolumeFromStorageProfile) {
+		return true
+	}
+
+	for _, set := range sets {
+		if claimPropertySetSupports(set, *accessModes, *volumeMode, required) {
+			return true
+		}
+	}
+
+	if keepVolumeMode {
+		// The restored data only fits the volume mode it was backed up with
+		for _, set := range sets {
+			if setVolumeMode(set) == claimVolumeMode(*volumeMode) {
+				*accessModes = append([]k8score.PersistentVolumeAccessMode{}, set.AccessModes...)
+				return true
+			}
+		}
+		return false
+	}
+
+	*accessModes = append([]k8score.PersistentVolumeAccessMode{}, sets[0].AccessModes...)
+	if sets[0].VolumeMode != nil {
+		mode := *sets[0].VolumeMode
+		*volumeMode = &mode
+	}
+	return true
+}
+
+func claimPropertySetSupports(set cdiv1.ClaimPropertySet, accessModes []k8score.PersistentVolumeAccessMode, volumeMode *k8score.PersistentVolumeMode, required bool) bool {
+	if len(accessModes) == 0 && required {
+		return false
+	}
+
+	autoMode := volumeMode == nil || *volumeMode == cdiv1.PersistentVolumeFromStorageProfile
+	if (!autoMode || required) && claimVolumeMode(volumeMode) != setVolumeMode(set) {
+		return false
+	}
+
+	for _, accessMode := range accessModes {
+		found := false
+		for _, supported := range set.AccessModes {
+			if accessMode == supported {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// claimVolumeMode returns the volume mode of a claim, Filesystem when it is not set
+func claimVolumeMode(volumeMode *k8score.PersistentVolumeMode) k8score.PersistentVolumeMode {
+	if volumeMode == nil || *volumeMode == cdiv1.PersistentVolumeFromStorageProfile {
+		return k8score.PersistentVolumeFilesystem
+	}
+	return *volumeMode
+}
+
+// setVolumeMode returns the volume mode of a claim property set, Filesystem when it is not set
+func setVolumeMode(set cdiv1.ClaimPropertySet) k8score.PersistentVolumeMode {
+	if set.VolumeMode == nil {
+		return k8score.PersistentVolumeFilesystem
+	}
+	return *set.VolumeMode
+}
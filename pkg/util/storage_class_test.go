@@ -0,0 +1,140 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	k8score "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+func TestRemapDataVolumeStorageClass(t *testing.T) {
+	rwo := []k8score.PersistentVolumeAccessMode{k8score.ReadWriteOnce}
+	rwx := []k8score.PersistentVolumeAccessMode{k8score.ReadWriteMany}
+	block := ptr.To(k8score.PersistentVolumeBlock)
+	filesystem := ptr.To(k8score.PersistentVolumeFilesystem)
+	mapping := map[string]string{"old-class": "new-class", "other-class": "missing-class"}
+
+	testCases := []struct {
+		name                string
+		spec                cdiv1.DataVolumeSpec
+		withData            bool
+		expectedClass       string
+		expectedAccessModes []k8score.PersistentVolumeAccessMode
+		expectedVolumeMode  *k8score.PersistentVolumeMode
+	}{
+		{"Unmapped class is kept",
+			cdiv1.DataVolumeSpec{Storage: &cdiv1.StorageSpec{StorageClassName: ptr.To("kept-class"), AccessModes: rwo}},
+			false, "kept-class", rwo, nil},
+		{"Default class is kept",
+			cdiv1.DataVolumeSpec{Storage: &cdiv1.StorageSpec{AccessModes: rwo}},
+			false, "", rwo, nil},
+		{"Storage modes left to CDI are kept empty",
+			cdiv1.DataVolumeSpec{Storage: &cdiv1.StorageSpec{StorageClassName: ptr.To("old-class")}},
+			false, "new-class", nil, nil},
+		{"Supported storage modes are kept",
+			cdiv1.DataVolumeSpec{Storage: &cdiv1.StorageSpec{StorageClassName: ptr.To("old-class"), AccessModes: rwx, VolumeMode: block}},
+			false, "new-class", rwx, block},
+		{"Unsupported storage modes are replaced",
+			cdiv1.DataVolumeSpec{Storage: &cdiv1.StorageSpec{StorageClassName: ptr.To("old-class"), AccessModes: rwo, VolumeMode: filesystem}},
+			false, "new-class", rwx, block},
+		{"Empty PVC modes are filled",
+			cdiv1.DataVolumeSpec{PVC: &k8score.PersistentVolumeClaimSpec{StorageClassName: ptr.To("old-class")}},
+			false, "new-class", rwx, block},
+		{"Modes are kept without a StorageProfile",
+			cdiv1.DataVolumeSpec{PVC: &k8score.PersistentVolumeClaimSpec{StorageClassName: ptr.To("other-class"), AccessModes: rwo}},
+			false, "missing-class", rwo, nil},
+		{"Pre-populated DataVolume only gets its access modes replaced",
+			cdiv1.DataVolumeSpec{PVC: &k8score.PersistentVolumeClaimSpec{StorageClassName: ptr.To("old-class"), AccessModes: rwo, VolumeMode: filesystem}},
+			true, "new-class", rwx, filesystem},
+		{"Pre-populated DataVolume without volume mode keeps it empty",
+			cdiv1.DataVolumeSpec{PVC: &k8score.PersistentVolumeClaimSpec{StorageClassName: ptr.To("old-class"), AccessModes: rwo}},
+			true, "new-class", rwx, nil},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	GetStorageProfile = func(name string) (*cdiv1.StorageProfile, error) {
+		if name != "new-class" {
+			return nil, k8serrors.NewNotFound(schema.GroupResource{Group: "cdi.kubevirt.io", Resource: "storageprofiles"}, name)
+		}
+		return &cdiv1.StorageProfile{Status: cdiv1.StorageProfileStatus{
+			ClaimPropertySets: []cdiv1.ClaimPropertySet{
+				{AccessModes: rwx, VolumeMode: block},
+				{AccessModes: rwx, VolumeMode: filesystem},
+			},
+		}}, nil
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := tc.spec.DeepCopy()
+			class := RemapDataVolumeStorageClass(spec, mapping, tc.withData, logrus.StandardLogger())
+
+			var storageClass *string
+			var accessModes []k8score.PersistentVolumeAccessMode
+			var volumeMode *k8score.PersistentVolumeMode
+			if spec.Storage != nil {
+				storageClass, accessModes, volumeMode = spec.Storage.StorageClassName, spec.Storage.AccessModes, spec.Storage.VolumeMode
+			} else {
+				storageClass, accessModes, volumeMode = spec.PVC.StorageClassName, spec.PVC.AccessModes, spec.PVC.VolumeMode
+			}
+
+			if tc.expectedClass == "" {
+				assert.Nil(t, storageClass)
+			} else {
+				assert.Equal(t, tc.expectedClass, *storageClass)
+			}
+			if tc.expectedClass == "new-class" || tc.expectedClass == "missing-class" {
+				assert.Equal(t, tc.expectedClass, class)
+			} else {
+				assert.Empty(t, class)
+			}
+			assert.Equal(t, tc.expectedAccessModes, accessModes)
+			assert.Equal(t, tc.expectedVolumeMode, volumeMode)
+		})
+	}
+}
+
+func TestRemapPVCStorageClass(t *testing.T) {
+	rwo := []k8score.PersistentVolumeAccessMode{k8score.ReadWriteOnce}
+	rwx := []k8score.PersistentVolumeAccessMode{k8score.ReadWriteMany}
+	mapping := map[string]string{"old-class": "new-class"}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	GetStorageProfile = func(name string) (*cdiv1.StorageProfile, error) {
+		return &cdiv1.StorageProfile{Status: cdiv1.StorageProfileStatus{
+			ClaimPropertySets: []cdiv1.ClaimPropertySet{{AccessModes: rwx, VolumeMode: ptr.To(k8score.PersistentVolumeFilesystem)}},
+		}}, nil
+	}
+
+	t.Run("Mapped class is remapped", func(t *testing.T) {
+		spec := &k8score.PersistentVolumeClaimSpec{StorageClassName: ptr.To("old-class"), AccessModes: rwo}
+		assert.Equal(t, "new-class", RemapPVCStorageClass(spec, mapping, logrus.StandardLogger()))
+		assert.Equal(t, "new-class", *spec.StorageClassName)
+		assert.Equal(t, rwx, spec.AccessModes)
+	})
+
+	t.Run("Class remapped by Velero still fits the StorageProfile", func(t *testing.T) {
+		spec := &k8score.PersistentVolumeClaimSpec{StorageClassName: ptr.To("new-class"), AccessModes: rwo}
+		assert.Empty(t, RemapPVCStorageClass(spec, mapping, logrus.StandardLogger()))
+		assert.Equal(t, "new-class", *spec.StorageClassName)
+		assert.Equal(t, rwx, spec.AccessModes)
+	})
+
+	t.Run("Volume mode of the restored data is kept", func(t *testing.T) {
+		spec := &k8score.PersistentVolumeClaimSpec{StorageClassName: ptr.To("old-class"), AccessModes: rwo, VolumeMode: ptr.To(k8score.PersistentVolumeBlock)}
+		assert.Equal(t, "new-class", RemapPVCStorageClass(spec, mapping, logrus.StandardLogger()))
+		assert.Equal(t, rwo, spec.AccessModes)
+		assert.Equal(t, k8score.PersistentVolumeBlock, *spec.VolumeMode)
+	})
+
+	t.Run("Unmapped class is left alone", func(t *testing.T) {
+		spec := &k8score.PersistentVolumeClaimSpec{StorageClassName: ptr.To("kept-class"), AccessModes: rwo}
+		assert.Empty(t, RemapPVCStorageClass(spec, mapping, logrus.StandardLogger()))
+		assert.Equal(t, rwo, spec.AccessModes)
+	})
+}
@@ -2,15 +2,21 @@ package util
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v7/apis/volumesnapshot/v1"
 	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
 	corev1api "k8s.io/api/core/v1"
 	k8score "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
@@ -26,11 +32,42 @@ import (
 	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
 )
 
+// DefaultVMHealthTimeout is how long a restored VM is tracked unless VMHealthTimeoutLabel says otherwise
+const DefaultVMHealthTimeout = 10 * time.Minute
+
+// VolumeRestoreClass describes what happens to the data of a volume when the VM is restored
+type VolumeRestoreClass string
+
+const (
+	// VolumePersisted volumes keep their data, as long as their PVCs are part of the backup
+	VolumePersisted VolumeRestoreClass = "Persisted"
+	// VolumeRecreatable volumes are regenerated from the VM definition or the objects it references
+	VolumeRecreatable VolumeRestoreClass = "Recreatable"
+	// VolumeLost volumes hold data which is not part of the backup
+	VolumeLost VolumeRestoreClass = "Lost"
+)
+
+// LostVolumePolicy tells how to handle VMs with volumes whose data is lost on restore
+type LostVolumePolicy string
+
+const (
+	LostVolumePolicyFail   LostVolumePolicy = "fail"
+	LostVolumePolicyWarn   LostVolumePolicy = "warn"
+	LostVolumePolicyIgnore LostVolumePolicy = "ignore"
+)
+
+// DefaultFreezeTimeout is how long a guest may stay frozen during a backup unless FreezeTimeoutLabel says otherwise
+const DefaultFreezeTimeout = 5 * time.Minute
+
 const (
 	// MetadataBackupLabel indicates that the object will be backed up for metadata purposes.
 	// This allows skipping restore and consistency-specific checks while ensuring the object is backed up.
 	MetadataBackupLabel = "velero.kubevirt.io/metadataBackup"
 
+	// BackupClusterInstancetypesLabel indicates that the cluster scoped instancetypes and preferences
+	// referenced by the backed up VMs should be backed up too.
+	BackupClusterInstancetypesLabel = "velero.kubevirt.io/backup-cluster-instancetypes"
+
 	// RestoreRunStrategy indicates that the backed up VMs will be powered with the specified run strategy after restore.
 	RestoreRunStrategy = "velero.kubevirt.io/restore-run-strategy"
 
@@ -40,6 +77,108 @@ const (
 	// GenerateNewFirmwareUUIDLabel indicates that a new firmware UUID should be generated for VMs as part of the restore workflow.
 	GenerateNewFirmwareUUIDLabel = "velero.kubevirt.io/generate-new-firmware-uuid"
 
+	// RestoreHotplugVolumesLabel indicates that the volumes hotplugged to the backed up VMs should be
+	// re-applied as persistent volumes of the restored VMs. Otherwise they are dropped.
+	RestoreHotplugVolumesLabel = "velero.kubevirt.io/restore-hotplug-volumes"
+
+	// HotplugVolumesAnnotation stores the volumes hotplugged to a VM at backup time
+	HotplugVolumesAnnotation = "velero.kubevirt.io/hotplug-volumes"
+
+	// SkipPoolOwnedVMsLabel indicates that VMs owned by a VirtualMachinePool should not be restored.
+	// The restored pool recreates them instead of adopting the restored VMs.
+	SkipPoolOwnedVMsLabel = "velero.kubevirt.io/skip-pool-owned-vms"
+
+	// PoolOwnerAnnotation stores the name of the VirtualMachinePool owning a backed up VM
+	PoolOwnerAnnotation = "velero.kubevirt.io/pool-owner"
+
+	// PoolVMsAnnotation stores the names of the VMs owned by a backed up VirtualMachinePool
+	PoolVMsAnnotation = "velero.kubevirt.io/pool-vms"
+
+	// SkipGuestFreezeLabel indicates that the guest file systems of running VMIs should not be
+	// frozen during the backup, for example when Velero hooks already take care of it.
+	SkipGuestFreezeLabel = "velero.kubevirt.io/skip-guest-freeze"
+
+	// PauseWithoutGuestAgentLabel indicates that running VMIs without a connected guest agent should be
+	// paused while their volumes are snapshotted, instead of being backed up crash consistent.
+	PauseWithoutGuestAgentLabel = "velero.kubevirt.io/pause-without-guest-agent"
+
+	// FreezeTimeoutLabel overrides how long a guest may stay frozen before KubeVirt thaws it, as a duration (e.g. 2m)
+	FreezeTimeoutLabel = "velero.kubevirt.io/freeze-timeout"
+
+	// LostVolumePolicyLabel chooses whether backing up a VM with volumes whose data is lost on restore,
+	// like HostDisk or Ephemeral volumes, should fail, warn or be ignored. Defaults to warn.
+	LostVolumePolicyLabel = "velero.kubevirt.io/lost-volume-policy"
+
+	// SkipUnsafeLabel indicates that VMs failing a safety check should be left out of the backup with
+	// a warning, instead of failing the backup item
+	SkipUnsafeLabel = "velero.kubevirt.io/skip-unsafe"
+
+	// SkippedUnsafeAnnotation marks a VM or VMI left out of a backup skipping unsafe VMs, with the failed check.
+	// Velero still stores an item its backup action does not fail, the restore actions do not restore it.
+	SkippedUnsafeAnnotation = "velero.kubevirt.io/skipped-unsafe"
+
+	// QuiescedByBackupAnnotation marks a live VMI frozen or paused by a backup, as <operation>/<backup name>,
+	// so the VMI can still be released when the backup is deleted before its operations completed
+	QuiescedByBackupAnnotation = "velero.kubevirt.io/quiesced-by-backup"
+
+	// RestoreEventsAnnotation holds the events to record on a restored VM once it is created, see AddRestoreEvent
+	RestoreEventsAnnotation = "velero.kubevirt.io/restore-events"
+
+	// CrashConsistentAnnotation records on a backed up VMI why its guest could not be frozen
+	CrashConsistentAnnotation = "velero.kubevirt.io/crash-consistent"
+
+	// WaitForHealthyVMsLabel indicates that the restore should track every restored VM until it reaches the
+	// steady state of its run strategy. VMs which don't are reported as errors, or as warnings with the "warn" value.
+	WaitForHealthyVMsLabel = "velero.kubevirt.io/wait-for-healthy-vms"
+
+	// VMHealthTimeoutLabel overrides how long a restored VM is tracked before it is reported, as a duration (e.g. 30m)
+	VMHealthTimeoutLabel = "velero.kubevirt.io/vm-health-timeout"
+
+	// RenamePrefixLabel and RenameSuffixLabel rename every restored VM by adding the value before or after its name
+	RenamePrefixLabel = "velero.kubevirt.io/rename-prefix"
+	RenameSuffixLabel = "velero.kubevirt.io/rename-suffix"
+
+	// RenameVMsAnnotation renames the listed restored VMs, as comma separated old=new pairs. It is an
+	// annotation on the Restore, as label values cannot hold the list.
+	RenameVMsAnnotation = "velero.kubevirt.io/rename-vms"
+
+	// NetworkMappingAnnotation remaps the Multus networks of the restored VMs and VMIs, as comma separated
+	// <namespace>/<name>=<namespace>/<name> pairs from the backed up NetworkAttachmentDefinition to the restored one
+	NetworkMappingAnnotation = "velero.kubevirt.io/network-mapping"
+
+	// PodNetworkFallbackLabel indicates that the Multus networks without a mapping should be replaced by the pod network
+	PodNetworkFallbackLabel = "velero.kubevirt.io/pod-network-fallback"
+
+	// NodePlacementLabel chooses whether the node placement of the restored VMs and VMIs is kept, stripped of the
+	// node name pins of the source cluster (strip-node-names), or removed altogether (strip)
+	NodePlacementLabel = "velero.kubevirt.io/node-placement"
+
+	// NodeLabelMappingAnnotation rewrites the node label keys used by the node placement of the restored VMs and
+	// VMIs, as comma separated old=new pairs
+	NodeLabelMappingAnnotation = "velero.kubevirt.io/node-label-mapping"
+
+	// HostDevicePolicyLabel chooses whether the host devices, GPUs and SR-IOV interfaces of the restored VMs and VMIs
+	// are kept, removed, or remapped to the devices and bindings available in the target cluster
+	HostDevicePolicyLabel = "velero.kubevirt.io/host-device-policy"
+
+	// DeviceMappingAnnotation rewrites the device names of the host devices and GPUs of the restored VMs and VMIs,
+	// as comma separated old=new pairs
+	DeviceMappingAnnotation = "velero.kubevirt.io/device-mapping"
+
+	// SRIOVBindingLabel chooses the binding, bridge or masquerade, replacing SR-IOV when host devices are remapped
+	SRIOVBindingLabel = "velero.kubevirt.io/sriov-binding"
+
+	// OwnerVMAnnotation stores the name of the VM owning a backed up DataVolume, PVC or secret, so the restore
+	// can rename it together with the VM
+	OwnerVMAnnotation = "velero.kubevirt.io/owner-vm"
+
+	// OwnedSecretsAnnotation lists the cloud-init secrets backed up with a VM which only this VM uses, comma
+	// separated, so the restore renames its references together with the secrets
+	OwnedSecretsAnnotation = "velero.kubevirt.io/owned-secrets"
+
+	// VMNameLabel is set by KubeVirt on the VMIs and launcher pods of a VirtualMachine, to the VM name
+	VMNameLabel = "vm.kubevirt.io/name"
+
 	// VeleroExcludeLabel is used to exclude an object from Velero backups.
 	VeleroExcludeLabel = "velero.io/exclude-from-backup"
 
@@ -51,7 +190,20 @@ const (
 	OriginalVolumeSnapshotUIDAnnotation = "velero.kubevirt.io/original-volumesnapshot-uid"
 )
 
+var (
+	clientLock     sync.Mutex
+	k8sClient      *kubernetes.Clientset
+	kubevirtClient *kubecli.KubevirtClient
+)
+
+// GetK8sClient returns the process wide Kubernetes client, creating it on first use
 func GetK8sClient() (*kubernetes.Clientset, error) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	if k8sClient != nil {
+		return k8sClient, nil
+	}
+
 	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
 	configOverrides := &clientcmd.ConfigOverrides{}
 	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
@@ -65,14 +217,25 @@ func GetK8sClient() (*kubernetes.Clientset, error) {
 		return nil, errors.WithStack(err)
 	}
 
+	k8sClient = client
 	return client, nil
 }
 
-func GetLauncherPod(vmiName, vmiNamespace string) (*k8score.Pod, error) {
+// GetLauncherPod returns the launcher pod of the VMI, or nil when it has none. The launcher pods of
+// VMIs not owned by a VM are found among all the launcher pods of the namespace, listed once per backup.
+func GetLauncherPod(vmiName, vmiNamespace string, backup *velerov1.Backup) (*k8score.Pod, error) {
 	pods, err := ListPods(vmiName, vmiNamespace)
 	if err != nil {
 		return nil, err
 	}
+	if len(pods.Items) == 0 {
+		pods, err = CachedLookup(backupLookups, backup, "launcher-pods/"+vmiNamespace, func() (*corev1api.PodList, error) {
+			return ListLauncherPods(vmiNamespace)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	for _, pod := range pods.Items {
 		if pod.Annotations["kubevirt.io/domain"] == vmiName {
@@ -83,17 +246,25 @@ func GetLauncherPod(vmiName, vmiNamespace string) (*k8score.Pod, error) {
 	return nil, nil
 }
 
+// GetKubeVirtclient returns the process wide KubeVirt client, creating it on first use
 func GetKubeVirtclient() (*kubecli.KubevirtClient, error) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	if kubevirtClient != nil {
+		return kubevirtClient, nil
+	}
+
 	kubeConfig := os.Getenv("KUBECONFIG")
 	cfg, err := clientcmd.BuildConfigFromFlags("", kubeConfig)
 	if err != nil {
 		return nil, err
 	}
-	kubevirtClient, err := kubecli.GetKubevirtClientFromRESTConfig(cfg)
+	client, err := kubecli.GetKubevirtClientFromRESTConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
-	return &kubevirtClient, nil
+	kubevirtClient = &client
+	return kubevirtClient, nil
 }
 
 func IsResourceIncluded(resourceKind string, backup *velerov1.Backup) bool {
@@ -146,6 +317,26 @@ func IsResourceInBackup(resourceKind string, backup *velerov1.Backup) bool {
 	return IsResourceIncluded(resourceKind, backup) && !IsResourceExcluded(resourceKind, backup)
 }
 
+// IsResourceInRestore checks the restore included and excluded resources
+func IsResourceInRestore(resourceKind string, restore *velerov1.Restore) bool {
+	included := len(restore.Spec.IncludedResources) == 0
+	for _, res := range restore.Spec.IncludedResources {
+		gr := schema.ParseGroupResource(res)
+		if res == "*" || equalIgnorePlural(gr.Resource, resourceKind) {
+			included = true
+		}
+	}
+
+	for _, res := range restore.Spec.ExcludedResources {
+		gr := schema.ParseGroupResource(res)
+		if equalIgnorePlural(gr.Resource, resourceKind) {
+			return false
+		}
+	}
+
+	return included
+}
+
 func AddAnnotation(item runtime.Unstructured, annotation, value string) {
 	metadata, err := meta.Accessor(item)
 	if err != nil {
@@ -179,8 +370,10 @@ var ListPods = func(name, ns string) (*corev1api.PodList, error) {
 		return nil, err
 	}
 
+	// Launcher pods of VM owned VMIs carry the VM name label, so they don't need
+	// the whole namespace to be listed
 	pods, err := client.CoreV1().Pods(ns).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: "kubevirt.io=virt-launcher",
+		LabelSelector: fmt.Sprintf("kubevirt.io=virt-launcher,%s=%s", VMNameLabel, name),
 	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get launcher pod from VMI %s/%s", ns, name)
@@ -189,6 +382,23 @@ var ListPods = func(name, ns string) (*corev1api.PodList, error) {
 	return pods, nil
 }
 
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var ListLauncherPods = func(ns string) (*corev1api.PodList, error) {
+	client, err := GetK8sClient()
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := client.CoreV1().Pods(ns).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: "kubevirt.io=virt-launcher",
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list launcher pods in namespace %s", ns)
+	}
+
+	return pods, nil
+}
+
 // This is assigned to a variable so it can be replaced by a mock function in tests
 var GetPVC = func(ns, name string) (*corev1api.PersistentVolumeClaim, error) {
 	client, err := GetK8sClient()
@@ -236,6 +446,77 @@ var GetDV = func(ns, name string) (*cdiv1.DataVolume, error) {
 	return dv, nil
 }
 
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var GetDataSource = func(ns, name string) (*cdiv1.DataSource, error) {
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return nil, err
+	}
+
+	dataSource, err := (*client).CdiClient().CdiV1beta1().DataSources(ns).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, err
+		}
+		return nil, errors.Wrapf(err, "failed to get DataSource %s/%s", ns, name)
+	}
+
+	return dataSource, nil
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var GetVMI = func(ns, name string) (*kvv1.VirtualMachineInstance, error) {
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return nil, err
+	}
+
+	vmi, err := (*client).VirtualMachineInstance(ns).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, err
+		}
+		return nil, errors.Wrapf(err, "failed to get VMI %s/%s", ns, name)
+	}
+
+	return vmi, nil
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var GetVM = func(ns, name string) (*kvv1.VirtualMachine, error) {
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return nil, err
+	}
+
+	vm, err := (*client).VirtualMachine(ns).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, err
+		}
+		return nil, errors.Wrapf(err, "failed to get VM %s/%s", ns, name)
+	}
+
+	return vm, nil
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var ListVMs = func(labelSelector, namespace string) (*kvv1.VirtualMachineList, error) {
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return nil, err
+	}
+
+	vms, err := (*client).VirtualMachine(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: labelSelector,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list VMs in namespace %s", namespace)
+	}
+
+	return vms, nil
+}
+
 // This is assigned to a variable so it can be replaced by a mock function in tests
 var IsDVExcludedByLabel = func(namespace, dvName string) (bool, error) {
 	dv, err := GetDV(namespace, dvName)
@@ -273,73 +554,304 @@ var IsPVCExcludedByLabel = func(namespace, pvcName string) (bool, error) {
 	return ok && label == "true", nil
 }
 
-func checkRestoreDataVolumePossible(backup *velerov1.Backup, namespace, name string) (bool, error) {
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var IsConfigMapExcludedByLabel = func(namespace, name string) (bool, error) {
+	client, err := GetK8sClient()
+	if err != nil {
+		return false, err
+	}
+
+	configMap, err := (*client).CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	labels := configMap.GetLabels()
+	if labels == nil {
+		return false, nil
+	}
+
+	label, ok := labels[VeleroExcludeLabel]
+	return ok && label == "true", nil
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var IsSecretExcludedByLabel = func(namespace, name string) (bool, error) {
+	client, err := GetK8sClient()
+	if err != nil {
+		return false, err
+	}
+
+	secret, err := (*client).CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	labels := secret.GetLabels()
+	if labels == nil {
+		return false, nil
+	}
+
+	label, ok := labels[VeleroExcludeLabel]
+	return ok && label == "true", nil
+}
+
+func checkRestoreDataVolumePossible(backup *velerov1.Backup, namespace, name string) (*SafetyCheckFailure, error) {
 	// IsDVExcludedByLabel first checks if DV exists
 	// If not no use of checking restore of DV
-	excluded, err := IsDVExcludedByLabel(namespace, name)
+	excluded, err := CachedLookup(backupLookups, backup, "datavolume/"+namespace+"/"+name, func() (bool, error) {
+		return IsDVExcludedByLabel(namespace, name)
+	})
 	if err != nil {
-		return false, err
+		return nil, err
 	}
+	object := objectRef("datavolumes", namespace, name)
 	if excluded {
-		return false, nil
+		return &SafetyCheckFailure{Reason: DVExcluded, Object: object, Hint: ExcludedByLabelHint()}, nil
 	}
 
 	if !IsResourceInBackup("datavolume", backup) {
-		return false, nil
+		return &SafetyCheckFailure{Reason: DVExcluded, Object: object, Hint: ResourceNotInBackupHint("datavolumes")}, nil
 	}
-	return true, nil
+	return nil, nil
 }
 
-func checkRestorePVCPossible(backup *velerov1.Backup, namespace, claimName string) (bool, error) {
+func checkRestorePVCPossible(backup *velerov1.Backup, namespace, claimName string) (*SafetyCheckFailure, error) {
+	object := objectRef("persistentvolumeclaims", namespace, claimName)
 	if !IsResourceInBackup("persistentvolumeclaims", backup) {
-		return false, nil
+		return &SafetyCheckFailure{Reason: PVCMissing, Object: object, Hint: ResourceNotInBackupHint("persistentvolumeclaims")}, nil
 	}
 
-	excluded, err := IsPVCExcludedByLabel(namespace, claimName)
+	excluded, err := CachedLookup(backupLookups, backup, "persistentvolumeclaim/"+namespace+"/"+claimName, func() (bool, error) {
+		return IsPVCExcludedByLabel(namespace, claimName)
+	})
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	if excluded {
+		return &SafetyCheckFailure{Reason: PVCMissing, Object: object, Hint: ExcludedByLabelHint()}, nil
+	}
+
+	return nil, nil
+}
+
+// IsPVCInBackup checks whether the PVC is backed up along with the objects referencing it: PVCs
+// are part of the backup, and the PVC exists and is not excluded by label
+func IsPVCInBackup(backup *velerov1.Backup, namespace, claimName string) (bool, error) {
+	failure, err := checkRestorePVCPossible(backup, namespace, claimName)
+	if k8serrors.IsNotFound(err) {
 		return false, nil
 	}
+	return failure == nil, err
+}
+
+func checkRestoreConfigMapPossible(backup *velerov1.Backup, namespace, name string) (*SafetyCheckFailure, error) {
+	object := objectRef("configmaps", namespace, name)
+	if !IsResourceInBackup("configmaps", backup) {
+		return &SafetyCheckFailure{Reason: ConfigMapMissing, Object: object, Hint: ResourceNotInBackupHint("configmaps")}, nil
+	}
 
-	return true, nil
+	excluded, err := CachedLookup(backupLookups, backup, "configmap/"+namespace+"/"+name, func() (bool, error) {
+		return IsConfigMapExcludedByLabel(namespace, name)
+	})
+	if k8serrors.IsNotFound(err) {
+		return &SafetyCheckFailure{Reason: ConfigMapMissing, Object: object, Hint: "create it before backing up the VM"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if excluded {
+		return &SafetyCheckFailure{Reason: ConfigMapMissing, Object: object, Hint: ExcludedByLabelHint()}, nil
+	}
+
+	return nil, nil
 }
 
-// RestorePossible returns false in cases when restoring a VM would not be possible due to missing objects
-func RestorePossible(volumes []kvv1.Volume, backup *velerov1.Backup, namespace string, skipVolume func(volume kvv1.Volume) bool, log logrus.FieldLogger) (bool, error) {
+func checkRestoreSecretPossible(backup *velerov1.Backup, namespace, name string) (*SafetyCheckFailure, error) {
+	object := objectRef("secrets", namespace, name)
+	if !IsResourceInBackup("secrets", backup) {
+		return &SafetyCheckFailure{Reason: SecretMissing, Object: object, Hint: ResourceNotInBackupHint("secrets")}, nil
+	}
+
+	excluded, err := CachedLookup(backupLookups, backup, "secret/"+namespace+"/"+name, func() (bool, error) {
+		return IsSecretExcludedByLabel(namespace, name)
+	})
+	if k8serrors.IsNotFound(err) {
+		return &SafetyCheckFailure{Reason: SecretMissing, Object: object, Hint: "create it before backing up the VM"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if excluded {
+		return &SafetyCheckFailure{Reason: SecretMissing, Object: object, Hint: ExcludedByLabelHint()}, nil
+	}
+
+	return nil, nil
+}
+
+// RestorePossible returns why restoring a VM would not be possible due to missing objects, or nil when it is
+func RestorePossible(volumes []kvv1.Volume, backup *velerov1.Backup, config *PluginConfig, namespace string, skipVolume func(volume kvv1.Volume) bool, log logrus.FieldLogger) (*SafetyCheckFailure, error) {
 	// Restore will not be possible if a DV or PVC volume outside VM's DVTemplates is not backed up
 	for _, volume := range volumes {
 		if volume.VolumeSource.DataVolume != nil && !skipVolume(volume) {
-			possible, err := checkRestoreDataVolumePossible(backup, namespace, volume.VolumeSource.DataVolume.Name)
+			failure, err := checkRestoreDataVolumePossible(backup, namespace, volume.VolumeSource.DataVolume.Name)
 			if k8serrors.IsNotFound(err) {
 				// If DV doesnt exist check that the related PVC exists
 				// and can be backed up
-				possible, err = checkRestorePVCPossible(backup, namespace, volume.VolumeSource.DataVolume.Name)
-				if err != nil || !possible {
-					log.Infof("PVC of DV volume source %s not included in backup", volume.VolumeSource.DataVolume.Name)
-					return possible, err
-				}
-			} else if err != nil || !possible {
-				log.Infof("DataVolume %s not included in backup", volume.VolumeSource.DataVolume.Name)
-				return possible, err
+				failure, err = checkRestorePVCPossible(backup, namespace, volume.VolumeSource.DataVolume.Name)
+			}
+			if err != nil || failure != nil {
+				return failure, err
 			}
 		}
 
 		if volume.VolumeSource.PersistentVolumeClaim != nil {
-			possible, err := checkRestorePVCPossible(backup, namespace, volume.VolumeSource.PersistentVolumeClaim.ClaimName)
-			if err != nil || !possible {
-				log.Infof("PVC %s not included in backup", volume.VolumeSource.PersistentVolumeClaim.ClaimName)
-				return possible, err
+			failure, err := checkRestorePVCPossible(backup, namespace, volume.VolumeSource.PersistentVolumeClaim.ClaimName)
+			if err != nil || failure != nil {
+				return failure, err
+			}
+		}
+		if volume.VolumeSource.MemoryDump != nil {
+			// Classified as persisted, so its PVC has to be restored as well
+			failure, err := checkRestorePVCPossible(backup, namespace, volume.VolumeSource.MemoryDump.ClaimName)
+			if err != nil || failure != nil {
+				return failure, err
+			}
+		}
+		if volume.VolumeSource.Sysprep != nil {
+			// The Sysprep answer file is required for the guest to boot
+			if volume.VolumeSource.Sysprep.ConfigMap != nil {
+				failure, err := checkRestoreConfigMapPossible(backup, namespace, volume.VolumeSource.Sysprep.ConfigMap.Name)
+				if err != nil || failure != nil {
+					return failure, err
+				}
+			}
+			if volume.VolumeSource.Sysprep.Secret != nil {
+				failure, err := checkRestoreSecretPossible(backup, namespace, volume.VolumeSource.Sysprep.Secret.Name)
+				if err != nil || failure != nil {
+					return failure, err
+				}
+			}
+		}
+		if volume.VolumeSource.Ephemeral != nil && volume.VolumeSource.Ephemeral.PersistentVolumeClaim != nil {
+			// The overlay is lost, but the VM still needs the backing PVC to boot
+			failure, err := checkRestorePVCPossible(backup, namespace, volume.VolumeSource.Ephemeral.PersistentVolumeClaim.ClaimName)
+			if err != nil || failure != nil {
+				return failure, err
+			}
+		}
+
+		if ClassifyVolume(volume) == VolumeLost {
+			switch GetLostVolumePolicy(backup, config, namespace) {
+			case LostVolumePolicyFail:
+				return &SafetyCheckFailure{
+					Reason: VolumeDataLost,
+					Object: "volume " + volume.Name,
+					Hint:   fmt.Sprintf("set the %s label to %s or %s to back it up anyway", LostVolumePolicyLabel, LostVolumePolicyWarn, LostVolumePolicyIgnore),
+				}, nil
+			case LostVolumePolicyWarn:
+				log.Warnf("Volume %s holds data which is lost on restore", volume.Name)
 			}
 		}
-		// TODO: what about other types of volumes?
 	}
 
-	return true, nil
+	return nil, nil
 }
 
-func getNamespaceAndNetworkName(vmiNamespace, fullNetworkName string) (string, string) {
+// ClassifyVolume tells what happens to the data of a volume when the VM is restored
+func ClassifyVolume(volume kvv1.Volume) VolumeRestoreClass {
+	source := volume.VolumeSource
+	switch {
+	case source.DataVolume != nil, source.PersistentVolumeClaim != nil, source.MemoryDump != nil:
+		return VolumePersisted
+	case source.ContainerDisk != nil, source.EmptyDisk != nil:
+		// Both are reset on every boot anyway
+		return VolumeRecreatable
+	case source.CloudInitNoCloud != nil, source.CloudInitConfigDrive != nil, source.Sysprep != nil,
+		source.ConfigMap != nil, source.Secret != nil, source.ServiceAccount != nil,
+		source.DownwardAPI != nil, source.DownwardMetrics != nil:
+		// Generated from the VM definition and the objects it references
+		return VolumeRecreatable
+	case source.HostDisk != nil, source.Ephemeral != nil:
+		// Node local contents and ephemeral overlays are not part of the backup
+		return VolumeLost
+	default:
+		// Assume the worst for volume types unknown to the plugin
+		return VolumeLost
+	}
+}
+
+// GetLostVolumePolicy returns the policy requested by the backup for volumes whose data is lost on restore
+func GetLostVolumePolicy(backup *velerov1.Backup, config *PluginConfig, namespace string) LostVolumePolicy {
+	value, _ := lookupSetting(backup.ObjectMeta, config, namespace, LostVolumePolicyLabel)
+	switch policy := LostVolumePolicy(value); policy {
+	case LostVolumePolicyFail, LostVolumePolicyWarn, LostVolumePolicyIgnore:
+		return policy
+	default:
+		return LostVolumePolicyWarn
+	}
+}
+
+// NodePlacementPolicy tells what happens to the node placement of restored VMs and VMIs
+type NodePlacementPolicy string
+
+const (
+	NodePlacementKeep           NodePlacementPolicy = "keep"
+	NodePlacementStripNodeNames NodePlacementPolicy = "strip-node-names"
+	NodePlacementStrip          NodePlacementPolicy = "strip"
+)
+
+// GetNodePlacementPolicy returns the node placement policy requested by the restore, keep by default
+func GetNodePlacementPolicy(restore *velerov1.Restore, config *PluginConfig, namespace string) NodePlacementPolicy {
+	value, _ := lookupSetting(restore.ObjectMeta, config, namespace, NodePlacementLabel)
+	switch policy := NodePlacementPolicy(value); policy {
+	case NodePlacementStripNodeNames, NodePlacementStrip:
+		return policy
+	default:
+		return NodePlacementKeep
+	}
+}
+
+// HostDevicePolicy tells what happens to the host devices, GPUs and SR-IOV interfaces of restored VMs and VMIs
+type HostDevicePolicy string
+
+const (
+	HostDevicePolicyKeep   HostDevicePolicy = "keep"
+	HostDevicePolicyRemove HostDevicePolicy = "remove"
+	HostDevicePolicyRemap  HostDevicePolicy = "remap"
+)
+
+// GetHostDevicePolicy returns the host device policy requested by the restore, keep by default
+func GetHostDevicePolicy(restore *velerov1.Restore, config *PluginConfig, namespace string) HostDevicePolicy {
+	value, _ := lookupSetting(restore.ObjectMeta, config, namespace, HostDevicePolicyLabel)
+	switch policy := HostDevicePolicy(value); policy {
+	case HostDevicePolicyRemove, HostDevicePolicyRemap:
+		return policy
+	default:
+		return HostDevicePolicyKeep
+	}
+}
+
+// SRIOVBinding is the interface binding replacing SR-IOV when host devices are remapped
+type SRIOVBinding string
+
+const (
+	SRIOVBindingBridge     SRIOVBinding = "bridge"
+	SRIOVBindingMasquerade SRIOVBinding = "masquerade"
+)
+
+// GetSRIOVBinding returns the interface binding replacing SR-IOV requested by the restore, bridge by default
+func GetSRIOVBinding(restore *velerov1.Restore, config *PluginConfig, namespace string) SRIOVBinding {
+	value, _ := lookupSetting(restore.ObjectMeta, config, namespace, SRIOVBindingLabel)
+	if binding := SRIOVBinding(value); binding == SRIOVBindingMasquerade {
+		return binding
+	}
+	return SRIOVBindingBridge
+}
+
+// GetNamespaceAndNetworkName splits a Multus network name in the <namespace>/<networkName> format.
+// If the namespace is not specified the VMI namespace is assumed.
+func GetNamespaceAndNetworkName(vmiNamespace, fullNetworkName string) (string, string) {
 	if strings.Contains(fullNetworkName, "/") {
 		res := strings.SplitN(fullNetworkName, "/", 2)
 		return res[0], res[1]
@@ -347,19 +859,350 @@ func getNamespaceAndNetworkName(vmiNamespace, fullNetworkName string) (string, s
 	return vmiNamespace, fullNetworkName
 }
 
-func GetRestoreRunStrategy(restore *velerov1.Restore) (kvv1.VirtualMachineRunStrategy, bool) {
-	if metav1.HasLabel(restore.ObjectMeta, RestoreRunStrategy) {
-		return kvv1.VirtualMachineRunStrategy(restore.Labels[RestoreRunStrategy]), true
+// GetCrossNamespaceNetworks returns the Multus network names referenced by the VMI spec
+// which live outside of the VMI namespace and therefore are not part of the object graph
+func GetCrossNamespaceNetworks(vmiSpec *kvv1.VirtualMachineInstanceSpec, vmiNamespace string) []string {
+	var networks []string
+	for _, network := range vmiSpec.Networks {
+		if network.Multus == nil {
+			continue
+		}
+		namespace, _ := GetNamespaceAndNetworkName(vmiNamespace, network.Multus.NetworkName)
+		if namespace != vmiNamespace {
+			networks = append(networks, network.Multus.NetworkName)
+		}
+	}
+	return networks
+}
+
+// GetRestoreRunStrategy returns the run strategy requested by the restore, if any. An invalid one keeps the
+// run strategy of the backed up VM.
+func GetRestoreRunStrategy(restore *velerov1.Restore, config *PluginConfig, namespace string) (kvv1.VirtualMachineRunStrategy, bool) {
+	runStrategy, ok := lookupSetting(restore.ObjectMeta, config, namespace, RestoreRunStrategy)
+	if !ok || validateRunStrategy(runStrategy) != nil {
+		return "", false
+	}
+	return kvv1.VirtualMachineRunStrategy(runStrategy), true
+}
+
+func IsMetadataBackup(backup *velerov1.Backup, config *PluginConfig, namespace string) bool {
+	return isSettingEnabled(backup.ObjectMeta, config, namespace, MetadataBackupLabel)
+}
+
+func ShouldSkipGuestFreeze(backup *velerov1.Backup, config *PluginConfig, namespace string) bool {
+	return isSettingEnabled(backup.ObjectMeta, config, namespace, SkipGuestFreezeLabel)
+}
+
+func ShouldSkipUnsafe(backup *velerov1.Backup, config *PluginConfig, namespace string) bool {
+	return isSettingEnabled(backup.ObjectMeta, config, namespace, SkipUnsafeLabel)
+}
+
+func ShouldPauseWithoutGuestAgent(backup *velerov1.Backup, config *PluginConfig, namespace string) bool {
+	return isSettingEnabled(backup.ObjectMeta, config, namespace, PauseWithoutGuestAgentLabel)
+}
+
+// GetFreezeTimeout returns the freeze timeout requested by the backup or the config, or DefaultFreezeTimeout
+func GetFreezeTimeout(backup *velerov1.Backup, config *PluginConfig, namespace string) (time.Duration, error) {
+	return getTimeoutSetting(backup.ObjectMeta, config, namespace, FreezeTimeoutLabel, DefaultFreezeTimeout)
+}
+
+func IsGuestAgentConnected(vmi *kvv1.VirtualMachineInstance) bool {
+	for _, c := range vmi.Status.Conditions {
+		if c.Type == kvv1.VirtualMachineInstanceAgentConnected && c.Status == k8score.ConditionTrue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var FreezeVMI = func(ns, name string, unfreezeTimeout time.Duration) error {
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return err
+	}
+
+	return (*client).VirtualMachineInstance(ns).Freeze(context.TODO(), name, unfreezeTimeout)
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var UnfreezeVMI = func(ns, name string) error {
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return err
+	}
+
+	return (*client).VirtualMachineInstance(ns).Unfreeze(context.TODO(), name)
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var SetVMIAnnotation = func(ns, name, key string, value *string) error {
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return err
+	}
+
+	// A nil value removes the annotation
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{key: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = (*client).VirtualMachineInstance(ns).Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var SetVMAnnotation = func(ns, name, key string, value *string) error {
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return err
+	}
+
+	// A nil value removes the annotation
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{key: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = (*client).VirtualMachine(ns).Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var PauseVMI = func(ns, name string) error {
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return err
+	}
+
+	return (*client).VirtualMachineInstance(ns).Pause(context.TODO(), name, &kvv1.PauseOptions{})
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var UnpauseVMI = func(ns, name string) error {
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return err
+	}
+
+	return (*client).VirtualMachineInstance(ns).Unpause(context.TODO(), name, &kvv1.UnpauseOptions{})
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var ListBackupVolumeSnapshots = func(backup *velerov1.Backup, ns string) ([]snapshotv1.VolumeSnapshot, error) {
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return nil, err
+	}
+
+	// Velero labels the CSI snapshots it takes with the name of the backup
+	list, err := (*client).DynamicClient().Resource(snapshotv1.SchemeGroupVersion.WithResource("volumesnapshots")).Namespace(ns).
+		List(context.TODO(), metav1.ListOptions{LabelSelector: velerov1.BackupNameLabel + "=" + label.GetValidName(backup.Name)})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			// The snapshot CRDs are not installed
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to list the volume snapshots of backup %s in namespace %s", backup.Name, ns)
+	}
+
+	snapshots := make([]snapshotv1.VolumeSnapshot, len(list.Items))
+	for i := range list.Items {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(list.Items[i].UnstructuredContent(), &snapshots[i]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return snapshots, nil
+}
+
+// This is assigned to a variable so it can be replaced by a mock function in tests
+var ListBackupPodVolumeBackups = func(backup *velerov1.Backup) ([]velerov1.PodVolumeBackup, error) {
+	client, err := GetKubeVirtclient()
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := (*client).DynamicClient().Resource(velerov1.SchemeGroupVersion.WithResource("podvolumebackups")).Namespace(GetVeleroNamespace()).
+		List(context.TODO(), metav1.ListOptions{LabelSelector: velerov1.BackupNameLabel + "=" + label.GetValidName(backup.Name)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list the pod volume backups of backup %s", backup.Name)
+	}
+
+	podVolumeBackups := make([]velerov1.PodVolumeBackup, len(list.Items))
+	for i := range list.Items {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(list.Items[i].UnstructuredContent(), &podVolumeBackups[i]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return podVolumeBackups, nil
+}
+
+func ShouldBackupClusterInstancetypes(backup *velerov1.Backup, config *PluginConfig, namespace string) bool {
+	return isSettingEnabled(backup.ObjectMeta, config, namespace, BackupClusterInstancetypesLabel)
+}
+
+func ShouldRestoreHotplugVolumes(restore *velerov1.Restore, config *PluginConfig, namespace string) bool {
+	return isSettingEnabled(restore.ObjectMeta, config, namespace, RestoreHotplugVolumesLabel)
+}
+
+// GetHotplugVolumes returns the volumes hotplugged to the VM which are not part of the VM template,
+// either pending in the VM volume requests or attached to the running VMI
+func GetHotplugVolumes(vm *kvv1.VirtualMachine, vmi *kvv1.VirtualMachineInstance) []kvv1.AddVolumeOptions {
+	known := map[string]bool{}
+	if vm.Spec.Template != nil {
+		for _, volume := range vm.Spec.Template.Spec.Volumes {
+			known[volume.Name] = true
+		}
+	}
+
+	var hotplugVolumes []kvv1.AddVolumeOptions
+	for _, request := range vm.Status.VolumeRequests {
+		options := request.AddVolumeOptions
+		if options == nil || options.VolumeSource == nil || known[options.Name] {
+			continue
+		}
+		known[options.Name] = true
+		hotplugVolumes = append(hotplugVolumes, *options)
+	}
+
+	if vmi == nil {
+		return hotplugVolumes
+	}
+	for _, volumeStatus := range vmi.Status.VolumeStatus {
+		if volumeStatus.HotplugVolume == nil || known[volumeStatus.Name] {
+			continue
+		}
+		for _, volume := range vmi.Spec.Volumes {
+			if volume.Name != volumeStatus.Name {
+				continue
+			}
+			source := &kvv1.HotplugVolumeSource{
+				DataVolume:            volume.DataVolume,
+				PersistentVolumeClaim: volume.PersistentVolumeClaim,
+			}
+			if source.DataVolume == nil && source.PersistentVolumeClaim == nil {
+				continue
+			}
+			options := kvv1.AddVolumeOptions{
+				Name:         volume.Name,
+				VolumeSource: source,
+			}
+			for i := range vmi.Spec.Domain.Devices.Disks {
+				if vmi.Spec.Domain.Devices.Disks[i].Name == volume.Name {
+					options.Disk = vmi.Spec.Domain.Devices.Disks[i].DeepCopy()
+				}
+			}
+			known[volume.Name] = true
+			hotplugVolumes = append(hotplugVolumes, options)
+		}
+	}
+
+	return hotplugVolumes
+}
+
+// ApplyHotplugVolumes adds the hotplugged volumes and their disks to the VMI spec as persistent volumes
+func ApplyHotplugVolumes(vmiSpec *kvv1.VirtualMachineInstanceSpec, hotplugVolumes []kvv1.AddVolumeOptions) {
+	for _, options := range hotplugVolumes {
+		exists := false
+		for _, volume := range vmiSpec.Volumes {
+			if volume.Name == options.Name {
+				exists = true
+			}
+		}
+		if exists || options.VolumeSource == nil {
+			continue
+		}
+
+		vmiSpec.Volumes = append(vmiSpec.Volumes, kvv1.Volume{
+			Name: options.Name,
+			VolumeSource: kvv1.VolumeSource{
+				DataVolume:            options.VolumeSource.DataVolume,
+				PersistentVolumeClaim: options.VolumeSource.PersistentVolumeClaim,
+			},
+		})
+		disk := kvv1.Disk{}
+		if options.Disk != nil {
+			disk = *options.Disk
+		}
+		disk.Name = options.Name
+		vmiSpec.Domain.Devices.Disks = append(vmiSpec.Domain.Devices.Disks, disk)
+	}
+}
+
+func ShouldWaitForHealthyVMs(restore *velerov1.Restore, config *PluginConfig, namespace string) bool {
+	return isSettingEnabled(restore.ObjectMeta, config, namespace, WaitForHealthyVMsLabel)
+}
+
+// ShouldWarnOnUnhealthyVMs tells whether unhealthy restored VMs are reported as warnings instead of errors
+func ShouldWarnOnUnhealthyVMs(restore *velerov1.Restore, config *PluginConfig, namespace string) bool {
+	value, _ := lookupSetting(restore.ObjectMeta, config, namespace, WaitForHealthyVMsLabel)
+	return value == "warn"
+}
+
+// GetVMHealthTimeout returns the VM health timeout requested by the restore or the config, or DefaultVMHealthTimeout
+func GetVMHealthTimeout(restore *velerov1.Restore, config *PluginConfig, namespace string) (time.Duration, error) {
+	return getTimeoutSetting(restore.ObjectMeta, config, namespace, VMHealthTimeoutLabel, DefaultVMHealthTimeout)
+}
+
+// IsVMInSteadyState checks whether a VM reached the steady state of its run strategy
+func IsVMInSteadyState(vm *kvv1.VirtualMachine) bool {
+	runStrategy, err := vm.RunStrategy()
+	if err != nil {
+		return false
+	}
+
+	status := vm.Status.PrintableStatus
+	switch runStrategy {
+	case kvv1.RunStrategyAlways, kvv1.RunStrategyRerunOnFailure:
+		return status == kvv1.VirtualMachineStatusRunning && vm.Status.Ready
+	case kvv1.RunStrategyHalted:
+		return status == kvv1.VirtualMachineStatusStopped
+	case kvv1.RunStrategyManual:
+		return status == kvv1.VirtualMachineStatusStopped || status == kvv1.VirtualMachineStatusRunning || status == kvv1.VirtualMachineStatusPaused
+	case kvv1.RunStrategyOnce:
+		return status == kvv1.VirtualMachineStatusRunning || status == kvv1.VirtualMachineStatusStopped
+	case kvv1.RunStrategyWaitAsReceiver:
+		return status == kvv1.VirtualMachineStatusWaitingForReceiver
+	}
+	return false
+}
+
+func ShouldSkipPoolOwnedVMs(restore *velerov1.Restore, config *PluginConfig, namespace string) bool {
+	return isSettingEnabled(restore.ObjectMeta, config, namespace, SkipPoolOwnedVMsLabel)
+}
+
+// GetPoolOwner returns the name of the VirtualMachinePool controlling the object, if any
+func GetPoolOwner(obj metav1.Object) (string, bool) {
+	for _, owner := range obj.GetOwnerReferences() {
+		if owner.Kind == "VirtualMachinePool" && owner.Controller != nil && *owner.Controller {
+			return owner.Name, true
+		}
 	}
 	return "", false
 }
 
-func IsMetadataBackup(backup *velerov1.Backup) bool {
-	return metav1.HasLabel(backup.ObjectMeta, MetadataBackupLabel)
+// GetVMOwner returns the name of the VirtualMachine controlling the object, if any
+func GetVMOwner(obj metav1.Object) (string, bool) {
+	for _, owner := range obj.GetOwnerReferences() {
+		if owner.Kind == "VirtualMachine" && owner.Controller != nil && *owner.Controller {
+			return owner.Name, true
+		}
+	}
+	return "", false
 }
 
-func ShouldClearMacAddress(restore *velerov1.Restore) bool {
-	return metav1.HasLabel(restore.ObjectMeta, ClearMacAddressLabel)
+func ShouldClearMacAddress(restore *velerov1.Restore, config *PluginConfig, namespace string) bool {
+	return isSettingEnabled(restore.ObjectMeta, config, namespace, ClearMacAddressLabel)
 }
 
 func ClearMacAddress(vmiSpec *kvv1.VirtualMachineInstanceSpec) {
@@ -368,8 +1211,8 @@ func ClearMacAddress(vmiSpec *kvv1.VirtualMachineInstanceSpec) {
 	}
 }
 
-func ShouldGenerateNewFirmwareUUID(restore *velerov1.Restore) bool {
-	return metav1.HasLabel(restore.ObjectMeta, GenerateNewFirmwareUUIDLabel)
+func ShouldGenerateNewFirmwareUUID(restore *velerov1.Restore, config *PluginConfig, namespace string) bool {
+	return isSettingEnabled(restore.ObjectMeta, config, namespace, GenerateNewFirmwareUUIDLabel)
 }
 
 // GenerateNewFirmwareUUID generates a new random firmware UUID for the restored VM
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/sirupsen/logrus"
@@ -10,6 +11,7 @@ import (
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
 	kvcore "kubevirt.io/api/core/v1"
 )
 
@@ -410,10 +412,276 @@ func TestRestorePossible(t *testing.T) {
 		IsPVCExcludedByLabel = func(namespace, pvcName string) (bool, error) { return tc.isPvcExcluded(namespace, pvcName) }
 
 		t.Run(tc.name, func(t *testing.T) {
-			possible, err := RestorePossible(tc.volumes, &tc.backup, "", tc.extraTest, &logrus.Logger{})
+			failure, err := RestorePossible(tc.volumes, &tc.backup, nil, "", tc.extraTest, &logrus.Logger{})
 
 			assert.NoError(t, err)
-			assert.Equal(t, tc.expected, possible)
+			assert.Equal(t, tc.expected, failure == nil)
+		})
+	}
+}
+
+func TestRestorePossibleSysprep(t *testing.T) {
+	returnFalse := func(something ...interface{}) (bool, error) { return false, nil }
+	returnTrue := func(something ...interface{}) (bool, error) { return true, nil }
+	returnNotFound := func(something ...interface{}) (bool, error) {
+		return false, k8serrors.NewNotFound(schema.GroupResource{Group: "", Resource: "configmaps"}, "sysprep")
+	}
+	skipFalse := func(volume kvcore.Volume) bool { return false }
+
+	configMapVolumes := []kvcore.Volume{
+		{
+			VolumeSource: kvcore.VolumeSource{
+				Sysprep: &kvcore.SysprepSource{
+					ConfigMap: &v1.LocalObjectReference{Name: "sysprep-cm"},
+				},
+			},
+		},
+	}
+	secretVolumes := []kvcore.Volume{
+		{
+			VolumeSource: kvcore.VolumeSource{
+				Sysprep: &kvcore.SysprepSource{
+					Secret: &v1.LocalObjectReference{Name: "sysprep-secret"},
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name                string
+		volumes             []kvcore.Volume
+		backup              velerov1.Backup
+		isConfigMapExcluded func(something ...interface{}) (bool, error)
+		isSecretExcluded    func(something ...interface{}) (bool, error)
+		expected            bool
+	}{
+		{"Returns true if Sysprep ConfigMap is included in backup",
+			configMapVolumes,
+			velerov1.Backup{},
+			returnFalse,
+			returnFalse,
+			true,
+		},
+		{"Returns false if Sysprep ConfigMap is excluded from backup",
+			configMapVolumes,
+			velerov1.Backup{
+				Spec: velerov1.BackupSpec{
+					ExcludedResources: []string{"configmaps"},
+				},
+			},
+			returnFalse,
+			returnFalse,
+			false,
+		},
+		{"Returns false if Sysprep ConfigMap is excluded by label",
+			configMapVolumes,
+			velerov1.Backup{},
+			returnTrue,
+			returnFalse,
+			false,
+		},
+		{"Returns false if Sysprep ConfigMap does not exist",
+			configMapVolumes,
+			velerov1.Backup{},
+			returnNotFound,
+			returnFalse,
+			false,
+		},
+		{"Returns true if Sysprep Secret is included in backup",
+			secretVolumes,
+			velerov1.Backup{
+				Spec: velerov1.BackupSpec{
+					IncludedResources: []string{"secrets"},
+				},
+			},
+			returnFalse,
+			returnFalse,
+			true,
+		},
+		{"Returns false if Sysprep Secret is not included in backup",
+			secretVolumes,
+			velerov1.Backup{
+				Spec: velerov1.BackupSpec{
+					IncludedResources: []string{"configmaps"},
+				},
+			},
+			returnFalse,
+			returnFalse,
+			false,
+		},
+		{"Returns false if Sysprep Secret is excluded by label",
+			secretVolumes,
+			velerov1.Backup{},
+			returnFalse,
+			returnTrue,
+			false,
+		},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	for _, tc := range testCases {
+		IsConfigMapExcludedByLabel = func(namespace, name string) (bool, error) { return tc.isConfigMapExcluded(namespace, name) }
+		IsSecretExcludedByLabel = func(namespace, name string) (bool, error) { return tc.isSecretExcluded(namespace, name) }
+
+		t.Run(tc.name, func(t *testing.T) {
+			failure, err := RestorePossible(tc.volumes, &tc.backup, nil, "", skipFalse, &logrus.Logger{})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, failure == nil)
+		})
+	}
+}
+
+func TestClassifyVolume(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   kvcore.VolumeSource
+		expected VolumeRestoreClass
+	}{
+		{"DataVolume is persisted", kvcore.VolumeSource{DataVolume: &kvcore.DataVolumeSource{Name: "dv"}}, VolumePersisted},
+		{"PVC is persisted", kvcore.VolumeSource{PersistentVolumeClaim: &kvcore.PersistentVolumeClaimVolumeSource{}}, VolumePersisted},
+		{"MemoryDump is persisted", kvcore.VolumeSource{MemoryDump: &kvcore.MemoryDumpVolumeSource{}}, VolumePersisted},
+		{"ContainerDisk is recreatable", kvcore.VolumeSource{ContainerDisk: &kvcore.ContainerDiskSource{}}, VolumeRecreatable},
+		{"EmptyDisk is recreatable", kvcore.VolumeSource{EmptyDisk: &kvcore.EmptyDiskSource{}}, VolumeRecreatable},
+		{"CloudInitNoCloud is recreatable", kvcore.VolumeSource{CloudInitNoCloud: &kvcore.CloudInitNoCloudSource{}}, VolumeRecreatable},
+		{"DownwardAPI is recreatable", kvcore.VolumeSource{DownwardAPI: &kvcore.DownwardAPIVolumeSource{}}, VolumeRecreatable},
+		{"HostDisk is lost", kvcore.VolumeSource{HostDisk: &kvcore.HostDisk{}}, VolumeLost},
+		{"Ephemeral is lost", kvcore.VolumeSource{Ephemeral: &kvcore.EphemeralVolumeSource{}}, VolumeLost},
+		{"Unknown volume is lost", kvcore.VolumeSource{}, VolumeLost},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, ClassifyVolume(kvcore.Volume{VolumeSource: tc.source}))
+		})
+	}
+}
+
+func TestRestorePossibleLostVolumes(t *testing.T) {
+	skipFalse := func(volume kvcore.Volume) bool { return false }
+	hostDiskVolumes := []kvcore.Volume{
+		{
+			Name:         "hostdisk",
+			VolumeSource: kvcore.VolumeSource{HostDisk: &kvcore.HostDisk{Path: "/data/disk.img"}},
+		},
+	}
+	ephemeralVolumes := []kvcore.Volume{
+		{
+			Name: "ephemeral",
+			VolumeSource: kvcore.VolumeSource{
+				Ephemeral: &kvcore.EphemeralVolumeSource{
+					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "base-pvc"},
+				},
+			},
+		},
+	}
+	memoryDumpVolumes := []kvcore.Volume{
+		{
+			Name: "memorydump",
+			VolumeSource: kvcore.VolumeSource{
+				MemoryDump: &kvcore.MemoryDumpVolumeSource{
+					PersistentVolumeClaimVolumeSource: kvcore.PersistentVolumeClaimVolumeSource{
+						PersistentVolumeClaimVolumeSource: v1.PersistentVolumeClaimVolumeSource{ClaimName: "memorydump-pvc"},
+					},
+				},
+			},
+		},
+	}
+	backupWithPolicy := func(policy string) velerov1.Backup {
+		return velerov1.Backup{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{LostVolumePolicyLabel: policy},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name          string
+		volumes       []kvcore.Volume
+		backup        velerov1.Backup
+		isPvcExcluded bool
+		expected      SafetyCheckReason
+	}{
+		{"Lost volume should be allowed by default", hostDiskVolumes, velerov1.Backup{}, false, ""},
+		{"Lost volume should be allowed with warn policy", hostDiskVolumes, backupWithPolicy("warn"), false, ""},
+		{"Lost volume should be allowed with ignore policy", hostDiskVolumes, backupWithPolicy("ignore"), false, ""},
+		{"Lost volume should fail with fail policy", hostDiskVolumes, backupWithPolicy("fail"), false, VolumeDataLost},
+		{"Unknown policy should fall back to warn", hostDiskVolumes, backupWithPolicy("explode"), false, ""},
+		{"Ephemeral volume should fail with fail policy", ephemeralVolumes, backupWithPolicy("fail"), false, VolumeDataLost},
+		{"Ephemeral volume should require its backing PVC", ephemeralVolumes, velerov1.Backup{}, true, PVCMissing},
+		{"Memory dump volume should require its PVC", memoryDumpVolumes, velerov1.Backup{}, true, PVCMissing},
+		{"Memory dump volume should be allowed with its PVC", memoryDumpVolumes, velerov1.Backup{}, false, ""},
+		{"Memory dump volume should require PVCs in the backup", memoryDumpVolumes,
+			velerov1.Backup{Spec: velerov1.BackupSpec{ExcludedResources: []string{"persistentvolumeclaims"}}}, false, PVCMissing},
+	}
+
+	logrus.SetLevel(logrus.ErrorLevel)
+	for _, tc := range testCases {
+		IsPVCExcludedByLabel = func(namespace, pvcName string) (bool, error) { return tc.isPvcExcluded, nil }
+
+		t.Run(tc.name, func(t *testing.T) {
+			failure, err := RestorePossible(tc.volumes, &tc.backup, nil, "", skipFalse, &logrus.Logger{})
+
+			assert.NoError(t, err)
+			if tc.expected == "" {
+				assert.Nil(t, failure)
+			} else if assert.NotNil(t, failure) {
+				assert.Equal(t, tc.expected, failure.Reason)
+			}
+		})
+	}
+}
+
+func TestIsResourceInRestore(t *testing.T) {
+	testCases := []struct {
+		name     string
+		spec     velerov1.RestoreSpec
+		expected bool
+	}{
+		{"Resource should be in restore by default", velerov1.RestoreSpec{}, true},
+		{"Resource should be in restore when included", velerov1.RestoreSpec{IncludedResources: []string{"persistentvolumeclaims"}}, true},
+		{"Resource should be in restore when all resources are included", velerov1.RestoreSpec{IncludedResources: []string{"*"}}, true},
+		{"Resource should not be in restore when not included", velerov1.RestoreSpec{IncludedResources: []string{"datavolumes"}}, false},
+		{"Resource should not be in restore when excluded", velerov1.RestoreSpec{ExcludedResources: []string{"persistentvolumeclaims"}}, false},
+		{"Resource should not be in restore when included and excluded", velerov1.RestoreSpec{IncludedResources: []string{"*"}, ExcludedResources: []string{"persistentvolumeclaim"}}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, IsResourceInRestore("persistentvolumeclaims", &velerov1.Restore{Spec: tc.spec}))
+		})
+	}
+}
+
+func TestIsVMInSteadyState(t *testing.T) {
+	newVM := func(runStrategy kvcore.VirtualMachineRunStrategy, status kvcore.VirtualMachinePrintableStatus, ready bool) *kvcore.VirtualMachine {
+		return &kvcore.VirtualMachine{
+			Spec:   kvcore.VirtualMachineSpec{RunStrategy: &runStrategy},
+			Status: kvcore.VirtualMachineStatus{PrintableStatus: status, Ready: ready},
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		vm       *kvcore.VirtualMachine
+		expected bool
+	}{
+		{"Always VM should be healthy when running and ready", newVM(kvcore.RunStrategyAlways, kvcore.VirtualMachineStatusRunning, true), true},
+		{"Always VM should not be healthy when running but not ready", newVM(kvcore.RunStrategyAlways, kvcore.VirtualMachineStatusRunning, false), false},
+		{"Always VM should not be healthy when unschedulable", newVM(kvcore.RunStrategyAlways, kvcore.VirtualMachineStatusUnschedulable, false), false},
+		{"RerunOnFailure VM should not be healthy on DataVolume error", newVM(kvcore.RunStrategyRerunOnFailure, kvcore.VirtualMachineStatusDataVolumeError, false), false},
+		{"Halted VM should be healthy when stopped", newVM(kvcore.RunStrategyHalted, kvcore.VirtualMachineStatusStopped, false), true},
+		{"Halted VM should not be healthy while provisioning", newVM(kvcore.RunStrategyHalted, kvcore.VirtualMachineStatusProvisioning, false), false},
+		{"Manual VM should be healthy when paused", newVM(kvcore.RunStrategyManual, kvcore.VirtualMachineStatusPaused, false), true},
+		{"Once VM should be healthy when stopped", newVM(kvcore.RunStrategyOnce, kvcore.VirtualMachineStatusStopped, false), true},
+		{"VM with running and run strategy should not be healthy", &kvcore.VirtualMachine{
+			Spec: kvcore.VirtualMachineSpec{Running: ptr.To(true), RunStrategy: ptr.To(kvcore.RunStrategyAlways)},
+		}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, IsVMInSteadyState(tc.vm))
 		})
 	}
 }
@@ -450,10 +718,168 @@ func TestIsMacAddressCleared(t *testing.T) {
 	logrus.SetLevel(logrus.ErrorLevel)
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result := ShouldClearMacAddress(&tc.restore)
+			result := ShouldClearMacAddress(&tc.restore, nil, "")
 
 			assert.Equal(t, tc.expected, result)
 		})
 	}
 }
 
+func TestGetCrossNamespaceNetworks(t *testing.T) {
+	vmiSpec := &kvcore.VirtualMachineInstanceSpec{
+		Networks: []kvcore.Network{
+			{
+				Name: "default",
+				NetworkSource: kvcore.NetworkSource{
+					Pod: &kvcore.PodNetwork{},
+				},
+			},
+			{
+				Name: "same-namespace",
+				NetworkSource: kvcore.NetworkSource{
+					Multus: &kvcore.MultusNetwork{NetworkName: "nad"},
+				},
+			},
+			{
+				Name: "explicit-namespace",
+				NetworkSource: kvcore.NetworkSource{
+					Multus: &kvcore.MultusNetwork{NetworkName: "test-namespace/nad"},
+				},
+			},
+			{
+				Name: "other-namespace",
+				NetworkSource: kvcore.NetworkSource{
+					Multus: &kvcore.MultusNetwork{NetworkName: "other-namespace/nad"},
+				},
+			},
+		},
+	}
+
+	networks := GetCrossNamespaceNetworks(vmiSpec, "test-namespace")
+	assert.Equal(t, []string{"other-namespace/nad"}, networks)
+}
+
+func TestGetHotplugVolumes(t *testing.T) {
+	vm := &kvcore.VirtualMachine{
+		Spec: kvcore.VirtualMachineSpec{
+			Template: &kvcore.VirtualMachineInstanceTemplateSpec{
+				Spec: kvcore.VirtualMachineInstanceSpec{
+					Volumes: []kvcore.Volume{
+						{
+							Name: "rootdisk",
+							VolumeSource: kvcore.VolumeSource{
+								DataVolume: &kvcore.DataVolumeSource{Name: "rootdisk-dv"},
+							},
+						},
+					},
+				},
+			},
+		},
+		Status: kvcore.VirtualMachineStatus{
+			VolumeRequests: []kvcore.VirtualMachineVolumeRequest{
+				{
+					AddVolumeOptions: &kvcore.AddVolumeOptions{
+						Name: "requested",
+						VolumeSource: &kvcore.HotplugVolumeSource{
+							DataVolume: &kvcore.DataVolumeSource{Name: "requested-dv", Hotpluggable: true},
+						},
+					},
+				},
+				{
+					RemoveVolumeOptions: &kvcore.RemoveVolumeOptions{
+						Name: "removed",
+					},
+				},
+			},
+		},
+	}
+	vmi := &kvcore.VirtualMachineInstance{
+		Spec: kvcore.VirtualMachineInstanceSpec{
+			Domain: kvcore.DomainSpec{
+				Devices: kvcore.Devices{
+					Disks: []kvcore.Disk{
+						{Name: "rootdisk"},
+						{Name: "attached", DiskDevice: kvcore.DiskDevice{Disk: &kvcore.DiskTarget{Bus: kvcore.DiskBusSCSI}}},
+					},
+				},
+			},
+			Volumes: []kvcore.Volume{
+				{
+					Name: "rootdisk",
+					VolumeSource: kvcore.VolumeSource{
+						DataVolume: &kvcore.DataVolumeSource{Name: "rootdisk-dv"},
+					},
+				},
+				{
+					Name: "attached",
+					VolumeSource: kvcore.VolumeSource{
+						PersistentVolumeClaim: &kvcore.PersistentVolumeClaimVolumeSource{
+							PersistentVolumeClaimVolumeSource: v1.PersistentVolumeClaimVolumeSource{ClaimName: "attached-pvc"},
+							Hotpluggable:                      true,
+						},
+					},
+				},
+			},
+		},
+		Status: kvcore.VirtualMachineInstanceStatus{
+			VolumeStatus: []kvcore.VolumeStatus{
+				{Name: "rootdisk"},
+				{Name: "attached", HotplugVolume: &kvcore.HotplugVolumeStatus{AttachPodName: "hp-volume-abcde"}},
+			},
+		},
+	}
+
+	hotplugVolumes := GetHotplugVolumes(vm, vmi)
+	assert.Equal(t, 2, len(hotplugVolumes))
+	assert.Equal(t, "requested", hotplugVolumes[0].Name)
+	assert.Equal(t, "attached", hotplugVolumes[1].Name)
+	assert.Equal(t, "attached-pvc", hotplugVolumes[1].VolumeSource.PersistentVolumeClaim.ClaimName)
+	assert.Equal(t, kvcore.DiskBusSCSI, hotplugVolumes[1].Disk.Disk.Bus)
+
+	ApplyHotplugVolumes(&vm.Spec.Template.Spec, hotplugVolumes)
+	assert.Equal(t, 3, len(vm.Spec.Template.Spec.Volumes))
+	assert.Equal(t, "requested-dv", vm.Spec.Template.Spec.Volumes[1].DataVolume.Name)
+	assert.Equal(t, "attached-pvc", vm.Spec.Template.Spec.Volumes[2].PersistentVolumeClaim.ClaimName)
+	assert.Equal(t, 2, len(vm.Spec.Template.Spec.Domain.Devices.Disks))
+}
+
+func TestGetLauncherPod(t *testing.T) {
+	launcherPod := func(name, vmiName string) v1.Pod {
+		return v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "test-namespace",
+			Annotations: map[string]string{"kubevirt.io/domain": vmiName},
+		}}
+	}
+	ListPods = func(name, ns string) (*v1.PodList, error) {
+		if name == "test-vm" {
+			return &v1.PodList{Items: []v1.Pod{launcherPod("virt-launcher-test-vm", "test-vm")}}, nil
+		}
+		// Launcher pods of VMIs not owned by a VM have no VM name label
+		return &v1.PodList{}, nil
+	}
+	lists := 0
+	ListLauncherPods = func(ns string) (*v1.PodList, error) {
+		lists++
+		return &v1.PodList{Items: []v1.Pod{
+			launcherPod("virt-launcher-test-vmi-1", "test-vmi-1"),
+			launcherPod("virt-launcher-test-vmi-2", "test-vmi-2"),
+		}}, nil
+	}
+	backup := &velerov1.Backup{ObjectMeta: metav1.ObjectMeta{UID: "test-launcher-pods"}}
+
+	pod, err := GetLauncherPod("test-vm", "test-namespace", backup)
+	assert.NoError(t, err)
+	assert.Equal(t, "virt-launcher-test-vm", pod.Name)
+	assert.Equal(t, 0, lists)
+
+	for i := 1; i <= 2; i++ {
+		pod, err = GetLauncherPod(fmt.Sprintf("test-vmi-%d", i), "test-namespace", backup)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("virt-launcher-test-vmi-%d", i), pod.Name)
+	}
+	pod, err = GetLauncherPod("test-vmi-3", "test-namespace", backup)
+	assert.NoError(t, err)
+	assert.Nil(t, pod)
+	assert.Equal(t, 1, lists, "launcher pods should be listed once per namespace and backup")
+}